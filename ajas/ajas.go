@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/bradfitz/go-smtpd/smtpd"
@@ -25,6 +26,10 @@ func onNewMail(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, erro
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "queue" {
+		queueMain(os.Args[2:])
+		return
+	}
 	s := &smtpd.Server{
 		Addr:      ":2500",
 		OnNewMail: onNewMail,
@@ -0,0 +1,157 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd/queue"
+)
+
+const queueUsage = `usage: ajas queue [-spool dir] command [id ...]
+
+Commands:
+  list          list queued messages (like mailq)
+  dead          list messages whose delivery time expired
+  show id       print a message's metadata
+  cat id        print a message's contents
+  retry id ...  try delivering messages now
+  flush         try delivering all messages now
+  hold id ...   stop delivering messages
+  release id .. resume delivering held messages
+  delete id ... remove messages without bouncing them
+`
+
+// queueMain runs the "ajas queue" subcommand.
+func queueMain(args []string) {
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	spool := fs.String("spool", "/var/spool/ajas", "queue spool directory")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, queueUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	q := &queue.Queue{Dir: *spool}
+	cmd, ids := fs.Arg(0), fs.Args()[1:]
+	var err error
+	switch cmd {
+	case "list":
+		err = listMessages(q.List())
+	case "dead":
+		err = listMessages(q.DeadLetters())
+	case "flush":
+		err = q.Flush()
+	case "show":
+		err = forEach(ids, showMessage(q))
+	case "cat":
+		err = forEach(ids, catMessage(q))
+	case "retry":
+		err = forEach(ids, q.Retry)
+	case "hold":
+		err = forEach(ids, q.Hold)
+	case "release":
+		err = forEach(ids, q.Release)
+	case "delete":
+		err = forEach(ids, q.Delete)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("ajas queue %s: %v", cmd, err)
+	}
+}
+
+// forEach calls fn for each of ids, stopping at the first error.
+func forEach(ids []string, fn func(id string) error) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("no message IDs given")
+	}
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func listMessages(ms []*queue.Message, err error) error {
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		held := ""
+		if m.Held {
+			held = "!"
+		}
+		from := m.From
+		if from == "" {
+			from = "MAILER-DAEMON"
+		}
+		fmt.Printf("%-20s%s %8d %s  %s\n", m.ID, held, m.Size, m.Created.Format(time.Stamp), from)
+		for _, r := range m.Recipients {
+			if r.Status == queue.Delivered {
+				continue
+			}
+			if r.LastError != "" {
+				fmt.Printf("        (%s)\n", r.LastError)
+			}
+			fmt.Printf("        %s\n", r.Addr)
+		}
+	}
+	if len(ms) == 0 {
+		fmt.Println("No messages")
+	} else {
+		fmt.Printf("-- %d messages\n", len(ms))
+	}
+	return nil
+}
+
+func showMessage(q *queue.Queue) func(string) error {
+	return func(id string) error {
+		m, err := q.Get(id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("ID:           %s\n", m.ID)
+		fmt.Printf("From:         <%s>\n", m.From)
+		fmt.Printf("Size:         %d\n", m.Size)
+		fmt.Printf("Created:      %s\n", m.Created.Format(time.RFC1123Z))
+		fmt.Printf("Attempts:     %d\n", m.Attempts)
+		fmt.Printf("Next attempt: %s\n", m.NextAttempt.Format(time.RFC1123Z))
+		if m.Held {
+			fmt.Printf("Held:         yes\n")
+		}
+		for _, r := range m.Recipients {
+			fmt.Printf("To:           <%s> %s", r.Addr, r.Status)
+			if r.LastError != "" {
+				fmt.Printf(" (%s)", r.LastError)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+}
+
+func catMessage(q *queue.Queue) func(string) error {
+	return func(id string) error {
+		rc, err := q.Open(id)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(os.Stdout, rc)
+		return err
+	}
+}
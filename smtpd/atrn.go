@@ -0,0 +1,160 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SpooledMessage is a message held in a per-domain spool for a
+// client that dequeues its mail with ATRN (RFC 2645), such as those
+// returned by the queue package's Queue.Spooled.
+type SpooledMessage interface {
+	From() string
+	Recipients() []string
+
+	// Body returns the message contents, with \r\n or \n line endings
+	// and without dot-stuffing.
+	Body() (io.ReadCloser, error)
+
+	// Done is called once the message has been offered to the client,
+	// with the result for each of Recipients, or a non-nil err if the
+	// whole attempt failed. Recipients with nil results were accepted,
+	// and may be removed from the spool.
+	Done(rcptErrs []error, err error)
+}
+
+// atrnConn is the session's connection as the client side of a
+// reversed ATRN session. Reads are served by the session's buffered
+// reader, so input it already holds isn't lost, and are bounded by
+// ReadTimeout and SessionTimeout, as the session's own reads are.
+type atrnConn struct {
+	net.Conn
+	s *session
+}
+
+func (c atrnConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(c.s.readDeadline(c.s.srv.ReadTimeout))
+	return c.s.br.Read(p)
+}
+
+// handleATRN handles an ATRN command and reports whether the
+// connection was reversed, ending the session.
+func (s *session) handleATRN(arg string) bool {
+	if !s.extended() {
+		s.sendlinef("503 5.5.1 Error: send EHLO first")
+		return false
+	}
+	if s.user == "" {
+		s.sendlinef("530 5.7.0 Authentication required")
+		return false
+	}
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: ATRN not permitted during mail transaction")
+		return false
+	}
+	var domains []string
+	for _, d := range strings.Split(arg, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, strings.ToLower(d))
+		}
+	}
+	msgs, err := s.srv.OnATRN(s, domains)
+	if err != nil {
+		s.sendSMTPErrorOrLinef(err, "450 4.7.0 ATRN request refused")
+		return false
+	}
+	if len(msgs) == 0 {
+		s.sendlinef("453 4.7.0 You have no mail")
+		return false
+	}
+	s.sendlinef("250 2.0.0 OK now reversing the connection")
+	s.reverseATRN(msgs)
+	return true
+}
+
+// reverseATRN takes the client role on the session's connection and
+// delivers msgs to the peer, which is now acting as the server.
+func (s *session) reverseATRN(msgs []SpooledMessage) {
+	c, err := smtp.NewClient(atrnConn{s.rwc, s}, s.helloHost)
+	if err != nil {
+		s.logf(LogDelivery, LogInfo, "ATRN: reading greeting: %v", err)
+		for _, m := range msgs {
+			m.Done(nil, err)
+		}
+		return
+	}
+	defer c.Close()
+	if err := c.Hello(s.srv.hostname()); err != nil {
+		s.logf(LogDelivery, LogInfo, "ATRN: EHLO: %v", err)
+		for _, m := range msgs {
+			m.Done(nil, err)
+		}
+		return
+	}
+	for i, m := range msgs {
+		rcptErrs, err := s.deliverSpooled(c, m)
+		m.Done(rcptErrs, err)
+		for j, rerr := range rcptErrs {
+			if rerr != nil {
+				s.logf(LogDelivery, LogInfo, "ATRN delivery from %q to %q failed: %v", m.From(), m.Recipients()[j], rerr)
+			}
+		}
+		if err == nil {
+			continue
+		}
+		s.logf(LogDelivery, LogInfo, "ATRN delivery from %q failed: %v", m.From(), err)
+		if c.Reset() != nil {
+			for _, m := range msgs[i+1:] {
+				m.Done(nil, err)
+			}
+			return
+		}
+	}
+	c.Quit()
+}
+
+// deliverSpooled sends m to the client, returning the result for each
+// of its recipients, or a non-nil err if the whole attempt failed.
+func (s *session) deliverSpooled(c *smtp.Client, m SpooledMessage) (rcptErrs []error, err error) {
+	if s.srv.WriteTimeout != 0 {
+		s.rwc.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
+	}
+	if err := c.Mail(m.From()); err != nil {
+		return nil, err
+	}
+	rcpts := m.Recipients()
+	rcptErrs = make([]error, len(rcpts))
+	accepted := 0
+	for i, rcpt := range rcpts {
+		if rcptErrs[i] = c.Rcpt(rcpt); rcptErrs[i] == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		return rcptErrs, nil
+	}
+	body, err := m.Body()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	w, err := c.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return rcptErrs, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"encoding/base64"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSpooled is a SpooledMessage that reports Done's arguments.
+type testSpooled struct {
+	from  string
+	rcpts []string
+	body  string
+	done  chan doneArgs
+}
+
+type doneArgs struct {
+	rcptErrs []error
+	err      error
+}
+
+func (m *testSpooled) From() string         { return m.from }
+func (m *testSpooled) Recipients() []string { return m.rcpts }
+
+func (m *testSpooled) Body() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(m.body)), nil
+}
+
+func (m *testSpooled) Done(rcptErrs []error, err error) {
+	m.done <- doneArgs{rcptErrs, err}
+}
+
+func TestATRNRecipientResults(t *testing.T) {
+	msg := &testSpooled{
+		from:  "sender@example.org",
+		rcpts: []string{"a@atrn.example", "b@atrn.example"},
+		body:  "Subject: test\r\n\r\nbody\r\n",
+		done:  make(chan doneArgs, 1),
+	}
+	c := testServer(t, &Server{
+		PlainAuth:         true,
+		AllowInsecureAuth: true,
+		OnAuth: func(c Connection, mechanism, identity, username, password string) error {
+			return nil
+		},
+		OnATRN: func(c Connection, domains []string) ([]SpooledMessage, error) {
+			if !reflect.DeepEqual(domains, []string{"atrn.example"}) {
+				t.Errorf("domains = %q", domains)
+			}
+			return []SpooledMessage{msg}, nil
+		},
+	})
+	cmd(t, c, 530, "ATRN atrn.example")
+	cmd(t, c, 235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00client\x00secret")))
+	cmd(t, c, 250, "ATRN ATRN.example")
+
+	// Now the client plays the server.
+	reply := func(line string) {
+		t.Helper()
+		if err := c.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		line, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, want) {
+			t.Fatalf("got %q; want %q", line, want)
+		}
+	}
+	reply("220 client.example ESMTP")
+	expect("EHLO mx.example.com")
+	reply("250 client.example")
+	expect("MAIL FROM:<sender@example.org>")
+	reply("250 2.1.0 Ok")
+	expect("RCPT TO:<a@atrn.example>")
+	reply("250 2.1.5 Ok")
+	expect("RCPT TO:<b@atrn.example>")
+	reply("550 5.1.1 no such user")
+	expect("DATA")
+	reply("354 go ahead")
+	body, err := c.ReadDotBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Subject: test\n\nbody\n" {
+		t.Errorf("body = %q", body)
+	}
+	reply("250 2.0.0 Ok: queued")
+	expect("QUIT")
+	reply("221 2.0.0 Bye")
+
+	d := <-msg.done
+	if d.err != nil {
+		t.Fatalf("Done err = %v; want nil", d.err)
+	}
+	rcptErrs := d.rcptErrs
+	if len(rcptErrs) != 2 || rcptErrs[0] != nil || rcptErrs[1] == nil || !strings.Contains(rcptErrs[1].Error(), "no such user") {
+		t.Errorf("Done rcptErrs = %v; want [nil, 550 no such user]", rcptErrs)
+	}
+}
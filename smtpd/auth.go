@@ -0,0 +1,128 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+var (
+	errAuthCancelled = SMTPError("501 5.0.0 Error: authentication cancelled")
+	errAuthDecode    = SMTPError("501 5.5.2 Error: cannot decode response")
+
+	errAuthLineTooLong = SMTPError("500 5.5.6 Error: authentication exchange line is too long")
+	errAuthFailed      = SMTPError("535 5.7.8 Error: authentication failed")
+)
+
+func (s *session) User() string { return s.user }
+
+// authAllowed reports whether the client may authenticate: over TLS,
+// unless Server.AllowInsecureAuth is set.
+func (s *session) authAllowed() bool {
+	return s.tlsState != nil || s.srv.AllowInsecureAuth
+}
+
+// maxAuthSteps bounds the challenges in an authentication exchange.
+const maxAuthSteps = 10
+
+// handleAuth handles an AUTH command (RFC 4954). It reports whether
+// the session goes on.
+func (s *session) handleAuth(arg string) bool {
+	name, initial, hasInitial := strings.Cut(arg, " ")
+	name = strings.ToUpper(name)
+	mech := s.authMechanism(name)
+	switch {
+	case !s.extended():
+		s.sendlinef("503 5.5.1 Error: send EHLO first")
+		return true
+	case !s.authAllowed():
+		s.sendlinef("538 5.7.11 Error: encryption required for requested authentication mechanism")
+		return true
+	case s.user != "":
+		s.sendlinef("503 5.5.1 Error: already authenticated")
+		return true
+	case s.env != nil:
+		s.sendlinef("503 5.5.1 Error: AUTH not permitted during mail transaction")
+		return true
+	case mech == nil:
+		s.sendlinef("504 5.5.4 Error: unrecognized authentication type")
+		return true
+	}
+	var resp []byte
+	var err error
+	if hasInitial {
+		resp, err = decodeAuthResponse(initial)
+	}
+	ex := mech.Start(s)
+	for step := 0; err == nil; step++ {
+		var challenge []byte
+		var done bool
+		var user string
+		stop := s.watchClient()
+		challenge, done, user, err = ex.Next(resp)
+		stop()
+		if err != nil {
+			s.logf(LogAuth, LogInfo, "%s authentication failed: %v", name, err)
+			s.recordEvent(EventAuthFailure)
+			s.srv.metrics().Auth(name, false)
+			s.sendSMTPErrorOrLinef(err, "%s", errAuthFailed.Error())
+			return true
+		}
+		if done {
+			if err := s.setUser(user); err != nil {
+				s.sendFinalLinef("%s", err.Error())
+				return false
+			}
+			s.logf(LogAuth, LogInfo, "authenticated as %q with %s", user, name)
+			s.srv.metrics().Auth(name, true)
+			s.sendlinef("235 2.7.0 Authentication successful")
+			return true
+		}
+		if step == maxAuthSteps {
+			err = errAuthFailed
+			break
+		}
+		resp, err = s.authChallenge(challenge)
+	}
+	if _, ok := err.(SMTPError); !ok {
+		s.errorf("read error during AUTH: %v", err)
+		return false
+	}
+	s.sendlinef("%s", err.Error())
+	return true
+}
+
+// authChallenge sends a 334 challenge and returns the client's
+// decoded response.
+func (s *session) authChallenge(challenge []byte) ([]byte, error) {
+	s.sendlinef("334 %s", base64.StdEncoding.EncodeToString(challenge))
+	s.rwc.SetReadDeadline(s.readDeadline(s.srv.ReadTimeout))
+	sl, tooLong, err := s.readLine(maxAuthLine)
+	if err != nil {
+		return nil, err
+	}
+	if tooLong {
+		return nil, errAuthLineTooLong
+	}
+	line := strings.TrimRight(string(sl), "\r\n")
+	if line == "*" {
+		return nil, errAuthCancelled
+	}
+	return decodeAuthResponse(line)
+}
+
+// decodeAuthResponse decodes a base64 client response, where "="
+// stands for an empty one.
+func decodeAuthResponse(s string) ([]byte, error) {
+	if s == "=" {
+		return []byte{}, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errAuthDecode
+	}
+	return b, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package autocert provides TLS certificates for an smtpd.Server
+// from Let's Encrypt or another ACME certificate authority, using
+// golang.org/x/crypto/acme/autocert.
+//
+// ACME CAs don't validate domains over SMTP, so the server's hosts
+// must also answer HTTP-01 challenges on port 80; see ServeHTTP.
+package autocert
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// NewManager returns a Manager that accepts the CA's terms of service,
+// caches certificates in the directory cacheDir, and only requests
+// certificates for hosts.
+func NewManager(cacheDir string, hosts ...string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+	}
+}
+
+// TLSConfig returns a TLS configuration that serves certificates
+// from m, for use as smtpd.Server.TLSConfig or with an implicit TLS
+// listener. Many SMTP clients don't send a server name (SNI) in the
+// TLS handshake; they're given the certificate for defaultHost.
+func TLSConfig(m *autocert.Manager, defaultHost string) *tls.Config {
+	cfg := m.TLSConfig()
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			h := *hello
+			h.ServerName = defaultHost
+			hello = &h
+		}
+		return m.GetCertificate(hello)
+	}
+	return cfg
+}
+
+// ServeHTTP answers the CA's HTTP-01 challenges for m on addr, ":80"
+// if empty, redirecting other requests to HTTPS. It only returns on
+// error.
+func ServeHTTP(m *autocert.Manager, addr string) error {
+	if addr == "" {
+		addr = ":80"
+	}
+	return http.ListenAndServe(addr, m.HTTPHandler(nil))
+}
+
+// Configure sets srv.TLSConfig to serve certificates for the given
+// hosts, cached in cacheDir, and starts answering HTTP-01 challenges
+// on port 80 in the background. Clients without SNI get the
+// certificate for the first host, which should be srv's hostname.
+func Configure(srv *smtpd.Server, cacheDir string, hosts ...string) *autocert.Manager {
+	m := NewManager(cacheDir, hosts...)
+	def := srv.Hostname
+	if len(hosts) > 0 {
+		def = hosts[0]
+	}
+	srv.TLSConfig = TLSConfig(m, def)
+	go func() {
+		if err := ServeHTTP(m, ""); err != nil {
+			log.Printf("autocert: serving ACME challenges: %v", err)
+		}
+	}()
+	return m
+}
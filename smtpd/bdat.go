@@ -0,0 +1,220 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bdatState is the progress of a message being sent in chunks with
+// BDAT (RFC 3030).
+type bdatState struct {
+	end      func()    // from beginData
+	start    time.Time // of the first chunk
+	n        int64     // bytes received so far
+	inHeader bool      // still collecting the header for OnHeaders
+	hdr      []byte
+	has8bit  bool
+	line     []byte // the start of a line continued in the next chunk
+	tooLong  bool   // has a line over MaxDataLine; the rest is discarded
+}
+
+// handleBDAT handles a BDAT command and reads its chunk. It reports
+// whether the session goes on.
+func (s *session) handleBDAT(arg string) bool {
+	size, last, ok := parseBDAT(arg)
+	if !ok {
+		// The chunk's length is unknown, so the session can't go on.
+		s.sendFinalLinef("501 5.5.4 Syntax: BDAT <size> [LAST]")
+		return false
+	}
+	if s.env == nil {
+		s.sendlinef("503 5.5.1 Error: need RCPT command")
+		return s.readChunk(size, s.srv.now(), 0, nil)
+	}
+	if s.bdat == nil {
+		end, ok := s.beginData()
+		if !ok {
+			// beginData replied; the rest of the message is discarded.
+			s.resetTx()
+			return s.readChunk(size, s.srv.now(), 0, nil)
+		}
+		s.bdat = &bdatState{end: end, start: s.srv.now(), inHeader: s.srv.OnHeaders != nil}
+	}
+	st := s.bdat
+	if max := s.srv.MaxSize; max > 0 && st.n+size > max {
+		s.rejectTooBig()
+		return s.readChunk(size, s.srv.now(), 0, nil)
+	}
+	defer s.useDataReader()()
+	var werr error // the rest of the chunk is discarded after it
+	if !s.readChunk(size, st.start, st.n, func(p []byte) bool {
+		st.n += int64(len(p))
+		// The Envelope is passed whole lines, as with DATA.
+		for len(p) > 0 && werr == nil && !st.tooLong {
+			i := bytes.IndexByte(p, '\n') + 1
+			if i == 0 {
+				i = len(p)
+			}
+			st.line = append(st.line, p[:i]...)
+			p = p[i:]
+			if len(st.line) > s.dataLineLimit() {
+				st.tooLong = true
+				st.line = nil
+				s.logf(LogProto, LogInfo, "sent a message line over %d bytes", s.dataLineLimit())
+				break
+			}
+			if st.line[len(st.line)-1] != '\n' {
+				break
+			}
+			werr = s.writeBDATLine(st.line)
+			st.line = st.line[:0]
+			if werr == errSessionEnded {
+				return false
+			}
+		}
+		return true
+	}) {
+		return false
+	}
+	if werr == nil && last && len(st.line) > 0 {
+		// The message doesn't end in a line break.
+		if werr = s.writeBDATLine(st.line); werr == errSessionEnded {
+			return false
+		}
+	}
+	if werr != nil {
+		s.sendSMTPErrorOrLinef(werr, "451 4.3.0 Error: writing message failed")
+		s.countMessage(true)
+		s.resetTx()
+		return true
+	}
+	if !last {
+		s.sendlinef("250 2.0.0 %d octets received", size)
+		return true
+	}
+	s.timing.DataEnd = s.srv.now()
+	if st.tooLong {
+		s.recordEvent(EventRejected)
+		s.sendlinef("%s", errLineTooLong)
+		s.countMessage(true)
+		s.resetTx()
+		return true
+	}
+	if st.inHeader && !s.checkHeader(st.hdr) {
+		return false
+	}
+	s.finishData(st.has8bit, false)
+	s.resetTx()
+	return true
+}
+
+// errSessionEnded is returned by writeBDATLine if the message header
+// was refused, which ends the session.
+var errSessionEnded = errors.New("smtpd: session ended")
+
+// writeBDATLine passes a line of a message sent with BDAT to the
+// Envelope, returning its error unless it's a Verdict.
+func (s *session) writeBDATLine(line []byte) error {
+	st := s.bdat
+	if !st.has8bit && !s.body8bit {
+		st.has8bit = is8bit(line)
+	}
+	if st.inHeader && len(st.hdr) <= maxHeaderBytes {
+		st.hdr = append(st.hdr, line...)
+	}
+	if err := s.write(line); err != nil && !s.envVerdict(err) {
+		return err
+	}
+	if hdr, ok := st.header(); ok {
+		st.inHeader = false
+		if !s.checkHeader(hdr) {
+			return errSessionEnded
+		}
+	}
+	return nil
+}
+
+// readChunk reads a BDAT chunk of size bytes, passing them to f, or
+// discarding them if f is nil. start and n are when the message began
+// and how much of it was read before, for dataDeadline. It reports
+// whether the session goes on: false on read errors or if f returns
+// false, having ended the session.
+func (s *session) readChunk(size int64, start time.Time, n int64, f func(p []byte) bool) bool {
+	buf := make([]byte, 32<<10)
+	if size < int64(len(buf)) {
+		buf = buf[:size]
+	}
+	for size > 0 {
+		if d := s.dataDeadline(start, n); !d.IsZero() {
+			s.rwc.SetReadDeadline(d)
+		}
+		p := buf
+		if size < int64(len(p)) {
+			p = p[:size]
+		}
+		nr, err := s.br.Read(p)
+		size -= int64(nr)
+		n += int64(nr)
+		if nr > 0 && f != nil && !f(p[:nr]) {
+			return false
+		}
+		if err != nil {
+			if isTimeout(err) {
+				s.sendFinalLinef("421 4.4.2 %s Error: timeout exceeded", s.srv.hostname())
+				s.rwc.Close()
+			}
+			s.errorf("read error after %v and %d bytes of BDAT: %v", s.srv.now().Sub(start), n, err)
+			return false
+		}
+	}
+	return true
+}
+
+// endBDAT releases what a BDAT transfer in progress holds.
+func (s *session) endBDAT() {
+	if s.bdat != nil {
+		s.bdat.end()
+		s.bdat = nil
+	}
+}
+
+// header returns the message header collected so far, and whether it
+// is complete: ended by a blank line or grown past maxHeaderBytes.
+func (st *bdatState) header() ([]byte, bool) {
+	if !st.inHeader {
+		return nil, false
+	}
+	if bytes.HasPrefix(st.hdr, []byte("\r\n")) {
+		return nil, true
+	}
+	if i := bytes.Index(st.hdr, []byte("\r\n\r\n")); i >= 0 {
+		return st.hdr[:i+2], true
+	}
+	if len(st.hdr) > maxHeaderBytes {
+		return st.hdr[:maxHeaderBytes], true
+	}
+	return nil, false
+}
+
+// parseBDAT parses the arguments of a BDAT command, such as "1000" or
+// "1000 LAST".
+func parseBDAT(arg string) (size int64, last, ok bool) {
+	f := strings.Fields(arg)
+	if len(f) == 0 || len(f) > 2 || len(f) == 2 && !strings.EqualFold(f[1], "LAST") {
+		return 0, false, false
+	}
+	for _, c := range f[0] {
+		if c < '0' || c > '9' {
+			return 0, false, false
+		}
+	}
+	size, err := strconv.ParseInt(f[0], 10, 64)
+	return size, len(f) == 2, err == nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBDATLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		code   int
+		lines  []string
+	}{
+		{
+			name:   "split lines",
+			chunks: []string{"Subject: hi\r", "\n\r\nline1\r\nli", "ne2\r\n"},
+			code:   250,
+			lines:  []string{"Subject: hi\r\n", "\r\n", "line1\r\n", "line2\r\n"},
+		},
+		{
+			name:   "no final line break",
+			chunks: []string{"Subject: hi\r\n\r\nli", "ne1"},
+			code:   250,
+			lines:  []string{"Subject: hi\r\n", "\r\n", "line1"},
+		},
+		{
+			name:   "empty last chunk",
+			chunks: []string{"Subject: hi\r\n\r\nline1\r\n", ""},
+			code:   250,
+			lines:  []string{"Subject: hi\r\n", "\r\n", "line1\r\n"},
+		},
+		{
+			name:   "line too long",
+			chunks: []string{"Subject: hi\r\n\r\n", strings.Repeat("x", 600), strings.Repeat("x", 600) + "\r\n"},
+			code:   500,
+			lines:  []string{"Subject: hi\r\n", "\r\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &testEnvelope{}
+			c := testServer(t, &Server{
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					return env, nil
+				},
+			})
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+			cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+			for i, chunk := range tt.chunks {
+				last := ""
+				if i == len(tt.chunks)-1 {
+					last = " LAST"
+				}
+				fmt.Fprintf(c.W, "BDAT %d%s\r\n%s", len(chunk), last, chunk)
+				if err := c.W.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				code, msg, _ := c.ReadResponse(0)
+				if last == "" && code != 250 {
+					t.Fatalf("chunk %d: %d %s", i, code, msg)
+				}
+				if last != "" && code != tt.code {
+					t.Errorf("reply = %d %s; want %d", code, msg, tt.code)
+				}
+			}
+			if got := env.Lines(); !reflect.DeepEqual(got, tt.lines) {
+				t.Errorf("lines = %q; want %q", got, tt.lines)
+			}
+			// The transaction is over either way.
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+		})
+	}
+}
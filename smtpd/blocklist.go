@@ -0,0 +1,122 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd/dnsbl"
+)
+
+// defaultDNSBLTimeout bounds DNSBL lookups if Server.DNSBLTimeout
+// isn't set.
+const defaultDNSBLTimeout = 5 * time.Second
+
+// defaultDNSBLReply is the reply to MAIL from listed clients if
+// Server.DNSBLReply isn't set.
+const defaultDNSBLReply = "554 5.7.1 Service unavailable; client host [${ip}] blocked using ${zone}"
+
+// dnsblLookup is a set of DNSBL lookups in progress.
+type dnsblLookup struct {
+	done     chan struct{} // closed when listings and err are set
+	listings []dnsbl.Listing
+	err      error
+	signal   sync.Once // adds signals for listings
+}
+
+// startDNSBL starts looking up the client's address in
+// Server.DNSBLs in the background.
+func (s *session) startDNSBL() {
+	if len(s.srv.DNSBLs) == 0 {
+		return
+	}
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.IP == nil {
+		return
+	}
+	d := s.srv.DNSBLTimeout
+	if d == 0 {
+		d = defaultDNSBLTimeout
+	}
+	l := &dnsblLookup{done: make(chan struct{})}
+	s.dnsbl = l
+	ctx, cancel := context.WithTimeout(s.ctx, d)
+	go func() {
+		defer cancel()
+		defer close(l.done)
+		l.listings, l.err = dnsbl.Check(ctx, s.srv.resolver(), addr.IP, s.srv.DNSBLs)
+	}()
+}
+
+// DNSBL waits for the lookups started with the connection and
+// returns the client's listings.
+func (s *session) DNSBL() []dnsbl.Listing {
+	l := s.dnsbl
+	if l == nil {
+		return nil
+	}
+	<-l.done
+	l.signal.Do(func() {
+		if l.err != nil {
+			s.logf(LogConn, LogInfo, "DNSBL lookup: %v", l.err)
+		}
+		for _, li := range l.listings {
+			s.logf(LogConn, LogInfo, "listed in %s: %v %q", li.Zone, li.Codes, li.Reason)
+			s.AddSignal(SignalDNSBL + li.Zone)
+		}
+	})
+	return l.listings
+}
+
+// maxReplyText is the most of a DNSBL's TXT record quoted in a reply.
+const maxReplyText = 200
+
+// replyText returns text from outside, such as a DNSBL's TXT record,
+// made safe to include in a reply line: printable ASCII, and at most
+// maxReplyText bytes.
+func replyText(text string) string {
+	b := make([]byte, 0, len(text))
+	for i := 0; i < len(text) && len(b) < maxReplyText; i++ {
+		if c := text[i]; c >= ' ' && c < 0x7f {
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// checkDNSBL refuses MAIL from a listed client if Server.RejectDNSBL
+// is set, and reports whether the command goes on.
+func (s *session) checkDNSBL() bool {
+	listings := s.DNSBL()
+	if !s.srv.RejectDNSBL || len(listings) == 0 {
+		return true
+	}
+	reply := s.srv.DNSBLReply
+	if reply == "" {
+		reply = defaultDNSBLReply
+	}
+	ip := ""
+	if addr, ok := s.Addr().(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+	}
+	reply = os.Expand(reply, func(name string) string {
+		switch name {
+		case "ip":
+			return ip
+		case "zone":
+			return listings[0].Zone
+		case "reason":
+			return replyText(listings[0].Reason)
+		}
+		return ""
+	})
+	s.recordEvent(EventRejected)
+	s.sendlinef("%s", reply)
+	return false
+}
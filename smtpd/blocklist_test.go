@@ -0,0 +1,100 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// listedResolver lists every address in DNSBLs, with the TXT record
+// txt.
+type listedResolver struct {
+	txt string
+}
+
+var errNoDNS = errors.New("no DNS in tests")
+
+func (r listedResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, errNoDNS
+}
+
+func (r listedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 2)}}, nil
+}
+
+func (r listedResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return []string{r.txt}, nil
+}
+
+func (r listedResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, errNoDNS
+}
+
+func TestDNSBLReason(t *testing.T) {
+	tests := []struct {
+		txt, want string
+	}{
+		{"listed; see https://bl.example/", "listed; see https://bl.example/"},
+		{"listed\r\n250 2.0.0 Ok\r\n", "listed250 2.0.0 Ok"},
+		{"tab\there\x00\x7f", "tabhere"},
+		{"café", "caf"},
+		{strings.Repeat("x", 500), strings.Repeat("x", maxReplyText)},
+	}
+	for _, tt := range tests {
+		c := testServer(t, &Server{
+			Resolver:    listedResolver{tt.txt},
+			DNSBLs:      []string{"bl.example"},
+			RejectDNSBL: true,
+			DNSBLReply:  "554 5.7.1 ${zone}: ${reason}",
+		})
+		msg := cmd(t, c, 554, "MAIL FROM:<sender@example.org>")
+		if want := "5.7.1 bl.example: " + tt.want; msg != want {
+			t.Errorf("TXT %q: reply %q; want %q", tt.txt, msg, want)
+		}
+		// Nothing more was sent in the reply.
+		cmd(t, c, 250, "NOOP")
+	}
+}
+
+func TestDNSBLSignals(t *testing.T) {
+	var wg sync.WaitGroup
+	sigs := make(chan map[string]int, 1)
+	c := testServer(t, &Server{
+		Resolver: listedResolver{"listed"},
+		DNSBLs:   []string{"bl.example"},
+		Scoring:  &Scoring{Weights: map[string]float64{SignalDNSBL + "bl.example": 1}},
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			// Hooks may record signals from other goroutines.
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.DNSBL()
+					c.AddSignal("test")
+				}()
+			}
+			return &testEnvelope{}, nil
+		},
+		OnSessionEnd: func(c Connection, st SessionStats) {
+			wg.Wait()
+			sigs <- c.Signals()
+		},
+	})
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	if code, msg := sendData(t, c, "Subject: test\r\n\r\nbody\r\n.\r\n"); code != 250 {
+		t.Fatalf("reply = %d %s", code, msg)
+	}
+	cmd(t, c, 221, "QUIT")
+	got := <-sigs
+	if got[SignalDNSBL+"bl.example"] != 1 || got["test"] != 4 {
+		t.Errorf("signals = %v; want the listing once and test 4 times", got)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnLimiter counts open connections by client IP address for
+// Server.MaxConnectionsPerIP. Servers in a cluster can share one, such
+// as a table in a database, to limit clients' connections across
+// them.
+type ConnLimiter interface {
+	// Acquire counts a new connection from the client at addr and
+	// returns how many it now has open, including the new one.
+	Acquire(addr net.Addr) (int, error)
+
+	// Release ends the count of a connection acquired for addr.
+	Release(addr net.Addr) error
+}
+
+// MemoryConnLimiter is a ConnLimiter in process memory, used by
+// Server if ConnLimiter is nil. The zero value is ready to use.
+type MemoryConnLimiter struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+func (l *MemoryConnLimiter) Acquire(addr net.Addr) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m == nil {
+		l.m = make(map[string]int)
+	}
+	ip := addrIP(addr)
+	l.m[ip]++
+	return l.m[ip], nil
+}
+
+func (l *MemoryConnLimiter) Release(addr net.Addr) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ip := addrIP(addr)
+	if l.m[ip]--; l.m[ip] <= 0 {
+		delete(l.m, ip)
+	}
+	return nil
+}
+
+func (srv *Server) connLimiter() ConnLimiter {
+	if srv.ConnLimiter != nil {
+		return srv.ConnLimiter
+	}
+	return &srv.conns
+}
+
+var errTooManyConns = SMTPError("421 4.3.2 Error: too many connections, try again later")
+
+// acquireConn counts the session against Server.MaxConnections and
+// MaxConnectionsPerIP, returning an error to close it with if either
+// is exceeded. Its count is released by releaseConn.
+func (s *session) acquireConn() error {
+	srv := s.srv
+	if max := srv.MaxConnections; max > 0 && int(srv.sessions.Load()) > max {
+		s.logf(LogConn, LogInfo, "too many connections")
+		return errTooManyConns
+	}
+	max := srv.MaxConnectionsPerIP
+	if max <= 0 {
+		return nil
+	}
+	n, err := srv.connLimiter().Acquire(s.Addr())
+	if err != nil {
+		// Better to serve the client than to refuse everyone.
+		s.logf(LogConn, LogError, "counting connections: %v", err)
+		return nil
+	}
+	s.connAddr = s.Addr()
+	if n > max {
+		s.logf(LogConn, LogInfo, "%d connections from address, refusing", n)
+		return errTooManyConns
+	}
+	return nil
+}
+
+func (s *session) releaseConn() {
+	if s.connAddr == nil {
+		return
+	}
+	if err := s.srv.connLimiter().Release(s.connAddr); err != nil {
+		s.srv.logf(LogConn, LogError, "%v: counting connections: %v", s.connAddr, err)
+	}
+	s.connAddr = nil
+}
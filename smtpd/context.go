@@ -0,0 +1,79 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var errClientGone = errors.New("smtpd: client disconnected")
+
+// baseContext returns the parent of the sessions' contexts, which is
+// canceled when Shutdown gives up waiting for them.
+func (srv *Server) baseContext() context.Context {
+	srv.ctxOnce.Do(func() {
+		srv.ctx, srv.cancelCtx = context.WithCancel(context.Background())
+	})
+	return srv.ctx
+}
+
+func (s *session) Context() context.Context { return s.ctx }
+
+// connReader is the reader under the session's buffered reader. It
+// can read from the connection in the background while hooks run, to
+// notice the client disconnecting, without losing what it sends.
+type connReader struct {
+	conn    net.Conn
+	s       *session // counts what's read
+	pending []byte   // read in the background
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	if len(cr.pending) > 0 {
+		n := copy(p, cr.pending)
+		cr.pending = cr.pending[n:]
+		cr.s.bytesIn += int64(n)
+		cr.s.record(fromClient, p[:n])
+		return n, nil
+	}
+	n, err := cr.conn.Read(p)
+	cr.s.bytesIn += int64(n)
+	cr.s.record(fromClient, p[:n])
+	if err != nil {
+		cr.s.setConnErr(err)
+	}
+	return n, err
+}
+
+// watchClient cancels the session's context if the client disconnects
+// before the returned func is called. It's used while the session
+// isn't reading, such as during hooks. A client that has already sent
+// more input isn't watched.
+func (s *session) watchClient() (stop func()) {
+	if s.br.Buffered() > 0 || s.ctx.Err() != nil {
+		return func() {}
+	}
+	cr := s.cr
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var b [1]byte
+		n, err := cr.conn.Read(b[:])
+		if n > 0 {
+			cr.pending = append(cr.pending, b[0])
+		}
+		if err != nil && !isTimeout(err) {
+			s.cancel(errClientGone)
+		}
+	}()
+	return func() {
+		cr.conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		cr.conn.SetReadDeadline(time.Time{})
+	}
+}
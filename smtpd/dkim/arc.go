@@ -0,0 +1,221 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"context"
+	"crypto/sha256"
+	"strconv"
+	"strings"
+)
+
+// maxARCInstance is the most ARC sets a message may have
+// (RFC 8617 s4.2.1).
+const maxARCInstance = 50
+
+// Chain is the result of validating a message's Authenticated
+// Received Chain (RFC 8617), the ARC sets added by the hops that
+// forwarded it.
+type Chain struct {
+	// Result is None if the message has no ARC sets, Pass or Fail,
+	// or TempError if a key couldn't be fetched.
+	Result Result
+	Err    error // why Result isn't Pass or None
+
+	// Sets describes the message's ARC sets, by instance from 1.
+	Sets []ARCSet
+}
+
+// ARCSet describes an ARC set: the seal one hop put on the message.
+type ARCSet struct {
+	Instance int
+	Domain   string // d= of the ARC-Seal, the sealer's domain
+	Selector string // s= of the ARC-Seal
+
+	// AuthResults is the sealer's ARC-Authentication-Results after
+	// its i= tag: its authserv-id and the results it found.
+	AuthResults string
+}
+
+// arcSet is the raw fields of an ARC set.
+type arcSet struct {
+	aar, ams, seal string
+}
+
+// collectARC gathers the ARC sets in a message header by instance,
+// checking that each has one of each field. A message without any
+// has none.
+func collectARC(fields []string) ([]arcSet, error) {
+	var sets []arcSet
+	for _, f := range fields {
+		name := fieldName(f)
+		_, value, _ := strings.Cut(f, ":")
+		var i int
+		var err error
+		switch {
+		case strings.EqualFold(name, "ARC-Authentication-Results"):
+			spec, _, _ := strings.Cut(value, ";")
+			n, v, _ := strings.Cut(spec, "=")
+			if strings.TrimSpace(n) != "i" {
+				return nil, errorf("ARC-Authentication-Results lacks i= tag")
+			}
+			i, err = parseInstance(v)
+		case strings.EqualFold(name, "ARC-Message-Signature"), strings.EqualFold(name, "ARC-Seal"):
+			var tags map[string]string
+			if tags, err = parseTags(value); err == nil {
+				i, err = parseInstance(tags["i"])
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for len(sets) < i {
+			sets = append(sets, arcSet{})
+		}
+		var p *string
+		switch s := &sets[i-1]; {
+		case strings.EqualFold(name, "ARC-Seal"):
+			p = &s.seal
+		case strings.EqualFold(name, "ARC-Message-Signature"):
+			p = &s.ams
+		default:
+			p = &s.aar
+		}
+		if *p != "" {
+			return nil, errorf("duplicate %s for ARC instance %d", name, i)
+		}
+		*p = f
+	}
+	for i, s := range sets {
+		if s.aar == "" || s.ams == "" || s.seal == "" {
+			return nil, errorf("ARC set %d is incomplete", i+1)
+		}
+	}
+	return sets, nil
+}
+
+// parseInstance parses the i= tag of an ARC field.
+func parseInstance(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxARCInstance {
+		return 0, errorf("bad ARC instance %q", strings.TrimSpace(s))
+	}
+	return n, nil
+}
+
+// parseSeal parses an ARC-Seal field into a Signature for its key
+// lookup and its cv= tag.
+func parseSeal(field string) (sig *Signature, cv string, err error) {
+	_, value, _ := strings.Cut(field, ":")
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, t := range []string{"a", "b", "cv", "d", "s"} {
+		if _, ok := tags[t]; !ok {
+			return nil, "", errorf("ARC-Seal lacks %s= tag", t)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return nil, "", errorf("ARC-Seal has h= tag")
+	}
+	sig = &Signature{
+		Domain:    strings.ToLower(tags["d"]),
+		Selector:  tags["s"],
+		Algorithm: strings.ToLower(tags["a"]),
+		field:     field,
+	}
+	switch sig.Algorithm {
+	case "rsa-sha256", "ed25519-sha256":
+	default:
+		return nil, "", errorf("unknown algorithm %q", sig.Algorithm)
+	}
+	if sig.sig, err = decodeBase64(tags["b"]); err != nil {
+		return nil, "", errorf("bad b= tag: %v", err)
+	}
+	return sig, strings.ToLower(tags["cv"]), nil
+}
+
+// hashSeal returns the digest an ARC-Seal signs: the ARC sets up to
+// and including its own, whose seal is last, without its signature
+// (RFC 8617 s5.1.1).
+func hashSeal(sets []arcSet) []byte {
+	h := sha256.New()
+	for i, s := range sets {
+		h.Write([]byte(canonHeader(s.aar, true, true)))
+		h.Write([]byte(canonHeader(s.ams, true, true)))
+		if i < len(sets)-1 {
+			h.Write([]byte(canonHeader(s.seal, true, true)))
+		}
+	}
+	h.Write([]byte(canonHeader(stripSignature(sets[len(sets)-1].seal), true, false)))
+	return h.Sum(nil)
+}
+
+// validateARC validates the chain of ARC sets (RFC 8617 s5.2), given
+// the latest set's ARC-Message-Signature with its body hash computed.
+func validateARC(ctx context.Context, r Resolver, fields []string, sets []arcSet, ams *Signature) *Chain {
+	c := &Chain{Result: Fail}
+	if len(sets) == 0 {
+		c.Result = None
+		return c
+	}
+	seals := make([]*Signature, len(sets))
+	for i, s := range sets {
+		sig, cv, err := parseSeal(s.seal)
+		if err != nil {
+			c.Err = err
+			return c
+		}
+		want := "pass"
+		if i == 0 {
+			want = "none"
+		}
+		if cv != want {
+			c.Err = errorf("ARC-Seal %d has cv=%s", i+1, cv)
+			return c
+		}
+		seals[i] = sig
+		_, aar, _ := strings.Cut(s.aar, ":")
+		_, aar, _ = strings.Cut(aar, ";")
+		c.Sets = append(c.Sets, ARCSet{
+			Instance:    i + 1,
+			Domain:      sig.Domain,
+			Selector:    sig.Selector,
+			AuthResults: strings.TrimSpace(aar),
+		})
+	}
+
+	// The latest hop's message signature must verify, then each
+	// seal from the latest back.
+	if ams.Result == "" {
+		ams.verify(ctx, r, fields)
+	}
+	if ams.Result != Pass {
+		if ams.Result == TempError {
+			c.Result = TempError
+		}
+		c.Err = ams.Err
+		return c
+	}
+	for i := len(sets) - 1; i >= 0; i-- {
+		key, res, err := lookupKey(ctx, r, seals[i])
+		if err != nil {
+			if res == TempError {
+				c.Result = TempError
+			}
+			c.Err = err
+			return c
+		}
+		if !checkSignature(key.key, hashSeal(sets[:i+1]), seals[i].sig) {
+			c.Err = errorf("ARC-Seal %d did not verify", i+1)
+			return c
+		}
+	}
+	c.Result, c.Err = Pass, nil
+	return c
+}
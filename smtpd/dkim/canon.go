@@ -0,0 +1,187 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"strings"
+)
+
+var crlf = []byte("\r\n")
+
+// canonHeader canonicalizes a raw header field (RFC 6376 s3.4.1,
+// s3.4.2), ending it with CRLF if crlf is set.
+func canonHeader(field string, relaxed, crlf bool) string {
+	if relaxed {
+		name, value, _ := strings.Cut(field, ":")
+		value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+		field = strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.TrimSpace(squeeze(value))
+	}
+	if crlf {
+		field += "\r\n"
+	}
+	return field
+}
+
+// lineSplitter splits a message written in parts into lines.
+type lineSplitter struct {
+	partial []byte // a line not yet ended
+}
+
+// write calls fn with each line p ends, without its line ending,
+// which may be CRLF or a bare LF.
+func (ls *lineSplitter) write(p []byte, fn func(line []byte)) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			ls.partial = append(ls.partial, p...)
+			return
+		}
+		line := p[:i]
+		if len(ls.partial) > 0 {
+			ls.partial = append(ls.partial, line...)
+			line = ls.partial
+		}
+		fn(bytes.TrimSuffix(line, []byte("\r")))
+		ls.partial = ls.partial[:0]
+		p = p[i+1:]
+	}
+}
+
+// flush calls fn with the last line, if it wasn't ended.
+func (ls *lineSplitter) flush(fn func(line []byte)) {
+	if len(ls.partial) > 0 {
+		fn(ls.partial)
+		ls.partial = nil
+	}
+}
+
+// addHeaderLine adds a header line, without its line ending, to
+// fields: a new field, or a continuation of the last one.
+func addHeaderLine(fields []string, l []byte) []string {
+	if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') && len(fields) > 0 {
+		fields[len(fields)-1] += "\r\n" + string(l)
+		return fields
+	}
+	return append(fields, string(l))
+}
+
+// splitMessage returns the header fields of msg, as Verifier.Header,
+// and its body.
+func splitMessage(msg []byte) (fields []string, body []byte) {
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line, msg = msg[:i], msg[i+1:]
+		} else {
+			msg = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			return fields, msg
+		}
+		fields = addHeaderLine(fields, line)
+	}
+	return fields, nil
+}
+
+// hashBody returns the hash of a whole message body.
+func hashBody(body []byte, relaxed bool) []byte {
+	b := newBodyHasher(relaxed, -1)
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line, body = body[:i], body[i+1:]
+		} else {
+			body = nil
+		}
+		b.line(bytes.TrimSuffix(line, []byte("\r")))
+	}
+	return b.sum()
+}
+
+// squeeze replaces each run of spaces and tabs in s with one space.
+func squeeze(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// bodyHasher hashes a message body a line at a time, canonicalized
+// (RFC 6376 s3.4.3, s3.4.4). Empty lines are held back until a
+// non-empty one follows, since those ending the body aren't hashed.
+type bodyHasher struct {
+	h       hash.Hash
+	relaxed bool
+	limit   int64 // bytes to hash, or -1 for all
+	n       int64 // canonical body length
+	blank   int   // empty lines held back
+}
+
+func newBodyHasher(relaxed bool, limit int64) *bodyHasher {
+	return &bodyHasher{h: sha256.New(), relaxed: relaxed, limit: limit}
+}
+
+// line adds a body line, without its line ending.
+func (b *bodyHasher) line(l []byte) {
+	if b.relaxed {
+		l = []byte(strings.TrimRight(squeeze(string(l)), " "))
+	}
+	if len(l) == 0 {
+		b.blank++
+		return
+	}
+	for ; b.blank > 0; b.blank-- {
+		b.write(crlf)
+	}
+	b.write(l)
+	b.write(crlf)
+}
+
+func (b *bodyHasher) write(p []byte) {
+	if b.limit >= 0 {
+		if rest := b.limit - b.n; rest < int64(len(p)) {
+			if rest < 0 {
+				rest = 0
+			}
+			b.h.Write(p[:rest])
+			b.n += int64(len(p))
+			return
+		}
+	}
+	b.h.Write(p)
+	b.n += int64(len(p))
+}
+
+// sum returns the body hash. Under simple canonicalization an empty
+// body is a single CRLF.
+func (b *bodyHasher) sum() []byte {
+	if !b.relaxed && b.n == 0 {
+		b.write(crlf)
+	}
+	return b.h.Sum(nil)
+}
+
+// short reports whether the body was shorter than the length to hash.
+func (b *bodyHasher) short() bool {
+	return b.limit > b.n
+}
@@ -0,0 +1,444 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dkim verifies DomainKeys Identified Mail signatures
+// (RFC 6376) as messages are received, and signs messages being sent.
+// It also validates and adds the ARC sets (RFC 8617) of forwarded
+// messages.
+//
+// Signatures may use the rsa-sha256 and ed25519-sha256 (RFC 8463)
+// algorithms, with simple or relaxed canonicalization. Signatures
+// using rsa-sha1, or RSA keys under 1024 bits, aren't accepted
+// (RFC 8301).
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result is the outcome of verifying a signature (RFC 8601 s2.7.1).
+type Result string
+
+const (
+	None      Result = "none"      // the message isn't signed
+	Pass      Result = "pass"      // the signature verified
+	Fail      Result = "fail"      // the signature didn't verify
+	TempError Result = "temperror" // the key couldn't be fetched
+	PermError Result = "permerror" // the signature or key is unusable
+)
+
+// Resolver looks up signers' public keys. *net.Resolver and
+// smtpd.Resolver implement it.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// maxSignatures is how many signatures are verified in a message.
+// Any more are given PermError without looking up their keys.
+const maxSignatures = 10
+
+// minRSABits is the smallest RSA key accepted (RFC 8301 s3.2).
+const minRSABits = 1024
+
+// Signature is the result of verifying one DKIM-Signature field.
+type Signature struct {
+	Result Result
+	Err    error // why Result isn't Pass
+
+	Domain     string   // d=, the signing domain
+	Selector   string   // s=
+	Identifier string   // i=, the agent or user signing; "@" + Domain if unset
+	Algorithm  string   // a=, such as "rsa-sha256"
+	Headers    []string // h=, the names of the signed fields
+	BodyLength int64    // l=, or -1 if the whole body is signed
+
+	Time       time.Time // t=, when it was signed; zero if unset
+	Expiration time.Time // x=; zero if unset
+
+	// Testing is set if the signer's key is marked as being tested
+	// (t=y), so Fail shouldn't be treated differently from an
+	// unsigned message.
+	Testing bool
+
+	field    string // the raw DKIM-Signature field
+	sig      []byte // b=
+	bodySum  []byte // bh=
+	canon    string // c=, as "header/body"
+	body     *bodyHasher
+	instance int // i= of an ARC-Message-Signature
+}
+
+// errorf returns a Signature error.
+func errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("dkim: "+format, args...)
+}
+
+// parseSignature parses a DKIM-Signature field, or if ams is set an
+// ARC-Message-Signature field, whose raw text is field. If it fails,
+// the returned Signature holds what could be parsed along with the
+// error.
+func parseSignature(field string, ams bool) (*Signature, error) {
+	sig := &Signature{field: field, BodyLength: -1}
+	_, value, _ := strings.Cut(field, ":")
+	tags, err := parseTags(value)
+	if err != nil {
+		return sig, err
+	}
+	sig.Domain = strings.ToLower(tags["d"])
+	sig.Selector = tags["s"]
+	sig.Algorithm = strings.ToLower(tags["a"])
+	if ams {
+		// The i= tag is the instance, and there's no v= tag
+		// (RFC 8617 s4.1.2).
+		if sig.instance, err = parseInstance(tags["i"]); err != nil {
+			return sig, err
+		}
+		delete(tags, "i")
+	} else if v := tags["v"]; v != "1" {
+		return sig, errorf("unsupported signature version %q", v)
+	}
+	for _, t := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return sig, errorf("signature lacks %s= tag", t)
+		}
+	}
+	switch sig.Algorithm {
+	case "rsa-sha256", "ed25519-sha256":
+	case "rsa-sha1":
+		return sig, errorf("rsa-sha1 signatures aren't accepted")
+	default:
+		return sig, errorf("unknown algorithm %q", sig.Algorithm)
+	}
+	if sig.sig, err = decodeBase64(tags["b"]); err != nil {
+		return sig, errorf("bad b= tag: %v", err)
+	}
+	if sig.bodySum, err = decodeBase64(tags["bh"]); err != nil {
+		return sig, errorf("bad bh= tag: %v", err)
+	}
+	if sig.Domain == "" || sig.Selector == "" {
+		return sig, errorf("empty d= or s= tag")
+	}
+
+	hasFrom := false
+	for _, h := range strings.Split(tags["h"], ":") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			return sig, errorf("bad h= tag %q", tags["h"])
+		}
+		hasFrom = hasFrom || strings.EqualFold(h, "From")
+		sig.Headers = append(sig.Headers, h)
+	}
+	if !hasFrom && !ams {
+		return sig, errorf("From field isn't signed")
+	}
+
+	sig.canon = "simple/simple"
+	if c, ok := tags["c"]; ok {
+		hc, bc, _ := strings.Cut(strings.ToLower(c), "/")
+		if bc == "" {
+			bc = "simple"
+		}
+		if !validCanon(hc) || !validCanon(bc) {
+			return sig, errorf("unknown canonicalization %q", c)
+		}
+		sig.canon = hc + "/" + bc
+	}
+
+	sig.Identifier = "@" + sig.Domain
+	if i, ok := tags["i"]; ok {
+		at := strings.LastIndex(i, "@")
+		if at < 0 {
+			return sig, errorf("bad i= tag %q", i)
+		}
+		d := strings.ToLower(i[at+1:])
+		if d != sig.Domain && !strings.HasSuffix(d, "."+sig.Domain) {
+			return sig, errorf("i= domain %q isn't within d= domain %q", d, sig.Domain)
+		}
+		sig.Identifier = i
+	}
+	if q, ok := tags["q"]; ok && !hasItem(q, "dns/txt") {
+		return sig, errorf("unsupported query method %q", q)
+	}
+	if l, ok := tags["l"]; ok {
+		if sig.BodyLength, err = parseDecimal(l); err != nil {
+			return sig, errorf("bad l= tag %q", l)
+		}
+	}
+	if t, ok := tags["t"]; ok {
+		n, err := parseDecimal(t)
+		if err != nil {
+			return sig, errorf("bad t= tag %q", t)
+		}
+		sig.Time = time.Unix(n, 0)
+	}
+	if x, ok := tags["x"]; ok {
+		n, err := parseDecimal(x)
+		if err != nil {
+			return sig, errorf("bad x= tag %q", x)
+		}
+		sig.Expiration = time.Unix(n, 0)
+		if !sig.Time.IsZero() && sig.Expiration.Before(sig.Time) {
+			return sig, errorf("signature expires before it was made")
+		}
+		if now().After(sig.Expiration) {
+			return sig, errorf("signature expired at %v", sig.Expiration)
+		}
+	}
+	return sig, nil
+}
+
+var now = time.Now
+
+func validCanon(c string) bool { return c == "simple" || c == "relaxed" }
+
+// parseDecimal parses a tag's unsigned decimal value.
+func parseDecimal(s string) (int64, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, errors.New("not a number")
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// hasItem reports whether the colon-separated list s holds item.
+func hasItem(s, item string) bool {
+	for _, v := range strings.Split(s, ":") {
+		if strings.EqualFold(strings.TrimSpace(v), item) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTags parses a tag-list (RFC 6376 s3.2), as in DKIM-Signature
+// fields and key records.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, errorf("bad tag %q", strings.TrimSpace(spec))
+		}
+		if _, dup := tags[name]; dup {
+			return nil, errorf("duplicate %s= tag", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// decodeBase64 decodes a base64 tag value, which may be broken up by
+// whitespace.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// publicKey is a signer's key, from its key record.
+type publicKey struct {
+	key     crypto.PublicKey
+	testing bool // t=y
+	strict  bool // t=s: i= must be in d= itself, not a subdomain
+}
+
+// lookupKey fetches and parses the key for sig.
+func lookupKey(ctx context.Context, r Resolver, sig *Signature) (*publicKey, Result, error) {
+	name := sig.Selector + "._domainkey." + sig.Domain
+	txts, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, PermError, errorf("no key at %s", name)
+		}
+		return nil, TempError, errorf("looking up key: %v", err)
+	}
+	if len(txts) == 0 {
+		return nil, PermError, errorf("no key at %s", name)
+	}
+	// Use the first record that parses, should there be several.
+	for _, txt := range txts {
+		var k *publicKey
+		if k, err = parseKey(txt, sig.Algorithm); err == nil {
+			return k, Pass, nil
+		}
+	}
+	return nil, PermError, err
+}
+
+// parseKey parses a key record (RFC 6376 s3.6.1) for a signature
+// using alg.
+func parseKey(txt, alg string) (*publicKey, error) {
+	tags, err := parseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, errorf("unsupported key version %q", v)
+	}
+	if h, ok := tags["h"]; ok && !hasItem(h, "sha256") {
+		return nil, errorf("key isn't for sha256 signatures")
+	}
+	if s, ok := tags["s"]; ok && !hasItem(s, "*") && !hasItem(s, "email") {
+		return nil, errorf("key isn't for email")
+	}
+	k := &publicKey{}
+	if t, ok := tags["t"]; ok {
+		k.testing = hasItem(t, "y")
+		k.strict = hasItem(t, "s")
+	}
+	p, ok := tags["p"]
+	if !ok {
+		return nil, errorf("key record lacks p= tag")
+	}
+	der, err := decodeBase64(p)
+	if err != nil {
+		return nil, errorf("bad p= tag: %v", err)
+	}
+	if len(der) == 0 {
+		return nil, errorf("key has been revoked")
+	}
+	kt := "rsa"
+	if v, ok := tags["k"]; ok {
+		kt = strings.ToLower(v)
+	}
+	if !strings.HasPrefix(alg, kt+"-") {
+		return nil, errorf("key type %q doesn't match algorithm %q", kt, alg)
+	}
+	switch kt {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// Some signers publish a bare RSAPublicKey.
+			pk, err2 := x509.ParsePKCS1PublicKey(der)
+			if err2 != nil {
+				return nil, errorf("bad RSA key: %v", err)
+			}
+			pub = pk
+		}
+		rk, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errorf("key isn't an RSA key")
+		}
+		if rk.N.BitLen() < minRSABits {
+			return nil, errorf("%d-bit RSA key is too short", rk.N.BitLen())
+		}
+		k.key = rk
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, errorf("bad Ed25519 key")
+		}
+		k.key = ed25519.PublicKey(der)
+	default:
+		return nil, errorf("unknown key type %q", kt)
+	}
+	return k, nil
+}
+
+// verify checks sig, whose body hash has been computed, against the
+// message header fields.
+func (sig *Signature) verify(ctx context.Context, r Resolver, fields []string) {
+	if !bytes.Equal(sig.body.sum(), sig.bodySum) {
+		if sig.body.short() {
+			sig.Result, sig.Err = PermError, errorf("body is shorter than l=%d", sig.BodyLength)
+			return
+		}
+		sig.Result, sig.Err = Fail, errorf("body hash did not verify")
+		return
+	}
+	key, res, err := lookupKey(ctx, r, sig)
+	if err != nil {
+		sig.Result, sig.Err = res, err
+		return
+	}
+	sig.Testing = key.testing
+	if key.strict && strings.ToLower(sig.Identifier[strings.LastIndex(sig.Identifier, "@")+1:]) != sig.Domain {
+		sig.Result, sig.Err = PermError, errorf("key doesn't allow i= subdomain")
+		return
+	}
+
+	relaxed := strings.HasPrefix(sig.canon, "relaxed/")
+	h := sha256.New()
+	writeSignedHeader(h, fields, sig.Headers, relaxed)
+	h.Write([]byte(canonHeader(stripSignature(sig.field), relaxed, false)))
+	if !checkSignature(key.key, h.Sum(nil), sig.sig) {
+		sig.Result, sig.Err = Fail, errorf("signature did not verify")
+		return
+	}
+	sig.Result = Pass
+}
+
+// checkSignature reports whether sig is key's signature of digest.
+func checkSignature(key crypto.PublicKey, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, digest, sig)
+	}
+	return false
+}
+
+// writeSignedHeader writes to h the fields named by signed, each
+// canonicalized. Each name takes the last of its fields not already
+// taken; names with none left add nothing (RFC 6376 s5.4.2).
+func writeSignedHeader(h hash.Hash, fields, signed []string, relaxed bool) {
+	used := make(map[string]int)
+	for _, name := range signed {
+		key := strings.ToLower(name)
+		skip := used[key]
+		used[key]++
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			h.Write([]byte(canonHeader(fields[i], relaxed, true)))
+			break
+		}
+	}
+}
+
+// stripSignature returns a signature field with the value of its b=
+// tag removed, as it's hashed.
+func stripSignature(field string) string {
+	colon := strings.IndexByte(field, ':')
+	specs := strings.Split(field[colon+1:], ";")
+	for i, spec := range specs {
+		name, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(name) == "b" {
+			specs[i] = spec[:len(name)+1]
+		}
+	}
+	return field[:colon+1] + strings.Join(specs, ";")
+}
+
+// fieldName returns the name of a raw header field.
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimRight(name, " \t")
+}
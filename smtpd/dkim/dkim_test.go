@@ -0,0 +1,279 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// txtResolver answers LookupTXT from a map; other names aren't found,
+// except those mapped to nil, which fail temporarily.
+type txtResolver map[string][]string
+
+func (r txtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if txts == nil {
+		return nil, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	return txts, nil
+}
+
+const testMessage = "From: Joe <joe@example.com>\r\n" +
+	"To: jane@example.net\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Tue, 1 Nov 2011 12:00:00 +0000\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n"
+
+// keys returns an RSA and an Ed25519 key, and a resolver publishing
+// them as the "rsa" and "ed" selectors of example.com.
+func keys(t *testing.T) (*rsa.PrivateKey, ed25519.PrivateKey, txtResolver) {
+	t.Helper()
+	rk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epub, ek, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rk, ek, txtResolver{
+		"rsa._domainkey.example.com": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)},
+		"ed._domainkey.example.com":  {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(epub)},
+	}
+}
+
+// verify verifies msg, passed to a Verifier in pieces of n bytes.
+func verify(t *testing.T, r Resolver, msg string, n int) []*Signature {
+	t.Helper()
+	v := &Verifier{Resolver: r}
+	for len(msg) > 0 {
+		m := n
+		if m > len(msg) {
+			m = len(msg)
+		}
+		v.Write([]byte(msg[:m]))
+		msg = msg[m:]
+	}
+	return v.Verify(context.Background())
+}
+
+func TestSignVerify(t *testing.T) {
+	rk, ek, r := keys(t)
+	for _, tt := range []struct {
+		selector string
+		key      crypto.Signer
+		alg      string
+	}{
+		{"rsa", rk, "rsa-sha256"},
+		{"ed", ek, "ed25519-sha256"},
+	} {
+		s := &Signer{Domain: "example.com", Selector: tt.selector, Key: tt.key, Identifier: "@mail.example.com"}
+		sig, err := s.Sign([]byte(testMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := sig + testMessage
+		for _, n := range []int{1, 7, len(signed)} {
+			sigs := verify(t, r, signed, n)
+			if len(sigs) != 1 || sigs[0].Result != Pass {
+				t.Fatalf("%s in %d-byte writes: %+v", tt.alg, n, sigs[0])
+			}
+		}
+		got := verify(t, r, signed, len(signed))[0]
+		if got.Domain != "example.com" || got.Selector != tt.selector || got.Algorithm != tt.alg || got.Identifier != "@mail.example.com" {
+			t.Errorf("%s: signature %+v", tt.alg, got)
+		}
+		if want := []string{"from", "to", "subject", "date", "from"}; strings.Join(got.Headers, ":") != strings.Join(want, ":") {
+			t.Errorf("%s: signed %q; want %q", tt.alg, got.Headers, want)
+		}
+
+		// Relaxed canonicalization tolerates changes to
+		// whitespace, header case and trailing blank lines.
+		relaxed := strings.Replace(signed, "Subject: Is dinner ready?", "subject:   Is dinner\r\n\tready?  ", 1)
+		relaxed = strings.Replace(relaxed, "Are you hungry yet?\r\n", "Are you   hungry yet? \r\n\r\n\r\n", 1)
+		relaxed = strings.ReplaceAll(relaxed, "\r\n", "\n")
+		if sigs := verify(t, r, relaxed, 5); sigs[0].Result != Pass {
+			t.Errorf("%s: relaxed changes: %s, %v", tt.alg, sigs[0].Result, sigs[0].Err)
+		}
+
+		for name, tampered := range map[string]string{
+			"body":    strings.Replace(signed, "lost", "won", 1),
+			"subject": strings.Replace(signed, "dinner", "lunch", 1),
+			"from":    "From: Mallory <mallory@example.org>\r\n" + signed,
+		} {
+			if sigs := verify(t, r, tampered, 64); sigs[0].Result != Fail {
+				t.Errorf("%s: tampered %s: %s, %v; want fail", tt.alg, name, sigs[0].Result, sigs[0].Err)
+			}
+		}
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	rk, _, r := keys(t)
+	short, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&short.PublicKey)
+	r["short._domainkey.example.com"] = []string{"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(der)}
+	r["revoked._domainkey.example.com"] = []string{"v=DKIM1; k=rsa; p="}
+	r["down._domainkey.example.com"] = nil
+
+	sign := func(s *Signer) string {
+		t.Helper()
+		s.Domain, s.Key = "example.com", rk
+		if s.Selector == "" {
+			s.Selector = "rsa"
+		}
+		sig, err := s.Sign([]byte(testMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig + testMessage
+	}
+	tests := []struct {
+		name string
+		msg  string
+		want Result
+	}{
+		{"no key", sign(&Signer{Selector: "missing"}), PermError},
+		{"short key", sign(&Signer{Selector: "short"}), PermError},
+		{"revoked key", sign(&Signer{Selector: "revoked"}), PermError},
+		{"DNS failure", sign(&Signer{Selector: "down"}), TempError},
+		{"bad version", strings.Replace(sign(&Signer{}), "v=1;", "v=2;", 1), PermError},
+		{"rsa-sha1", strings.Replace(sign(&Signer{}), "a=rsa-sha256", "a=rsa-sha1", 1), PermError},
+	}
+	for _, tt := range tests {
+		sigs := verify(t, r, tt.msg, 100)
+		if len(sigs) != 1 || sigs[0].Result != tt.want || sigs[0].Err == nil {
+			t.Errorf("%s: %s, %v; want %s", tt.name, sigs[0].Result, sigs[0].Err, tt.want)
+		}
+	}
+
+	if sigs := verify(t, r, testMessage, 100); len(sigs) != 0 {
+		t.Errorf("unsigned message: %d signatures", len(sigs))
+	}
+
+	defer func(old func() time.Time) { now = old }(now)
+	msg := sign(&Signer{Expiration: time.Hour})
+	now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if sigs := verify(t, r, msg, 100); sigs[0].Result != PermError {
+		t.Errorf("expired signature: %s, %v", sigs[0].Result, sigs[0].Err)
+	}
+}
+
+func TestARC(t *testing.T) {
+	_, ek, r := keys(t)
+	s := &Sealer{Domain: "example.com", Selector: "ed", Key: ek}
+	msg := testMessage
+
+	// Seal the message at each of two hops, validating its chain
+	// as each receives it.
+	var chain *Chain
+	for hop := 1; hop <= 2; hop++ {
+		set, err := s.Seal([]byte(msg), chain, "spf=pass smtp.mailfrom=example.com")
+		if err != nil {
+			t.Fatalf("hop %d: %v", hop, err)
+		}
+		msg = set + msg
+		v := &Verifier{Resolver: r}
+		v.Write([]byte(msg))
+		chain = v.VerifyARC(context.Background())
+		if chain.Result != Pass || len(chain.Sets) != hop {
+			t.Fatalf("hop %d: chain %s, %v, %d sets", hop, chain.Result, chain.Err, len(chain.Sets))
+		}
+	}
+	if set := chain.Sets[1]; set.Instance != 2 || set.Domain != "example.com" || !strings.Contains(set.AuthResults, "arc=pass") {
+		t.Errorf("second set: %+v", set)
+	}
+
+	v := &Verifier{Resolver: r}
+	v.Write([]byte(strings.Replace(msg, "lost", "won", 1)))
+	if chain := v.VerifyARC(context.Background()); chain.Result != Fail {
+		t.Errorf("changed message: chain %s; want fail", chain.Result)
+	}
+
+	v = &Verifier{Resolver: r}
+	v.Write([]byte(testMessage))
+	if chain := v.VerifyARC(context.Background()); chain.Result != None {
+		t.Errorf("unsealed message: chain %s; want none", chain.Result)
+	}
+}
+
+// collector is an Envelope keeping the message it's given.
+type collector struct {
+	msg    strings.Builder
+	closed bool
+}
+
+func (c *collector) AddRecipient(rcpt smtpd.MailAddress) error { return nil }
+func (c *collector) BeginData() error                          { return nil }
+func (c *collector) Write(line []byte) error                   { c.msg.Write(line); return nil }
+func (c *collector) Close() error                              { c.closed = true; return nil }
+
+func TestEnvelopes(t *testing.T) {
+	rk, _, r := keys(t)
+	dst := &collector{}
+	verifying := &Envelope{Envelope: dst, Resolver: r}
+	var domain string
+	signing := &SigningEnvelope{
+		Envelope: verifying,
+		SignerFor: func(d string) (*Signer, error) {
+			domain = d
+			return &Signer{Domain: "example.com", Selector: "rsa", Key: rk}, nil
+		},
+	}
+	if err := signing.BeginData(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.SplitAfter(testMessage, "\n") {
+		signing.Write([]byte(line))
+	}
+	if err := signing.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if domain != "example.com" {
+		t.Errorf("SignerFor(%q); want the From domain", domain)
+	}
+	if !dst.closed || !strings.HasPrefix(dst.msg.String(), "DKIM-Signature: ") || !strings.HasSuffix(dst.msg.String(), testMessage) {
+		t.Errorf("passed on %q", dst.msg.String())
+	}
+	if sigs := verifying.Signatures(); len(sigs) != 1 || sigs[0].Result != Pass {
+		t.Errorf("signatures %+v", sigs)
+	}
+
+	// A failure to sign refuses the message.
+	signing = &SigningEnvelope{
+		Envelope:  &collector{},
+		SignerFor: func(string) (*Signer, error) { return &Signer{Domain: "example.com", Key: rk}, nil },
+	}
+	signing.BeginData()
+	signing.Write([]byte("Subject: no From\r\n\r\nbody\r\n"))
+	if err := signing.Close(); err != errSign {
+		t.Errorf("signing without From: Close = %v; want %v", err, errSign)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"log"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// ResultCloser is implemented by Envelopes that take the results of
+// verifying their messages. If the Envelope embedded in an Envelope
+// implements it, CloseResults is called in place of its Close.
+type ResultCloser interface {
+	CloseResults(ctx context.Context, sigs []*Signature) error
+}
+
+// Envelope is an smtpd.Envelope that verifies the DKIM signatures of
+// messages as they're passed to the embedded Envelope. Once the
+// message ends, the signatures are verified and their results given
+// to the embedded Envelope's CloseResults, if it's a ResultCloser, or
+// else kept for Signatures. The message's ARC chain is validated too,
+// for ARC.
+type Envelope struct {
+	smtpd.Envelope
+
+	// Resolver looks up the signers' keys; net.DefaultResolver if
+	// nil.
+	Resolver Resolver
+
+	v     Verifier
+	sigs  []*Signature
+	chain *Chain
+}
+
+func (e *Envelope) BeginData() error {
+	e.v = Verifier{}
+	e.sigs, e.chain = nil, nil
+	return e.Envelope.BeginData()
+}
+
+func (e *Envelope) Write(line []byte) error {
+	e.v.Write(line)
+	return e.Envelope.Write(line)
+}
+
+func (e *Envelope) Close() error {
+	return e.CloseContext(context.Background())
+}
+
+// CloseContext verifies the message's signatures, bounded by ctx,
+// then closes the embedded Envelope.
+func (e *Envelope) CloseContext(ctx context.Context) error {
+	e.v.Resolver = e.Resolver
+	e.sigs = e.v.Verify(ctx)
+	e.chain = e.v.VerifyARC(ctx)
+	switch env := e.Envelope.(type) {
+	case ResultCloser:
+		return env.CloseResults(ctx, e.sigs)
+	case smtpd.ContextCloser:
+		return env.CloseContext(ctx)
+	}
+	return e.Envelope.Close()
+}
+
+// Signatures returns the results of verifying the message's
+// signatures, once it's closed.
+func (e *Envelope) Signatures() []*Signature {
+	return e.sigs
+}
+
+// ARC returns the result of validating the message's ARC chain, once
+// it's closed. Its CloseResults may call it.
+func (e *Envelope) ARC() *Chain {
+	return e.chain
+}
+
+// Header returns the message's header fields, as Verifier.Header.
+func (e *Envelope) Header() []string {
+	return e.v.Header()
+}
+
+// RecipientVerdict passes through the embedded Envelope's verdict if
+// it's an smtpd.PRDREnvelope.
+func (e *Envelope) RecipientVerdict(rcpt smtpd.MailAddress) error {
+	if pe, ok := e.Envelope.(smtpd.PRDREnvelope); ok {
+		return pe.RecipientVerdict(rcpt)
+	}
+	return nil
+}
+
+// Abort passes the end of the transaction on to the embedded
+// Envelope if it's an smtpd.AbortEnvelope.
+func (e *Envelope) Abort() {
+	if ae, ok := e.Envelope.(smtpd.AbortEnvelope); ok {
+		ae.Abort()
+	}
+}
+
+// SigningEnvelope is an smtpd.Envelope that signs messages with DKIM
+// before passing them to the embedded Envelope, such as for a
+// submission server relaying its users' mail. The body is hashed as
+// it arrives, but the message is buffered in memory until Close,
+// when it's passed on after its signature.
+type SigningEnvelope struct {
+	smtpd.Envelope
+
+	// SignerFor returns the Signer for a message whose From field
+	// has the given domain, or nil to pass it on unsigned. If it
+	// returns an error, the message is refused with a temporary
+	// failure.
+	SignerFor func(domain string) (*Signer, error)
+
+	buf    bytes.Buffer
+	lines  lineSplitter
+	fields []string
+	body   *bodyHasher // once the header has ended
+}
+
+var errSign = smtpd.SMTPError("451 4.3.0 Error: message could not be signed")
+
+func (e *SigningEnvelope) BeginData() error {
+	e.buf.Reset()
+	e.lines = lineSplitter{}
+	e.fields, e.body = nil, nil
+	return e.Envelope.BeginData()
+}
+
+func (e *SigningEnvelope) Write(line []byte) error {
+	e.buf.Write(line)
+	e.lines.write(line, e.line)
+	return nil
+}
+
+// line handles a line of the message, without its line ending.
+func (e *SigningEnvelope) line(l []byte) {
+	switch {
+	case e.body != nil:
+		e.body.line(l)
+	case len(l) == 0:
+		e.body = newBodyHasher(true, -1)
+	default:
+		e.fields = addHeaderLine(e.fields, l)
+	}
+}
+
+func (e *SigningEnvelope) Close() error {
+	return e.CloseContext(context.Background())
+}
+
+// CloseContext signs the message and passes it to the embedded
+// Envelope, then closes it.
+func (e *SigningEnvelope) CloseContext(ctx context.Context) error {
+	e.lines.flush(e.line)
+	if e.body == nil {
+		e.body = newBodyHasher(true, -1)
+	}
+	domain := fromDomain(e.fields)
+	s, err := e.SignerFor(domain)
+	if err == nil && s != nil {
+		var sig string
+		if sig, err = s.sign(e.fields, e.body.sum()); err == nil {
+			err = e.Envelope.Write([]byte(sig))
+		}
+	}
+	if err != nil {
+		log.Printf("dkim: signing message from %q: %v", domain, err)
+		return errSign
+	}
+	msg := e.buf.Bytes()
+	for len(msg) > 0 {
+		n := bytes.IndexByte(msg, '\n') + 1
+		if n == 0 {
+			n = len(msg)
+		}
+		if err := e.Envelope.Write(msg[:n]); err != nil {
+			return err
+		}
+		msg = msg[n:]
+	}
+	if cc, ok := e.Envelope.(smtpd.ContextCloser); ok {
+		return cc.CloseContext(ctx)
+	}
+	return e.Envelope.Close()
+}
+
+// RecipientVerdict passes through the embedded Envelope's verdict if
+// it's an smtpd.PRDREnvelope.
+func (e *SigningEnvelope) RecipientVerdict(rcpt smtpd.MailAddress) error {
+	if pe, ok := e.Envelope.(smtpd.PRDREnvelope); ok {
+		return pe.RecipientVerdict(rcpt)
+	}
+	return nil
+}
+
+// Abort passes the end of the transaction on to the embedded
+// Envelope if it's an smtpd.AbortEnvelope.
+func (e *SigningEnvelope) Abort() {
+	if ae, ok := e.Envelope.(smtpd.AbortEnvelope); ok {
+		ae.Abort()
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sealer adds ARC sets to messages it forwards, such as for a mailing
+// list, so later receivers can rely on the authentication results it
+// found even though it changed the messages (RFC 8617 s5.1).
+type Sealer struct {
+	Domain   string        // d=, the sealing domain
+	Selector string        // s=, naming the public key under Domain
+	Key      crypto.Signer // an *rsa.PrivateKey or ed25519.PrivateKey
+
+	// AuthServID names the sealer in its ARC-Authentication-Results
+	// field; Domain if empty.
+	AuthServID string
+
+	// Headers are the names of the fields to sign, those the message
+	// has. If nil, the usual ones are signed.
+	Headers []string
+}
+
+// Seal returns a new ARC set for msg, three header fields each ending
+// in CRLF, to add to the top of msg as it's sent on. The set is
+// sealed with the message as it is then, after any changes.
+//
+// chain is the result of validating msg's chain when it was
+// received, with Verifier.VerifyARC, or nil if it was unsealed.
+// results are the authentication results found then, as in an
+// Authentication-Results field (RFC 8601), such as
+// "spf=pass smtp.mailfrom=example.org; dkim=pass header.d=example.org".
+// The chain's result is added to them if they don't have it.
+func (s *Sealer) Seal(msg []byte, chain *Chain, results string) (string, error) {
+	alg, err := algorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+	fields, body := splitMessage(msg)
+
+	cv := None
+	if chain != nil {
+		cv = chain.Result
+	}
+	var sets []arcSet
+	n := 1
+	switch cv {
+	case None:
+		if highestInstance(fields) > 0 {
+			return "", errors.New("dkim: message has ARC sets but no validated chain")
+		}
+	case Pass:
+		if sets, err = collectARC(fields); err != nil {
+			return "", err
+		}
+		n = len(sets) + 1
+	case Fail:
+		// A failed chain ends with a seal covering only its own
+		// set, as the earlier ones can't be relied on.
+		n = highestInstance(fields) + 1
+	default:
+		return "", errors.New("dkim: can't seal message whose chain couldn't be validated")
+	}
+	if n > maxARCInstance {
+		return "", errorf("message has %d ARC sets already", n-1)
+	}
+
+	if results = strings.TrimSpace(results); !strings.Contains(results, "arc=") {
+		if results != "" {
+			results += "; "
+		}
+		results += "arc=" + string(cv)
+	}
+	authServID := s.AuthServID
+	if authServID == "" {
+		authServID = s.Domain
+	}
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s; %s", n, authServID, results)
+
+	signed := signedFields(fields, s.Headers)
+	bh := hashBody(body, true)
+	t := now().Unix()
+	ams := formatField("ARC-Message-Signature", []string{
+		fmt.Sprintf("i=%d", n),
+		"a=" + alg,
+		"c=relaxed/relaxed",
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		fmt.Sprintf("t=%d", t),
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bh),
+		"b=",
+	})
+	h := sha256.New()
+	writeSignedHeader(h, fields, signed, true)
+	h.Write([]byte(canonHeader(ams, true, false)))
+	sig, err := signDigest(s.Key, h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	ams = appendSignature(ams, sig)
+
+	seal := formatField("ARC-Seal", []string{
+		fmt.Sprintf("i=%d", n),
+		"a=" + alg,
+		fmt.Sprintf("t=%d", t),
+		"cv=" + string(cv),
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"b=",
+	})
+	sets = append(sets, arcSet{aar, ams, seal})
+	if sig, err = signDigest(s.Key, hashSeal(sets)); err != nil {
+		return "", err
+	}
+	seal = appendSignature(seal, sig)
+	return seal + "\r\n" + ams + "\r\n" + aar + "\r\n", nil
+}
+
+// highestInstance returns the highest instance of the ARC fields in
+// the header, which may be ill-formed.
+func highestInstance(fields []string) int {
+	n := 0
+	for _, f := range fields {
+		switch name := fieldName(f); {
+		case strings.EqualFold(name, "ARC-Seal"),
+			strings.EqualFold(name, "ARC-Message-Signature"),
+			strings.EqualFold(name, "ARC-Authentication-Results"):
+			_, value, _ := strings.Cut(f, ":")
+			for _, spec := range strings.Split(value, ";") {
+				k, v, _ := strings.Cut(spec, "=")
+				if strings.TrimSpace(k) != "i" {
+					continue
+				}
+				if i, err := parseInstance(v); err == nil && i > n {
+					n = i
+				}
+				break
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,195 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// defaultHeaders are the fields signed if Signer.Headers or
+// Sealer.Headers is nil, those of them the message has.
+var defaultHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "DKIM-Signature",
+}
+
+// Signer signs messages with DKIM (RFC 6376 s5), using relaxed
+// canonicalization.
+type Signer struct {
+	Domain   string        // d=, the signing domain
+	Selector string        // s=, naming the public key under Domain
+	Key      crypto.Signer // an *rsa.PrivateKey or ed25519.PrivateKey
+
+	// Identifier is the i= tag, the agent or user the message is
+	// signed for, such as "@example.com"; omitted if empty.
+	Identifier string
+
+	// Headers are the names of the fields to sign, those the message
+	// has. If nil, the usual ones are signed. The From field is
+	// signed once more than the message has it, so no other can be
+	// added.
+	Headers []string
+
+	// Expiration, if non-zero, is how long signatures are valid.
+	Expiration time.Duration
+}
+
+// Sign returns a DKIM-Signature field for msg, ending in CRLF, to add
+// to its top.
+func (s *Signer) Sign(msg []byte) (string, error) {
+	fields, body := splitMessage(msg)
+	return s.sign(fields, hashBody(body, true))
+}
+
+// sign returns a DKIM-Signature field for a message with the header
+// fields and relaxed body hash bh.
+func (s *Signer) sign(fields []string, bh []byte) (string, error) {
+	alg, err := algorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+	signed := signedFields(fields, s.Headers)
+	hasFrom := false
+	for _, name := range signed {
+		hasFrom = hasFrom || name == "from"
+	}
+	if !hasFrom {
+		return "", errorf("message has no From field")
+	}
+	signed = append(signed, "from")
+
+	t := now()
+	tags := []string{"v=1", "a=" + alg, "c=relaxed/relaxed", "d=" + s.Domain, "s=" + s.Selector}
+	if s.Identifier != "" {
+		tags = append(tags, "i="+s.Identifier)
+	}
+	tags = append(tags, fmt.Sprintf("t=%d", t.Unix()))
+	if s.Expiration > 0 {
+		tags = append(tags, fmt.Sprintf("x=%d", t.Add(s.Expiration).Unix()))
+	}
+	tags = append(tags,
+		"h="+strings.Join(signed, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bh),
+		"b=")
+	field := formatField("DKIM-Signature", tags)
+	h := sha256.New()
+	writeSignedHeader(h, fields, signed, true)
+	h.Write([]byte(canonHeader(field, true, false)))
+	sig, err := signDigest(s.Key, h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	return appendSignature(field, sig) + "\r\n", nil
+}
+
+// signedFields returns the names of the fields to sign: each of
+// names, or defaultHeaders if nil, as many times as the header has
+// it.
+func signedFields(fields, names []string) []string {
+	if names == nil {
+		names = defaultHeaders
+	}
+	var signed []string
+	for _, name := range names {
+		for _, f := range fields {
+			if strings.EqualFold(fieldName(f), name) {
+				signed = append(signed, strings.ToLower(name))
+			}
+		}
+	}
+	return signed
+}
+
+// fromDomain returns the domain of the first author in a message's
+// From field, or "" if it has none.
+func fromDomain(fields []string) string {
+	for _, f := range fields {
+		if !strings.EqualFold(fieldName(f), "From") {
+			continue
+		}
+		_, value, _ := strings.Cut(f, ":")
+		addrs, err := mail.ParseAddressList(strings.ReplaceAll(value, "\r\n", ""))
+		if err != nil || len(addrs) == 0 {
+			return ""
+		}
+		a := addrs[0].Address
+		return strings.ToLower(a[strings.LastIndex(a, "@")+1:])
+	}
+	return ""
+}
+
+// algorithm returns the a= tag for signatures made with key.
+func algorithm(key crypto.Signer) (string, error) {
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSABits {
+			return "", errorf("%d-bit RSA key is too short", k.N.BitLen())
+		}
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", errorf("unsupported key type %T", key.Public())
+}
+
+// signDigest signs a SHA-256 digest with key. Ed25519 signs the
+// digest itself as its message (RFC 8463 s3).
+func signDigest(key crypto.Signer, digest []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	return key.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+// formatField formats a signature header field from its tag-specs,
+// folding its lines before 78 columns where it can. The last should
+// be the empty "b=", for appendSignature to fill in.
+func formatField(name string, tags []string) string {
+	var b strings.Builder
+	b.WriteString(name + ":")
+	col := b.Len()
+	for i, t := range tags {
+		if i < len(tags)-1 {
+			t += ";"
+		}
+		if col+1+len(t) > 77 && i > 0 {
+			b.WriteString("\r\n\t")
+			col = 8
+		} else {
+			b.WriteByte(' ')
+			col++
+		}
+		b.WriteString(t)
+		col += len(t)
+	}
+	return b.String()
+}
+
+// appendSignature appends the value of the b= tag ending field,
+// folded over lines of its own.
+func appendSignature(field string, sig []byte) string {
+	v := base64.StdEncoding.EncodeToString(sig)
+	var b strings.Builder
+	b.WriteString(field)
+	for len(v) > 0 {
+		n := len(v)
+		if n > 70 {
+			n = 70
+		}
+		b.WriteString("\r\n\t" + v[:n])
+		v = v[n:]
+	}
+	return b.String()
+}
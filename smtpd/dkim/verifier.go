@@ -0,0 +1,143 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Verifier verifies a message's DKIM signatures, and its ARC chain,
+// as it's written, hashing the body as it goes so only the header is
+// kept in memory. The zero value is ready to use.
+type Verifier struct {
+	// Resolver looks up the signers' keys; net.DefaultResolver if
+	// nil.
+	Resolver Resolver
+
+	lines    lineSplitter
+	fields   []string // the header fields
+	inBody   bool
+	sigs     []*Signature
+	hashers  []*bodyHasher
+	verified bool
+
+	arcSets []arcSet
+	arcErr  error      // from collecting arcSets
+	ams     *Signature // the latest ARC-Message-Signature
+	chain   *Chain
+}
+
+func (v *Verifier) resolver() Resolver {
+	if v.Resolver != nil {
+		return v.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Write adds p, the next part of the message, to the Verifier. Lines
+// may end in CRLF or a bare LF.
+func (v *Verifier) Write(p []byte) (int, error) {
+	v.lines.write(p, v.line)
+	return len(p), nil
+}
+
+// line handles a line of the message, without its line ending.
+func (v *Verifier) line(l []byte) {
+	if v.inBody {
+		for _, h := range v.hashers {
+			h.line(l)
+		}
+		return
+	}
+	if len(l) == 0 {
+		v.endHeader()
+		return
+	}
+	v.fields = addHeaderLine(v.fields, l)
+}
+
+// endHeader parses the message's signatures once its header is
+// complete, and starts hashing the body for each.
+func (v *Verifier) endHeader() {
+	v.inBody = true
+	for _, f := range v.fields {
+		if !strings.EqualFold(fieldName(f), "DKIM-Signature") {
+			continue
+		}
+		sig, err := parseSignature(f, false)
+		if err == nil && len(v.sigs) >= maxSignatures {
+			err = errorf("too many signatures")
+		}
+		if err != nil {
+			sig.Result, sig.Err = PermError, err
+		} else {
+			_, bc, _ := strings.Cut(sig.canon, "/")
+			sig.body = newBodyHasher(bc == "relaxed", sig.BodyLength)
+			v.hashers = append(v.hashers, sig.body)
+		}
+		v.sigs = append(v.sigs, sig)
+	}
+
+	v.arcSets, v.arcErr = collectARC(v.fields)
+	if n := len(v.arcSets); n > 0 {
+		sig, err := parseSignature(v.arcSets[n-1].ams, true)
+		if err != nil {
+			sig.Result, sig.Err = PermError, err
+		} else {
+			_, bc, _ := strings.Cut(sig.canon, "/")
+			sig.body = newBodyHasher(bc == "relaxed", sig.BodyLength)
+			v.hashers = append(v.hashers, sig.body)
+		}
+		v.ams = sig
+	}
+}
+
+// finish ends the message.
+func (v *Verifier) finish() {
+	v.lines.flush(v.line)
+	if !v.inBody {
+		v.endHeader()
+	}
+}
+
+// Header returns the message's header fields as received, any folded
+// lines separated by CRLF.
+func (v *Verifier) Header() []string {
+	return v.fields
+}
+
+// Verify finishes the message and verifies its signatures, returning
+// a result for each in the order they appear in the header. A message
+// without signatures has none. Later calls return the same results.
+func (v *Verifier) Verify(ctx context.Context) []*Signature {
+	if v.verified {
+		return v.sigs
+	}
+	v.verified = true
+	v.finish()
+	for _, sig := range v.sigs {
+		if sig.body != nil {
+			sig.verify(ctx, v.resolver(), v.fields)
+		}
+	}
+	return v.sigs
+}
+
+// VerifyARC finishes the message and validates its ARC chain. Later
+// calls return the same result.
+func (v *Verifier) VerifyARC(ctx context.Context) *Chain {
+	if v.chain != nil {
+		return v.chain
+	}
+	v.finish()
+	if v.arcErr != nil {
+		v.chain = &Chain{Result: Fail, Err: v.arcErr}
+	} else {
+		v.chain = validateARC(ctx, v.resolver(), v.fields, v.arcSets, v.ams)
+	}
+	return v.chain
+}
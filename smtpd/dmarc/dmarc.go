@@ -0,0 +1,414 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dmarc evaluates the DMARC policy (RFC 7489) of a message's
+// author domain, from the results of checking its sender with SPF and
+// its signatures with DKIM.
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd/dkim"
+	"github.com/bradfitz/go-smtpd/smtpd/spf"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Result is the outcome of a DMARC evaluation (RFC 8601 s2.7.4).
+type Result string
+
+const (
+	None      Result = "none"      // the domain has no policy
+	Pass      Result = "pass"      // an aligned identifier passed SPF or DKIM
+	Fail      Result = "fail"      // none did
+	TempError Result = "temperror" // the policy couldn't be fetched
+	PermError Result = "permerror" // the message's author domain is unusable
+)
+
+// Policy is a disposition a domain asks for messages that fail.
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// Resolver looks up policy records. *net.Resolver and smtpd.Resolver
+// implement it.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Record is a domain's DMARC policy record (RFC 7489 s6.3).
+type Record struct {
+	Policy          Policy   // p=
+	SubdomainPolicy Policy   // sp=, for subdomains; Policy if unset
+	Percent         int      // pct=, of failing messages to apply the policy to
+	StrictDKIM      bool     // adkim=s
+	StrictSPF       bool     // aspf=s
+	AggregateURIs   []string // rua=, where to send aggregate reports
+	FailureURIs     []string // ruf=, where to send failure reports
+	FailureOptions  string   // fo=, when to send failure reports; "0" if unset
+	ReportInterval  int      // ri=, seconds between aggregate reports
+}
+
+// ParseRecord parses a DMARC policy record.
+func ParseRecord(txt string) (*Record, error) {
+	rec := &Record{Percent: 100, FailureOptions: "0", ReportInterval: 86400}
+	specs := strings.Split(txt, ";")
+	if v, ok := cutTag(specs[0]); !ok || v[0] != "v" || v[1] != "DMARC1" {
+		return nil, errors.New("dmarc: record doesn't begin with v=DMARC1")
+	}
+	hasPolicy := false
+	for _, spec := range specs[1:] {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		tv, ok := cutTag(spec)
+		if !ok {
+			return nil, fmt.Errorf("dmarc: bad tag %q", strings.TrimSpace(spec))
+		}
+		name, value := tv[0], tv[1]
+		var err error
+		switch name {
+		case "p":
+			rec.Policy, err = parsePolicy(value)
+			hasPolicy = true
+		case "sp":
+			rec.SubdomainPolicy, err = parsePolicy(value)
+		case "adkim":
+			rec.StrictDKIM, err = parseAlignment(value)
+		case "aspf":
+			rec.StrictSPF, err = parseAlignment(value)
+		case "pct":
+			rec.Percent, err = strconv.Atoi(value)
+			if err == nil && (rec.Percent < 0 || rec.Percent > 100) {
+				err = errors.New("out of range")
+			}
+		case "rua":
+			rec.AggregateURIs = splitURIs(value)
+		case "ruf":
+			rec.FailureURIs = splitURIs(value)
+		case "fo":
+			rec.FailureOptions = value
+		case "ri":
+			rec.ReportInterval, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dmarc: bad %s= tag %q", name, value)
+		}
+	}
+	if !hasPolicy {
+		// A record meant only to collect reports may omit p=
+		// (RFC 7489 s6.6.3).
+		if len(rec.AggregateURIs) == 0 {
+			return nil, errors.New("dmarc: record lacks p= tag")
+		}
+		rec.Policy = PolicyNone
+	}
+	if rec.SubdomainPolicy == "" {
+		rec.SubdomainPolicy = rec.Policy
+	}
+	return rec, nil
+}
+
+// cutTag splits a tag-spec into its name and value.
+func cutTag(spec string) ([2]string, bool) {
+	name, value, ok := strings.Cut(spec, "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	return [2]string{name, value}, ok && name != ""
+}
+
+func parsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p, nil
+	}
+	return "", errors.New("unknown policy")
+}
+
+func parseAlignment(s string) (strict bool, err error) {
+	switch strings.ToLower(s) {
+	case "r":
+		return false, nil
+	case "s":
+		return true, nil
+	}
+	return false, errors.New("unknown alignment")
+}
+
+func splitURIs(s string) []string {
+	var uris []string
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			uris = append(uris, u)
+		}
+	}
+	return uris
+}
+
+// OrganizationalDomain returns the domain registered for domain under
+// a public suffix, such as "example.co.uk" for "mail.example.co.uk"
+// (RFC 7489 s3.2).
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if od, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return od
+	}
+	return domain
+}
+
+// aligned reports whether the authenticated domain d is aligned with
+// the author domain from (RFC 7489 s3.1).
+func aligned(d, from string, strict bool) bool {
+	d = strings.ToLower(strings.TrimSuffix(d, "."))
+	if d == "" {
+		return false
+	}
+	if strict {
+		return d == from
+	}
+	return OrganizationalDomain(d) == OrganizationalDomain(from)
+}
+
+// FromDomain returns the author domain of a message from its header
+// fields, as returned by dkim.Verifier.Header. The message must have
+// exactly one From field, whose addresses all share a domain
+// (RFC 7489 s6.6.1).
+func FromDomain(header []string) (string, error) {
+	var from string
+	n := 0
+	for _, f := range header {
+		name, value, _ := strings.Cut(f, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "From") {
+			from = value
+			n++
+		}
+	}
+	if n != 1 {
+		return "", fmt.Errorf("dmarc: message has %d From fields", n)
+	}
+	addrs, err := mail.ParseAddressList(strings.ReplaceAll(from, "\r\n", ""))
+	if err != nil {
+		return "", fmt.Errorf("dmarc: bad From field: %v", err)
+	}
+	var domain string
+	for _, a := range addrs {
+		at := strings.LastIndex(a.Address, "@")
+		d := strings.ToLower(a.Address[at+1:])
+		if at < 0 || d == "" {
+			return "", fmt.Errorf("dmarc: From address %q has no domain", a.Address)
+		}
+		if domain != "" && d != domain {
+			return "", errors.New("dmarc: From addresses have different domains")
+		}
+		domain = d
+	}
+	return domain, nil
+}
+
+// Checker evaluates DMARC policies. The zero value is ready to use.
+type Checker struct {
+	// Resolver looks up policy records; net.DefaultResolver if nil.
+	Resolver Resolver
+}
+
+func (c *Checker) resolver() Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Verdict is the outcome of evaluating a message's DMARC policy.
+type Verdict struct {
+	Result Result
+
+	// Disposition is what the policy asks be done with the message:
+	// PolicyNone unless it failed.
+	Disposition Policy
+
+	Domain       string  // the author domain, from the From field
+	PolicyDomain string  // the domain whose record applied
+	Record       *Record // nil if there was none
+
+	SPFAligned  bool // an aligned domain passed SPF
+	DKIMAligned bool // an aligned signature verified
+
+	// Signatures are the results of verifying the message's DKIM
+	// signatures.
+	Signatures []*dkim.Signature
+
+	// ARC is the result of validating the message's ARC chain, set
+	// by Envelope. A VerdictCloser may accept a message that fails
+	// if its chain passes and was sealed by a trusted forwarder.
+	ARC *dkim.Chain
+
+	// Report is the message's entry in aggregate reports.
+	Report ReportRow
+
+	// Err is the problem behind a TempError or PermError.
+	Err error
+}
+
+// ReportRow is what a message contributes to an aggregate report
+// (RFC 7489 s7.2 and appendix C).
+type ReportRow struct {
+	SourceIP     net.IP
+	HeaderFrom   string // the author domain
+	EnvelopeFrom string // the MAIL FROM domain; empty for a null sender
+
+	Disposition Policy // as applied
+	DKIM        Result // Pass if an aligned signature verified, else Fail
+	SPF         Result // Pass if an aligned domain passed SPF, else Fail
+
+	// Reason is why Disposition isn't the domain's policy:
+	// "sampled_out" if the message wasn't among its pct= share.
+	Reason string
+
+	DKIMResults []DKIMResult
+	SPFResult   SPFResult
+}
+
+// DKIMResult reports one signature's verification.
+type DKIMResult struct {
+	Domain   string
+	Selector string
+	Result   dkim.Result
+}
+
+// SPFResult reports an SPF check.
+type SPFResult struct {
+	Domain string
+	Scope  string // "mfrom" or "helo"
+	Result spf.Result
+}
+
+// sampled reports whether a failing message falls within the share
+// of messages a policy applies to.
+var sampled = func(percent int) bool {
+	return percent >= 100 || rand.Intn(100) < percent
+}
+
+// Check evaluates the DMARC policy of the author domain from, for a
+// message whose sender was checked with SPF, giving sv (which may be
+// nil if it wasn't), and whose signatures were verified, giving sigs.
+func (c *Checker) Check(ctx context.Context, from string, sv *spf.Verdict, sigs []*dkim.Signature) *Verdict {
+	from = strings.ToLower(strings.TrimSuffix(from, "."))
+	v := &Verdict{Domain: from, Disposition: PolicyNone, Signatures: sigs}
+	r := &v.Report
+	r.HeaderFrom = from
+	r.Disposition = PolicyNone
+	r.DKIM, r.SPF = Fail, Fail
+	for _, sig := range sigs {
+		r.DKIMResults = append(r.DKIMResults, DKIMResult{sig.Domain, sig.Selector, sig.Result})
+	}
+	if sv != nil {
+		r.SourceIP = sv.IP
+		r.SPFResult = SPFResult{Domain: sv.Domain, Scope: "mfrom", Result: sv.Result}
+		if sv.Identity == "helo" {
+			r.SPFResult.Scope = "helo"
+		} else {
+			r.EnvelopeFrom = sv.Domain
+		}
+	}
+	if from == "" {
+		v.Result, v.Err = PermError, errors.New("dmarc: no author domain")
+		return v
+	}
+
+	rec, domain, err := c.lookup(ctx, from)
+	if err != nil {
+		v.Result, v.Err = TempError, err
+		return v
+	}
+	if rec == nil {
+		v.Result = None
+		return v
+	}
+	v.Record, v.PolicyDomain = rec, domain
+
+	if sv != nil && sv.Result == spf.Pass && aligned(sv.Domain, from, rec.StrictSPF) {
+		v.SPFAligned = true
+		r.SPF = Pass
+	}
+	for _, sig := range sigs {
+		if sig.Result == dkim.Pass && aligned(sig.Domain, from, rec.StrictDKIM) {
+			v.DKIMAligned = true
+			r.DKIM = Pass
+			break
+		}
+	}
+	if v.SPFAligned || v.DKIMAligned {
+		v.Result = Pass
+		return v
+	}
+
+	v.Result = Fail
+	p := rec.Policy
+	if domain != from {
+		p = rec.SubdomainPolicy
+	}
+	if p != PolicyNone && !sampled(rec.Percent) {
+		// Messages outside the sample get the next milder
+		// treatment (RFC 7489 s6.6.4).
+		r.Reason = "sampled_out"
+		if p == PolicyReject {
+			p = PolicyQuarantine
+		} else {
+			p = PolicyNone
+		}
+	}
+	v.Disposition, r.Disposition = p, p
+	return v
+}
+
+// lookup finds the policy record for the author domain from, falling
+// back to its organizational domain's (RFC 7489 s6.6.3). It returns
+// a nil Record if neither has one.
+func (c *Checker) lookup(ctx context.Context, from string) (*Record, string, error) {
+	rec, err := c.record(ctx, from)
+	if rec != nil || err != nil {
+		return rec, from, err
+	}
+	if od := OrganizationalDomain(from); od != from {
+		rec, err = c.record(ctx, od)
+		return rec, od, err
+	}
+	return nil, "", nil
+}
+
+// record fetches and parses the policy record of domain itself. A
+// domain with no record, several, or an unparsable one has none.
+func (c *Checker) record(ctx context.Context, domain string) (*Record, error) {
+	txts, err := c.resolver().LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("dmarc: looking up policy of %s: %v", domain, err)
+	}
+	var found []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			found = append(found, txt)
+		}
+	}
+	if len(found) != 1 {
+		return nil, nil
+	}
+	rec, err := ParseRecord(found[0])
+	if err != nil {
+		return nil, nil
+	}
+	return rec, nil
+}
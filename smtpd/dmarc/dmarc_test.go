@@ -0,0 +1,186 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dmarc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/bradfitz/go-smtpd/smtpd/dkim"
+	"github.com/bradfitz/go-smtpd/smtpd/spf"
+)
+
+// txtResolver answers LookupTXT from a map; other names aren't found,
+// except those mapped to nil, which fail temporarily.
+type txtResolver map[string][]string
+
+func (r txtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if txts == nil {
+		return nil, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	return txts, nil
+}
+
+func TestParseRecord(t *testing.T) {
+	rec, err := ParseRecord("v=DMARC1; p=reject; sp=quarantine; adkim=s; pct=25; rua=mailto:a@example.com, mailto:b@example.com; fo=1; ri=3600;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Record{
+		Policy:          PolicyReject,
+		SubdomainPolicy: PolicyQuarantine,
+		Percent:         25,
+		StrictDKIM:      true,
+		AggregateURIs:   []string{"mailto:a@example.com", "mailto:b@example.com"},
+		FailureOptions:  "1",
+		ReportInterval:  3600,
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("got %+v\nwant %+v", rec, want)
+	}
+
+	rec, err = ParseRecord("v=DMARC1;p=none")
+	if err != nil || rec.SubdomainPolicy != PolicyNone || rec.Percent != 100 || rec.FailureOptions != "0" || rec.ReportInterval != 86400 {
+		t.Errorf("defaults: %+v, %v", rec, err)
+	}
+	// A record only collecting reports needn't have p=.
+	if rec, err := ParseRecord("v=DMARC1; rua=mailto:a@example.com"); err != nil || rec.Policy != PolicyNone {
+		t.Errorf("report-only record: %+v, %v", rec, err)
+	}
+
+	for _, bad := range []string{
+		"p=reject",
+		"v=DMARC2; p=reject",
+		"v=DMARC1",
+		"v=DMARC1; p=discard",
+		"v=DMARC1; p=reject; pct=101",
+		"v=DMARC1; p=reject; aspf=x",
+		"v=DMARC1; p=reject; junk",
+	} {
+		if _, err := ParseRecord(bad); err == nil {
+			t.Errorf("ParseRecord(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	tests := []struct {
+		d, from string
+		strict  bool
+		want    bool
+	}{
+		{"example.com", "example.com", false, true},
+		{"example.com", "example.com", true, true},
+		{"mail.example.com", "example.com", false, true},
+		{"mail.example.com", "example.com", true, false},
+		{"example.com", "news.example.com", false, true},
+		{"Mail.Example.COM.", "mail.example.com", true, true},
+		{"example.net", "example.com", false, false},
+		{"a.example.co.uk", "b.example.co.uk", false, true},
+		{"example.co.uk", "other.co.uk", false, false},
+		{"", "example.com", false, false},
+	}
+	for _, tt := range tests {
+		if got := aligned(tt.d, tt.from, tt.strict); got != tt.want {
+			t.Errorf("aligned(%q, %q, strict=%v) = %v", tt.d, tt.from, tt.strict, got)
+		}
+	}
+}
+
+func TestFromDomain(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   string // "" for an error
+	}{
+		{[]string{"From: Joe <joe@Example.COM>"}, "example.com"},
+		{[]string{"Subject: x", "from: a@example.com,\r\n b@example.com"}, "example.com"},
+		{[]string{"From: a@example.com, b@example.net"}, ""},
+		{[]string{"From: a@example.com", "From: b@example.com"}, ""},
+		{[]string{"Subject: no author"}, ""},
+		{[]string{"From: not an address"}, ""},
+	}
+	for _, tt := range tests {
+		got, err := FromDomain(tt.header)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("FromDomain(%q) = %q, %v; want %q", tt.header, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	r := txtResolver{
+		"_dmarc.example.com":   {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.org":    {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+		"_dmarc.sampled.org":   {"v=DMARC1; p=reject; pct=10"},
+		"_dmarc.two.org":       {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.broken.org":    {"v=DMARC1; p=maybe"},
+		"_dmarc.flaky.org":     nil,
+		"_dmarc.monitored.org": {"v=DMARC1; p=none"},
+	}
+	c := &Checker{Resolver: r}
+	spfPass := func(domain string) *spf.Verdict {
+		return &spf.Verdict{Result: spf.Pass, Identity: "mailfrom", Domain: domain, IP: net.ParseIP("192.0.2.1")}
+	}
+	dkimPass := func(domain string) []*dkim.Signature {
+		return []*dkim.Signature{{Result: dkim.Pass, Domain: domain, Selector: "s"}}
+	}
+
+	defer func(old func(int) bool) { sampled = old }(sampled)
+	sampled = func(percent int) bool { return percent >= 100 }
+
+	tests := []struct {
+		name        string
+		from        string
+		sv          *spf.Verdict
+		sigs        []*dkim.Signature
+		want        Result
+		disposition Policy
+		policy      string // PolicyDomain
+	}{
+		{"SPF aligned", "example.com", spfPass("bounces.example.com"), nil, Pass, PolicyNone, "example.com"},
+		{"DKIM aligned", "example.com", nil, dkimPass("example.com"), Pass, PolicyNone, "example.com"},
+		{"unaligned", "example.com", spfPass("example.net"), dkimPass("example.net"), Fail, PolicyReject, "example.com"},
+		{"DKIM failed", "example.com", nil, []*dkim.Signature{{Result: dkim.Fail, Domain: "example.com"}}, Fail, PolicyReject, "example.com"},
+		{"SPF softfail", "example.com", &spf.Verdict{Result: spf.SoftFail, Domain: "example.com"}, nil, Fail, PolicyReject, "example.com"},
+		{"subdomain", "news.example.com", nil, nil, Fail, PolicyQuarantine, "example.com"},
+		{"subdomain aligned", "news.example.com", nil, dkimPass("example.com"), Pass, PolicyNone, "example.com"},
+		{"strict SPF", "strict.org", spfPass("mail.strict.org"), nil, Fail, PolicyReject, "strict.org"},
+		{"strict DKIM", "strict.org", nil, dkimPass("strict.org"), Pass, PolicyNone, "strict.org"},
+		{"sampled out", "sampled.org", nil, nil, Fail, PolicyQuarantine, "sampled.org"},
+		{"monitoring", "monitored.org", nil, nil, Fail, PolicyNone, "monitored.org"},
+		{"no policy", "example.net", nil, nil, None, PolicyNone, ""},
+		{"two policies", "two.org", nil, nil, None, PolicyNone, ""},
+		{"unparsable policy", "broken.org", nil, nil, None, PolicyNone, ""},
+		{"DNS failure", "flaky.org", nil, nil, TempError, PolicyNone, ""},
+		{"no author", "", nil, nil, PermError, PolicyNone, ""},
+	}
+	for _, tt := range tests {
+		v := c.Check(context.Background(), tt.from, tt.sv, tt.sigs)
+		if v.Result != tt.want || v.Disposition != tt.disposition || v.PolicyDomain != tt.policy {
+			t.Errorf("%s: %s, disposition %s, policy of %q (%v); want %s, %s, %q", tt.name, v.Result, v.Disposition, v.PolicyDomain, v.Err, tt.want, tt.disposition, tt.policy)
+		}
+		if (v.Err != nil) != (v.Result == TempError || v.Result == PermError) {
+			t.Errorf("%s: %s with Err %v", tt.name, v.Result, v.Err)
+		}
+	}
+
+	v := c.Check(context.Background(), "example.com", spfPass("example.net"), dkimPass("example.com"))
+	row := v.Report
+	if !row.SourceIP.Equal(net.ParseIP("192.0.2.1")) || row.HeaderFrom != "example.com" || row.EnvelopeFrom != "example.net" ||
+		row.DKIM != Pass || row.SPF != Fail || row.Disposition != PolicyNone ||
+		len(row.DKIMResults) != 1 || row.SPFResult.Scope != "mfrom" || row.SPFResult.Result != spf.Pass {
+		t.Errorf("report row %+v", row)
+	}
+	v = c.Check(context.Background(), "sampled.org", nil, nil)
+	if v.Report.Reason != "sampled_out" || v.Report.Disposition != PolicyQuarantine {
+		t.Errorf("sampled out: report row %+v", v.Report)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dmarc
+
+import (
+	"context"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+	"github.com/bradfitz/go-smtpd/smtpd/dkim"
+	"github.com/bradfitz/go-smtpd/smtpd/spf"
+)
+
+// VerdictCloser is implemented by Envelopes that decide what to do
+// with their messages from the DMARC Verdict. If the Envelope
+// embedded in an Envelope implements it, CloseVerdict is called in
+// place of its Close, and its error decides the reply.
+type VerdictCloser interface {
+	CloseVerdict(ctx context.Context, v *Verdict) error
+}
+
+// Envelope is an smtpd.Envelope that verifies the DKIM signatures of
+// messages as they're passed to the embedded Envelope, then evaluates
+// their DMARC policy before the embedded Envelope is closed.
+type Envelope struct {
+	smtpd.Envelope
+
+	// Checker evaluates the policy, and its Resolver also looks up
+	// DKIM keys. If nil, a zero Checker is used.
+	Checker *Checker
+
+	// SPF is the result of checking the message's sender, such as
+	// from spf.VerdictFor. If nil, only DKIM can pass the message.
+	SPF *spf.Verdict
+
+	// Enforce makes the Envelope carry out the policy itself if the
+	// embedded Envelope isn't a VerdictCloser: a message to reject is
+	// refused with a 550 reply, without closing the embedded
+	// Envelope, and one to quarantine is first passed to its
+	// Quarantine method if it's an smtpd.QuarantineEnvelope.
+	Enforce bool
+
+	v       dkim.Verifier
+	verdict *Verdict
+}
+
+func (e *Envelope) BeginData() error {
+	e.v = dkim.Verifier{}
+	e.verdict = nil
+	return e.Envelope.BeginData()
+}
+
+func (e *Envelope) Write(line []byte) error {
+	e.v.Write(line)
+	return e.Envelope.Write(line)
+}
+
+func (e *Envelope) Close() error {
+	return e.CloseContext(context.Background())
+}
+
+// CloseContext evaluates the message's policy, bounded by ctx, then
+// closes the embedded Envelope.
+func (e *Envelope) CloseContext(ctx context.Context) error {
+	c := e.Checker
+	if c == nil {
+		c = &Checker{}
+	}
+	e.v.Resolver = c.Resolver
+	sigs := e.v.Verify(ctx)
+	from, err := FromDomain(e.v.Header())
+	v := c.Check(ctx, from, e.SPF, sigs)
+	if err != nil {
+		v.Err = err
+	}
+	v.ARC = e.v.VerifyARC(ctx)
+	e.verdict = v
+
+	if vc, ok := e.Envelope.(VerdictCloser); ok {
+		return vc.CloseVerdict(ctx, v)
+	}
+	if e.Enforce {
+		switch v.Disposition {
+		case PolicyReject:
+			return smtpd.Reject(550, "5.7.1 Error: message rejected by DMARC policy of "+v.PolicyDomain)
+		case PolicyQuarantine:
+			if qe, ok := e.Envelope.(smtpd.QuarantineEnvelope); ok {
+				qe.Quarantine("DMARC policy of " + v.PolicyDomain)
+			}
+		}
+	}
+	if cc, ok := e.Envelope.(smtpd.ContextCloser); ok {
+		return cc.CloseContext(ctx)
+	}
+	return e.Envelope.Close()
+}
+
+// Verdict returns the message's DMARC Verdict, once it's closed.
+func (e *Envelope) Verdict() *Verdict {
+	return e.verdict
+}
+
+// RecipientVerdict passes through the embedded Envelope's verdict if
+// it's an smtpd.PRDREnvelope.
+func (e *Envelope) RecipientVerdict(rcpt smtpd.MailAddress) error {
+	if pe, ok := e.Envelope.(smtpd.PRDREnvelope); ok {
+		return pe.RecipientVerdict(rcpt)
+	}
+	return nil
+}
+
+// Abort passes the end of the transaction on to the embedded
+// Envelope if it's an smtpd.AbortEnvelope.
+func (e *Envelope) Abort() {
+	if ae, ok := e.Envelope.(smtpd.AbortEnvelope); ok {
+		ae.Abort()
+	}
+}
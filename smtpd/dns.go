@@ -0,0 +1,31 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver performs the DNS lookups needed by DNS-based features
+// such as reverse DNS, SPF and DNSBL checks. *net.Resolver
+// implements it; other implementations can add caching or stub out
+// DNS in tests.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) (names []string, err error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+var _ Resolver = (*net.Resolver)(nil)
+
+// resolver returns the Resolver for the server's DNS lookups.
+func (srv *Server) resolver() Resolver {
+	if srv.Resolver != nil {
+		return srv.Resolver
+	}
+	return net.DefaultResolver
+}
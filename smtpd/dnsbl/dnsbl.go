@@ -0,0 +1,114 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnsbl looks up IP addresses in DNS blocklists (RFC 5782),
+// such as zen.spamhaus.org.
+package dnsbl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Resolver performs the DNS lookups for a check. *net.Resolver and
+// smtpd.Resolver implement it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Listing is an address's entry in a blocklist.
+type Listing struct {
+	Zone string
+
+	// Codes are the addresses the list returned, such as
+	// 127.0.0.2, whose meanings are the list's own.
+	Codes []net.IP
+
+	// Reason is the list's TXT record for the address, if any,
+	// often a URL explaining the listing.
+	Reason string
+}
+
+// Query returns the name looked up for ip in zone, with the address's
+// octets, or for IPv6 its nibbles, reversed, such as
+// "2.0.0.127.zen.spamhaus.org". It returns "" if ip isn't valid.
+func Query(ip net.IP, zone string) string {
+	zone = strings.TrimSuffix(zone, ".")
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], zone)
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	var b strings.Builder
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip16[i]&0xf, ip16[i]>>4)
+	}
+	return b.String() + zone
+}
+
+// Lookup looks up ip in the blocklist zone. It returns nil and no
+// error if ip isn't listed.
+func Lookup(ctx context.Context, r Resolver, ip net.IP, zone string) (*Listing, error) {
+	q := Query(ip, zone)
+	if q == "" {
+		return nil, fmt.Errorf("dnsbl: invalid IP address %v", ip)
+	}
+	addrs, err := r.LookupIPAddr(ctx, q)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	l := &Listing{Zone: zone}
+	for _, a := range addrs {
+		// Answers outside 127.0.0.0/8 aren't listings (RFC 5782
+		// s2.1), such as from resolvers that redirect failed
+		// lookups.
+		if ip4 := a.IP.To4(); ip4 != nil && ip4[0] == 127 {
+			l.Codes = append(l.Codes, a.IP)
+		}
+	}
+	if len(l.Codes) == 0 {
+		return nil, nil
+	}
+	if txts, err := r.LookupTXT(ctx, q); err == nil {
+		l.Reason = strings.Join(txts, " ")
+	}
+	return l, nil
+}
+
+// Check looks up ip in each of zones concurrently, and returns its
+// listings in the order of zones. If any lookups fail, such as when
+// ctx is done, it also returns the first error.
+func Check(ctx context.Context, r Resolver, ip net.IP, zones []string) ([]Listing, error) {
+	res := make([]*Listing, len(zones))
+	errs := make([]error, len(zones))
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			res[i], errs[i] = Lookup(ctx, r, ip, zone)
+		}(i, zone)
+	}
+	wg.Wait()
+	var listings []Listing
+	var err error
+	for i, l := range res {
+		if l != nil {
+			listings = append(listings, *l)
+		}
+		if err == nil {
+			err = errs[i]
+		}
+	}
+	return listings, err
+}
@@ -0,0 +1,180 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// CachingResolver is a Resolver that caches the answers of another,
+// so that many connections from the same networks don't each wait
+// for the same lookups. Concurrent identical lookups share one query.
+//
+// The Resolver interface doesn't report record TTLs, so answers are
+// kept for a fixed TTL, which should be no longer than the TTLs of
+// the records looked up. Only answers and "not found" errors are
+// cached; other failures are retried.
+type CachingResolver struct {
+	// Resolver does the lookups; net.DefaultResolver if nil.
+	Resolver Resolver
+
+	// TTL is how long answers are kept; 5 minutes if zero.
+	// NegativeTTL is how long "not found" errors are kept; 1
+	// minute if zero.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	// MaxEntries limits the number of cached answers; 10000 if
+	// zero. The least recently used are evicted first.
+	MaxEntries int
+
+	// Clock, if non-nil, times expiry.
+	Clock Clock
+
+	mu  sync.Mutex
+	m   map[dnsKey]*dnsEntry
+	lru list.List // of *dnsEntry, most recently used first
+}
+
+var _ Resolver = (*CachingResolver)(nil)
+
+type dnsKey struct {
+	kind byte // 'P' (PTR), 'A', 'T' (TXT), 'M' (MX)
+	name string
+}
+
+type dnsEntry struct {
+	key     dnsKey
+	val     interface{}
+	err     error
+	expires time.Time
+	elem    *list.Element
+	done    chan struct{} // closed when the lookup finishes
+}
+
+func (r *CachingResolver) resolver() Resolver {
+	if r.Resolver != nil {
+		return r.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// lookup returns the cached answer for key, calling fn to look it up
+// if there's none.
+func (r *CachingResolver) lookup(ctx context.Context, key dnsKey, fn func() (interface{}, error)) (interface{}, error) {
+	now := clockOrSystem(r.Clock).Now()
+	r.mu.Lock()
+	if r.m == nil {
+		r.m = make(map[dnsKey]*dnsEntry)
+	}
+	e := r.m[key]
+	if e != nil {
+		select {
+		case <-e.done:
+			if now.Before(e.expires) {
+				r.lru.MoveToFront(e.elem)
+				r.mu.Unlock()
+				return e.val, e.err
+			}
+			r.remove(e)
+			e = nil
+		default:
+			r.mu.Unlock()
+			select {
+			case <-e.done:
+				return e.val, e.err
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	e = &dnsEntry{key: key, done: make(chan struct{})}
+	e.elem = r.lru.PushFront(e)
+	r.m[key] = e
+	r.mu.Unlock()
+
+	val, err := fn()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.val, e.err = val, err
+	var de *net.DNSError
+	switch {
+	case err == nil:
+		e.expires = now.Add(durationOr(r.TTL, 5*time.Minute))
+	case errors.As(err, &de) && de.IsNotFound:
+		e.expires = now.Add(durationOr(r.NegativeTTL, time.Minute))
+	default:
+		r.remove(e)
+	}
+	close(e.done)
+	max := r.MaxEntries
+	if max == 0 {
+		max = 10000
+	}
+	for r.lru.Len() > max {
+		r.remove(r.lru.Back().Value.(*dnsEntry))
+	}
+	return val, err
+}
+
+// remove drops e from the cache. r.mu must be held.
+func (r *CachingResolver) remove(e *dnsEntry) {
+	if r.m[e.key] == e {
+		delete(r.m, e.key)
+		r.lru.Remove(e.elem)
+	}
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// The answers are copied so callers can't modify the cached ones.
+
+func (r *CachingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	v, err := r.lookup(ctx, dnsKey{'P', addr}, func() (interface{}, error) {
+		return r.resolver().LookupAddr(ctx, addr)
+	})
+	names, _ := v.([]string)
+	return append([]string(nil), names...), err
+}
+
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	v, err := r.lookup(ctx, dnsKey{'A', host}, func() (interface{}, error) {
+		return r.resolver().LookupIPAddr(ctx, host)
+	})
+	addrs, _ := v.([]net.IPAddr)
+	return append([]net.IPAddr(nil), addrs...), err
+}
+
+func (r *CachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, err := r.lookup(ctx, dnsKey{'T', name}, func() (interface{}, error) {
+		return r.resolver().LookupTXT(ctx, name)
+	})
+	txts, _ := v.([]string)
+	return append([]string(nil), txts...), err
+}
+
+func (r *CachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, err := r.lookup(ctx, dnsKey{'M', name}, func() (interface{}, error) {
+		return r.resolver().LookupMX(ctx, name)
+	})
+	mxs, _ := v.([]*net.MX)
+	out := make([]*net.MX, len(mxs))
+	for i, mx := range mxs {
+		c := *mx
+		out[i] = &c
+	}
+	return out, err
+}
@@ -0,0 +1,249 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package downgrade converts 8-bit MIME messages to 7-bit, for
+// passing mail received with 8BITMIME to servers and backends that
+// don't support it (RFC 6152 s3).
+//
+// Body parts holding 8-bit data are re-encoded: text as
+// quoted-printable, anything else as base64. Multipart and message/
+// parts, which can't be encoded, are converted part by part. Headers
+// are left alone.
+package downgrade
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// Needed reports whether msg contains 8-bit data.
+func Needed(msg []byte) bool {
+	for _, b := range msg {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// Message returns msg, a message with CRLF line endings, converted to
+// 7-bit. If msg is already 7-bit, it's returned as is.
+func Message(msg []byte) []byte {
+	if !Needed(msg) {
+		return msg
+	}
+	var buf bytes.Buffer
+	header, _ := splitHeader(msg)
+	if fieldValue(splitFields(header), "MIME-Version") == "" {
+		buf.WriteString("MIME-Version: 1.0\r\n")
+	}
+	part(&buf, msg, "text/plain")
+	return buf.Bytes()
+}
+
+// part writes the MIME entity p to buf, converted to 7-bit. The
+// entity's media type is defType unless its header says otherwise.
+func part(buf *bytes.Buffer, p []byte, defType string) {
+	header, body := splitHeader(p)
+	if !Needed(body) {
+		buf.Write(p)
+		return
+	}
+	fields := splitFields(header)
+	mediaType, params := defType, map[string]string(nil)
+	if v := fieldValue(fields, "Content-Type"); v != "" {
+		if mt, ps, err := mime.ParseMediaType(v); err == nil {
+			mediaType, params = mt, ps
+		}
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		writeFields(buf, fields, "7bit", true)
+		sub := "text/plain"
+		if mediaType == "multipart/digest" {
+			sub = "message/rfc822"
+		}
+		multipart(buf, body, params["boundary"], sub)
+	case strings.HasPrefix(mediaType, "message/"):
+		writeFields(buf, fields, "7bit", true)
+		part(buf, body, "text/plain")
+	case strings.HasPrefix(mediaType, "text/"):
+		writeFields(buf, fields, "quoted-printable", false)
+		w := quotedprintable.NewWriter(buf)
+		w.Write(body)
+		w.Close()
+	default:
+		writeFields(buf, fields, "base64", false)
+		enc := base64.StdEncoding.EncodeToString(body)
+		for len(enc) > 76 {
+			buf.WriteString(enc[:76])
+			buf.WriteString("\r\n")
+			enc = enc[76:]
+		}
+		buf.WriteString(enc)
+		if bytes.HasSuffix(body, []byte("\n")) {
+			// Not part of a multipart body, so it must end in a
+			// line break.
+			buf.WriteString("\r\n")
+		}
+	}
+}
+
+// multipart writes the body of a multipart entity, converting each
+// of its parts, whose default type is defType.
+func multipart(buf *bytes.Buffer, body []byte, boundary, defType string) {
+	delim := []byte("--" + boundary)
+	start := 0 // of the current preamble or part
+	first := true
+	for i := 0; i < len(body); {
+		line := body[i:]
+		if nl := bytes.IndexByte(line, '\n'); nl != -1 {
+			line = line[:nl+1]
+		}
+		next := i + len(line)
+		if !bytes.HasPrefix(line, delim) {
+			i = next
+			continue
+		}
+		rest := bytes.TrimRight(line[len(delim):], " \t\r\n")
+		closing := bytes.Equal(rest, []byte("--"))
+		if len(rest) > 0 && !closing {
+			i = next
+			continue
+		}
+		// The line break before a delimiter belongs to it.
+		end := i
+		if end > start && body[end-1] == '\n' {
+			end--
+			if end > start && body[end-1] == '\r' {
+				end--
+			}
+		}
+		if first {
+			buf.Write(body[start:end])
+			first = false
+		} else {
+			part(buf, body[start:end], defType)
+		}
+		buf.Write(body[end:next])
+		start = next
+		if closing {
+			buf.Write(body[start:])
+			return
+		}
+		i = next
+	}
+	if !first {
+		part(buf, body[start:], defType)
+		return
+	}
+	buf.Write(body[start:])
+}
+
+// splitHeader splits a MIME entity into its header, including the
+// blank line ending it, and its body.
+func splitHeader(p []byte) (header, body []byte) {
+	if bytes.HasPrefix(p, []byte("\r\n")) {
+		return p[:2], p[2:]
+	}
+	if i := bytes.Index(p, []byte("\r\n\r\n")); i != -1 {
+		return p[:i+4], p[i+4:]
+	}
+	return p, nil
+}
+
+// field is a raw header field, possibly folded over several lines.
+type field struct {
+	name string
+	raw  []byte
+}
+
+func splitFields(header []byte) []field {
+	var fields []field
+	for len(header) > 0 {
+		n := bytes.Index(header, []byte("\r\n"))
+		if n == -1 {
+			n = len(header)
+		} else {
+			n += 2
+		}
+		line := header[:n]
+		header = header[n:]
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			f := &fields[len(fields)-1]
+			f.raw = append(f.raw, line...)
+			continue
+		}
+		name := ""
+		if c := bytes.IndexByte(line, ':'); c != -1 {
+			name = string(bytes.TrimSpace(line[:c]))
+		}
+		fields = append(fields, field{name, append([]byte(nil), line...)})
+	}
+	return fields
+}
+
+// fieldValue returns the unfolded value of the named field.
+func fieldValue(fields []field, name string) string {
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			v := string(f.raw[bytes.IndexByte(f.raw, ':')+1:])
+			return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(v))
+		}
+	}
+	return ""
+}
+
+// writeFields writes the header with its Content-Transfer-Encoding
+// set to cte. If onlyIfPresent is set, a missing one isn't added.
+func writeFields(buf *bytes.Buffer, fields []field, cte string, onlyIfPresent bool) {
+	present := false
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "Content-Transfer-Encoding") {
+			present = true
+			continue
+		}
+		if string(f.raw) == "\r\n" {
+			continue // the blank line ending the header
+		}
+		buf.Write(f.raw)
+	}
+	if present || !onlyIfPresent {
+		buf.WriteString("Content-Transfer-Encoding: " + cte + "\r\n")
+	}
+	buf.WriteString("\r\n")
+}
+
+// Envelope is an smtpd.Envelope that passes messages to the embedded
+// Envelope converted to 7-bit, for backends that can't store 8-bit
+// data. The message is buffered in memory until Close.
+type Envelope struct {
+	smtpd.Envelope
+	buf bytes.Buffer
+}
+
+func (e *Envelope) Write(line []byte) error {
+	e.buf.Write(line)
+	return nil
+}
+
+func (e *Envelope) Close() error {
+	msg := Message(e.buf.Bytes())
+	for len(msg) > 0 {
+		n := bytes.IndexByte(msg, '\n') + 1
+		if n == 0 {
+			n = len(msg)
+		}
+		if err := e.Envelope.Write(msg[:n]); err != nil {
+			return err
+		}
+		msg = msg[n:]
+	}
+	return e.Envelope.Close()
+}
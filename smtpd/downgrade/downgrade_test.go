@@ -0,0 +1,194 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downgrade_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+	"github.com/bradfitz/go-smtpd/smtpd/downgrade"
+)
+
+// decode returns the body of an entity with header h, undoing its
+// Content-Transfer-Encoding.
+func decode(t *testing.T, h map[string][]string, body io.Reader) []byte {
+	t.Helper()
+	cte := ""
+	if v := h["Content-Transfer-Encoding"]; len(v) > 0 {
+		cte = strings.ToLower(v[0])
+	}
+	switch cte {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSevenBit(t *testing.T) {
+	msg := []byte("Subject: plain\r\n\r\nJust ASCII.\r\n")
+	if downgrade.Needed(msg) {
+		t.Error("Needed for a 7-bit message")
+	}
+	if got := downgrade.Message(msg); &got[0] != &msg[0] {
+		t.Error("7-bit message copied")
+	}
+}
+
+func TestText(t *testing.T) {
+	const body = "Grüße aus Köln,\r\nein langer Satz, der länger ist als sechsundsiebzig Zeichen, damit er umbrochen werden muss.\r\n"
+	tests := []struct {
+		name, header string
+	}{
+		{"no MIME", "Subject: hi\r\n"},
+		{"8bit text", "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n"},
+	}
+	for _, tt := range tests {
+		out := downgrade.Message([]byte(tt.header + "\r\n" + body))
+		if downgrade.Needed(out) {
+			t.Errorf("%s: output has 8-bit data:\n%s", tt.name, out)
+		}
+		m, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if v := m.Header["Mime-Version"]; len(v) != 1 || v[0] != "1.0" {
+			t.Errorf("%s: MIME-Version %q", tt.name, v)
+		}
+		if v := m.Header["Content-Transfer-Encoding"]; len(v) != 1 || v[0] != "quoted-printable" {
+			t.Errorf("%s: Content-Transfer-Encoding %q", tt.name, v)
+		}
+		if got := decode(t, m.Header, m.Body); string(got) != body {
+			t.Errorf("%s: decoded body %q; want %q", tt.name, got, body)
+		}
+		for _, line := range strings.Split(string(out), "\r\n") {
+			if len(line) > 78 {
+				t.Errorf("%s: line of %d bytes", tt.name, len(line))
+			}
+		}
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	binary := bytes.Repeat([]byte{0, 0xff, 0x80, '\n', 'x'}, 40)
+	msg := "MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"ASCII part\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"caf\xe9\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"\r\n" +
+		string(binary) + "\r\n" +
+		"--b1\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Subject: forwarded\r\n" +
+		"\r\n" +
+		"na\xefve\r\n" +
+		"--b1--\r\n" +
+		"epilogue\r\n"
+	out := downgrade.Message([]byte(msg))
+	if downgrade.Needed(out) {
+		t.Fatalf("output has 8-bit data:\n%q", out)
+	}
+	if !bytes.Contains(out, []byte("\r\n\r\npreamble\r\n--b1\r\n")) || !bytes.HasSuffix(out, []byte("--b1--\r\nepilogue\r\n")) {
+		t.Errorf("preamble or epilogue changed:\n%s", out)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	want := []struct {
+		cte  string
+		body string
+	}{
+		{"", "ASCII part"},
+		{"quoted-printable", "caf\xe9"},
+		{"base64", string(binary)},
+		{"", "Subject: forwarded\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nna=EFve"},
+	}
+	for i := 0; ; i++ {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("%d parts; want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) {
+			t.Fatalf("extra part %d", i)
+		}
+		if got := p.Header.Get("Content-Transfer-Encoding"); got != want[i].cte {
+			t.Errorf("part %d: Content-Transfer-Encoding %q; want %q", i, got, want[i].cte)
+		}
+		if got := decode(t, p.Header, p); string(got) != want[i].body {
+			t.Errorf("part %d: body %q; want %q", i, got, want[i].body)
+		}
+	}
+}
+
+// lines is an Envelope keeping the lines it's given.
+type lines struct {
+	smtpd.Envelope
+	got    []string
+	closed bool
+}
+
+func (e *lines) Write(line []byte) error { e.got = append(e.got, string(line)); return nil }
+func (e *lines) Close() error            { e.closed = true; return nil }
+
+func TestEnvelope(t *testing.T) {
+	dst := &lines{}
+	e := &downgrade.Envelope{Envelope: dst}
+	for _, l := range []string{"Subject: hi\r\n", "\r\n", "\xe9t\xe9\r\n"} {
+		e.Write([]byte(l))
+	}
+	if len(dst.got) != 0 {
+		t.Errorf("lines passed on before Close: %q", dst.got)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"MIME-Version: 1.0\r\n",
+		"Subject: hi\r\n",
+		"Content-Transfer-Encoding: quoted-printable\r\n",
+		"\r\n",
+		"=E9t=E9\r\n",
+	}
+	if strings.Join(dst.got, "|") != strings.Join(want, "|") || !dst.closed {
+		t.Errorf("passed on %q (closed %v); want %q", dst.got, dst.closed, want)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd/parse"
+)
+
+// RcptOptions are the delivery status notification parameters
+// (RFC 3461) of a RCPT command.
+type RcptOptions struct {
+	// Notify lists the NOTIFY keywords in upper case: "NEVER", or
+	// some of "SUCCESS", "FAILURE" and "DELAY". It's nil if the
+	// client didn't say, leaving it to the server.
+	Notify []string
+
+	// ORCPT is the original recipient, with its address type, such
+	// as "rfc822", in ORCPTType. Both are "" if not given.
+	ORCPT     string
+	ORCPTType string
+}
+
+// NotifyOn reports whether a notification should be sent for the
+// event, "SUCCESS", "FAILURE" or "DELAY". Without NOTIFY, that's
+// only for failures and delays.
+func (o RcptOptions) NotifyOn(event string) bool {
+	if o.Notify == nil {
+		return event != "SUCCESS"
+	}
+	for _, n := range o.Notify {
+		if n == event {
+			return true
+		}
+	}
+	return false
+}
+
+// RcptOptionsEnvelope is an Envelope that takes each recipient's DSN
+// parameters. AddRecipientWithOptions is called instead of
+// AddRecipient.
+type RcptOptionsEnvelope interface {
+	Envelope
+	AddRecipientWithOptions(rcpt MailAddress, opts RcptOptions) error
+}
+
+// parseRcptOptions parses the DSN parameters of a RCPT command.
+func parseRcptOptions(params map[string]string) (RcptOptions, error) {
+	var o RcptOptions
+	if v, ok := params["NOTIFY"]; ok {
+		o.Notify = strings.Split(strings.ToUpper(v), ",")
+		for _, n := range o.Notify {
+			switch n {
+			case "SUCCESS", "FAILURE", "DELAY":
+			case "NEVER":
+				if len(o.Notify) > 1 {
+					return o, SMTPError("501 5.5.4 Error: NOTIFY=NEVER can't be combined")
+				}
+			default:
+				return o, SMTPError("501 5.5.4 Error: bad NOTIFY parameter")
+			}
+		}
+	}
+	if v, ok := params["ORCPT"]; ok {
+		typ, addr, found := strings.Cut(v, ";")
+		addr, err := parse.XText(addr)
+		if !found || typ == "" || addr == "" || err != nil {
+			return o, SMTPError("501 5.5.4 Error: bad ORCPT parameter")
+		}
+		o.ORCPT, o.ORCPTType = addr, strings.ToLower(typ)
+	}
+	return o, nil
+}
+
+// checkMailDSN checks the DSN parameters of a MAIL command.
+func checkMailDSN(params map[string]string) error {
+	if v, ok := params["RET"]; ok && !strings.EqualFold(v, "FULL") && !strings.EqualFold(v, "HDRS") {
+		return SMTPError("501 5.5.4 Error: bad RET parameter")
+	}
+	if v, ok := params["ENVID"]; ok {
+		if id, err := parse.XText(v); err != nil || id == "" || len(v) > 100 {
+			return SMTPError("501 5.5.4 Error: bad ENVID parameter")
+		}
+	}
+	return nil
+}
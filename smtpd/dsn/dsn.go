@@ -0,0 +1,184 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dsn composes delivery status notifications (RFC 3464), the
+// bounce messages sent back to a message's sender when it can't be
+// delivered.
+package dsn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Recipient is the delivery status of one recipient.
+type Recipient struct {
+	Addr              string // final recipient
+	OriginalRecipient string // optional, as given by the ORCPT parameter
+	Action            string // "failed", "delayed", "delivered", "relayed" or "expanded"
+	Status            string // enhanced status code, such as "5.1.1"
+	Diagnostic        string // optional reply from the remote server
+	RemoteMTA         string // optional host name of the remote server
+}
+
+// Report is a delivery status notification.
+type Report struct {
+	ReportingMTA string    // host name of the MTA sending the report
+	EnvelopeID   string    // optional, as given by the ENVID parameter
+	ArrivalDate  time.Time // when the message was received
+	Recipients   []Recipient
+}
+
+var statusRE = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// FromError returns the status of rcpt given the error that prevented
+// delivery to it. SMTP replies, as *textproto.Error or as strings
+// beginning with a reply code, keep their enhanced status code and
+// text as the diagnostic; other errors are reported with status
+// "5.0.0" or, if temporary, "4.0.0".
+func FromError(rcpt string, err error, temporary bool) Recipient {
+	r := Recipient{Addr: rcpt, Action: "failed"}
+	if temporary {
+		r.Action = "delayed"
+	}
+	var code int
+	var msg string
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		code, msg = te.Code, strings.ReplaceAll(te.Msg, "\n", " ")
+	} else if s := err.Error(); len(s) > 4 && s[3] == ' ' && s[0] >= '2' && s[0] <= '5' {
+		fmt.Sscanf(s, "%d", &code)
+		msg = s[4:]
+	}
+	switch {
+	case code != 0 && statusRE.MatchString(msg):
+		r.Status = statusRE.FindString(msg)
+	case code != 0:
+		r.Status = fmt.Sprintf("%d.0.0", code/100)
+	case temporary:
+		r.Status = "4.0.0"
+	default:
+		r.Status = "5.0.0"
+	}
+	if code != 0 {
+		r.Diagnostic = fmt.Sprintf("%d %s", code, msg)
+	} else {
+		r.Diagnostic = err.Error()
+	}
+	return r
+}
+
+// Compose writes a bounce message for the report to w, addressed to
+// to, the sender of the original message. The original message, if
+// non-nil, is attached: only its header if headersOnly is set.
+func (r *Report) Compose(w io.Writer, to string, original io.Reader, headersOnly bool) error {
+	bw := bufio.NewWriter(w)
+	boundary := randomBoundary()
+	now := time.Now()
+	fmt.Fprintf(bw, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", r.ReportingMTA)
+	fmt.Fprintf(bw, "To: <%s>\r\n", to)
+	fmt.Fprintf(bw, "Subject: %s\r\n", r.subject())
+	fmt.Fprintf(bw, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(bw, "Message-ID: <%d.%s@%s>\r\n", now.UnixNano(), boundary[:8], r.ReportingMTA)
+	fmt.Fprintf(bw, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(bw, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(bw, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(bw, "--%s\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n", boundary)
+	fmt.Fprintf(bw, "This is the mail system at host %s.\r\n\r\n", r.ReportingMTA)
+	fmt.Fprintf(bw, "%s\r\n\r\n", r.explanation())
+	for _, rc := range r.Recipients {
+		fmt.Fprintf(bw, "<%s>: %s\r\n", rc.Addr, rc.Diagnostic)
+	}
+
+	fmt.Fprintf(bw, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(bw, "Reporting-MTA: dns; %s\r\n", r.ReportingMTA)
+	if r.EnvelopeID != "" {
+		fmt.Fprintf(bw, "Original-Envelope-Id: %s\r\n", r.EnvelopeID)
+	}
+	if !r.ArrivalDate.IsZero() {
+		fmt.Fprintf(bw, "Arrival-Date: %s\r\n", r.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, rc := range r.Recipients {
+		fmt.Fprintf(bw, "\r\n")
+		if rc.OriginalRecipient != "" {
+			fmt.Fprintf(bw, "Original-Recipient: rfc822; %s\r\n", rc.OriginalRecipient)
+		}
+		fmt.Fprintf(bw, "Final-Recipient: rfc822; %s\r\n", rc.Addr)
+		fmt.Fprintf(bw, "Action: %s\r\n", rc.Action)
+		fmt.Fprintf(bw, "Status: %s\r\n", rc.Status)
+		if rc.RemoteMTA != "" {
+			fmt.Fprintf(bw, "Remote-MTA: dns; %s\r\n", rc.RemoteMTA)
+		}
+		if rc.Diagnostic != "" {
+			fmt.Fprintf(bw, "Diagnostic-Code: smtp; %s\r\n", rc.Diagnostic)
+		}
+	}
+
+	if original != nil {
+		ctype := "message/rfc822"
+		if headersOnly {
+			ctype = "text/rfc822-headers"
+		}
+		fmt.Fprintf(bw, "\r\n--%s\r\nContent-Type: %s\r\n\r\n", boundary, ctype)
+		if err := copyOriginal(bw, original, headersOnly); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(bw, "\r\n--%s--\r\n", boundary)
+	return bw.Flush()
+}
+
+func (r *Report) subject() string {
+	for _, rc := range r.Recipients {
+		if rc.Action == "failed" {
+			return "Undelivered Mail Returned to Sender"
+		}
+	}
+	return "Delayed Mail (still being retried)"
+}
+
+func (r *Report) explanation() string {
+	if r.subject() == "Undelivered Mail Returned to Sender" {
+		return "I'm sorry to have to inform you that your message could not\r\n" +
+			"be delivered to one or more recipients."
+	}
+	return "Your message could not yet be delivered to one or more\r\n" +
+		"recipients. Delivery will be retried; no action is required."
+}
+
+// copyOriginal copies the original message, or just its header, with
+// CRLF line endings.
+func copyOriginal(w *bufio.Writer, r io.Reader, headersOnly bool) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n")
+			if headersOnly && line == "" {
+				return nil
+			}
+			w.WriteString(line + "\r\n")
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func randomBoundary() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x", b[:])
+}
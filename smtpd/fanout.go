@@ -0,0 +1,169 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"bytes"
+	"strings"
+)
+
+// FanoutEnvelope is an Envelope that delivers a separate copy of the
+// message to a backend Envelope for each recipient, such as one
+// mailbox per user. The message is buffered in memory once and
+// written to each backend when it's complete.
+//
+// Deliveries succeed or fail independently. If any fails, Close
+// returns a RecipientErrors with each recipient's result, so clients
+// using the PRDR extension see exactly which recipients failed, and
+// other clients are asked to retry the message if any failure was
+// temporary. Otherwise they're told it was accepted, and permanent
+// failures must be reported to the sender some other way, such as a
+// bounce.
+type FanoutEnvelope struct {
+	// New returns the backend Envelope for rcpt, or an error to
+	// reject the recipient. The backend's AddRecipient is then
+	// called with rcpt.
+	New func(rcpt MailAddress) (Envelope, error)
+
+	// Stamp prefixes each copy with X-Original-To and Delivered-To
+	// headers naming its recipient, as Postfix does when delivering
+	// or forwarding mail. Copies for recipients the message names
+	// in a Delivered-To header already fail, to break forwarding
+	// loops.
+	Stamp bool
+
+	rcpts []MailAddress
+	envs  []Envelope
+	errs  []error
+	buf   bytes.Buffer
+}
+
+func (e *FanoutEnvelope) AddRecipient(rcpt MailAddress) error {
+	env, err := e.New(rcpt)
+	if err != nil {
+		return err
+	}
+	if err := env.AddRecipient(rcpt); err != nil {
+		return err
+	}
+	e.rcpts = append(e.rcpts, rcpt)
+	e.envs = append(e.envs, env)
+	e.errs = append(e.errs, nil)
+	return nil
+}
+
+func (e *FanoutEnvelope) BeginData() error {
+	if len(e.rcpts) == 0 {
+		return SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	for i, env := range e.envs {
+		e.errs[i] = env.BeginData()
+	}
+	return e.allFailed()
+}
+
+func (e *FanoutEnvelope) Write(line []byte) error {
+	e.buf.Write(line)
+	return nil
+}
+
+func (e *FanoutEnvelope) Close() error {
+	lines := bytes.SplitAfter(e.buf.Bytes(), []byte("\n"))
+	var delivered map[string]bool
+	if e.Stamp {
+		delivered = deliveredTo(lines)
+	}
+	for i, env := range e.envs {
+		if e.errs[i] != nil {
+			continue
+		}
+		if e.Stamp {
+			e.errs[i] = stamp(env, e.rcpts[i], delivered)
+		}
+		for _, line := range lines {
+			if e.errs[i] != nil {
+				break
+			}
+			if len(line) == 0 {
+				continue
+			}
+			e.errs[i] = env.Write(line)
+		}
+		if e.errs[i] == nil {
+			e.errs[i] = env.Close()
+		}
+	}
+	var rerrs RecipientErrors
+	for i, err := range e.errs {
+		if err == nil {
+			continue
+		}
+		if rerrs == nil {
+			rerrs = make(RecipientErrors, len(e.errs))
+		}
+		if _, ok := err.(SMTPError); !ok && verdict(err) == nil {
+			// Not a reply from the backend, such as an I/O error,
+			// so have the client try again.
+			err, e.errs[i] = errFanout, errFanout
+		}
+		rerrs[i] = err
+	}
+	if rerrs == nil {
+		return nil
+	}
+	return rerrs
+}
+
+var errFanout = SMTPError("451 4.3.0 Error: local delivery failed")
+
+// deliveredTo returns the lower-cased addresses in the Delivered-To
+// headers of the message split into lines.
+func deliveredTo(lines [][]byte) map[string]bool {
+	m := make(map[string]bool)
+	for _, line := range lines {
+		s := strings.TrimRight(string(line), "\r\n")
+		if s == "" {
+			break
+		}
+		if k, v, ok := strings.Cut(s, ":"); ok && strings.EqualFold(k, "Delivered-To") {
+			m[strings.ToLower(strings.Trim(strings.TrimSpace(v), "<>"))] = true
+		}
+	}
+	return m
+}
+
+// stamp writes the recipient headers for rcpt's copy to env, or
+// fails if the message was already delivered to rcpt.
+func stamp(env Envelope, rcpt MailAddress, delivered map[string]bool) error {
+	addr := rcpt.Email()
+	if delivered[strings.ToLower(addr)] {
+		return SMTPError("554 5.4.6 Error: mail forwarding loop for <" + addr + ">")
+	}
+	if err := env.Write([]byte("X-Original-To: " + addr + "\r\n")); err != nil {
+		return err
+	}
+	return env.Write([]byte("Delivered-To: " + addr + "\r\n"))
+}
+
+// allFailed returns the first recipient's error if no recipient has
+// succeeded so far.
+func (e *FanoutEnvelope) allFailed() error {
+	for _, err := range e.errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return e.errs[0]
+}
+
+// RecipientVerdict returns the result of delivering to rcpt.
+func (e *FanoutEnvelope) RecipientVerdict(rcpt MailAddress) error {
+	for i, r := range e.rcpts {
+		if r == rcpt {
+			return e.errs[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd/parse"
+)
+
+// Features describes the SMTP service extensions a client has used,
+// in the session and in its current or most recent mail transaction,
+// for trace headers and policy decisions.
+type Features struct {
+	ESMTP      bool // greeted with EHLO, or LHLO, rather than HELO
+	TLS        bool // started TLS
+	Pipelining bool // sent commands without waiting for replies
+
+	// From the MAIL command's parameters:
+	Body     string // BODY type, such as "8BITMIME", or "" if undeclared
+	SMTPUTF8 bool   // SMTPUTF8 requested: UTF-8 addresses and headers
+	Size     int64  // declared SIZE, or 0 if undeclared
+	PRDR     bool   // PRDR requested
+	Ret      string // DSN RET, "FULL" or "HDRS", or "" if undeclared
+	EnvID    string // DSN ENVID, decoded, or "" if undeclared
+
+	// RequireTLS is whether the client asked with REQUIRETLS for
+	// the message to be relayed only over validated TLS. It's only
+	// set if the server offers REQUIRETLS.
+	RequireTLS bool
+}
+
+func (s *session) Features() Features {
+	f := Features{
+		ESMTP:      s.extended(),
+		TLS:        s.tlsState != nil,
+		Pipelining: s.pipelined,
+		Body:       strings.ToUpper(s.mailParams["BODY"]),
+		PRDR:       s.prdr,
+	}
+	f.SMTPUTF8 = s.smtpUTF8()
+	f.Size, _ = strconv.ParseInt(s.mailParams["SIZE"], 10, 64)
+	f.Ret = strings.ToUpper(s.mailParams["RET"])
+	f.EnvID, _ = parse.XText(s.mailParams["ENVID"])
+	if s.srv.OfferREQUIRETLS && s.tlsState != nil {
+		_, f.RequireTLS = s.mailParams["REQUIRETLS"]
+	}
+	return f
+}
@@ -0,0 +1,162 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gateway assembles a store-and-forward mail gateway: an
+// smtpd.Server that spools accepted mail to a queue, which forwards
+// it to a smarthost with retries and bounces it to the sender if it
+// can't be delivered in time.
+package gateway
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+	"github.com/bradfitz/go-smtpd/smtpd/queue"
+	"github.com/bradfitz/go-smtpd/smtpd/relay"
+)
+
+// Gateway is a store-and-forward gateway. Its parts may be adjusted
+// between New and ListenAndServe.
+type Gateway struct {
+	Server *smtpd.Server
+	Queue  *queue.Queue
+	Relay  *relay.Client
+
+	// Domains, if non-empty, restricts the recipient domains
+	// accepted. Otherwise any recipient is accepted, and the
+	// gateway must be protected some other way (a firewall, or the
+	// Server's PlainAuth) to avoid being an open relay.
+	Domains []string
+
+	// Forward, if non-nil, returns the addresses mail for an
+	// accepted recipient is redirected to, or nil to deliver it as
+	// addressed. Each recipient then gets its own copy, stamped
+	// with X-Original-To and Delivered-To headers (see
+	// smtpd.FanoutEnvelope's Stamp).
+	Forward func(rcpt smtpd.MailAddress) []string
+}
+
+// New returns a Gateway listening on addr, spooling mail in spoolDir
+// and forwarding it to the smarthost host:port. If smarthost is empty,
+// mail is sent directly to each recipient domain's MX hosts.
+func New(addr, spoolDir, smarthost string) *Gateway {
+	hostname, _ := os.Hostname()
+	g := &Gateway{
+		Relay: &relay.Client{
+			Smarthost: smarthost,
+			LocalName: hostname,
+		},
+	}
+	g.Queue = &queue.Queue{
+		Dir:       spoolDir,
+		Transport: g.Relay,
+		Hostname:  hostname,
+	}
+	g.Server = &smtpd.Server{
+		Addr:      addr,
+		Hostname:  hostname,
+		OnNewMail: g.onNewMail,
+	}
+	return g
+}
+
+func (g *Gateway) onNewMail(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+	if g.Forward != nil {
+		return &smtpd.FanoutEnvelope{
+			New: func(rcpt smtpd.MailAddress) (smtpd.Envelope, error) {
+				if !g.accepts(rcpt) {
+					return nil, errRelayDenied
+				}
+				env, err := g.Queue.OnNewMail(c, from)
+				if err != nil {
+					return nil, err
+				}
+				if to := g.Forward(rcpt); len(to) > 0 {
+					env = &forwardEnvelope{Envelope: env, to: to}
+				}
+				return env, nil
+			},
+			Stamp: true,
+		}, nil
+	}
+	env, err := g.Queue.OnNewMail(c, from)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{Envelope: env, g: g}, nil
+}
+
+// accepts reports whether mail to rcpt is accepted.
+func (g *Gateway) accepts(rcpt smtpd.MailAddress) bool {
+	if len(g.Domains) == 0 {
+		return true
+	}
+	host := rcpt.Hostname()
+	for _, d := range g.Domains {
+		if strings.EqualFold(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+var errRelayDenied = smtpd.SMTPError("554 5.7.1 Error: relay access denied")
+
+type envelope struct {
+	smtpd.Envelope
+	g *Gateway
+}
+
+func (e *envelope) AddRecipient(rcpt smtpd.MailAddress) error {
+	if !e.g.accepts(rcpt) {
+		return errRelayDenied
+	}
+	return e.Envelope.AddRecipient(rcpt)
+}
+
+// forwardEnvelope sends the message to the addresses to instead of
+// its recipient.
+type forwardEnvelope struct {
+	smtpd.Envelope
+	to []string
+}
+
+func (e *forwardEnvelope) AddRecipient(smtpd.MailAddress) error {
+	for _, addr := range e.to {
+		if err := e.Envelope.AddRecipient(address(addr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// address is a MailAddress for a forwarding target.
+type address string
+
+func (a address) Email() string       { return string(a) }
+func (a address) Raw() string         { return string(a) }
+func (a address) Tag() string         { return "" }
+func (a address) BaseAddress() string { return string(a) }
+
+func (a address) Hostname() string {
+	if at := strings.LastIndex(string(a), "@"); at != -1 {
+		return strings.ToLower(string(a)[at+1:])
+	}
+	return ""
+}
+
+// ListenAndServe runs the queue and the server. It returns when
+// either fails.
+func (g *Gateway) ListenAndServe() error {
+	errc := make(chan error, 2)
+	go func() {
+		errc <- fmt.Errorf("gateway: queue: %v", g.Queue.Run(nil))
+	}()
+	go func() {
+		errc <- g.Server.ListenAndServe()
+	}()
+	return <-errc
+}
@@ -0,0 +1,54 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+// Health is a snapshot of a Server's state, for health and readiness
+// checks such as an HTTP health endpoint or a systemd watchdog.
+type Health struct {
+	Serving  bool // accepting connections
+	Sessions int  // open client sessions
+
+	// InData is how many sessions are receiving a message, out of
+	// MaxConcurrentData (zero if unlimited).
+	InData            int
+	MaxConcurrentData int
+
+	// Checks holds the result of each of Server.HealthChecks.
+	Checks map[string]error
+}
+
+// Ready reports whether the server is serving, has room for another
+// message, and passed all its health checks.
+func (h Health) Ready() bool {
+	if !h.Serving {
+		return false
+	}
+	if h.MaxConcurrentData > 0 && h.InData >= h.MaxConcurrentData {
+		return false
+	}
+	for _, err := range h.Checks {
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Health reports the server's state, running its HealthChecks.
+func (srv *Server) Health() Health {
+	h := Health{
+		Serving:           srv.listeners.Load() > 0,
+		Sessions:          int(srv.sessions.Load()),
+		InData:            int(srv.inData.Load()),
+		MaxConcurrentData: srv.MaxConcurrentData,
+	}
+	if len(srv.HealthChecks) > 0 {
+		h.Checks = make(map[string]error, len(srv.HealthChecks))
+		for name, check := range srv.HealthChecks {
+			h.Checks[name] = check()
+		}
+	}
+	return h
+}
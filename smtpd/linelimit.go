@@ -0,0 +1,72 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import "bufio"
+
+// Line length limits, including CRLF.
+const (
+	// defaultMaxCommandLine is the command line length RFC 5321
+	// (s4.5.3.1.4) requires servers to accept.
+	defaultMaxCommandLine = 512
+
+	// paramsAllowance is how much longer MAIL and RCPT commands may
+	// be, for the parameters of the extensions offered (RFC 5321
+	// s4.5.3.1: RFC 1870, RFC 3461, RFC 4954 and others).
+	paramsAllowance = 1024
+
+	// maxAuthLine is the longest AUTH command or response to a
+	// challenge (RFC 4954 s4).
+	maxAuthLine = 12288
+)
+
+var errLineTooLong = SMTPError("500 5.5.2 Error: line too long")
+
+// commandLimit returns the longest line allowed for a command with
+// verb.
+func (s *session) commandLimit(verb string) int {
+	n := s.srv.MaxCommandLine
+	if n <= 0 {
+		n = defaultMaxCommandLine
+	}
+	switch verb {
+	case "MAIL", "RCPT":
+		n += paramsAllowance
+	case "AUTH":
+		if n < maxAuthLine {
+			n = maxAuthLine
+		}
+	}
+	return n
+}
+
+// dataLineLimit returns the longest line allowed in a message.
+func (s *session) dataLineLimit() int {
+	if n := s.srv.MaxDataLine; n > 0 {
+		return n
+	}
+	return maxDataLine
+}
+
+// readLine reads a line ending in LF of up to max bytes, which is
+// only valid until the next read. A longer line is read to its end
+// and discarded, and only its start returned, with tooLong set.
+func (s *session) readLine(max int) (line []byte, tooLong bool, err error) {
+	line, err = s.br.ReadSlice('\n')
+	if err != bufio.ErrBufferFull && len(line) <= max {
+		return line, false, err
+	}
+	buf := append([]byte(nil), line...)
+	for err == bufio.ErrBufferFull {
+		line, err = s.br.ReadSlice('\n')
+		if len(buf) <= max {
+			buf = append(buf, line...)
+		}
+	}
+	if len(buf) <= max {
+		return buf, false, err
+	}
+	return buf[:max], true, err
+}
@@ -0,0 +1,51 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+// extended reports whether the client greeted the server with EHLO,
+// or LHLO in LMTP mode, enabling service extensions.
+func (s *session) extended() bool {
+	return s.helloType == "EHLO" || s.helloType == "LHLO"
+}
+
+// finishLMTP sends the replies at the end of a message in LMTP mode
+// (RFC 2033 s4.2): one for each recipient accepted, in order. err is
+// the result of Close, which applies to all of them; otherwise rerrs
+// or a PRDREnvelope's RecipientVerdict decides each. Discarded
+// recipients are told the message was delivered.
+func (s *session) finishLMTP(err error, rerrs RecipientErrors) {
+	if err != nil {
+		s.logf(LogDelivery, LogInfo, "message failed: %v", err)
+	}
+	pe, _ := s.env.(PRDREnvelope)
+	accepted := 0
+	i := 0
+	for _, kept := range s.rcptKept {
+		if !kept {
+			accepted++
+			s.sendlinef("250 2.1.5 Ok")
+			continue
+		}
+		rcpt := s.rcpts[i]
+		rerr := err
+		if rerr == nil {
+			rerr = recipientResult(i, rcpt, pe, rerrs)
+		}
+		i++
+		if rerr != nil {
+			s.sendSMTPErrorOrLinef(rerr, "451 4.3.0 <%s> Error: delivery failed, try again later", rcpt.Email())
+			continue
+		}
+		accepted++
+		s.sendlinef("250 2.1.5 <%s> Ok", rcpt.Email())
+	}
+	if accepted == 0 {
+		s.recordEvent(EventRejected)
+	} else {
+		s.recordEvent(EventAccepted)
+	}
+	s.countMessage(accepted == 0)
+	s.resetTx()
+}
@@ -0,0 +1,344 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package lmtp implements an LMTP (RFC 2033) client for handing
+// accepted mail to a local delivery agent such as Dovecot or Cyrus.
+package lmtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+	"github.com/bradfitz/go-smtpd/smtpd/dsn"
+)
+
+// Client delivers messages to an LMTP server.
+type Client struct {
+	Network   string        // "tcp" or "unix"
+	Addr      string        // e.g. "localhost:24" or "/var/run/dovecot/lmtp"
+	LocalName string        // name sent with LHLO; "localhost" if empty
+	Timeout   time.Duration // optional per-operation timeout
+
+	// Bounce, if non-nil, is called by an Envelope whose message was
+	// accepted from a client not using PRDR although the LMTP server
+	// refused it permanently for some recipients, to notify the
+	// sender, from, of the failed ones. If nil, the failures are
+	// only logged.
+	Bounce func(from string, failed []dsn.Recipient)
+}
+
+type conn struct {
+	nc      net.Conn
+	tc      *textproto.Conn
+	timeout time.Duration
+}
+
+func (c *Client) dial() (*conn, error) {
+	nc, err := net.DialTimeout(c.Network, c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{nc: nc, tc: textproto.NewConn(nc), timeout: c.Timeout}
+	cn.deadline()
+	if _, _, err := cn.tc.ReadResponse(220); err != nil {
+		cn.close()
+		return nil, err
+	}
+	name := c.LocalName
+	if name == "" {
+		name = "localhost"
+	}
+	if err := cn.cmd(250, "LHLO %s", name); err != nil {
+		cn.close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+func (cn *conn) deadline() {
+	if cn.timeout != 0 {
+		cn.nc.SetDeadline(time.Now().Add(cn.timeout))
+	}
+}
+
+func (cn *conn) cmd(expect int, format string, args ...interface{}) error {
+	cn.deadline()
+	id, err := cn.tc.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	cn.tc.StartResponse(id)
+	defer cn.tc.EndResponse(id)
+	_, _, err = cn.tc.ReadResponse(expect)
+	return err
+}
+
+// endData finishes the message body and reads the reply for each
+// of n accepted recipients, in order. If the connection fails while
+// the replies are read, the recipients whose replies are missing get
+// its error, as the others' results stand.
+func (cn *conn) endData(w io.WriteCloser, n int) ([]error, error) {
+	cn.deadline()
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	errs := make([]error, n)
+	for i := range errs {
+		cn.deadline()
+		_, _, err := cn.tc.ReadResponse(250)
+		if _, ok := err.(*textproto.Error); !ok && err != nil {
+			for j := i; j < n; j++ {
+				errs[j] = err
+			}
+			break
+		}
+		errs[i] = err
+	}
+	return errs, nil
+}
+
+func (cn *conn) close() error {
+	cn.deadline()
+	if id, err := cn.tc.Cmd("QUIT"); err == nil {
+		cn.tc.StartResponse(id)
+		cn.tc.ReadResponse(221)
+		cn.tc.EndResponse(id)
+	}
+	return cn.tc.Close()
+}
+
+// Send delivers the message read from r to the LMTP server. The
+// returned slice holds the result for each of rcpts, which the LMTP
+// server reports separately, so a queue using the Client as its
+// Transport retries or bounces each one as its result says; err is
+// non-nil if the transaction failed as a whole.
+func (c *Client) Send(from string, rcpts []string, r io.Reader) (rcptErrs []error, err error) {
+	cn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer cn.close()
+	if err := cn.cmd(250, "MAIL FROM:<%s>", from); err != nil {
+		return nil, err
+	}
+	rcptErrs = make([]error, len(rcpts))
+	var accepted []int
+	for i, rcpt := range rcpts {
+		if rcptErrs[i] = cn.cmd(250, "RCPT TO:<%s>", rcpt); rcptErrs[i] == nil {
+			accepted = append(accepted, i)
+		}
+	}
+	if len(accepted) == 0 {
+		return rcptErrs, nil
+	}
+	if err := cn.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	w := cn.tc.DotWriter()
+	cn.deadline()
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	errs, err := cn.endData(w, len(accepted))
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range accepted {
+		rcptErrs[i] = errs[j]
+	}
+	return rcptErrs, nil
+}
+
+// Envelope is an smtpd.Envelope that relays a message to an LMTP
+// server as it arrives. Recipients are checked with the LMTP server
+// when they're added, and if the LMTP server refuses the message for
+// some of them, Close returns an smtpd.RecipientErrors: clients
+// negotiating PRDR get an individual reply for each recipient, others
+// are asked to retry if any failure was temporary, and otherwise the
+// Client's Bounce is called for the recipients that failed.
+//
+// The LMTP connection is opened by the first AddRecipient and closed
+// by Close. Set the Client's Timeout so connections of abandoned
+// transactions are reclaimed.
+type Envelope struct {
+	c        *Client
+	sc       smtpd.Connection // or nil
+	from     smtpd.MailAddress
+	cn       *conn
+	rcpts    []smtpd.MailAddress // accepted by the LMTP server
+	w        io.WriteCloser
+	verdicts map[string]error // by Email
+}
+
+// NewEnvelope returns an Envelope delivering a message from from.
+// Without the smtpd.Connection, it logs with the standard logger, and
+// assumes the client isn't using PRDR; see OnNewMail.
+func (c *Client) NewEnvelope(from smtpd.MailAddress) *Envelope {
+	return &Envelope{c: c, from: from}
+}
+
+// OnNewMail is like NewEnvelope, but logs through the smtpd.Server's
+// logging hooks and knows whether the client uses PRDR. It's suitable
+// as a Server's OnNewMail hook.
+func (c *Client) OnNewMail(sc smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+	e := c.NewEnvelope(from)
+	e.sc = sc
+	return e, nil
+}
+
+// logf logs an error delivering the message.
+func (e *Envelope) logf(format string, args ...interface{}) {
+	if e.sc != nil {
+		e.sc.Logf(smtpd.LogDelivery, smtpd.LogError, "lmtp: "+format, args...)
+		return
+	}
+	log.Printf("lmtp: "+format, args...)
+}
+
+func (e *Envelope) AddRecipient(rcpt smtpd.MailAddress) error {
+	if e.cn == nil {
+		cn, err := e.c.dial()
+		if err != nil {
+			return e.replyError(err)
+		}
+		from := ""
+		if e.from != nil {
+			from = e.from.Email()
+		}
+		if err := cn.cmd(250, "MAIL FROM:<%s>", from); err != nil {
+			cn.close()
+			return e.replyError(err)
+		}
+		e.cn = cn
+	}
+	if err := e.cn.cmd(250, "RCPT TO:<%s>", rcpt.Email()); err != nil {
+		return e.replyError(err)
+	}
+	e.rcpts = append(e.rcpts, rcpt)
+	return nil
+}
+
+func (e *Envelope) BeginData() error {
+	if len(e.rcpts) == 0 {
+		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	if err := e.cn.cmd(354, "DATA"); err != nil {
+		e.abort()
+		return e.replyError(err)
+	}
+	e.w = e.cn.tc.DotWriter()
+	return nil
+}
+
+var errAborted = smtpd.SMTPError("451 4.4.1 Error: local delivery aborted")
+
+func (e *Envelope) Write(line []byte) error {
+	if e.cn == nil {
+		return errAborted
+	}
+	e.cn.deadline()
+	if _, err := e.w.Write(line); err != nil {
+		e.abort()
+		return e.replyError(err)
+	}
+	return nil
+}
+
+func (e *Envelope) Close() error {
+	if e.cn == nil {
+		if e.w != nil {
+			return errAborted
+		}
+		return nil
+	}
+	if e.w == nil {
+		e.abort()
+		return nil
+	}
+	errs, err := e.cn.endData(e.w, len(e.rcpts))
+	e.abort()
+	if err != nil {
+		return e.replyError(err)
+	}
+	e.verdicts = make(map[string]error)
+	rerrs := make(smtpd.RecipientErrors, len(e.rcpts))
+	failed := false
+	for i, rcpt := range e.rcpts {
+		if errs[i] != nil {
+			e.logf("delivery to %s failed: %v", rcpt.Email(), errs[i])
+			rerrs[i] = e.replyError(errs[i])
+			e.verdicts[rcpt.Email()] = rerrs[i]
+			failed = true
+		}
+	}
+	if !failed {
+		return nil
+	}
+	e.bounce(rerrs)
+	return rerrs
+}
+
+// bounce calls the Client's Bounce for the recipients that refused
+// the message permanently if the smtpd client will be told it was
+// accepted: it isn't using PRDR, and rerrs has no temporary failures,
+// which it would be asked to retry for, and some successes.
+func (e *Envelope) bounce(rerrs smtpd.RecipientErrors) {
+	if e.sc != nil && e.sc.Features().PRDR {
+		return
+	}
+	var failed []dsn.Recipient
+	for i, err := range rerrs {
+		if err == nil {
+			continue
+		}
+		if strings.HasPrefix(err.Error(), "4") {
+			return
+		}
+		failed = append(failed, dsn.FromError(e.rcpts[i].Email(), err, false))
+	}
+	if len(failed) == len(rerrs) {
+		return
+	}
+	if e.c.Bounce == nil {
+		e.logf("no Bounce func; not reporting %d failed recipients to the sender", len(failed))
+		return
+	}
+	from := ""
+	if e.from != nil {
+		from = e.from.Email()
+	}
+	e.c.Bounce(from, failed)
+}
+
+// RecipientVerdict returns the LMTP server's delivery result for
+// rcpt. It's only meaningful after Close.
+func (e *Envelope) RecipientVerdict(rcpt smtpd.MailAddress) error {
+	return e.verdicts[rcpt.Email()]
+}
+
+func (e *Envelope) abort() {
+	if e.cn != nil {
+		e.cn.close()
+		e.cn = nil
+	}
+}
+
+// replyError converts an error from the LMTP server into an SMTP
+// reply for the smtpd client.
+func (e *Envelope) replyError(err error) error {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		msg := strings.Join(strings.Fields(te.Msg), " ")
+		return smtpd.SMTPError(fmt.Sprintf("%03d %s", te.Code, msg))
+	}
+	e.logf("%v", err)
+	return smtpd.SMTPError("451 4.4.1 Error: local delivery agent unavailable")
+}
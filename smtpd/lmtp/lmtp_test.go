@@ -0,0 +1,244 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lmtp
+
+import (
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+	"github.com/bradfitz/go-smtpd/smtpd/dsn"
+)
+
+// addr is a MailAddress for tests.
+type addr string
+
+func (a addr) Email() string       { return string(a) }
+func (a addr) Raw() string         { return string(a) }
+func (a addr) Hostname() string    { return string(a)[strings.LastIndex(string(a), "@")+1:] }
+func (a addr) Tag() string         { return "" }
+func (a addr) BaseAddress() string { return string(a) }
+
+// lmtpServer is an LMTP server for tests. Recipients are refused at
+// RCPT with rcpt's reply for them, and after DATA with data's;
+// others are accepted.
+type lmtpServer struct {
+	rcpt, data map[string]string
+
+	mu   sync.Mutex
+	msgs []string // messages received
+	from []string // their senders
+}
+
+func newServer(t *testing.T, s *lmtpServer) *Client {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return &Client{Network: "tcp", Addr: ln.Addr().String(), Timeout: 5 * time.Second}
+}
+
+func (s *lmtpServer) serve(c net.Conn) {
+	tc := textproto.NewConn(c)
+	defer tc.Close()
+	tc.PrintfLine("220 lmtp.example.com LMTP ready")
+	var from string
+	var accepted []string
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			tc.PrintfLine("250 lmtp.example.com")
+		case "MAIL":
+			from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tc.PrintfLine("250 2.1.0 Ok")
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if reply, ok := s.rcpt[rcpt]; ok {
+				tc.PrintfLine("%s", reply)
+				continue
+			}
+			accepted = append(accepted, rcpt)
+			tc.PrintfLine("250 2.1.5 Ok")
+		case "DATA":
+			tc.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			msg, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.msgs = append(s.msgs, string(msg))
+			s.from = append(s.from, from)
+			s.mu.Unlock()
+			for _, rcpt := range accepted {
+				if reply, ok := s.data[rcpt]; ok {
+					tc.PrintfLine("%s", reply)
+				} else {
+					tc.PrintfLine("250 2.0.0 <%s> Saved", rcpt)
+				}
+			}
+			accepted = nil
+		case "QUIT":
+			tc.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			tc.PrintfLine("502 5.5.2 Error: command not recognized")
+		}
+	}
+}
+
+func (s *lmtpServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+const testMessage = "Subject: hi\r\n\r\n.leading dot\r\nbody\r\n"
+
+func TestSend(t *testing.T) {
+	s := &lmtpServer{
+		rcpt: map[string]string{"nobody@example.com": "550 5.1.1 <nobody@example.com> User unknown"},
+		data: map[string]string{"full@example.com": "452 4.2.2 <full@example.com> Mailbox full"},
+	}
+	c := newServer(t, s)
+	rcpts := []string{"jane@example.com", "nobody@example.com", "full@example.com", "joe@example.com"}
+	errs, err := c.Send("sender@example.org", rcpts, strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := make([]int, len(errs))
+	for i, err := range errs {
+		if te, ok := err.(*textproto.Error); ok {
+			codes[i] = te.Code
+		} else if err != nil {
+			t.Errorf("%s: %v", rcpts[i], err)
+		}
+	}
+	if want := []int{0, 550, 452, 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("reply codes %v; want %v", codes, want)
+	}
+	if msgs := s.received(); len(msgs) != 1 || msgs[0] != strings.ReplaceAll(testMessage, "\r\n", "\n") {
+		t.Errorf("received %q", msgs)
+	}
+
+	// Without any accepted recipients, there's no message.
+	errs, err = c.Send("sender@example.org", []string{"nobody@example.com"}, strings.NewReader(testMessage))
+	if err != nil || len(errs) != 1 || errs[0] == nil {
+		t.Errorf("no recipients: %v, %v", errs, err)
+	}
+	if msgs := s.received(); len(msgs) != 1 {
+		t.Errorf("%d messages sent; want 1", len(msgs))
+	}
+}
+
+// send passes testMessage through an Envelope of c's to rcpts, and
+// returns the errors from AddRecipient and Close.
+func send(t *testing.T, c *Client, rcpts ...string) ([]error, error) {
+	t.Helper()
+	e := c.NewEnvelope(addr("sender@example.org"))
+	var rerrs []error
+	for _, rcpt := range rcpts {
+		rerrs = append(rerrs, e.AddRecipient(addr(rcpt)))
+	}
+	if err := e.BeginData(); err != nil {
+		return rerrs, err
+	}
+	for _, line := range strings.SplitAfter(testMessage, "\n") {
+		if err := e.Write([]byte(line)); err != nil {
+			return rerrs, err
+		}
+	}
+	return rerrs, e.Close()
+}
+
+func TestEnvelope(t *testing.T) {
+	s := &lmtpServer{
+		rcpt: map[string]string{"nobody@example.com": "550 5.1.1 <nobody@example.com> User unknown"},
+		data: map[string]string{
+			"full@example.com":   "452 4.2.2 Mailbox full",
+			"closed@example.com": "550 5.2.1 Mailbox disabled",
+		},
+	}
+	c := newServer(t, s)
+	var bounced []dsn.Recipient
+	c.Bounce = func(from string, failed []dsn.Recipient) {
+		if from != "sender@example.org" {
+			t.Errorf("bounce to %q", from)
+		}
+		bounced = append(bounced, failed...)
+	}
+
+	rerrs, err := send(t, c, "jane@example.com", "nobody@example.com")
+	if err != nil || rerrs[0] != nil || rerrs[1] != smtpd.SMTPError("550 5.1.1 <nobody@example.com> User unknown") {
+		t.Errorf("refused at RCPT: %v, %v", rerrs, err)
+	}
+
+	// Permanent failures after DATA are bounced if the message is
+	// accepted for the other recipients.
+	_, err = send(t, c, "jane@example.com", "closed@example.com")
+	re, ok := err.(smtpd.RecipientErrors)
+	if !ok || len(re) != 2 || re[0] != nil || re[1] != smtpd.SMTPError("550 5.2.1 Mailbox disabled") {
+		t.Fatalf("Close = %#v", err)
+	}
+	if len(bounced) != 1 || bounced[0].Addr != "closed@example.com" || bounced[0].Status != "5.2.1" {
+		t.Errorf("bounced %+v", bounced)
+	}
+
+	// A temporary failure has the client retry, so nothing's bounced.
+	bounced = nil
+	_, err = send(t, c, "jane@example.com", "closed@example.com", "full@example.com")
+	if re, ok := err.(smtpd.RecipientErrors); !ok || re[2] != smtpd.SMTPError("452 4.2.2 Mailbox full") {
+		t.Errorf("Close = %#v", err)
+	}
+	// As is the message refused for everyone.
+	_, err = send(t, c, "closed@example.com")
+	if _, ok := err.(smtpd.RecipientErrors); !ok {
+		t.Errorf("Close = %#v", err)
+	}
+	if len(bounced) != 0 {
+		t.Errorf("bounced %+v", bounced)
+	}
+
+	if msgs := s.received(); len(msgs) != 4 || msgs[0] != strings.ReplaceAll(testMessage, "\r\n", "\n") {
+		t.Errorf("received %q", msgs)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Network: "tcp", Addr: ln.Addr().String()}
+	ln.Close()
+	e := c.NewEnvelope(addr("sender@example.org"))
+	err = e.AddRecipient(addr("jane@example.com"))
+	if se, ok := err.(smtpd.SMTPError); !ok || !strings.HasPrefix(string(se), "451 4.4.1") {
+		t.Errorf("AddRecipient = %v; want 451 4.4.1", err)
+	}
+	if err := e.BeginData(); err == nil || !strings.HasPrefix(err.Error(), "554") {
+		t.Errorf("BeginData = %v; want 554", err)
+	}
+}
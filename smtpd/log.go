@@ -0,0 +1,120 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+)
+
+// LogCategory is a subsystem whose log verbosity can be set with
+// Server.SetLogLevel.
+type LogCategory int
+
+const (
+	LogConn     LogCategory = iota // connections and I/O errors
+	LogProto                       // SMTP commands and replies
+	LogTLS                         // TLS handshakes
+	LogAuth                        // authentication
+	LogDelivery                    // envelopes and message delivery
+	numLogCategories
+)
+
+var logCategoryNames = [numLogCategories]string{"conn", "proto", "tls", "auth", "delivery"}
+
+func (c LogCategory) String() string {
+	if c < 0 || c >= numLogCategories {
+		return "unknown"
+	}
+	return logCategoryNames[c]
+}
+
+// LogLevel is a log verbosity. The zero value is LogInfo.
+type LogLevel int32
+
+const (
+	LogError LogLevel = -1 // only errors
+	LogInfo  LogLevel = 0  // notable events, such as rejections
+	LogDebug LogLevel = 1  // protocol traces and other details
+)
+
+// SetLogLevel sets the verbosity for a category of log messages. It
+// may be called while the server is running.
+func (srv *Server) SetLogLevel(c LogCategory, l LogLevel) {
+	srv.logLevels[c].Store(int32(l))
+}
+
+// LogLevel returns the verbosity for a category of log messages.
+func (srv *Server) LogLevel(c LogCategory) LogLevel {
+	return LogLevel(srv.logLevels[c].Load())
+}
+
+// logf logs a message in category c at level l, if enabled.
+func (srv *Server) logf(c LogCategory, l LogLevel, format string, args ...interface{}) {
+	if l > srv.LogLevel(c) {
+		return
+	}
+	srv.output(nil, c, l, fmt.Sprintf(format, args...))
+}
+
+// logf logs a message about the session in category c at level l, if
+// enabled for the server or the session.
+func (s *session) logf(c LogCategory, l LogLevel, format string, args ...interface{}) {
+	if !s.logEnabled(c, l) {
+		return
+	}
+	s.srv.output(s, c, l, fmt.Sprintf(format, args...))
+}
+
+func (s *session) Logf(c LogCategory, l LogLevel, format string, args ...interface{}) {
+	s.logf(c, l, format, args...)
+}
+
+// logAttrs is like logf, with attributes for Server.Logger.
+func (s *session) logAttrs(c LogCategory, l LogLevel, msg string, attrs ...slog.Attr) {
+	if !s.logEnabled(c, l) {
+		return
+	}
+	s.srv.output(s, c, l, msg, attrs...)
+}
+
+func (s *session) logEnabled(c LogCategory, l LogLevel) bool {
+	return l <= s.srv.LogLevel(c) || s.debug && l <= LogDebug
+}
+
+var slogLevels = map[LogLevel]slog.Level{
+	LogError: slog.LevelError,
+	LogInfo:  slog.LevelInfo,
+	LogDebug: slog.LevelDebug,
+}
+
+// output writes a log message, about s if it's non-nil.
+func (srv *Server) output(s *session, c LogCategory, l LogLevel, msg string, attrs ...slog.Attr) {
+	if srv.Logger != nil {
+		ctx := context.Background()
+		attrs = append(attrs, slog.String("category", c.String()))
+		if s != nil {
+			ctx = s.ctx
+			attrs = append(attrs, slog.String("session", s.id), slog.String("remote", s.Addr().String()))
+		}
+		srv.Logger.LogAttrs(ctx, slogLevels[l], msg, attrs...)
+		return
+	}
+	if s != nil {
+		msg = s.Addr().String() + ": " + msg
+	}
+	if srv.LogEntry != nil {
+		srv.LogEntry(c, l, msg)
+		return
+	}
+	msg = "smtpd: " + logCategoryNames[c] + ": " + msg
+	if srv.Log != nil {
+		srv.Log("%s", msg)
+		return
+	}
+	log.Print(msg)
+}
@@ -0,0 +1,247 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package maildir provides an smtpd.Envelope that delivers messages
+// into Maildirs, the one-file-per-message mailbox format read by
+// Dovecot, Courier, mutt and most other mail clients.
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// SyncPolicy says what's synced to disk before a delivery is
+// acknowledged.
+type SyncPolicy int
+
+const (
+	// SyncAll syncs the message file, then the new directory after
+	// it's moved there, so the message survives a crash.
+	SyncAll SyncPolicy = iota
+
+	// SyncFile syncs only the message file.
+	SyncFile
+
+	// SyncNone leaves writing to disk to the operating system.
+	SyncNone
+)
+
+// Envelope delivers a message into the Maildir of each of its
+// recipients (those sharing one get one copy). The message is written
+// to a uniquely named file in the Maildir's tmp directory as it
+// arrives, with \n line endings, and moved to its new directory once
+// it ends. Files are only moved once every copy has been written, so
+// a failure delivers none of them.
+type Envelope struct {
+	// Root is the directory holding recipients' Maildirs, each named
+	// by the local part of their address in lower case, less any
+	// sub-address, if Dir is nil.
+	Root string
+
+	// Dir, if non-nil, returns the path of rcpt's Maildir. It may
+	// return an error to refuse rcpt, such as an smtpd.SMTPError.
+	Dir func(rcpt smtpd.MailAddress) (string, error)
+
+	// Create makes recipients' Maildirs if they don't exist.
+	// Otherwise recipients without one are refused.
+	Create bool
+
+	// Sync is what's synced to disk before the message is accepted.
+	Sync SyncPolicy
+
+	returnPath string
+	dirs       []*delivery
+}
+
+// delivery is a copy of the message being written to a Maildir.
+type delivery struct {
+	dir  string
+	name string // of the file in tmp, and then new
+	f    *os.File
+	w    *bufio.Writer
+	err  error
+}
+
+// New returns an Envelope for a message from from, delivered into
+// Maildirs in root. A Return-Path field holding from is added to the
+// top of the message.
+func New(from smtpd.MailAddress, root string) *Envelope {
+	rp := ""
+	if from != nil {
+		rp = from.Email()
+	}
+	return &Envelope{Root: root, returnPath: "Return-Path: <" + rp + ">\n"}
+}
+
+var (
+	errNoMailbox = smtpd.SMTPError("550 5.1.1 Error: mailbox unavailable")
+	errDelivery  = smtpd.SMTPError("451 4.3.0 Error: local delivery failed")
+)
+
+// dir returns the path of rcpt's Maildir.
+func (e *Envelope) dir(rcpt smtpd.MailAddress) (string, error) {
+	if e.Dir != nil {
+		return e.Dir(rcpt)
+	}
+	local := strings.ToLower(rcpt.BaseAddress())
+	if i := strings.LastIndex(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+	if local == "" || strings.HasPrefix(local, ".") || strings.ContainsAny(local, "/\\\x00") {
+		return "", errNoMailbox
+	}
+	return filepath.Join(e.Root, local), nil
+}
+
+func (e *Envelope) AddRecipient(rcpt smtpd.MailAddress) error {
+	dir, err := e.dir(rcpt)
+	if err != nil {
+		return err
+	}
+	for _, d := range e.dirs {
+		if d.dir == dir {
+			return nil
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("maildir: %s: %v", dir, err)
+			return errDelivery
+		}
+		if !e.Create {
+			return errNoMailbox
+		}
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+				log.Printf("maildir: creating %s: %v", dir, err)
+				return errDelivery
+			}
+		}
+	}
+	e.dirs = append(e.dirs, &delivery{dir: dir})
+	return nil
+}
+
+func (e *Envelope) BeginData() error {
+	if len(e.dirs) == 0 {
+		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	for _, d := range e.dirs {
+		d.name = uniqueName()
+		f, err := os.OpenFile(filepath.Join(d.dir, "tmp", d.name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Printf("maildir: %v", err)
+			e.abort()
+			return errDelivery
+		}
+		d.f, d.w = f, bufio.NewWriter(f)
+		d.w.WriteString(e.returnPath)
+	}
+	return nil
+}
+
+func (e *Envelope) Write(line []byte) error {
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		line = append(line[:len(line)-2:len(line)-2], '\n')
+	}
+	for _, d := range e.dirs {
+		if d.err == nil {
+			_, d.err = d.w.Write(line)
+		}
+	}
+	return nil
+}
+
+func (e *Envelope) Close() error {
+	for _, d := range e.dirs {
+		if d.err == nil {
+			d.err = d.w.Flush()
+		}
+		if d.err == nil && e.Sync != SyncNone {
+			d.err = d.f.Sync()
+		}
+		if err := d.f.Close(); d.err == nil {
+			d.err = err
+		}
+		d.f = nil
+		if d.err != nil {
+			log.Printf("maildir: writing %s: %v", filepath.Join(d.dir, "tmp", d.name), d.err)
+			e.abort()
+			return errDelivery
+		}
+	}
+	// Should a move fail after others succeeded, the client will
+	// try again, and those Maildirs will get the message twice.
+	for _, d := range e.dirs {
+		tmp := filepath.Join(d.dir, "tmp", d.name)
+		if err := os.Rename(tmp, filepath.Join(d.dir, "new", d.name)); err != nil {
+			log.Printf("maildir: %v", err)
+			os.Remove(tmp)
+			return errDelivery
+		}
+		if e.Sync == SyncAll {
+			if err := syncDir(filepath.Join(d.dir, "new")); err != nil {
+				log.Printf("maildir: syncing %s: %v", d.dir, err)
+				return errDelivery
+			}
+		}
+	}
+	return nil
+}
+
+// abort removes the message's files from tmp.
+func (e *Envelope) abort() {
+	for _, d := range e.dirs {
+		if d.name == "" {
+			continue
+		}
+		if d.f != nil {
+			d.f.Close()
+			d.f = nil
+		}
+		os.Remove(filepath.Join(d.dir, "tmp", d.name))
+	}
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+var (
+	deliveries atomic.Int64 // for unique names
+	hostOnce   sync.Once
+	host       string
+)
+
+// uniqueName returns a name for a new message file, unique across
+// processes and hosts: the time, process ID and a counter, then the
+// host name.
+func uniqueName() string {
+	hostOnce.Do(func() {
+		h, err := os.Hostname()
+		if err != nil || h == "" {
+			h = "localhost"
+		}
+		// '/' and ':' can't appear in names.
+		host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(h)
+	})
+	t := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", t.Unix(), t.Nanosecond()/1000, os.Getpid(), deliveries.Add(1), host)
+}
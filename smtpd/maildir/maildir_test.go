@@ -0,0 +1,186 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// addr is a MailAddress for tests, with sub-addresses after '+'.
+type addr string
+
+func (a addr) Email() string    { return string(a) }
+func (a addr) Raw() string      { return string(a) }
+func (a addr) Hostname() string { return string(a)[strings.LastIndex(string(a), "@")+1:] }
+func (a addr) Tag() string {
+	local := string(a)[:strings.LastIndex(string(a), "@")]
+	if i := strings.Index(local, "+"); i >= 0 {
+		return local[i+1:]
+	}
+	return ""
+}
+func (a addr) BaseAddress() string {
+	if tag := a.Tag(); tag != "" {
+		return strings.Replace(string(a), "+"+tag, "", 1)
+	}
+	return string(a)
+}
+
+// messages returns the contents of the messages in dir's new
+// directory, and fails if any are left in tmp.
+func messages(t *testing.T, dir string) []string {
+	t.Helper()
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("%s: %d files left in tmp", dir, len(tmp))
+	}
+	ents, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, ent := range ents {
+		b, err := os.ReadFile(filepath.Join(dir, "new", ent.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, string(b))
+	}
+	return msgs
+}
+
+func deliver(e *Envelope, lines ...string) error {
+	if err := e.BeginData(); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if err := e.Write([]byte(l)); err != nil {
+			return err
+		}
+	}
+	return e.Close()
+}
+
+func TestDeliver(t *testing.T) {
+	root := t.TempDir()
+	e := New(addr("sender@example.org"), root)
+	e.Create = true
+	for _, rcpt := range []string{"Jane@example.com", "jane+lists@example.com", "joe@example.com"} {
+		if err := e.AddRecipient(addr(rcpt)); err != nil {
+			t.Fatalf("AddRecipient(%s): %v", rcpt, err)
+		}
+	}
+	if err := deliver(e, "Subject: hi\r\n", "\r\n", "CRLF\r\n", "bare LF\n", "bare\rCR\r\n", "no line ending"); err != nil {
+		t.Fatal(err)
+	}
+	const want = "Return-Path: <sender@example.org>\nSubject: hi\n\nCRLF\nbare LF\nbare\rCR\nno line ending"
+	for _, box := range []string{"jane", "joe"} {
+		msgs := messages(t, filepath.Join(root, box))
+		if len(msgs) != 1 || msgs[0] != want {
+			t.Errorf("%s got %q; want one copy of %q", box, msgs, want)
+		}
+		if fi, err := os.Stat(filepath.Join(root, box, "cur")); err != nil || !fi.IsDir() {
+			t.Errorf("%s has no cur directory: %v", box, err)
+		}
+	}
+
+	// A null sender gets an empty Return-Path, and a second message
+	// gets a file of its own.
+	e = New(nil, root)
+	e.AddRecipient(addr("joe@example.com"))
+	if err := deliver(e, "Subject: bounce\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := messages(t, filepath.Join(root, "joe"))
+	if len(msgs) != 2 || !strings.Contains(strings.Join(msgs, ""), "Return-Path: <>\nSubject: bounce\n") {
+		t.Errorf("joe got %q", msgs)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	root := t.TempDir()
+	e := New(addr("sender@example.org"), root)
+	for _, rcpt := range []string{"nobody@example.com", ".hidden@example.com", "a/b@example.com", "@example.com"} {
+		if err := e.AddRecipient(addr(rcpt)); err != errNoMailbox {
+			t.Errorf("AddRecipient(%s) = %v; want %v", rcpt, err, errNoMailbox)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "nobody")); !os.IsNotExist(err) {
+		t.Errorf("Maildir made without Create: %v", err)
+	}
+	if err := e.BeginData(); err == nil || !strings.HasPrefix(err.Error(), "554") {
+		t.Errorf("BeginData without recipients = %v; want 554", err)
+	}
+
+	refused := smtpd.SMTPError("550 5.1.1 Error: no such user")
+	e = New(addr("sender@example.org"), "")
+	e.Create = true
+	e.Dir = func(rcpt smtpd.MailAddress) (string, error) {
+		if rcpt.Hostname() != "example.com" {
+			return "", refused
+		}
+		return filepath.Join(root, "shared"), nil
+	}
+	if err := e.AddRecipient(addr("a@example.net")); err != refused {
+		t.Errorf("Dir's error: AddRecipient = %v", err)
+	}
+	e.AddRecipient(addr("a@example.com"))
+	e.AddRecipient(addr("b@example.com"))
+	if err := deliver(e, "Subject: shared\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := messages(t, filepath.Join(root, "shared")); len(msgs) != 1 {
+		t.Errorf("shared Maildir got %d copies; want 1", len(msgs))
+	}
+}
+
+func TestDeliveryFailure(t *testing.T) {
+	root := t.TempDir()
+	e := New(addr("sender@example.org"), root)
+	e.Create = true
+	e.AddRecipient(addr("stuck@example.com"))
+	// The message can't be moved to new once it's not a directory.
+	stuck := filepath.Join(root, "stuck")
+	if err := os.Remove(filepath.Join(stuck, "new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stuck, "new"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := deliver(e, "Subject: hi\r\n"); err != errDelivery {
+		t.Errorf("Close = %v; want %v", err, errDelivery)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(stuck, "tmp")); len(tmp) != 0 {
+		t.Errorf("%d files left in tmp", len(tmp))
+	}
+}
+
+func TestCreateFailure(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	e := New(addr("sender@example.org"), root)
+	e.Create = true
+	e.Dir = func(smtpd.MailAddress) (string, error) { return filepath.Join(root, "file", "box"), nil }
+	if err := e.AddRecipient(addr("a@example.com")); err != errDelivery {
+		t.Errorf("AddRecipient = %v; want %v", err, errDelivery)
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		name := uniqueName()
+		if seen[name] || strings.ContainsAny(name, "/:") {
+			t.Fatalf("name %q repeated or invalid", name)
+		}
+		seen[name] = true
+	}
+}
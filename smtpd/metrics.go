@@ -0,0 +1,125 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics is told of a Server's activity, for monitoring. Its
+// methods are called concurrently by sessions, and shouldn't block.
+type Metrics interface {
+	ConnOpened()
+	ConnClosed()
+	TLSHandshake(resumed bool)
+	Auth(mechanism string, ok bool)
+	Message(accepted bool)
+
+	// Bytes is called as each session ends, with the bytes it read
+	// from and wrote to the client; see SessionStats.
+	Bytes(in, out int64)
+
+	// Command is called with the verb of each command read, or
+	// "UNKNOWN" for verbs the server doesn't know.
+	Command(verb string)
+}
+
+// commandVerbs are the verbs counted by Metrics.Command.
+var commandVerbs = map[string]bool{
+	"HELO": true, "EHLO": true, "LHLO": true, "QUIT": true, "RSET": true,
+	"NOOP": true, "MAIL": true, "RCPT": true, "DATA": true, "BDAT": true,
+	"ATRN": true, "STARTTLS": true, "AUTH": true, "CLIENTID": true,
+	"XCLIENT": true,
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ConnOpened()         {}
+func (nopMetrics) ConnClosed()         {}
+func (nopMetrics) TLSHandshake(bool)   {}
+func (nopMetrics) Auth(string, bool)   {}
+func (nopMetrics) Message(bool)        {}
+func (nopMetrics) Bytes(int64, int64)  {}
+func (nopMetrics) Command(verb string) {}
+
+// metrics returns Server.Metrics, or one that does nothing if it's
+// nil.
+func (srv *Server) metrics() Metrics {
+	if srv.Metrics == nil {
+		return nopMetrics{}
+	}
+	return srv.Metrics
+}
+
+// CounterMetrics is a Metrics that keeps counts in memory, such as
+// for exporting to a monitoring system. The zero value is ready to
+// use.
+type CounterMetrics struct {
+	ConnsOpened      atomic.Int64
+	ConnsClosed      atomic.Int64
+	TLSHandshakes    atomic.Int64
+	TLSResumed       atomic.Int64 // of TLSHandshakes
+	AuthSuccesses    atomic.Int64
+	AuthFailures     atomic.Int64
+	MessagesAccepted atomic.Int64
+	MessagesRejected atomic.Int64
+	BytesIn          atomic.Int64
+	BytesOut         atomic.Int64
+
+	mu       sync.Mutex
+	commands map[string]int64 // guarded by mu
+}
+
+func (m *CounterMetrics) ConnOpened() { m.ConnsOpened.Add(1) }
+func (m *CounterMetrics) ConnClosed() { m.ConnsClosed.Add(1) }
+
+func (m *CounterMetrics) TLSHandshake(resumed bool) {
+	m.TLSHandshakes.Add(1)
+	if resumed {
+		m.TLSResumed.Add(1)
+	}
+}
+
+func (m *CounterMetrics) Auth(mechanism string, ok bool) {
+	if ok {
+		m.AuthSuccesses.Add(1)
+	} else {
+		m.AuthFailures.Add(1)
+	}
+}
+
+func (m *CounterMetrics) Message(accepted bool) {
+	if accepted {
+		m.MessagesAccepted.Add(1)
+	} else {
+		m.MessagesRejected.Add(1)
+	}
+}
+
+func (m *CounterMetrics) Bytes(in, out int64) {
+	m.BytesIn.Add(in)
+	m.BytesOut.Add(out)
+}
+
+func (m *CounterMetrics) Command(verb string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.commands == nil {
+		m.commands = make(map[string]int64)
+	}
+	m.commands[verb]++
+}
+
+// Commands returns the number of commands received, by verb.
+func (m *CounterMetrics) Commands() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := make(map[string]int64, len(m.commands))
+	for verb, n := range m.commands {
+		c[verb] = n
+	}
+	return c
+}
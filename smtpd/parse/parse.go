@@ -0,0 +1,226 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package parse implements the parsing of SMTP command lines, paths
+// and ESMTP parameters used by package smtpd, for use by other
+// programs that need to interpret SMTP the same way.
+package parse
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"unicode"
+)
+
+// Line is an SMTP command line, as read from the client including
+// its trailing CRLF.
+type Line string
+
+// CheckValid returns an error if the line is not a well-formed
+// command line.
+func (l Line) CheckValid() error {
+	if !strings.HasSuffix(string(l), "\r\n") {
+		return errors.New(`line doesn't end in \r\n`)
+	}
+	// Check for verbs defined not to have an argument
+	// (RFC 5321 s4.1.1)
+	switch l.Verb() {
+	case "RSET", "DATA", "QUIT", "STARTTLS":
+		if l.Arg() != "" {
+			return errors.New("unexpected argument")
+		}
+	}
+	return nil
+}
+
+// Verb returns the command verb, in upper case.
+func (l Line) Verb() string {
+	s := strings.TrimSuffix(string(l), "\r\n")
+	if idx := strings.Index(s, " "); idx != -1 {
+		return strings.ToUpper(s[:idx])
+	}
+	return strings.ToUpper(s)
+}
+
+// Arg returns the text following the verb, with trailing space
+// removed.
+func (l Line) Arg() string {
+	s := strings.TrimSuffix(string(l), "\r\n")
+	if idx := strings.Index(s, " "); idx != -1 {
+		return strings.TrimRightFunc(s[idx+1:], unicode.IsSpace)
+	}
+	return ""
+}
+
+func (l Line) String() string {
+	return string(l)
+}
+
+// ErrPathSyntax is returned for MAIL and RCPT arguments without a
+// well-formed path.
+var ErrPathSyntax = errors.New("bad path syntax")
+
+// ReversePath parses the argument of a MAIL command, such as
+// "FROM:<foo@bar.com> SIZE=1000", returning the address inside the
+// angle brackets, which may be empty, and the ESMTP parameters that
+// follow it. The address must be well-formed, as described at
+// Mailbox, and may have a source route.
+func ReversePath(arg string) (path, params string, err error) {
+	return parsePath(arg, "FROM:", true)
+}
+
+// ForwardPath parses the argument of a RCPT command, such as
+// "TO:<foo@bar.com> NOTIFY=NEVER", returning the address inside the
+// angle brackets and the ESMTP parameters that follow it. The address
+// is checked as by ReversePath, but may also be "Postmaster".
+func ForwardPath(arg string) (path, params string, err error) {
+	return parsePath(arg, "TO:", false)
+}
+
+func parsePath(arg, prefix string, allowEmpty bool) (path, params string, err error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", "", ErrPathSyntax
+	}
+	// Some clients put a space before the path.
+	rest := strings.TrimLeft(arg[len(prefix):], " ")
+	end := pathEnd(rest)
+	if end == -1 {
+		return "", "", ErrPathSyntax
+	}
+	path, params = rest[1:end], rest[end+1:]
+	if params != "" && params[0] != ' ' {
+		return "", "", ErrPathSyntax
+	}
+	switch {
+	case path == "":
+		if !allowEmpty {
+			return "", "", ErrPathSyntax
+		}
+	case !allowEmpty && strings.EqualFold(path, "postmaster"):
+		// RCPT TO:<Postmaster> needs no domain (RFC 5321 s4.1.1.3).
+	default:
+		if err := checkPath(path); err != nil {
+			return "", "", err
+		}
+	}
+	return path, params, nil
+}
+
+// Params parses the ESMTP parameters following a path, such as
+// "SIZE=1000 BODY=8BITMIME SMTPUTF8", into a map from upper-cased
+// keyword to value. Keywords without a value map to "".
+func Params(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, p := range strings.Fields(s) {
+		k, v, _ := strings.Cut(p, "=")
+		if !validKeyword(k) || !validValue(v) {
+			return nil, errors.New("bad parameter syntax: " + p)
+		}
+		m[strings.ToUpper(k)] = v
+	}
+	return m, nil
+}
+
+// HasParam reports whether the ESMTP parameters params include the
+// keyword key.
+func HasParam(params, key string) bool {
+	for _, p := range strings.Fields(params) {
+		k, _, _ := strings.Cut(p, "=")
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// validKeyword reports whether k is an esmtp-keyword (RFC 5321 s4.1.2).
+func validKeyword(k string) bool {
+	if k == "" || k[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// validValue reports whether v is an esmtp-value (RFC 5321 s4.1.2),
+// allowing UTF-8 as RFC 6531 does.
+func validValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 33 || c == '=' || c == 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// AddressLiteral parses an RFC 5321 address literal, such as
+// "[192.0.2.1]" or "[IPv6:2001:db8::1]", as used in place of a domain
+// in EHLO and in addresses.
+func AddressLiteral(s string) (net.IP, bool) {
+	if len(s) < 2 || s[0] != '[' || s[len(s)-1] != ']' {
+		return nil, false
+	}
+	s = s[1 : len(s)-1]
+	if len(s) > 5 && strings.EqualFold(s[:5], "IPv6:") {
+		ip := net.ParseIP(s[5:])
+		if ip == nil || !strings.Contains(s[5:], ":") {
+			return nil, false
+		}
+		return ip, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil || strings.Contains(s, ":") {
+		return nil, false
+	}
+	return ip, true
+}
+
+// FormatAddressLiteral returns the RFC 5321 address literal for ip:
+// "[192.0.2.1]" for IPv4 and "[IPv6:2001:db8::1]" for IPv6.
+func FormatAddressLiteral(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "[" + ip4.String() + "]"
+	}
+	return "[IPv6:" + ip.String() + "]"
+}
+
+// XText decodes an xtext value (RFC 3461 s4), as used by the DSN
+// parameters ENVID and ORCPT, in which "+" and two upper-case hex
+// digits stand for a byte.
+func XText(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) || !isUpperHex(s[i+1]) || !isUpperHex(s[i+2]) {
+				return "", errors.New("bad xtext hex escape")
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case c < 33 || c > 126 || c == '=':
+			return "", errors.New("bad xtext character")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func isUpperHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	if c <= '9' {
+		return c - '0'
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,200 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parse
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestLine(t *testing.T) {
+	tests := []struct {
+		line      Line
+		verb, arg string
+		valid     bool
+	}{
+		{"HELO example.com\r\n", "HELO", "example.com", true},
+		{"mail FROM:<a@example.com>\r\n", "MAIL", "FROM:<a@example.com>", true},
+		{"RCPT TO:<a@example.com>  \r\n", "RCPT", "TO:<a@example.com>", true},
+		{"DATA\r\n", "DATA", "", true},
+		{"QUIT\r\n", "QUIT", "", true},
+		{"DATA now\r\n", "DATA", "now", false},
+		{"RSET x\r\n", "RSET", "x", false},
+		{"NOOP\n", "NOOP\n", "", false},
+		{"NOOP", "NOOP", "", false},
+	}
+	for _, tt := range tests {
+		if got := tt.line.Verb(); got != tt.verb {
+			t.Errorf("%q.Verb() = %q; want %q", tt.line, got, tt.verb)
+		}
+		if got := tt.line.Arg(); got != tt.arg {
+			t.Errorf("%q.Arg() = %q; want %q", tt.line, got, tt.arg)
+		}
+		if err := tt.line.CheckValid(); (err == nil) != tt.valid {
+			t.Errorf("%q.CheckValid() = %v; want valid = %v", tt.line, err, tt.valid)
+		}
+	}
+}
+
+func TestReversePath(t *testing.T) {
+	tests := []struct {
+		arg          string
+		path, params string
+		ok           bool
+	}{
+		{"FROM:<user@example.com>", "user@example.com", "", true},
+		{"from:<user@example.com>", "user@example.com", "", true},
+		{"FROM: <user@example.com>", "user@example.com", "", true},
+		{"FROM:<>", "", "", true},
+		{"FROM:<user@example.com> SIZE=1000 BODY=8BITMIME", "user@example.com", " SIZE=1000 BODY=8BITMIME", true},
+		{`FROM:<"john smith"@example.com>`, `"john smith"@example.com`, "", true},
+		{`FROM:<"a>b"@example.com> SIZE=1`, `"a>b"@example.com`, " SIZE=1", true},
+		{"FROM:<user@[192.0.2.1]>", "user@[192.0.2.1]", "", true},
+		{"FROM:<@relay.example:user@example.com>", "@relay.example:user@example.com", "", true},
+
+		{"FROM:user@example.com", "", "", false},
+		{"FROM:<user@example.com", "", "", false},
+		{"FROM:<user@example.com>SIZE=1", "", "", false},
+		{"FROM:<user>", "", "", false},
+		{"FROM:<Postmaster>", "", "", false},
+		{"FROM:<user@example..com>", "", "", false},
+		{"TO:<user@example.com>", "", "", false},
+		{"FROM", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		path, params, err := ReversePath(tt.arg)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("ReversePath(%q) error = %v; want ok = %v", tt.arg, err, tt.ok)
+			continue
+		}
+		if path != tt.path || params != tt.params {
+			t.Errorf("ReversePath(%q) = %q, %q; want %q, %q", tt.arg, path, params, tt.path, tt.params)
+		}
+	}
+}
+
+func TestForwardPath(t *testing.T) {
+	tests := []struct {
+		arg          string
+		path, params string
+		ok           bool
+	}{
+		{"TO:<user@example.com>", "user@example.com", "", true},
+		{"to: <user@example.com> NOTIFY=NEVER", "user@example.com", " NOTIFY=NEVER", true},
+		{"TO:<Postmaster>", "Postmaster", "", true},
+		{"TO:<postmaster>", "postmaster", "", true},
+		{"TO:<@a.example,@b.example:user@example.com>", "@a.example,@b.example:user@example.com", "", true},
+
+		{"TO:<>", "", "", false},
+		{"TO:<user>", "", "", false},
+		{"TO:<user@>", "", "", false},
+		{"TO:<us er@example.com>", "", "", false},
+		{"FROM:<user@example.com>", "", "", false},
+	}
+	for _, tt := range tests {
+		path, params, err := ForwardPath(tt.arg)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("ForwardPath(%q) error = %v; want ok = %v", tt.arg, err, tt.ok)
+			continue
+		}
+		if path != tt.path || params != tt.params {
+			t.Errorf("ForwardPath(%q) = %q, %q; want %q, %q", tt.arg, path, params, tt.path, tt.params)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+		ok   bool
+	}{
+		{"", map[string]string{}, true},
+		{" SIZE=1000 body=8BITMIME SMTPUTF8", map[string]string{"SIZE": "1000", "BODY": "8BITMIME", "SMTPUTF8": ""}, true},
+		{"ORCPT=rfc822;user+2Bx@example.com", map[string]string{"ORCPT": "rfc822;user+2Bx@example.com"}, true},
+		{"X-TAG=ünïcode", map[string]string{"X-TAG": "ünïcode"}, true},
+
+		{"=1000", nil, false},
+		{"-SIZE=1", nil, false},
+		{"SI_ZE=1", nil, false},
+		{"SIZE=1=2", nil, false},
+		{"SIZE=a\x7fb", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := Params(tt.in)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("Params(%q) error = %v; want ok = %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Params(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHasParam(t *testing.T) {
+	if !HasParam(" SIZE=10 prdr", "PRDR") {
+		t.Error("HasParam missed a lower-case keyword without a value")
+	}
+	if HasParam(" SIZE=PRDR", "PRDR") {
+		t.Error("HasParam matched a value")
+	}
+}
+
+func TestAddressLiteral(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // formatted, or "" if invalid
+	}{
+		{"[192.0.2.1]", "[192.0.2.1]"},
+		{"[IPv6:2001:db8::1]", "[IPv6:2001:db8::1]"},
+		{"[ipv6:2001:DB8:0:0:0:0:0:1]", "[IPv6:2001:db8::1]"},
+		{"[IPv6:::ffff:192.0.2.1]", "[192.0.2.1]"},
+		{"192.0.2.1", ""},
+		{"[192.0.2]", ""},
+		{"[2001:db8::1]", ""},
+		{"[IPv6:192.0.2.1]", ""},
+		{"[]", ""},
+		{"[", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := AddressLiteral(tt.in)
+		got := ""
+		if ok {
+			got = FormatAddressLiteral(ip)
+		}
+		if got != tt.want {
+			t.Errorf("AddressLiteral(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := FormatAddressLiteral(net.ParseIP("2001:db8::2")); got != "[IPv6:2001:db8::2]" {
+		t.Errorf("FormatAddressLiteral = %q", got)
+	}
+}
+
+func TestXText(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"abc", "abc", true},
+		{"user+2Bx@example.com", "user+x@example.com", true},
+		{"a+20b+3Dc", "a b=c", true},
+		{"", "", true},
+		{"a+2b", "", false},
+		{"a+2", "", false},
+		{"a+", "", false},
+		{"a=b", "", false},
+		{"a b", "", false},
+	}
+	for _, tt := range tests {
+		got, err := XText(tt.in)
+		if ok := err == nil; ok != tt.ok || got != tt.want {
+			t.Errorf("XText(%q) = %q, %v; want %q, ok = %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
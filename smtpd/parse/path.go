@@ -0,0 +1,163 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parse
+
+import "strings"
+
+// pathEnd returns the index of the '>' closing the path that s begins
+// with, skipping quoted strings, or -1.
+func pathEnd(s string) int {
+	if !strings.HasPrefix(s, "<") {
+		return -1
+	}
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '>':
+			return i
+		}
+	}
+	return -1
+}
+
+// checkPath checks the contents of a path (RFC 5321 s4.1.2): a mailbox,
+// optionally preceded by a source route such as "@a.example,@b.example:".
+func checkPath(path string) error {
+	if strings.HasPrefix(path, "@") {
+		route, mailbox, ok := strings.Cut(path, ":")
+		if !ok {
+			return ErrPathSyntax
+		}
+		for _, hop := range strings.Split(route, ",") {
+			if !strings.HasPrefix(hop, "@") || !validDomain(hop[1:]) {
+				return ErrPathSyntax
+			}
+		}
+		path = mailbox
+	}
+	_, _, err := Mailbox(path)
+	return err
+}
+
+// Mailbox parses an RFC 5321 mailbox, such as "user@example.com",
+// "\"john smith\"@example.com" or "user@[192.0.2.1]", into its local
+// part, quoted as sent, and its domain or address literal. UTF-8 is
+// allowed in both, as RFC 6531 does.
+func Mailbox(s string) (local, domain string, err error) {
+	var at int
+	if strings.HasPrefix(s, `"`) {
+		end := quotedEnd(s)
+		if end == -1 || end+1 >= len(s) || s[end+1] != '@' {
+			return "", "", ErrPathSyntax
+		}
+		at = end + 1
+	} else {
+		at = strings.IndexByte(s, '@')
+		if at == -1 || !validDotString(s[:at]) {
+			return "", "", ErrPathSyntax
+		}
+	}
+	local, domain = s[:at], s[at+1:]
+	if strings.HasPrefix(domain, "[") {
+		if !validAddressLiteral(domain) {
+			return "", "", ErrPathSyntax
+		}
+	} else if !validDomain(domain) {
+		return "", "", ErrPathSyntax
+	}
+	return local, domain, nil
+}
+
+// quotedEnd returns the index of the '"' closing the quoted string s
+// begins with, or -1 if it isn't a valid Quoted-string.
+func quotedEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return i
+		case c == '\\':
+			// quoted-pairSMTP
+			if i+1 == len(s) || s[i+1] < 32 || s[i+1] > 126 {
+				return -1
+			}
+			i++
+		case c < 32 || c == 127:
+			return -1
+		}
+	}
+	return -1
+}
+
+// validDotString reports whether s is a Dot-string: atoms separated
+// by single dots.
+func validDotString(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			if !isAtext(atom[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isAtext reports whether c may appear in an atom (RFC 5322 s3.2.3),
+// counting the bytes of UTF-8 sequences.
+func isAtext(c byte) bool {
+	return isLetDig(c) || c >= 0x80 || strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) != -1
+}
+
+func isLetDig(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// validDomain reports whether s is a Domain: labels of letters, digits
+// and inner hyphens, or UTF-8 U-labels, separated by single dots.
+func validDomain(s string) bool {
+	if s == "" || len(s) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			if c := label[i]; !isLetDig(c) && c != '-' && c < 0x80 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validAddressLiteral reports whether s is an address literal: an IP
+// address as accepted by AddressLiteral, or a General-address-literal
+// such as "[tag:content]".
+func validAddressLiteral(s string) bool {
+	if _, ok := AddressLiteral(s); ok {
+		return true
+	}
+	if len(s) < 2 || s[0] != '[' || s[len(s)-1] != ']' {
+		return false
+	}
+	tag, content, ok := strings.Cut(s[1:len(s)-1], ":")
+	if !ok || content == "" || !validDomain(tag) || strings.EqualFold(tag, "IPv6") {
+		return false
+	}
+	for i := 0; i < len(content); i++ {
+		// dcontent
+		if c := content[i]; c < 33 || c > 126 || c == '[' || c == '\\' || c == ']' {
+			return false
+		}
+	}
+	return true
+}
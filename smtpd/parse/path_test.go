@@ -0,0 +1,110 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parse
+
+import "testing"
+
+func TestMailbox(t *testing.T) {
+	tests := []struct {
+		in            string
+		local, domain string
+		ok            bool
+	}{
+		{"user@example.com", "user", "example.com", true},
+		{"first.last@sub.example.com", "first.last", "sub.example.com", true},
+		{"user+tag@example.com", "user+tag", "example.com", true},
+		{"!#$%&'*+-/=?^_`{|}~@example.com", "!#$%&'*+-/=?^_`{|}~", "example.com", true},
+		{`"john smith"@example.com`, `"john smith"`, "example.com", true},
+		{`"a\"b"@example.com`, `"a\"b"`, "example.com", true},
+		{`"a@b"@example.com`, `"a@b"`, "example.com", true},
+		{`""@example.com`, `""`, "example.com", true},
+		{"user@[192.0.2.1]", "user", "[192.0.2.1]", true},
+		{"user@[IPv6:2001:db8::1]", "user", "[IPv6:2001:db8::1]", true},
+		{"user@[x-tag:content]", "user", "[x-tag:content]", true},
+		{"用户@例子.广告", "用户", "例子.广告", true},
+		{"user@localhost", "user", "localhost", true},
+		{"user@a-b.example", "user", "a-b.example", true},
+
+		{"", "", "", false},
+		{"user", "", "", false},
+		{"@example.com", "", "", false},
+		{"user@", "", "", false},
+		{".user@example.com", "", "", false},
+		{"user.@example.com", "", "", false},
+		{"us..er@example.com", "", "", false},
+		{"us er@example.com", "", "", false},
+		{"us(er@example.com", "", "", false},
+		{"user@@example.com", "", "", false},
+		{`"unterminated@example.com`, "", "", false},
+		{`"a"b@example.com`, "", "", false},
+		{"\"a\x01\"@example.com", "", "", false},
+		{"user@-example.com", "", "", false},
+		{"user@example-.com", "", "", false},
+		{"user@example..com", "", "", false},
+		{"user@exa_mple.com", "", "", false},
+		{"user@[192.0.2.256]", "", "", false},
+		{"user@[IPv6:192.0.2.1]", "", "", false},
+		{"user@[IPv6:2001:db8::zz]", "", "", false},
+		{"user@[tag:]", "", "", false},
+		{"user@[tag:a]b]", "", "", false},
+		{"user@192.0.2.1]", "", "", false},
+	}
+	for _, tt := range tests {
+		local, domain, err := Mailbox(tt.in)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("Mailbox(%q) error = %v; want ok = %v", tt.in, err, tt.ok)
+			continue
+		}
+		if local != tt.local || domain != tt.domain {
+			t.Errorf("Mailbox(%q) = %q, %q; want %q, %q", tt.in, local, domain, tt.local, tt.domain)
+		}
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"user@example.com", true},
+		{"@relay.example:user@example.com", true},
+		{"@a.example,@b.example:user@example.com", true},
+		{"@relay.example:\"john smith\"@example.com", true},
+
+		{"@relay.example", false},
+		{"@relay.example:", false},
+		{"@:user@example.com", false},
+		{"@a.example,b.example:user@example.com", false},
+		{"@a.example,,@b.example:user@example.com", false},
+		{"@-bad.example:user@example.com", false},
+		{"relay.example:user@example.com", false},
+	}
+	for _, tt := range tests {
+		if err := checkPath(tt.in); (err == nil) != tt.ok {
+			t.Errorf("checkPath(%q) = %v; want ok = %v", tt.in, err, tt.ok)
+		}
+	}
+}
+
+func TestPathEnd(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"<user@example.com>", 17},
+		{"<user@example.com> SIZE=10", 17},
+		{"<>", 1},
+		{`<"a>b"@example.com>`, 18},
+		{`<"a\">"@example.com>`, 19},
+		{"user@example.com>", -1},
+		{"<user@example.com", -1},
+		{`<"a>b@example.com`, -1},
+	}
+	for _, tt := range tests {
+		if got := pathEnd(tt.in); got != tt.want {
+			t.Errorf("pathEnd(%q) = %d; want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pipe provides an smtpd.Envelope that delivers messages by
+// piping them to an external command, in the style of procmail or
+// maildrop.
+package pipe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// Envelope pipes a message to the standard input of a command.
+//
+// The command runs once per message, with SENDER set to the envelope
+// sender and RECIPIENT set to the space-separated envelope recipients
+// in its environment. Lines are passed with \n line endings. The
+// command's exit status is mapped to an SMTP reply following the
+// sysexits.h conventions used by other MTAs.
+type Envelope struct {
+	// Path and Args are as in exec.Cmd.
+	Path string
+	Args []string
+
+	// Env, if non-nil, is the base environment for the command.
+	// If nil, the current process's environment is used.
+	Env []string
+
+	// Dir is the command's working directory.
+	Dir string
+
+	// Conn, if non-nil, is the connection the message arrives on.
+	// Delivery failures are logged through its Server's logging
+	// hooks rather than the standard logger.
+	Conn smtpd.Connection
+
+	from   smtpd.MailAddress
+	rcpts  []smtpd.MailAddress
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	werr   error
+	cr     bool // a '\r' ending the last Write, held back
+}
+
+// New returns an Envelope for a message from from that's delivered
+// by running the named program with the given arguments.
+func New(from smtpd.MailAddress, name string, arg ...string) *Envelope {
+	return &Envelope{
+		Path: name,
+		Args: append([]string{name}, arg...),
+		from: from,
+	}
+}
+
+func (e *Envelope) AddRecipient(rcpt smtpd.MailAddress) error {
+	e.rcpts = append(e.rcpts, rcpt)
+	return nil
+}
+
+func (e *Envelope) BeginData() error {
+	if len(e.rcpts) == 0 {
+		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	env := e.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	rcpts := make([]string, len(e.rcpts))
+	for i, r := range e.rcpts {
+		rcpts[i] = r.Email()
+	}
+	from := ""
+	if e.from != nil {
+		from = e.from.Email()
+	}
+	e.cmd = &exec.Cmd{
+		Path:   e.Path,
+		Args:   e.Args,
+		Dir:    e.Dir,
+		Stderr: &e.stderr,
+		Env: append(env[:len(env):len(env)],
+			"SENDER="+from,
+			"RECIPIENT="+strings.Join(rcpts, " ")),
+	}
+	if lp, err := exec.LookPath(e.Path); err == nil {
+		e.cmd.Path = lp
+	}
+	stdin, err := e.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := e.cmd.Start(); err != nil {
+		e.logf("starting %s: %v", e.Path, err)
+		return smtpd.SMTPError("451 4.3.0 Error: local delivery unavailable")
+	}
+	e.stdin = stdin
+	return nil
+}
+
+// logf logs an error delivering the message.
+func (e *Envelope) logf(format string, args ...interface{}) {
+	if e.Conn != nil {
+		e.Conn.Logf(smtpd.LogDelivery, smtpd.LogError, "pipe: "+format, args...)
+		return
+	}
+	log.Printf("pipe: "+format, args...)
+}
+
+// Write passes p to the command with each CRLF turned into LF. p
+// needn't be a whole line: a CR ending it is held back until the
+// next Write shows whether an LF follows.
+func (e *Envelope) Write(p []byte) error {
+	if e.werr != nil {
+		// The command stopped reading; its exit status decides
+		// the reply once the message ends.
+		return nil
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, len(p)+1)
+	if e.cr && p[0] != '\n' {
+		buf = append(buf, '\r')
+	}
+	e.cr = false
+	for i, b := range p {
+		if b == '\r' {
+			if i == len(p)-1 {
+				e.cr = true
+				continue
+			}
+			if p[i+1] == '\n' {
+				continue
+			}
+		}
+		buf = append(buf, b)
+	}
+	_, e.werr = e.stdin.Write(buf)
+	return nil
+}
+
+func (e *Envelope) Close() error {
+	if e.cmd == nil {
+		return nil
+	}
+	if e.cr && e.werr == nil {
+		e.stdin.Write([]byte{'\r'})
+	}
+	e.stdin.Close()
+	err := e.cmd.Wait()
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(e.stderr.String()); msg != "" {
+		e.logf("%s: %v: %s", e.Path, err, msg)
+	} else {
+		e.logf("%s: %v", e.Path, err)
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) || !ee.Exited() {
+		return smtpd.SMTPError("451 4.3.0 Error: local delivery failed")
+	}
+	return ExitStatusError(ee.ExitCode())
+}
+
+// sysexits maps sysexits.h exit codes to SMTP replies.
+var sysexits = map[int]smtpd.SMTPError{
+	64: "554 5.3.0 Error: command line usage error",  // EX_USAGE
+	65: "554 5.6.0 Error: data format error",         // EX_DATAERR
+	66: "554 5.3.0 Error: cannot open input",         // EX_NOINPUT
+	67: "550 5.1.1 Error: user unknown",              // EX_NOUSER
+	68: "550 5.1.2 Error: host name unknown",         // EX_NOHOST
+	69: "554 5.3.0 Error: service unavailable",       // EX_UNAVAILABLE
+	70: "554 5.3.0 Error: internal software error",   // EX_SOFTWARE
+	71: "451 4.3.0 Error: system resource problem",   // EX_OSERR
+	72: "554 5.3.0 Error: critical OS file missing",  // EX_OSFILE
+	73: "554 5.2.0 Error: can't create output file",  // EX_CANTCREAT
+	74: "554 5.3.0 Error: input/output error",        // EX_IOERR
+	75: "451 4.3.0 Error: temporary failure",         // EX_TEMPFAIL
+	76: "554 5.5.0 Error: remote error in protocol",  // EX_PROTOCOL
+	77: "550 5.7.0 Error: permission denied",         // EX_NOPERM
+	78: "451 4.3.5 Error: local configuration error", // EX_CONFIG
+}
+
+// ExitStatusError returns the SMTP reply for a delivery command that
+// exited with the given non-zero status. Statuses without a
+// sysexits.h meaning are treated as temporary failures.
+func ExitStatusError(status int) smtpd.SMTPError {
+	if se, ok := sysexits[status]; ok {
+		return se
+	}
+	return smtpd.SMTPError(fmt.Sprintf("451 4.3.0 Error: delivery command exited with status %d", status))
+}
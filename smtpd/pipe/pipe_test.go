@@ -0,0 +1,125 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pipe
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// addr is a MailAddress for tests.
+type addr string
+
+func (a addr) Email() string       { return string(a) }
+func (a addr) Raw() string         { return string(a) }
+func (a addr) Hostname() string    { return string(a)[strings.LastIndex(string(a), "@")+1:] }
+func (a addr) Tag() string         { return "" }
+func (a addr) BaseAddress() string { return string(a) }
+
+// logConn is a Connection recording what's logged through it.
+type logConn struct {
+	smtpd.Connection
+	logged []string
+}
+
+func (c *logConn) Logf(_ smtpd.LogCategory, _ smtpd.LogLevel, format string, args ...interface{}) {
+	c.logged = append(c.logged, fmt.Sprintf(format, args...))
+}
+
+func shell(t *testing.T, script string) *Envelope {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	return New(addr("sender@example.org"), "sh", "-c", script)
+}
+
+func TestDeliver(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	e := shell(t, `{ echo "$SENDER $RECIPIENT"; cat; } > "$OUT"`)
+	e.Env = []string{"OUT=" + out}
+	e.AddRecipient(addr("a@example.com"))
+	e.AddRecipient(addr("b@example.com"))
+	if err := e.BeginData(); err != nil {
+		t.Fatal(err)
+	}
+	// Lines split across Writes, including between CR and LF.
+	for _, chunk := range []string{"Subject: hi\r", "\n\r\nbo", "dy\r\n", "bare\rCR\r", "", "\n", "end\r"} {
+		if err := e.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "sender@example.org a@example.com b@example.com\nSubject: hi\n\nbody\nbare\rCR\nend\r"
+	if string(got) != want {
+		t.Errorf("command read %q; want %q", got, want)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"cat >/dev/null; exit 67", "550 5.1.1"},
+		{"cat >/dev/null; exit 75", "451 4.3.0"},
+		{"cat >/dev/null; exit 3", "451 4.3.0"},
+		{"exec 0<&-; echo oops >&2; exit 65", "554 5.6.0"},
+		{"kill -9 $$", "451 4.3.0 Error: local delivery failed"},
+	}
+	for _, tt := range tests {
+		e := shell(t, tt.script)
+		c := &logConn{}
+		e.Conn = c
+		e.AddRecipient(addr("a@example.com"))
+		if err := e.BeginData(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			e.Write([]byte("line of the message\r\n"))
+		}
+		err := e.Close()
+		se, ok := err.(smtpd.SMTPError)
+		if !ok || !strings.HasPrefix(string(se), tt.want) {
+			t.Errorf("%q: Close = %v; want %s", tt.script, err, tt.want)
+		}
+		if len(c.logged) != 1 {
+			t.Errorf("%q: logged %q; want the failure", tt.script, c.logged)
+		}
+	}
+}
+
+func TestNoRecipients(t *testing.T) {
+	e := New(addr("sender@example.org"), "/nonexistent")
+	if err := e.BeginData(); err == nil || !strings.HasPrefix(err.Error(), "554") {
+		t.Errorf("BeginData = %v; want 554", err)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	e := New(addr("sender@example.org"), "/nonexistent/command")
+	c := &logConn{}
+	e.Conn = c
+	e.AddRecipient(addr("a@example.com"))
+	err := e.BeginData()
+	if err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("BeginData = %v; want 451", err)
+	}
+	if len(c.logged) != 1 || !strings.Contains(c.logged[0], "/nonexistent/command") {
+		t.Errorf("logged %q", c.logged)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import "time"
+
+// pregreet waits for Server.GreetDelay before the banner and reports
+// whether the client sent anything in the meantime, as bots that
+// don't wait for the greeting do. What it sent is kept for the
+// session to read.
+func (s *session) pregreet() (early bool) {
+	d := s.srv.GreetDelay
+	if d <= 0 {
+		return false
+	}
+	conn := s.cr.conn
+	conn.SetReadDeadline(time.Now().Add(d))
+	defer conn.SetReadDeadline(time.Time{})
+	var buf [512]byte
+	n, _ := conn.Read(buf[:])
+	s.cr.pending = append(s.cr.pending, buf[:n]...)
+	if n > 0 {
+		s.logf(LogConn, LogInfo, "sent %q before the greeting", buf[:n])
+	}
+	return n > 0
+}
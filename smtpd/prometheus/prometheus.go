@@ -0,0 +1,64 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package prometheus exports an smtpd.CounterMetrics in the
+// Prometheus text exposition format, for scraping, without depending
+// on the Prometheus client library.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// Handler returns an HTTP handler serving m's counts, to be mounted
+// at a path such as /metrics.
+func Handler(m *smtpd.CounterMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w, m)
+	})
+}
+
+// Write writes m's counts to w in the text exposition format.
+func Write(w io.Writer, m *smtpd.CounterMetrics) error {
+	bw := bufio.NewWriter(w)
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	metric("smtpd_connections_opened_total", "counter", "Connections accepted.")
+	fmt.Fprintf(bw, "smtpd_connections_opened_total %d\n", m.ConnsOpened.Load())
+	metric("smtpd_connections_closed_total", "counter", "Connections closed.")
+	fmt.Fprintf(bw, "smtpd_connections_closed_total %d\n", m.ConnsClosed.Load())
+	metric("smtpd_tls_handshakes_total", "counter", "Completed TLS handshakes.")
+	fmt.Fprintf(bw, "smtpd_tls_handshakes_total{resumed=\"false\"} %d\n", m.TLSHandshakes.Load()-m.TLSResumed.Load())
+	fmt.Fprintf(bw, "smtpd_tls_handshakes_total{resumed=\"true\"} %d\n", m.TLSResumed.Load())
+	metric("smtpd_auth_total", "counter", "Authentication attempts.")
+	fmt.Fprintf(bw, "smtpd_auth_total{result=\"success\"} %d\n", m.AuthSuccesses.Load())
+	fmt.Fprintf(bw, "smtpd_auth_total{result=\"failure\"} %d\n", m.AuthFailures.Load())
+	metric("smtpd_messages_total", "counter", "Messages received.")
+	fmt.Fprintf(bw, "smtpd_messages_total{result=\"accepted\"} %d\n", m.MessagesAccepted.Load())
+	fmt.Fprintf(bw, "smtpd_messages_total{result=\"rejected\"} %d\n", m.MessagesRejected.Load())
+	metric("smtpd_received_bytes_total", "counter", "Bytes read from clients, counted as sessions end.")
+	fmt.Fprintf(bw, "smtpd_received_bytes_total %d\n", m.BytesIn.Load())
+	metric("smtpd_sent_bytes_total", "counter", "Bytes written to clients, counted as sessions end.")
+	fmt.Fprintf(bw, "smtpd_sent_bytes_total %d\n", m.BytesOut.Load())
+
+	cmds := m.Commands()
+	verbs := make([]string, 0, len(cmds))
+	for verb := range cmds {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	metric("smtpd_commands_total", "counter", "Commands received, by verb.")
+	for _, verb := range verbs {
+		fmt.Fprintf(bw, "smtpd_commands_total{verb=%q} %d\n", verb, cmds[verb])
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,258 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package proxy relays mail transactions from an smtpd.Server to an
+// upstream SMTP server as they happen, so the server can sit in front
+// of an existing MTA for filtering, logging or migration.
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// Proxy relays each mail transaction to an upstream server. MAIL,
+// RCPT, DATA and the end of the message are sent upstream as the
+// client sends them, and the upstream server's rejections are passed
+// back to the client verbatim. Use its OnNewMail method as the
+// Server's OnNewMail hook.
+type Proxy struct {
+	Addr      string        // upstream host:port
+	LocalName string        // name sent with EHLO; "localhost" if empty
+	Timeout   time.Duration // optional dial and per-command timeout
+
+	// TLSConfig, if non-nil, is used to STARTTLS with the upstream
+	// server when it offers it. If RequireTLS is set, upstream
+	// servers that don't are refused.
+	TLSConfig  *tls.Config
+	RequireTLS bool
+
+	// RewriteSender and RewriteRecipient, if non-nil, may change
+	// the addresses sent upstream.
+	RewriteSender    func(c smtpd.Connection, from string) string
+	RewriteRecipient func(c smtpd.Connection, rcpt string) string
+}
+
+type upstream struct {
+	nc      net.Conn
+	tc      *textproto.Conn
+	timeout time.Duration
+}
+
+func (p *Proxy) dial() (*upstream, error) {
+	nc, err := net.DialTimeout("tcp", p.Addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	u := &upstream{nc: nc, tc: textproto.NewConn(nc), timeout: p.Timeout}
+	u.deadline()
+	if _, _, err := u.tc.ReadResponse(220); err != nil {
+		u.close()
+		return nil, err
+	}
+	ext, err := u.ehlo(p.localName())
+	if err != nil {
+		u.close()
+		return nil, err
+	}
+	if _, ok := ext["STARTTLS"]; ok && p.TLSConfig != nil {
+		if _, err := u.cmd(220, "STARTTLS"); err != nil {
+			u.close()
+			return nil, err
+		}
+		tc := tls.Client(nc, p.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		u.nc, u.tc = tc, textproto.NewConn(tc)
+		if _, err := u.ehlo(p.localName()); err != nil {
+			u.close()
+			return nil, err
+		}
+	} else if p.RequireTLS {
+		u.close()
+		return nil, errors.New("proxy: upstream server doesn't support STARTTLS")
+	}
+	return u, nil
+}
+
+func (p *Proxy) localName() string {
+	if p.LocalName == "" {
+		return "localhost"
+	}
+	return p.LocalName
+}
+
+func (u *upstream) deadline() {
+	if u.timeout != 0 {
+		u.nc.SetDeadline(time.Now().Add(u.timeout))
+	}
+}
+
+// ehlo greets the upstream server and returns its extensions.
+func (u *upstream) ehlo(name string) (map[string]string, error) {
+	msg, err := u.cmd(250, "EHLO %s", name)
+	if err != nil {
+		return nil, err
+	}
+	ext := make(map[string]string)
+	for _, line := range strings.Split(msg, "\n")[1:] {
+		k, v, _ := strings.Cut(line, " ")
+		ext[strings.ToUpper(k)] = v
+	}
+	return ext, nil
+}
+
+func (u *upstream) cmd(expect int, format string, args ...interface{}) (string, error) {
+	u.deadline()
+	id, err := u.tc.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	u.tc.StartResponse(id)
+	defer u.tc.EndResponse(id)
+	_, msg, err := u.tc.ReadResponse(expect)
+	return msg, err
+}
+
+func (u *upstream) close() {
+	u.deadline()
+	if id, err := u.tc.Cmd("QUIT"); err == nil {
+		u.tc.StartResponse(id)
+		u.tc.ReadResponse(221)
+		u.tc.EndResponse(id)
+	}
+	u.tc.Close()
+}
+
+// OnNewMail opens a connection to the upstream server and starts a
+// mail transaction from from. It's suitable as Server.OnNewMail.
+func (p *Proxy) OnNewMail(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+	u, err := p.dial()
+	if err != nil {
+		return nil, replyError(err)
+	}
+	addr := from.Email()
+	if p.RewriteSender != nil {
+		addr = p.RewriteSender(c, addr)
+	}
+	if _, err := u.cmd(250, "MAIL FROM:<%s>", addr); err != nil {
+		u.close()
+		return nil, replyError(err)
+	}
+	return &envelope{p: p, c: c, u: u}, nil
+}
+
+// envelope relays one transaction. The upstream connection is closed
+// when the message ends; set Proxy.Timeout so the connections of
+// abandoned transactions are reclaimed.
+type envelope struct {
+	p *Proxy
+	c smtpd.Connection
+	u *upstream
+	n int // recipients accepted upstream
+	w io.WriteCloser
+}
+
+var errAborted = smtpd.SMTPError("451 4.4.1 Error: upstream connection lost")
+
+func (e *envelope) AddRecipient(rcpt smtpd.MailAddress) error {
+	if e.u == nil {
+		return errAborted
+	}
+	addr := rcpt.Email()
+	if e.p.RewriteRecipient != nil {
+		addr = e.p.RewriteRecipient(e.c, addr)
+	}
+	if _, err := e.u.cmd(250, "RCPT TO:<%s>", addr); err != nil {
+		return e.fail(err)
+	}
+	e.n++
+	return nil
+}
+
+func (e *envelope) BeginData() error {
+	if e.u == nil {
+		return errAborted
+	}
+	if e.n == 0 {
+		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	if _, err := e.u.cmd(354, "DATA"); err != nil {
+		return e.fail(err)
+	}
+	e.w = e.u.tc.DotWriter()
+	return nil
+}
+
+func (e *envelope) Write(line []byte) error {
+	if e.u == nil {
+		return errAborted
+	}
+	e.u.deadline()
+	if _, err := e.w.Write(line); err != nil {
+		return e.fail(err)
+	}
+	return nil
+}
+
+func (e *envelope) Close() error {
+	if e.u == nil {
+		return errAborted
+	}
+	defer e.abort()
+	e.u.deadline()
+	if err := e.w.Close(); err != nil {
+		return replyError(err)
+	}
+	if _, _, err := e.u.tc.ReadResponse(250); err != nil {
+		return replyError(err)
+	}
+	return nil
+}
+
+// fail converts err for the client, dropping the upstream connection
+// if err wasn't just a rejection.
+func (e *envelope) fail(err error) error {
+	if _, ok := err.(*textproto.Error); !ok {
+		e.abort()
+	}
+	return replyError(err)
+}
+
+func (e *envelope) abort() {
+	if e.u != nil {
+		e.u.close()
+		e.u = nil
+	}
+}
+
+// replyError converts an error talking to the upstream server into
+// the reply for the client, passing upstream replies through.
+func replyError(err error) error {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		lines := strings.Split(te.Msg, "\n")
+		for i := range lines {
+			sep := "-"
+			if i == len(lines)-1 {
+				sep = " "
+			}
+			lines[i] = fmt.Sprintf("%03d%s%s", te.Code, sep, lines[i])
+		}
+		return smtpd.SMTPError(strings.Join(lines, "\r\n"))
+	}
+	log.Printf("proxy: %v", err)
+	return smtpd.SMTPError("451 4.4.1 Error: upstream server unavailable")
+}
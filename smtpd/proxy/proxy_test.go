@@ -0,0 +1,183 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// upstreamServer is the server being proxied to. It refuses senders and
+// recipients in refuse with their replies, and keeps the messages
+// it accepts.
+type upstreamServer struct {
+	refuse map[string]smtpd.SMTPError
+
+	mu   sync.Mutex
+	msgs []string
+	envs []string // "from -> rcpts" of each message
+}
+
+type collector struct {
+	s     *upstreamServer
+	from  string
+	rcpts []string
+	msg   strings.Builder
+}
+
+func (e *collector) AddRecipient(rcpt smtpd.MailAddress) error {
+	if err, ok := e.s.refuse[rcpt.Email()]; ok {
+		return err
+	}
+	e.rcpts = append(e.rcpts, rcpt.Email())
+	return nil
+}
+
+func (e *collector) BeginData() error        { return nil }
+func (e *collector) Write(line []byte) error { e.msg.Write(line); return nil }
+
+func (e *collector) Close() error {
+	e.s.mu.Lock()
+	defer e.s.mu.Unlock()
+	e.s.msgs = append(e.s.msgs, e.msg.String())
+	e.s.envs = append(e.s.envs, e.from+" -> "+strings.Join(e.rcpts, ","))
+	return nil
+}
+
+// serve runs srv on a new listener, returning its address.
+func serve(t *testing.T, srv *smtpd.Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv.Hostname = "mx.example.com"
+	srv.Log = func(string, ...interface{}) {} // sessions may outlive the test
+	go srv.Serve(ln)
+	return ln.Addr().String()
+}
+
+// newProxy starts an upstream server and a server proxying to it.
+func newProxy(t *testing.T, p *Proxy) (front string, up *upstreamServer) {
+	t.Helper()
+	up = &upstreamServer{refuse: map[string]smtpd.SMTPError{
+		"spammer@example.org": "553 5.7.1 Sender refused",
+		"nobody@example.com":  "550 5.1.1 User unknown",
+	}}
+	if p.Addr == "" {
+		p.Addr = serve(t, &smtpd.Server{
+			OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+				if err, ok := up.refuse[from.Email()]; ok {
+					return nil, err
+				}
+				return &collector{s: up, from: from.Email()}, nil
+			},
+		})
+	}
+	p.Timeout = 5 * time.Second
+	return serve(t, &smtpd.Server{OnNewMail: p.OnNewMail}), up
+}
+
+func dial(t *testing.T, addr string) *smtp.Client {
+	t.Helper()
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// code returns the reply code of err, an SMTP rejection, or 0.
+func code(err error) int {
+	if te, ok := err.(*textproto.Error); ok {
+		return te.Code
+	}
+	return 0
+}
+
+const testMessage = "Subject: hi\r\n\r\n.leading dot\r\nbody\r\n"
+
+func TestProxy(t *testing.T) {
+	front, up := newProxy(t, &Proxy{
+		RewriteRecipient: func(c smtpd.Connection, rcpt string) string {
+			return strings.Replace(rcpt, "@old.example", "@example.com", 1)
+		},
+	})
+	c := dial(t, front)
+	if err := c.Mail("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("jane@old.example"); err != nil {
+		t.Fatal(err)
+	}
+	err := c.Rcpt("nobody@example.com")
+	if te, ok := err.(*textproto.Error); !ok || te.Code != 550 || te.Msg != "5.1.1 User unknown" {
+		t.Errorf("refused recipient: %v; want the upstream reply", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(testMessage))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client's sender is refused as upstream refuses it.
+	if err := c.Mail("spammer@example.org"); code(err) != 553 {
+		t.Errorf("refused sender: %v; want 553", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if len(up.msgs) != 1 || up.msgs[0] != testMessage {
+		t.Errorf("upstream got %q; want %q", up.msgs, testMessage)
+	}
+	if len(up.envs) != 1 || up.envs[0] != "sender@example.org -> jane@example.com" {
+		t.Errorf("upstream envelopes %q", up.envs)
+	}
+}
+
+func TestUpstreamUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	front, _ := newProxy(t, &Proxy{Addr: down})
+	c := dial(t, front)
+	err = c.Mail("sender@example.org")
+	if te, ok := err.(*textproto.Error); !ok || te.Code != 451 || !strings.HasPrefix(te.Msg, "4.4.1") {
+		t.Errorf("MAIL = %v; want 451 4.4.1", err)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	front, _ := newProxy(t, &Proxy{RequireTLS: true})
+	c := dial(t, front)
+	if err := c.Mail("sender@example.org"); code(err) != 451 {
+		t.Errorf("MAIL with an upstream lacking STARTTLS = %v; want 451", err)
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	err := replyError(&textproto.Error{Code: 550, Msg: "5.7.1 Refused\nSee https://example.com/"})
+	if want := smtpd.SMTPError("550-5.7.1 Refused\r\n550 See https://example.com/"); err != want {
+		t.Errorf("multi-line reply = %q; want %q", err, want)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultProxyHeaderTimeout is how long a proxy has to send the PROXY
+// protocol header if ReadTimeout isn't set.
+const defaultProxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Sig begins a PROXY protocol version 2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("smtpd: bad PROXY protocol header")
+
+// readProxyHeader reads the PROXY protocol header, version 1 or 2,
+// that a proxy sends ahead of the client's connection, and takes the
+// client's address from it. It reads no further than the header, so
+// that TLS can start on the raw connection after it.
+func (s *session) readProxyHeader() error {
+	d := s.srv.ReadTimeout
+	if d == 0 {
+		d = defaultProxyHeaderTimeout
+	}
+	s.rwc.SetReadDeadline(time.Now().Add(d))
+	defer s.rwc.SetReadDeadline(time.Time{})
+
+	// Both versions' headers are at least this long.
+	hdr := make([]byte, len(proxyV2Sig))
+	if _, err := io.ReadFull(s.rwc, hdr); err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(hdr, proxyV2Sig):
+		return s.readProxyV2()
+	case bytes.HasPrefix(hdr, []byte("PROXY ")):
+		return s.readProxyV1(hdr)
+	}
+	return errProxyHeader
+}
+
+// readProxyV1 reads the rest of a version 1 header, a line such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n".
+func (s *session) readProxyV1(line []byte) error {
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return errProxyHeader
+		}
+		if _, err := io.ReadFull(s.rwc, b[:]); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return errProxyHeader
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil {
+		return errProxyHeader
+	}
+	s.remote = &net.TCPAddr{IP: ip, Port: int(port)}
+	return nil
+}
+
+// readProxyV2 reads the rest of a version 2 header, after its
+// signature.
+func (s *session) readProxyV2() error {
+	var h [4]byte // version and command, family, length
+	if _, err := io.ReadFull(s.rwc, h[:]); err != nil {
+		return err
+	}
+	if h[0]>>4 != 2 {
+		return errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[2:]))
+	if _, err := io.ReadFull(s.rwc, body); err != nil {
+		return err
+	}
+	if h[0]&0xf == 0 {
+		// LOCAL: the proxy's own connection, such as a health check.
+		return nil
+	}
+	switch h[1] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return errProxyHeader
+		}
+		s.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return errProxyHeader
+		}
+		s.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+	}
+	// Other families keep the connection's address.
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The methods in this file manage the queue's messages. They may be
+// used from another process than the one running the queue, such as
+// a command-line tool, as messages being delivered are locked with
+// files in the spool directory.
+
+var (
+	ErrNotFound = errors.New("queue: no such message")
+	ErrBusy     = errors.New("queue: message is being delivered")
+)
+
+func (q *Queue) lockPath(id string) string { return filepath.Join(q.Dir, id+".lock") }
+
+// lock locks message id against delivery and changes by others,
+// returning ErrBusy if it's already locked.
+func (q *Queue) lock(id string) (unlock func(), err error) {
+	f, err := os.OpenFile(q.lockPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, ErrBusy
+		}
+		return nil, err
+	}
+	f.Close()
+	return func() { os.Remove(q.lockPath(id)) }, nil
+}
+
+// removeStaleLocks removes locks left by a process that exited
+// during a delivery.
+func (q *Queue) removeStaleLocks() {
+	names, _ := filepath.Glob(filepath.Join(q.Dir, "*.lock"))
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
+
+// validID reports whether id could name a message, so that it's safe
+// to build paths from.
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
+
+// List returns the metadata of all queued messages, oldest first.
+func (q *Queue) List() ([]*Message, error) {
+	ms, err := q.messages()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Created.Before(ms[j].Created) })
+	return ms, nil
+}
+
+// DeadLetters returns the metadata of messages moved to the dead
+// letter directory after their delivery time expired, oldest first.
+func (q *Queue) DeadLetters() ([]*Message, error) {
+	ms, err := readMessages(q.deadDir())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Created.Before(ms[j].Created) })
+	return ms, nil
+}
+
+// Get returns the metadata of message id.
+func (q *Queue) Get(id string) (*Message, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	m, err := q.load(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return m, err
+}
+
+// Open returns the contents of message id.
+func (q *Queue) Open(id string) (io.ReadCloser, error) {
+	m, err := q.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return q.openBody(m)
+}
+
+// update applies fn to the metadata of message id and saves it.
+func (q *Queue) update(id string, fn func(*Message)) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	unlock, err := q.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	fn(m)
+	if err := q.save(m); err != nil {
+		return err
+	}
+	q.Kick()
+	return nil
+}
+
+// Retry schedules message id for immediate delivery. Held messages
+// stay held.
+func (q *Queue) Retry(id string) error {
+	now := q.now()
+	return q.update(id, func(m *Message) { m.NextAttempt = now })
+}
+
+// Flush schedules all messages that aren't held for immediate
+// delivery. Messages being delivered are skipped.
+func (q *Queue) Flush() error {
+	ms, err := q.messages()
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if m.Held {
+			continue
+		}
+		if err := q.Retry(m.ID); err != nil && err != ErrBusy && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hold stops message id from being delivered until it's released.
+func (q *Queue) Hold(id string) error {
+	return q.update(id, func(m *Message) { m.Held = true })
+}
+
+// Release undoes Hold, making message id due for delivery now.
+func (q *Queue) Release(id string) error {
+	now := q.now()
+	return q.update(id, func(m *Message) {
+		m.Held = false
+		m.NextAttempt = now
+	})
+}
+
+// Delete removes message id from the queue without delivering or
+// bouncing it.
+func (q *Queue) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	unlock, err := q.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := q.remove(id); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
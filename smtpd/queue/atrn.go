@@ -0,0 +1,125 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"io"
+	"log"
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// domain returns the lower-cased domain of addr.
+func domain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+}
+
+// onDemand reports whether mail for addr is spooled for ATRN.
+func (q *Queue) onDemand(addr string) bool {
+	return q.OnDemand != nil && q.OnDemand(domain(addr))
+}
+
+// Spooled returns the queued messages for recipients in the OnDemand
+// domains among domains, for a Server's OnATRN hook to return once it
+// has checked that the client may dequeue mail for them. Each message
+// is locked against delivery and changes by others until its Done is
+// called, so messages being delivered or changed are left out.
+//
+// When a message has been offered, each of its recipients in domains
+// is delivered if Done is passed a nil result for it; otherwise it
+// stays queued, or if the error is permanent, it's bounced.
+func (q *Queue) Spooled(domains []string) ([]smtpd.SpooledMessage, error) {
+	want := make(map[string]bool)
+	for _, d := range domains {
+		if d = strings.ToLower(d); q.OnDemand != nil && q.OnDemand(d) {
+			want[d] = true
+		}
+	}
+	if len(want) == 0 {
+		return nil, nil
+	}
+	ms, err := q.List()
+	if err != nil {
+		return nil, err
+	}
+	var spooled []smtpd.SpooledMessage
+	for _, m := range ms {
+		if m.Held || !q.hasPending(m, want) {
+			continue
+		}
+		unlock, err := q.lock(m.ID)
+		if err != nil {
+			if err != ErrBusy {
+				log.Printf("queue: locking %s: %v", m.ID, err)
+			}
+			continue
+		}
+		// Reload, as it may have changed since it was listed.
+		if m, err = q.load(m.ID); err != nil || m.Held || !q.hasPending(m, want) {
+			unlock()
+			continue
+		}
+		sm := &spooledMessage{q: q, m: m, unlock: unlock}
+		for _, r := range m.pending() {
+			if want[domain(r.Addr)] {
+				sm.rcpts = append(sm.rcpts, r)
+			}
+		}
+		spooled = append(spooled, sm)
+	}
+	return spooled, nil
+}
+
+// hasPending reports whether m has recipients awaiting delivery in
+// the domains.
+func (q *Queue) hasPending(m *Message, domains map[string]bool) bool {
+	for _, r := range m.pending() {
+		if domains[domain(r.Addr)] {
+			return true
+		}
+	}
+	return false
+}
+
+// spooledMessage is a queued message offered to an ATRN client.
+type spooledMessage struct {
+	q      *Queue
+	m      *Message
+	rcpts  []*Recipient // those being offered
+	unlock func()
+}
+
+func (sm *spooledMessage) From() string { return sm.m.From }
+
+func (sm *spooledMessage) Recipients() []string {
+	addrs := make([]string, len(sm.rcpts))
+	for i, r := range sm.rcpts {
+		addrs[i] = r.Addr
+	}
+	return addrs
+}
+
+func (sm *spooledMessage) Body() (io.ReadCloser, error) {
+	return sm.q.openBody(sm.m)
+}
+
+func (sm *spooledMessage) Done(rcptErrs []error, err error) {
+	q, m := sm.q, sm.m
+	defer sm.unlock()
+	failed := record(sm.rcpts, rcptErrs, err)
+	if len(failed) > 0 {
+		q.bounce(m, failed)
+	}
+	if len(m.pending()) == 0 {
+		if err := q.remove(m.ID); err != nil {
+			log.Printf("queue: removing %s: %v", m.ID, err)
+		}
+		return
+	}
+	if err := q.save(m); err != nil {
+		log.Printf("queue: saving %s: %v", m.ID, err)
+	}
+}
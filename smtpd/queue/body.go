@@ -0,0 +1,295 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// KeyProvider supplies the keys encrypting queued messages. Keys are
+// 32 bytes, for AES-256-GCM, and are identified by an ID stored with
+// each message, so keys can be rotated while old messages remain
+// readable.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new messages with.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider with a single 32-byte key, whose ID is
+// "static".
+type StaticKey []byte
+
+func (k StaticKey) CurrentKey() (string, []byte, error) { return "static", k, nil }
+
+func (k StaticKey) Key(id string) ([]byte, error) {
+	if id != "static" {
+		return nil, fmt.Errorf("queue: unknown key %q", id)
+	}
+	return k, nil
+}
+
+// bodyWriter writes a message's contents to a temporary file,
+// compressing and encrypting them as configured.
+type bodyWriter struct {
+	f          *os.File
+	w          io.Writer
+	layers     []io.Closer // innermost first
+	size       int64       // uncompressed, unencrypted
+	compressed bool
+	keyID      string
+}
+
+// createBody starts writing the contents of message id.
+func (q *Queue) createBody(id string) (*bodyWriter, error) {
+	f, err := os.OpenFile(filepath.Join(q.Dir, "tmp", id+".eml"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	bw := &bodyWriter{f: f, w: f}
+	if q.Keys != nil {
+		keyID, key, err := q.Keys.CurrentKey()
+		if err == nil {
+			var sw *sealWriter
+			if sw, err = newSealWriter(bw.w, key); err == nil {
+				bw.w, bw.keyID = sw, keyID
+				bw.layers = append(bw.layers, sw)
+			}
+		}
+		if err != nil {
+			bw.abort()
+			return nil, fmt.Errorf("queue: encrypting message: %v", err)
+		}
+	}
+	if q.Compress {
+		zw := gzip.NewWriter(bw.w)
+		bw.w, bw.compressed = zw, true
+		bw.layers = append(bw.layers, zw)
+	}
+	return bw, nil
+}
+
+func (bw *bodyWriter) Write(p []byte) (int, error) {
+	n, err := bw.w.Write(p)
+	bw.size += int64(n)
+	return n, err
+}
+
+// finish flushes and syncs the contents.
+func (bw *bodyWriter) finish() error {
+	var err error
+	for i := len(bw.layers) - 1; i >= 0; i-- {
+		if cerr := bw.layers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	if serr := bw.f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := bw.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// abort discards the contents.
+func (bw *bodyWriter) abort() {
+	bw.f.Close()
+	os.Remove(bw.f.Name())
+}
+
+// openBody opens the contents of m.
+func (q *Queue) openBody(m *Message) (io.ReadCloser, error) {
+	f, err := os.Open(q.bodyPath(m.ID))
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bufio.NewReader(f)
+	if m.KeyID != "" {
+		if q.Keys == nil {
+			f.Close()
+			return nil, fmt.Errorf("queue: message %s is encrypted and no Keys are set", m.ID)
+		}
+		key, err := q.Keys.Key(m.KeyID)
+		if err == nil {
+			r, err = newSealReader(r, key)
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("queue: decrypting message %s: %v", m.ID, err)
+		}
+	}
+	if m.Compressed {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("queue: message %s: %v", m.ID, err)
+		}
+		r = zr
+	}
+	return readCloser{r, f}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Encrypted contents are a random 7-byte nonce prefix followed by
+// chunks of up to sealChunk bytes sealed with AES-GCM, each preceded
+// by its sealed length as a 4-byte big-endian integer. A chunk's
+// nonce is the prefix, its 4-byte index and a byte that's 1 only for
+// the last chunk, so chunks can't be reordered or the contents
+// truncated undetected.
+const sealChunk = 64 << 10
+
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix [7]byte
+	n      uint32 // chunks written
+	buf    []byte
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newSealWriter(w io.Writer, key []byte) (*sealWriter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sw := &sealWriter{w: w, aead: aead}
+	if _, err := rand.Read(sw.prefix[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sw.prefix[:]); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func chunkNonce(prefix [7]byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[7:], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is only sealed once there's more to come,
+		// so Close always has the last one.
+		if len(sw.buf) == sealChunk {
+			if err := sw.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		m := sealChunk - len(sw.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		sw.buf = append(sw.buf, p[:m]...)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (sw *sealWriter) flush(last bool) error {
+	sealed := sw.aead.Seal(nil, chunkNonce(sw.prefix, sw.n, last), sw.buf, nil)
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(sealed)))
+	if _, err := sw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(sealed); err != nil {
+		return err
+	}
+	sw.n++
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+// Close seals the last chunk.
+func (sw *sealWriter) Close() error {
+	return sw.flush(true)
+}
+
+type sealReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix [7]byte
+	n      uint32
+	buf    []byte // unread plaintext
+	done   bool   // read the last chunk
+}
+
+var errTruncated = errors.New("encrypted contents truncated")
+
+func newSealReader(r io.Reader, key []byte) (*sealReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sr := &sealReader{r: r, aead: aead}
+	if _, err := io.ReadFull(r, sr.prefix[:]); err != nil {
+		return nil, errTruncated
+	}
+	return sr, nil
+}
+
+func (sr *sealReader) Read(p []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+		var hdr [4]byte
+		if _, err := io.ReadFull(sr.r, hdr[:]); err != nil {
+			return 0, errTruncated
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size > sealChunk+uint32(sr.aead.Overhead()) {
+			return 0, errors.New("encrypted chunk too large")
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(sr.r, sealed); err != nil {
+			return 0, errTruncated
+		}
+		plain, err := sr.aead.Open(nil, chunkNonce(sr.prefix, sr.n, false), sealed, nil)
+		if err != nil {
+			plain, err = sr.aead.Open(nil, chunkNonce(sr.prefix, sr.n, true), sealed, nil)
+			if err != nil {
+				return 0, errors.New("encrypted contents corrupt or key wrong")
+			}
+			sr.done = true
+		}
+		sr.n++
+		sr.buf = plain
+	}
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"log"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// NewEnvelope returns an Envelope that spools the message into q. It's
+// suitable for returning from a Server's OnNewMail hook. The message
+// is only acknowledged once it's safely on disk.
+func (q *Queue) NewEnvelope(from smtpd.MailAddress) (smtpd.Envelope, error) {
+	if err := q.init(); err != nil {
+		return nil, err
+	}
+	return &envelope{q: q, from: from.Email()}, nil
+}
+
+// OnNewMail is like NewEnvelope, but also records whether the client
+// asked for REQUIRETLS. It's suitable as a Server's OnNewMail hook.
+func (q *Queue) OnNewMail(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+	env, err := q.NewEnvelope(from)
+	if err != nil {
+		return nil, err
+	}
+	env.(*envelope).requireTLS = c.Features().RequireTLS
+	return env, nil
+}
+
+type envelope struct {
+	q          *Queue
+	from       string
+	rcpts      []string
+	requireTLS bool
+	id         string
+	body       *bodyWriter
+}
+
+func (e *envelope) AddRecipient(rcpt smtpd.MailAddress) error {
+	e.rcpts = append(e.rcpts, rcpt.Email())
+	return nil
+}
+
+func (e *envelope) BeginData() error {
+	if len(e.rcpts) == 0 {
+		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	e.id = newID()
+	body, err := e.q.createBody(e.id)
+	if err != nil {
+		log.Printf("queue: creating %s: %v", e.id, err)
+		return smtpd.SMTPError("451 4.3.0 Error: queue file write error")
+	}
+	e.body = body
+	return nil
+}
+
+func (e *envelope) Write(line []byte) error {
+	_, err := e.body.Write(line)
+	return err
+}
+
+// Abort discards the message's contents if the transaction ends
+// without Close.
+func (e *envelope) Abort() {
+	if e.body != nil {
+		e.body.abort()
+		e.body = nil
+	}
+}
+
+func (e *envelope) Close() error {
+	if e.body == nil {
+		return nil
+	}
+	err := e.q.commit(e.id, e.from, e.rcpts, e.requireTLS, e.body)
+	e.body = nil
+	if err != nil {
+		return smtpd.SMTPError("451 4.3.0 Error: queue file write error")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// addr is a MailAddress for tests.
+type addr string
+
+func (a addr) Email() string       { return string(a) }
+func (a addr) Raw() string         { return string(a) }
+func (a addr) Hostname() string    { return domain(string(a)) }
+func (a addr) Tag() string         { return "" }
+func (a addr) BaseAddress() string { return string(a) }
+
+func TestEnvelope(t *testing.T) {
+	q, _, _ := newTestQueue(t)
+	env, err := q.NewEnvelope(addr("sender@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.BeginData(); err == nil || !strings.HasPrefix(err.Error(), "554 ") {
+		t.Errorf("BeginData without recipients = %v; want 554", err)
+	}
+	env.AddRecipient(addr("a@example.com"))
+	env.AddRecipient(addr("b@example.com"))
+	if err := env.BeginData(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.SplitAfter(testMessage, "\n") {
+		if err := env.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Nothing is queued until Close.
+	if n, _ := q.Len(); n != 0 {
+		t.Errorf("Len before Close = %d", n)
+	}
+	if err := env.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := q.List()
+	if err != nil || len(ms) != 1 {
+		t.Fatalf("List = %v, %v; want one message", ms, err)
+	}
+	m := ms[0]
+	if m.From != "sender@example.org" || len(m.Recipients) != 2 || m.Size != int64(len(testMessage)) {
+		t.Errorf("queued %+v", m)
+	}
+	if !m.NextAttempt.Equal(start) {
+		t.Errorf("NextAttempt = %v; want %v", m.NextAttempt, start)
+	}
+}
+
+func TestEnvelopeAbort(t *testing.T) {
+	q, _, _ := newTestQueue(t)
+	env, err := q.NewEnvelope(addr("sender@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.AddRecipient(addr("a@example.com"))
+	if err := env.BeginData(); err != nil {
+		t.Fatal(err)
+	}
+	env.Write([]byte("Subject: abandoned\r\n"))
+	env.(smtpd.AbortEnvelope).Abort()
+	tmp, _ := os.ReadDir(filepath.Join(q.Dir, "tmp"))
+	if len(tmp) != 0 {
+		t.Errorf("temporary files left: %v", tmp)
+	}
+	if n, _ := q.Len(); n != 0 {
+		t.Errorf("Len = %d; want 0", n)
+	}
+}
+
+func TestEnvelopeBeginDataError(t *testing.T) {
+	q, _, _ := newTestQueue(t)
+	env, err := q.NewEnvelope(addr("sender@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.AddRecipient(addr("a@example.com"))
+	// Make the spool unwritable.
+	if err := os.RemoveAll(filepath.Join(q.Dir, "tmp")); err != nil {
+		t.Fatal(err)
+	}
+	err = env.BeginData()
+	if _, ok := err.(smtpd.SMTPError); !ok || !strings.HasPrefix(err.Error(), "451 4.3.0 ") {
+		t.Errorf("BeginData = %#v; want a 451 SMTPError", err)
+	}
+}
@@ -0,0 +1,695 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package queue implements a persistent mail queue: messages accepted
+// by an smtpd.Server are spooled to disk and delivered in the
+// background by a Transport, with retries, and bounced to the sender
+// if they can't be delivered.
+package queue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+	"github.com/bradfitz/go-smtpd/smtpd/dsn"
+	"github.com/bradfitz/go-smtpd/smtpd/relay"
+	"github.com/bradfitz/go-smtpd/smtpd/verp"
+)
+
+// Transport delivers messages from the queue. The relay and lmtp
+// packages' Clients are Transports.
+type Transport interface {
+	// Send delivers the message read from r, returning the result
+	// for each of rcpts, or a non-nil err if the whole attempt
+	// failed. Permanent failures are SMTP replies with 5xx codes.
+	Send(from string, rcpts []string, r io.Reader) (rcptErrs []error, err error)
+}
+
+// RequireTLSTransport is a Transport that can send messages with
+// REQUIRETLS (RFC 8689), such as a *relay.Client.
+type RequireTLSTransport interface {
+	Transport
+	SendRequireTLS(from string, rcpts []string, r io.Reader) (rcptErrs []error, err error)
+}
+
+// Queue is a directory of messages awaiting delivery.
+type Queue struct {
+	// Dir is the spool directory. It's created if needed.
+	Dir string
+
+	// Transport delivers the messages.
+	Transport Transport
+
+	// Hostname identifies this host in bounce messages.
+	Hostname string
+
+	// MaxAge is how long delivery is retried before a message is
+	// bounced; 5 days if zero.
+	MaxAge time.Duration
+
+	// RetryMin and RetryMax bound the interval between delivery
+	// attempts, which doubles after each failure. They default to
+	// 5 minutes and 4 hours.
+	RetryMin, RetryMax time.Duration
+
+	// Concurrency is how many messages are delivered at once; 4
+	// if zero.
+	Concurrency int
+
+	// VERP sends a separate bounce for each failed recipient, to
+	// the sender's VERP address for that recipient (see package
+	// verp), matching a relay.Client with VERP set.
+	VERP bool
+
+	// Clock, if non-nil, is used for scheduling and expiry.
+	Clock smtpd.Clock
+
+	// Compress gzips messages' contents on disk.
+	Compress bool
+
+	// Keys, if non-nil, provides the keys for encrypting messages'
+	// contents on disk. Their metadata, including addresses, isn't
+	// encrypted.
+	Keys KeyProvider
+
+	// OnDeadLetter, if non-nil, is called after a message whose
+	// delivery time expired has been bounced and moved to the dead
+	// letter directory, Dir/dead. Its recipients' LastError fields
+	// hold the last failures.
+	OnDeadLetter func(m *Message)
+
+	// OnDemand, if non-nil, reports whether mail for a domain is
+	// spooled for its intermittently connected server to dequeue
+	// with ATRN (RFC 2645; see Spooled), rather than delivered by
+	// the Transport. Such mail is still bounced after MaxAge.
+	OnDemand func(domain string) bool
+
+	mu       sync.Mutex
+	kick     chan struct{}
+	inflight map[string]bool
+}
+
+// Status is the delivery state of a recipient.
+type Status string
+
+const (
+	Pending   Status = "pending"
+	Delivered Status = "delivered"
+	Failed    Status = "failed"
+)
+
+// Recipient is a recipient of a queued message.
+type Recipient struct {
+	Addr      string
+	Status    Status
+	LastError string `json:",omitempty"`
+}
+
+// Message is the metadata of a queued message. Its contents are
+// stored separately.
+type Message struct {
+	ID          string
+	From        string
+	Recipients  []*Recipient
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	Size        int64 // of the contents, in bytes
+
+	// Held messages aren't delivered until released.
+	Held bool `json:",omitempty"`
+
+	// RequireTLS is set for messages received with REQUIRETLS.
+	// They're sent with the Transport's SendRequireTLS method.
+	RequireTLS bool `json:",omitempty"`
+
+	// How the contents are stored.
+	Compressed bool   `json:",omitempty"`
+	KeyID      string `json:",omitempty"` // of the encryption key
+}
+
+// pending returns the recipients still awaiting delivery.
+func (m *Message) pending() []*Recipient {
+	var rs []*Recipient
+	for _, r := range m.Recipients {
+		if r.Status == Pending {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+func (q *Queue) clock() smtpd.Clock {
+	if q.Clock == nil {
+		return smtpd.SystemClock
+	}
+	return q.Clock
+}
+
+func (q *Queue) now() time.Time { return q.clock().Now() }
+
+func (q *Queue) maxAge() time.Duration {
+	if q.MaxAge == 0 {
+		return 5 * 24 * time.Hour
+	}
+	return q.MaxAge
+}
+
+// retryDelay returns the wait after the given number of attempts.
+func (q *Queue) retryDelay(attempts int) time.Duration {
+	min, max := q.RetryMin, q.RetryMax
+	if min == 0 {
+		min = 5 * time.Minute
+	}
+	if max == 0 {
+		max = 4 * time.Hour
+	}
+	d := min
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (q *Queue) init() error {
+	q.mu.Lock()
+	if q.kick == nil {
+		q.kick = make(chan struct{}, 1)
+		q.inflight = make(map[string]bool)
+	}
+	q.mu.Unlock()
+	if err := os.MkdirAll(filepath.Join(q.Dir, "tmp"), 0700); err != nil {
+		return err
+	}
+	return os.MkdirAll(q.deadDir(), 0700)
+}
+
+// Kick makes the queue runner look for due messages now.
+func (q *Queue) Kick() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.kick == nil {
+		return
+	}
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+}
+
+func newID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + hex.EncodeToString(b[:])
+}
+
+func (q *Queue) metaPath(id string) string { return filepath.Join(q.Dir, id+".json") }
+func (q *Queue) bodyPath(id string) string { return filepath.Join(q.Dir, id+".eml") }
+func (q *Queue) deadDir() string           { return filepath.Join(q.Dir, "dead") }
+
+// save writes m's metadata atomically.
+func (q *Queue) save(m *Message) error {
+	return q.saveAs(m, q.metaPath(m.ID))
+}
+
+// saveAs writes m's metadata atomically to the file name, and syncs
+// it and its directory, so the message, whose contents are already
+// in that directory, survives a crash.
+func (q *Queue) saveAs(m *Message, name string) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(q.Dir, "tmp", m.ID+".json")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir syncs the directory dir, making renames into it durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// load reads the metadata of message id.
+func (q *Queue) load(id string) (*Message, error) {
+	return readMessage(q.metaPath(id))
+}
+
+// readMessage reads message metadata from the file name.
+func readMessage(name string) (*Message, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Message)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("queue: message %s: %v", strings.TrimSuffix(filepath.Base(name), ".json"), err)
+	}
+	return m, nil
+}
+
+func (q *Queue) remove(id string) error {
+	err := os.Remove(q.metaPath(id))
+	if err2 := os.Remove(q.bodyPath(id)); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// messages returns the metadata of all queued messages.
+func (q *Queue) messages() ([]*Message, error) {
+	return readMessages(q.Dir)
+}
+
+// readMessages returns the metadata of the messages in dir.
+func readMessages(dir string) ([]*Message, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ms []*Message
+	for _, name := range names {
+		m, err := readMessage(name)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("queue: %v", err)
+			}
+			continue
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// Len returns the number of messages in the queue.
+func (q *Queue) Len() (int, error) {
+	ents, err := os.ReadDir(q.Dir)
+	n := 0
+	for _, e := range ents {
+		if strings.HasSuffix(e.Name(), ".json") {
+			n++
+		}
+	}
+	return n, err
+}
+
+// HealthCheck returns a check for smtpd.Server.HealthChecks that fails
+// if the queue directory is unreadable or holds more than max
+// messages.
+func (q *Queue) HealthCheck(max int) func() error {
+	return func() error {
+		n, err := q.Len()
+		if err != nil {
+			return err
+		}
+		if n > max {
+			return fmt.Errorf("queue: %d messages queued, more than %d", n, max)
+		}
+		return nil
+	}
+}
+
+// Enqueue adds a message read from r to the queue.
+func (q *Queue) Enqueue(from string, rcpts []string, r io.Reader) (id string, err error) {
+	if err := q.init(); err != nil {
+		return "", err
+	}
+	id = newID()
+	bw, err := q.createBody(id)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(bw, r); err != nil {
+		bw.abort()
+		return "", err
+	}
+	if err := q.commit(id, from, rcpts, false, bw); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// commit finishes spooling a message whose contents were written to
+// bw.
+func (q *Queue) commit(id, from string, rcpts []string, requireTLS bool, bw *bodyWriter) error {
+	tmp := bw.f.Name()
+	err := bw.finish()
+	if err == nil {
+		err = os.Rename(tmp, q.bodyPath(id))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	now := q.now()
+	m := &Message{
+		ID:          id,
+		From:        from,
+		Created:     now,
+		NextAttempt: now,
+		Size:        bw.size,
+		RequireTLS:  requireTLS,
+		Compressed:  bw.compressed,
+		KeyID:       bw.keyID,
+	}
+	for _, r := range rcpts {
+		m.Recipients = append(m.Recipients, &Recipient{Addr: r, Status: Pending})
+	}
+	if err := q.save(m); err != nil {
+		os.Remove(q.bodyPath(id))
+		return err
+	}
+	q.Kick()
+	return nil
+}
+
+// Run delivers queued messages as they come due. It returns only if
+// the queue directory can't be used, or when stop is closed.
+func (q *Queue) Run(stop <-chan struct{}) error {
+	if err := q.init(); err != nil {
+		return err
+	}
+	if q.Transport == nil {
+		return errors.New("queue: no Transport")
+	}
+	conc := q.Concurrency
+	if conc == 0 {
+		conc = 4
+	}
+	q.removeStaleLocks()
+	sem := make(chan struct{}, conc)
+	for {
+		ms, err := q.messages()
+		if err != nil {
+			return err
+		}
+		now := q.now()
+		// Rescan at least every minute to notice messages
+		// changed by other processes, such as an admin tool.
+		wake := now.Add(time.Minute)
+		for _, m := range ms {
+			if m.Held {
+				continue
+			}
+			if m.NextAttempt.After(now) {
+				if m.NextAttempt.Before(wake) {
+					wake = m.NextAttempt
+				}
+				continue
+			}
+			q.mu.Lock()
+			busy := q.inflight[m.ID]
+			if !busy {
+				q.inflight[m.ID] = true
+			}
+			q.mu.Unlock()
+			if busy {
+				continue
+			}
+			sem <- struct{}{}
+			go func(id string) {
+				defer func() { <-sem }()
+				q.deliverID(id)
+				q.mu.Lock()
+				delete(q.inflight, id)
+				q.mu.Unlock()
+				q.Kick()
+			}(m.ID)
+		}
+		t := q.clock().NewTimer(wake.Sub(now))
+		select {
+		case <-stop:
+			t.Stop()
+			return nil
+		case <-q.kick:
+		case <-t.C():
+		}
+		t.Stop()
+	}
+}
+
+// deliverID makes a delivery attempt for message id, unless another
+// process has it locked, or it was held or removed since the queue
+// was scanned.
+func (q *Queue) deliverID(id string) {
+	unlock, err := q.lock(id)
+	if err != nil {
+		if err != ErrBusy {
+			log.Printf("queue: locking %s: %v", id, err)
+		}
+		return
+	}
+	defer unlock()
+	m, err := q.load(id)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("queue: %v", err)
+		}
+		return
+	}
+	if m.Held {
+		return
+	}
+	q.deliver(m)
+}
+
+// send sends m, read from body, to addrs with the Transport.
+func (q *Queue) send(m *Message, addrs []string, body io.Reader) ([]error, error) {
+	if !m.RequireTLS {
+		return q.Transport.Send(m.From, addrs, body)
+	}
+	if t, ok := q.Transport.(RequireTLSTransport); ok {
+		return t.SendRequireTLS(m.From, addrs, body)
+	}
+	return nil, smtpd.SMTPError("550 5.7.30 REQUIRETLS not supported by the queue's transport")
+}
+
+var errNoResult = errors.New("queue: no delivery result for recipient")
+
+// record applies the results of a delivery attempt to rcpts: one for
+// each, or a non-nil err for all of them. It returns those that
+// failed permanently.
+func record(rcpts []*Recipient, rcptErrs []error, err error) []dsn.Recipient {
+	var failed []dsn.Recipient
+	for i, r := range rcpts {
+		rerr := err
+		switch {
+		case err != nil:
+		case i < len(rcptErrs):
+			rerr = rcptErrs[i]
+		default:
+			// Retried, as its delivery can't be assumed.
+			rerr = errNoResult
+		}
+		switch {
+		case rerr == nil:
+			r.Status, r.LastError = Delivered, ""
+		case relay.IsPermanent(rerr):
+			r.Status, r.LastError = Failed, rerr.Error()
+			failed = append(failed, dsn.FromError(r.Addr, rerr, false))
+		default:
+			r.LastError = rerr.Error()
+		}
+	}
+	return failed
+}
+
+// deliver makes a delivery attempt for m.
+func (q *Queue) deliver(m *Message) {
+	var pending []*Recipient
+	var addrs []string
+	for _, r := range m.pending() {
+		if !q.onDemand(r.Addr) {
+			pending = append(pending, r)
+			addrs = append(addrs, r.Addr)
+		}
+	}
+	if len(pending) == 0 {
+		q.awaitATRN(m)
+		return
+	}
+	var rcptErrs []error
+	body, err := q.openBody(m)
+	if err == nil {
+		rcptErrs, err = q.send(m, addrs, body)
+		body.Close()
+	}
+	failed := record(pending, rcptErrs, err)
+	m.Attempts++
+	now := q.now()
+	expired := len(m.pending()) > 0 && now.Sub(m.Created) > q.maxAge()
+	if expired {
+		for _, r := range m.pending() {
+			failed = append(failed, q.expire(r))
+		}
+	}
+	if len(failed) > 0 {
+		q.bounce(m, failed)
+	}
+	if expired {
+		if err := q.deadLetter(m); err != nil {
+			log.Printf("queue: moving %s to dead letters: %v", m.ID, err)
+			return
+		}
+		if q.OnDeadLetter != nil {
+			q.OnDeadLetter(m)
+		}
+		return
+	}
+	if len(m.pending()) == 0 {
+		if err := q.remove(m.ID); err != nil {
+			log.Printf("queue: removing %s: %v", m.ID, err)
+		}
+		return
+	}
+	m.NextAttempt = now.Add(q.retryDelay(m.Attempts))
+	if err := q.save(m); err != nil {
+		log.Printf("queue: saving %s: %v", m.ID, err)
+	}
+}
+
+// awaitATRN handles m when its only pending recipients are spooled
+// for ATRN: they're bounced if it has expired, and otherwise it's
+// next looked at when it expires.
+func (q *Queue) awaitATRN(m *Message) {
+	expiry := m.Created.Add(q.maxAge())
+	if q.now().Before(expiry) {
+		if !m.NextAttempt.Equal(expiry) {
+			m.NextAttempt = expiry
+			if err := q.save(m); err != nil {
+				log.Printf("queue: saving %s: %v", m.ID, err)
+			}
+		}
+		return
+	}
+	var failed []dsn.Recipient
+	for _, r := range m.pending() {
+		failed = append(failed, q.expire(r))
+	}
+	q.bounce(m, failed)
+	if err := q.deadLetter(m); err != nil {
+		log.Printf("queue: moving %s to dead letters: %v", m.ID, err)
+		return
+	}
+	if q.OnDeadLetter != nil {
+		q.OnDeadLetter(m)
+	}
+}
+
+var (
+	errExpired     = errors.New("delivery time expired")
+	errNotDequeued = errors.New("delivery time expired; not dequeued with ATRN")
+)
+
+// expire marks r as failed for having been queued longer than MaxAge,
+// and returns its delivery status.
+func (q *Queue) expire(r *Recipient) dsn.Recipient {
+	r.Status = Failed
+	err := errExpired
+	diag := err.Error()
+	switch {
+	case q.onDemand(r.Addr):
+		err = errNotDequeued
+		diag = err.Error()
+	case r.LastError != "":
+		err = errors.New(r.LastError)
+		diag += "; last error: " + r.LastError
+	}
+	rc := dsn.FromError(r.Addr, err, false)
+	rc.Status = "4.4.7"
+	rc.Diagnostic = diag
+	return rc
+}
+
+// deadLetter moves m out of the queue into the dead letter directory.
+func (q *Queue) deadLetter(m *Message) error {
+	if err := q.saveAs(m, filepath.Join(q.deadDir(), m.ID+".json")); err != nil {
+		return err
+	}
+	err := os.Rename(q.bodyPath(m.ID), filepath.Join(q.deadDir(), m.ID+".eml"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := syncDir(q.deadDir()); err != nil {
+		return err
+	}
+	return os.Remove(q.metaPath(m.ID))
+}
+
+// bounce queues a delivery status notification to m's sender for the
+// failed recipients. Bounces themselves are never bounced.
+func (q *Queue) bounce(m *Message, failed []dsn.Recipient) {
+	if m.From == "" {
+		log.Printf("queue: dropping undeliverable bounce %s", m.ID)
+		return
+	}
+	if !q.VERP {
+		q.sendBounce(m, m.From, failed)
+		return
+	}
+	for _, rc := range failed {
+		q.sendBounce(m, verp.Encode(m.From, rc.Addr), []dsn.Recipient{rc})
+	}
+}
+
+// sendBounce queues a bounce to to reporting the failed recipients.
+func (q *Queue) sendBounce(m *Message, to string, failed []dsn.Recipient) {
+	rep := &dsn.Report{
+		ReportingMTA: q.Hostname,
+		ArrivalDate:  m.Created,
+		Recipients:   failed,
+	}
+	var buf bytes.Buffer
+	var original io.Reader
+	if body, err := q.openBody(m); err == nil {
+		defer body.Close()
+		original = body
+	}
+	err := rep.Compose(&buf, to, original, true)
+	if err != nil {
+		log.Printf("queue: composing bounce for %s: %v", m.ID, err)
+		return
+	}
+	if _, err := q.Enqueue("", []string{to}, &buf); err != nil {
+		log.Printf("queue: queueing bounce for %s: %v", m.ID, err)
+	}
+}
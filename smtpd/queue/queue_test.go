@@ -0,0 +1,534 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// testTransport records the messages sent, and fails the recipients
+// in errs with their errors.
+type testTransport struct {
+	mu    sync.Mutex
+	errs  map[string]error
+	err   error // for the whole attempt
+	sends []testSend
+}
+
+type testSend struct {
+	from  string
+	rcpts []string
+	body  string
+}
+
+func (t *testTransport) Send(from string, rcpts []string, r io.Reader) ([]error, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sends = append(t.sends, testSend{from, rcpts, string(body)})
+	if t.err != nil {
+		return nil, t.err
+	}
+	rcptErrs := make([]error, len(rcpts))
+	for i, rcpt := range rcpts {
+		rcptErrs[i] = t.errs[rcpt]
+	}
+	return rcptErrs, nil
+}
+
+var start = time.Date(2011, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestQueue(t *testing.T) (*Queue, *testTransport, *smtpd.FakeClock) {
+	tr := &testTransport{errs: map[string]error{}}
+	clock := smtpd.NewFakeClock(start)
+	q := &Queue{
+		Dir:       t.TempDir(),
+		Transport: tr,
+		Hostname:  "mx.example.com",
+		MaxAge:    24 * time.Hour,
+		RetryMin:  time.Minute,
+		RetryMax:  time.Hour,
+		Clock:     clock,
+	}
+	return q, tr, clock
+}
+
+const testMessage = "Subject: test\r\n\r\nbody\r\n"
+
+func enqueue(t *testing.T, q *Queue, from string, rcpts ...string) string {
+	t.Helper()
+	id, err := q.Enqueue(from, rcpts, strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// bounces returns the bodies of the bounces queued.
+func bounces(t *testing.T, q *Queue) []string {
+	t.Helper()
+	ms, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bs []string
+	for _, m := range ms {
+		if m.From != "" {
+			continue
+		}
+		r, err := q.Open(m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs = append(bs, string(b))
+	}
+	return bs
+}
+
+func TestExpiry(t *testing.T) {
+	deferred := smtpd.SMTPError("451 4.3.0 try again later")
+	tests := []struct {
+		name     string
+		errs     map[string]error
+		onDemand bool // for atrn.example
+		dead     bool
+		diags    []string // in the bounce
+	}{
+		{
+			name: "delivered at last",
+		},
+		{
+			name:  "still deferred",
+			errs:  map[string]error{"a@example.com": deferred},
+			dead:  true,
+			diags: []string{"delivery time expired; last error: 451 4.3.0 try again later"},
+		},
+		{
+			name:     "not dequeued",
+			onDemand: true,
+			dead:     true,
+			diags:    []string{"Diagnostic-Code: smtp; delivery time expired; not dequeued with ATRN\r\n"},
+		},
+		{
+			name:     "deferred and not dequeued",
+			errs:     map[string]error{"a@example.com": deferred},
+			onDemand: true,
+			dead:     true,
+			diags: []string{
+				"delivery time expired; last error: 451 4.3.0 try again later",
+				"Diagnostic-Code: smtp; delivery time expired; not dequeued with ATRN\r\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, tr, clock := newTestQueue(t)
+			tr.errs = tt.errs
+			if tt.onDemand {
+				q.OnDemand = func(domain string) bool { return domain == "atrn.example" }
+			}
+			var deadLetters []string
+			q.OnDeadLetter = func(m *Message) { deadLetters = append(deadLetters, m.ID) }
+			rcpts := []string{"a@example.com"}
+			if tt.onDemand {
+				rcpts = append(rcpts, "b@atrn.example")
+			}
+			id := enqueue(t, q, "sender@example.org", rcpts...)
+			clock.Advance(q.MaxAge + time.Minute)
+			q.deliverID(id)
+
+			if _, err := q.Get(id); err == nil {
+				t.Errorf("message still queued")
+			}
+			dead, err := q.DeadLetters()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(dead) == 1 && len(deadLetters) == 1; got != tt.dead {
+				t.Errorf("dead-lettered = %v (%d, OnDeadLetter %d times); want %v", got, len(dead), len(deadLetters), tt.dead)
+			}
+			bs := bounces(t, q)
+			if len(tt.diags) == 0 {
+				if len(bs) != 0 {
+					t.Errorf("%d bounces; want none", len(bs))
+				}
+				return
+			}
+			if len(bs) != 1 {
+				t.Fatalf("%d bounces; want 1", len(bs))
+			}
+			for _, d := range tt.diags {
+				if !strings.Contains(bs[0], d) {
+					t.Errorf("bounce lacks %q:\n%s", d, bs[0])
+				}
+			}
+			if strings.Contains(bs[0], "last error: \r\n") {
+				t.Errorf("bounce has an empty last error:\n%s", bs[0])
+			}
+		})
+	}
+}
+
+func TestSpooledDone(t *testing.T) {
+	q, _, _ := newTestQueue(t)
+	q.OnDemand = func(domain string) bool { return domain == "atrn.example" }
+	id := enqueue(t, q, "sender@example.org", "a@atrn.example", "b@atrn.example", "c@atrn.example", "d@example.com")
+	ms, err := q.Spooled([]string{"ATRN.example", "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 {
+		t.Fatalf("%d messages spooled; want 1", len(ms))
+	}
+	sm := ms[0]
+	if got, want := strings.Join(sm.Recipients(), " "), "a@atrn.example b@atrn.example c@atrn.example"; got != want {
+		t.Errorf("Recipients() = %q; want %q", got, want)
+	}
+	// Locked until Done.
+	if again, _ := q.Spooled([]string{"atrn.example"}); len(again) != 0 {
+		t.Errorf("message offered again before Done")
+	}
+	sm.Done([]error{
+		nil,
+		smtpd.SMTPError("550 5.1.1 no such user"),
+		smtpd.SMTPError("452 4.2.2 mailbox full"),
+	}, nil)
+
+	m, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Status{
+		"a@atrn.example": Delivered,
+		"b@atrn.example": Failed,
+		"c@atrn.example": Pending,
+		"d@example.com":  Pending,
+	}
+	for _, r := range m.Recipients {
+		if r.Status != want[r.Addr] {
+			t.Errorf("%s: status %s; want %s", r.Addr, r.Status, want[r.Addr])
+		}
+	}
+	bs := bounces(t, q)
+	if len(bs) != 1 || !strings.Contains(bs[0], "b@atrn.example") || strings.Contains(bs[0], "rfc822; a@atrn.example") {
+		t.Errorf("bounces = %q; want one for b@atrn.example", bs)
+	}
+	ms, err = q.Spooled([]string{"atrn.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || strings.Join(ms[0].Recipients(), " ") != "c@atrn.example" {
+		t.Fatalf("offered again: %v; want c@atrn.example", ms)
+	}
+	ms[0].Done(nil, smtpd.SMTPError("421 4.4.2 connection lost"))
+	if m, err = q.Get(id); err != nil || m.Recipients[2].Status != Pending {
+		t.Errorf("after a failed attempt, c@atrn.example = %+v, %v; want pending", m.Recipients[2], err)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	q, tr, clock := newTestQueue(t)
+	tr.errs = map[string]error{
+		"b@example.com": smtpd.SMTPError("550 5.1.1 no such user"),
+		"c@example.com": smtpd.SMTPError("451 4.3.0 try again later"),
+	}
+	id := enqueue(t, q, "sender@example.org", "a@example.com", "b@example.com", "c@example.com")
+	q.deliverID(id)
+
+	if len(tr.sends) != 1 {
+		t.Fatalf("%d sends; want 1", len(tr.sends))
+	}
+	s := tr.sends[0]
+	if s.from != "sender@example.org" || strings.Join(s.rcpts, " ") != "a@example.com b@example.com c@example.com" || s.body != testMessage {
+		t.Errorf("sent %+v", s)
+	}
+	m, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Attempts != 1 || !m.NextAttempt.Equal(start.Add(q.RetryMin)) {
+		t.Errorf("Attempts, NextAttempt = %d, %v; want 1, %v", m.Attempts, m.NextAttempt, start.Add(q.RetryMin))
+	}
+	want := []Status{Delivered, Failed, Pending}
+	for i, r := range m.Recipients {
+		if r.Status != want[i] {
+			t.Errorf("%s: %s; want %s", r.Addr, r.Status, want[i])
+		}
+	}
+	if got := m.Recipients[2].LastError; got != "451 4.3.0 try again later" {
+		t.Errorf("LastError = %q", got)
+	}
+	bs := bounces(t, q)
+	if len(bs) != 1 || !strings.Contains(bs[0], "Final-Recipient: rfc822; b@example.com") || strings.Contains(bs[0], "c@example.com") {
+		t.Fatalf("bounces = %q; want one for b@example.com", bs)
+	}
+
+	// The retry only goes to the recipient still pending.
+	delete(tr.errs, "c@example.com")
+	clock.Advance(q.RetryMin)
+	q.deliverID(id)
+	if len(tr.sends) != 2 || strings.Join(tr.sends[1].rcpts, " ") != "c@example.com" {
+		t.Fatalf("retry sent to %v; want c@example.com", tr.sends[1:])
+	}
+	if _, err := q.Get(id); err != ErrNotFound {
+		t.Errorf("Get after delivery = %v; want ErrNotFound", err)
+	}
+}
+
+func TestDeliverFailedAttempt(t *testing.T) {
+	q, tr, _ := newTestQueue(t)
+	tr.err = smtpd.SMTPError("421 4.4.2 connection lost")
+	id := enqueue(t, q, "sender@example.org", "a@example.com", "b@example.com")
+	q.deliverID(id)
+	m, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range m.Recipients {
+		if r.Status != Pending || r.LastError != "421 4.4.2 connection lost" {
+			t.Errorf("%+v; want pending with the error", r)
+		}
+	}
+
+	// A permanent failure of the whole attempt bounces everyone.
+	tr.err = smtpd.SMTPError("554 5.7.1 go away")
+	q.deliverID(id)
+	if _, err := q.Get(id); err != ErrNotFound {
+		t.Errorf("Get = %v; want ErrNotFound", err)
+	}
+	if bs := bounces(t, q); len(bs) != 1 {
+		t.Errorf("%d bounces; want 1", len(bs))
+	}
+}
+
+// shortTransport returns fewer results than recipients.
+type shortTransport struct{}
+
+func (shortTransport) Send(from string, rcpts []string, r io.Reader) ([]error, error) {
+	return []error{nil}, nil
+}
+
+func TestDeliverMissingResult(t *testing.T) {
+	q, _, _ := newTestQueue(t)
+	q.Transport = shortTransport{}
+	id := enqueue(t, q, "sender@example.org", "a@example.com", "b@example.com")
+	q.deliverID(id)
+	m, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Recipients[0].Status != Delivered || m.Recipients[1].Status != Pending || m.Recipients[1].LastError != errNoResult.Error() {
+		t.Errorf("recipients %+v %+v; want delivered, then pending", m.Recipients[0], m.Recipients[1])
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	q := &Queue{RetryMin: time.Minute, RetryMax: 10 * time.Minute}
+	want := []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for attempts, d := range want {
+		if got := q.retryDelay(attempts); got != d {
+			t.Errorf("retryDelay(%d) = %v; want %v", attempts, got, d)
+		}
+	}
+	q = &Queue{}
+	if got := q.retryDelay(1); got != 5*time.Minute {
+		t.Errorf("default first delay = %v", got)
+	}
+	if got := q.retryDelay(100); got != 4*time.Hour {
+		t.Errorf("default longest delay = %v", got)
+	}
+}
+
+func TestBounces(t *testing.T) {
+	refused := smtpd.SMTPError("550 5.1.1 no such user")
+	t.Run("null sender", func(t *testing.T) {
+		q, tr, _ := newTestQueue(t)
+		tr.errs["a@example.com"] = refused
+		enqueue(t, q, "", "a@example.com")
+		ms, _ := q.List()
+		q.deliverID(ms[0].ID)
+		if n, _ := q.Len(); n != 0 {
+			t.Errorf("a bounce was bounced: %d messages queued", n)
+		}
+	})
+	t.Run("VERP", func(t *testing.T) {
+		q, tr, _ := newTestQueue(t)
+		q.VERP = true
+		tr.errs["a@example.com"] = refused
+		tr.errs["b@example.net"] = refused
+		id := enqueue(t, q, "list@example.org", "a@example.com", "b@example.net")
+		q.deliverID(id)
+		ms, _ := q.List()
+		var tos []string
+		for _, m := range ms {
+			if m.From == "" {
+				tos = append(tos, m.Recipients[0].Addr)
+			}
+		}
+		sort.Strings(tos)
+		want := []string{"list+a=example.com@example.org", "list+b=example.net@example.org"}
+		if strings.Join(tos, " ") != strings.Join(want, " ") {
+			t.Errorf("bounces to %q; want %q", tos, want)
+		}
+	})
+}
+
+func TestStorage(t *testing.T) {
+	key := StaticKey(bytes.Repeat([]byte{7}, 32))
+	big := strings.Repeat("a fairly long line of message text\r\n", 4000) // over a sealed chunk
+	for _, tt := range []struct {
+		name     string
+		compress bool
+		keys     KeyProvider
+	}{
+		{"plain", false, nil},
+		{"compressed", true, nil},
+		{"encrypted", false, key},
+		{"both", true, key},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q, tr, _ := newTestQueue(t)
+			q.Compress, q.Keys = tt.compress, tt.keys
+			id, err := q.Enqueue("sender@example.org", []string{"a@example.com"}, strings.NewReader(big))
+			if err != nil {
+				t.Fatal(err)
+			}
+			onDisk, err := os.ReadFile(q.bodyPath(id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := string(onDisk) == big; stored != (!tt.compress && tt.keys == nil) {
+				t.Errorf("contents stored as sent: %v", stored)
+			}
+			if tt.keys != nil && strings.Contains(string(onDisk), "message text") {
+				t.Errorf("encrypted contents readable on disk")
+			}
+			q.deliverID(id)
+			if len(tr.sends) != 1 || tr.sends[0].body != big {
+				t.Errorf("delivered contents differ")
+			}
+		})
+	}
+	t.Run("tampered", func(t *testing.T) {
+		q, _, _ := newTestQueue(t)
+		q.Keys = key
+		id := enqueue(t, q, "sender@example.org", "a@example.com")
+		p := q.bodyPath(id)
+		b, _ := os.ReadFile(p)
+		b[len(b)-1] ^= 1
+		os.WriteFile(p, b, 0600)
+		r, err := q.Open(id)
+		if err == nil {
+			_, err = io.ReadAll(r)
+			r.Close()
+		}
+		if err == nil {
+			t.Errorf("read tampered contents without error")
+		}
+	})
+}
+
+func TestAdmin(t *testing.T) {
+	q, tr, clock := newTestQueue(t)
+	id := enqueue(t, q, "sender@example.org", "a@example.com")
+	if err := q.Hold(id); err != nil {
+		t.Fatal(err)
+	}
+	q.deliverID(id)
+	if len(tr.sends) != 0 {
+		t.Errorf("held message delivered")
+	}
+	clock.Advance(time.Hour)
+	if err := q.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := q.Get(id)
+	if m.Held || !m.NextAttempt.Equal(clock.Now()) {
+		t.Errorf("released %+v", m)
+	}
+
+	unlock, err := q.lock(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Hold(id); err != ErrBusy {
+		t.Errorf("Hold while locked = %v; want ErrBusy", err)
+	}
+	q.deliverID(id)
+	if len(tr.sends) != 0 {
+		t.Errorf("locked message delivered")
+	}
+	unlock()
+
+	for _, bad := range []string{"", "../x", "a/b", id + ".json"} {
+		if _, err := q.Get(bad); err != ErrNotFound {
+			t.Errorf("Get(%q) = %v; want ErrNotFound", bad, err)
+		}
+	}
+	if err := q.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Delete(id); err != ErrNotFound {
+		t.Errorf("second Delete = %v; want ErrNotFound", err)
+	}
+	if n, _ := q.Len(); n != 0 {
+		t.Errorf("Len = %d; want 0", n)
+	}
+}
+
+func TestRun(t *testing.T) {
+	q, tr, clock := newTestQueue(t)
+	tr.errs["b@example.com"] = smtpd.SMTPError("451 4.3.0 try again later")
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- q.Run(stop) }()
+	enqueue(t, q, "sender@example.org", "a@example.com", "b@example.com")
+
+	// sends waits for n sends, advancing the clock by step meanwhile.
+	sends := func(n int, step time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			tr.mu.Lock()
+			got := len(tr.sends)
+			tr.mu.Unlock()
+			if got == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d sends; want %d", got, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+			clock.Advance(step)
+		}
+	}
+	sends(1, 0)
+	tr.mu.Lock()
+	delete(tr.errs, "b@example.com")
+	tr.mu.Unlock()
+	// The retry comes due as the clock moves on.
+	sends(2, q.RetryMin)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("Run = %v", err)
+	}
+}
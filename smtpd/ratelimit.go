@@ -0,0 +1,97 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"sync"
+	"time"
+)
+
+// A RateLimiter limits the rate of events, such as a session's
+// commands.
+type RateLimiter interface {
+	// Reserve counts an event and returns how long to delay it to
+	// keep to the rate, or zero.
+	Reserve() time.Duration
+}
+
+// TokenBucket is a RateLimiter allowing Rate events per second on
+// average, in bursts of up to Burst (at least 1). Events beyond that
+// are delayed until enough time has passed.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+
+	// Clock, if non-nil, is the time source, as for tests.
+	Clock Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *TokenBucket) Reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	burst := float64(b.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := clockOrSystem(b.Clock).Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if b.tokens += now.Sub(b.last).Seconds() * b.Rate; b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 || b.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.Rate * float64(time.Second))
+}
+
+// maxCommandDelay is how long a client may be kept to
+// Server.CommandRate without a break before it's disconnected.
+const maxCommandDelay = 10 * time.Second
+
+// newCommandLimiter returns the session's RateLimiter for commands,
+// or nil.
+func (s *session) newCommandLimiter() RateLimiter {
+	srv := s.srv
+	if srv.NewCommandLimiter != nil {
+		return srv.NewCommandLimiter(s)
+	}
+	if srv.CommandRate <= 0 {
+		return nil
+	}
+	burst := srv.CommandBurst
+	if burst == 0 {
+		burst = int(srv.CommandRate)
+	}
+	return &TokenBucket{Rate: srv.CommandRate, Burst: burst, Clock: srv.Clock}
+}
+
+// throttle delays the command just read to keep to the session's
+// command rate, and reports whether the session can continue.
+func (s *session) throttle() bool {
+	if s.limiter == nil {
+		return true
+	}
+	d := s.limiter.Reserve()
+	if d <= 0 {
+		s.throttled = 0
+		return true
+	}
+	if s.throttled += d; s.throttled > maxCommandDelay {
+		s.logf(LogProto, LogInfo, "too many commands")
+		s.recordEvent(EventRejected)
+		s.sendFinalLinef("421 4.7.0 %s Error: too many commands, closing connection", s.srv.hostname())
+		return false
+	}
+	s.logf(LogProto, LogDebug, "delaying command by %v", d)
+	s.sleep(d)
+	return s.ctx.Err() == nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"strings"
+	"time"
+)
+
+// RecipientCache caches the results of a recipient validation
+// function, such as a directory or database lookup, so that clients
+// guessing addresses don't cause a lookup per guess. Call Check from
+// an Envelope's AddRecipient.
+//
+// Only successes and permanent (5xx) SMTPError rejections are cached;
+// other errors, such as a backend being unavailable, are returned
+// uncached.
+type RecipientCache struct {
+	// Lookup validates a recipient, returning nil if it exists.
+	Lookup func(rcpt MailAddress) error
+
+	// TTL is how long a recipient found to exist is remembered;
+	// one hour if zero. NegativeTTL is how long a rejection is
+	// remembered; ten minutes if zero.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	// Store holds the results. If nil, they're kept in memory.
+	Store Store
+
+	mem MemoryStore
+}
+
+func (c *RecipientCache) store() Store {
+	if c.Store != nil {
+		return c.Store
+	}
+	return &c.mem
+}
+
+// Check returns the cached result of looking up rcpt, calling Lookup
+// if there's none.
+func (c *RecipientCache) Check(rcpt MailAddress) error {
+	key := "rcpt:" + strings.ToLower(rcpt.Email())
+	if v, err := c.store().Get(key); err == nil && v != nil {
+		if len(v) == 1 && v[0] == '+' {
+			return nil
+		}
+		return SMTPError(v)
+	}
+	err := c.Lookup(rcpt)
+	switch {
+	case err == nil:
+		ttl := c.TTL
+		if ttl == 0 {
+			ttl = time.Hour
+		}
+		c.store().Set(key, []byte("+"), ttl)
+	case isPermanentSMTPError(err):
+		ttl := c.NegativeTTL
+		if ttl == 0 {
+			ttl = 10 * time.Minute
+		}
+		c.store().Set(key, []byte(err.(SMTPError)), ttl)
+	}
+	return err
+}
+
+func isPermanentSMTPError(err error) bool {
+	se, ok := err.(SMTPError)
+	return ok && strings.HasPrefix(string(se), "5")
+}
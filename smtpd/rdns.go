@@ -0,0 +1,115 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultReverseDNSTimeout bounds reverse DNS lookups if
+// Server.ReverseDNSTimeout isn't set.
+const defaultReverseDNSTimeout = 5 * time.Second
+
+// maxPTRNames bounds how many of an address's names are checked
+// against it, as PTR records may list many.
+const maxPTRNames = 10
+
+// RDNS is the result of a reverse DNS lookup of a client's address.
+type RDNS struct {
+	// Names are the names the address's PTR records give, without
+	// trailing dots.
+	Names []string
+
+	// Verified is the first of Names that resolves back to the
+	// address (forward-confirmed reverse DNS), or empty if none do.
+	Verified string
+
+	// Err is the error looking up the PTR records, if any, such as
+	// a *net.DNSError. Failures to confirm the names aren't errors.
+	Err error
+}
+
+// rdnsLookup is a reverse DNS lookup in progress.
+type rdnsLookup struct {
+	done chan struct{} // closed when res is set
+	res  RDNS
+}
+
+// startReverseDNS starts looking up the client's address in the
+// background, if Server.ReverseDNS is set.
+func (s *session) startReverseDNS() {
+	if !s.srv.ReverseDNS {
+		return
+	}
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.IP == nil {
+		return
+	}
+	d := s.srv.ReverseDNSTimeout
+	if d == 0 {
+		d = defaultReverseDNSTimeout
+	}
+	l := &rdnsLookup{done: make(chan struct{})}
+	s.rdns = l
+	ctx, cancel := context.WithTimeout(s.ctx, d)
+	go func() {
+		defer cancel()
+		defer close(l.done)
+		l.res = lookupRDNS(ctx, s.srv.resolver(), addr.IP)
+	}()
+}
+
+// ReverseDNS waits for the lookup started with the connection, which
+// is bounded by Server.ReverseDNSTimeout, and returns its result. It
+// returns the zero RDNS if Server.ReverseDNS isn't set.
+func (s *session) ReverseDNS() RDNS {
+	if s.rdns == nil {
+		return RDNS{}
+	}
+	<-s.rdns.done
+	return s.rdns.res
+}
+
+// verifiedName returns the client's verified host name, as passed by
+// XCLIENT or confirmed by reverse DNS, or "" if unknown.
+func (s *session) verifiedName() string {
+	if s.clientName != "" {
+		return s.clientName
+	}
+	return s.ReverseDNS().Verified
+}
+
+// lookupRDNS looks up ip's names with r, and the first that resolves
+// back to ip.
+func lookupRDNS(ctx context.Context, r Resolver, ip net.IP) RDNS {
+	var res RDNS
+	names, err := r.LookupAddr(ctx, ip.String())
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	for _, name := range names {
+		res.Names = append(res.Names, strings.TrimSuffix(name, "."))
+	}
+	for i, name := range res.Names {
+		if i == maxPTRNames {
+			break
+		}
+		addrs, err := r.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(ip) {
+				res.Verified = name
+				return res
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd/parse"
+)
+
+// EnvelopeInfo describes a message being received, for ReceivedLine.
+type EnvelopeInfo struct {
+	Hostname  string        // the receiving server's name
+	ID        string        // optional identifier, such as a queue ID
+	ClientPTR string        // optional verified reverse DNS name of the client
+	Rcpts     []MailAddress // named in the header if there's only one
+}
+
+// ReceivedLine returns a Received trace header (RFC 5321 s4.4) for a
+// message received from c, folded and ending in CRLF, such as:
+//
+//	Received: from mx.example.org (mx.example.org [192.0.2.1])
+//		by mail.example.com with ESMTPS id 1a2b3c
+//		(using TLS 1.3 with cipher TLS_AES_128_GCM_SHA256)
+//		for <user@example.com>; Mon, 2 Jan 2006 15:04:05 -0700
+//
+// clock, if non-nil, gives the time to stamp.
+func ReceivedLine(c Connection, env EnvelopeInfo, clock func() time.Time) []byte {
+	now := time.Now
+	if clock != nil {
+		now = clock
+	}
+	ip := "unknown"
+	if ta, ok := c.Addr().(*net.TCPAddr); ok {
+		ip = parse.FormatAddressLiteral(ta.IP)
+	}
+	helo := traceText(c.HeloName())
+	if helo == "" {
+		helo = ip
+	}
+	comment := ip
+	if env.ClientPTR != "" {
+		comment = traceText(env.ClientPTR) + " " + ip
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Received: from %s (%s)\r\n", helo, comment)
+	fmt.Fprintf(&b, "\tby %s with %s", traceText(env.Hostname), receivedProtocol(c))
+	if env.ID != "" {
+		fmt.Fprintf(&b, " id %s", traceText(env.ID))
+	}
+	if cs := c.TLS(); cs != nil {
+		fmt.Fprintf(&b, "\r\n\t(using %s with cipher %s)", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+	}
+	if len(env.Rcpts) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", traceText(env.Rcpts[0].Email()))
+	}
+	fmt.Fprintf(&b, "; %s\r\n", now().Format(time.RFC1123Z))
+	return b.Bytes()
+}
+
+// receivedProtocol returns the protocol type for the "with" clause
+// (RFC 3848, RFC 6531).
+func receivedProtocol(c Connection) string {
+	f := c.Features()
+	p := "SMTP"
+	switch {
+	case c.HeloType() == "LHLO" && f.SMTPUTF8:
+		p = "UTF8LMTP"
+	case c.HeloType() == "LHLO":
+		p = "LMTP"
+	case f.SMTPUTF8:
+		p = "UTF8SMTP"
+	case f.ESMTP:
+		p = "ESMTP"
+	}
+	if f.TLS {
+		p += "S"
+	}
+	if c.User() != "" {
+		p += "A"
+	}
+	if p == "SMTPS" || p == "SMTPA" || p == "SMTPSA" {
+		// No such types; plain SMTP has no extensions.
+		p = "E" + p
+	}
+	return p
+}
+
+// traceText returns s with the characters that can't appear in a
+// trace header's tokens removed.
+func traceText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f || r == '(' || r == ')' || r == ';' || r == '<' || r == '>' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// writeReceived writes the Received header to the current message,
+// a line at a time. Write errors show up again with the message.
+func (s *session) writeReceived() {
+	hdr := ReceivedLine(s, EnvelopeInfo{
+		Hostname:  s.srv.hostname(),
+		ID:        s.id,
+		ClientPTR: s.verifiedName(),
+		Rcpts:     s.rcpts,
+	}, s.srv.now)
+	for _, line := range bytes.SplitAfter(hdr, []byte("\r\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if s.write(line) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package redisstore implements an smtpd.Store backed by a Redis
+// server, so several smtpd instances can share policy state.
+package redisstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+var _ smtpd.Store = (*Store)(nil)
+
+// Store is an smtpd.Store using Redis.
+type Store struct {
+	Addr     string        // host:port of the Redis server
+	Password string        // optional AUTH password
+	DB       int           // database number to SELECT
+	Prefix   string        // optional prefix for all keys
+	Timeout  time.Duration // optional dial and I/O timeout
+	MaxIdle  int           // idle connections kept; 2 if zero
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+// New returns a Store for the Redis server at addr.
+func New(addr string) *Store {
+	return &Store{Addr: addr, Timeout: 5 * time.Second}
+}
+
+type conn struct {
+	nc net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+// Error is an error reply from the Redis server.
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+func (s *Store) get() (*conn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+	nc, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{nc: nc, br: bufio.NewReader(nc), bw: bufio.NewWriter(nc)}
+	if s.Password != "" {
+		if _, err := s.roundTrip(c, "AUTH", s.Password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if s.DB != 0 {
+		if _, err := s.roundTrip(c, "SELECT", strconv.Itoa(s.DB)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *Store) put(c *conn) {
+	max := s.MaxIdle
+	if max == 0 {
+		max = 2
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= max {
+		c.nc.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+// do runs a command and returns its reply: nil, an int64, a string
+// or a []byte.
+func (s *Store) do(args ...string) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	v, err := s.roundTrip(c, args...)
+	if _, ok := err.(Error); err != nil && !ok {
+		c.nc.Close()
+		return nil, err
+	}
+	s.put(c)
+	return v, err
+}
+
+func (s *Store) roundTrip(c *conn, args ...string) (interface{}, error) {
+	if s.Timeout != 0 {
+		c.nc.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	fmt.Fprintf(c.bw, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.bw, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.br)
+}
+
+func readReply(br *bufio.Reader) (interface{}, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, Error(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
+
+func (s *Store) Get(key string) ([]byte, error) {
+	v, err := s.do("GET", s.Prefix+key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %v", v)
+	}
+	return b, nil
+}
+
+func ms(d time.Duration) string {
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+func (s *Store) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.do("SET", s.Prefix+key, string(value), "PX", ms(ttl))
+	return err
+}
+
+// Incr increments key. The expiry is set by a separate command after
+// the key is created, so if that fails the key won't expire.
+func (s *Store) Incr(key string, ttl time.Duration) (int64, error) {
+	v, err := s.do("INCR", s.Prefix+key)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCR reply %v", v)
+	}
+	if n == 1 {
+		if _, err := s.do("PEXPIRE", s.Prefix+key, ms(ttl)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *Store) Delete(key string) error {
+	_, err := s.do("DEL", s.Prefix+key)
+	return err
+}
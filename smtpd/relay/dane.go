@@ -0,0 +1,146 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// TLSA usages, selectors and matching types used for SMTP
+// (RFC 7672 s3.1). PKIX usages are unusable with SMTP and ignored.
+const (
+	DANETA = 2 // trust anchor
+	DANEEE = 3 // end entity
+
+	SelectorCert = 0
+	SelectorSPKI = 1
+
+	MatchFull   = 0
+	MatchSHA256 = 1
+	MatchSHA512 = 2
+)
+
+// TLSA is a TLSA record (RFC 6698).
+type TLSA struct {
+	Usage, Selector, MatchingType uint8
+	Data                          []byte
+}
+
+// TLSAResolver looks up TLSA records. The standard library can't,
+// nor can it check DNSSEC, so users wanting DANE must supply one
+// backed by a validating resolver.
+type TLSAResolver interface {
+	// LookupTLSA returns the TLSA records for name, such as
+	// "_25._tcp.mx.example.com". It must return only records whose
+	// DNSSEC signatures were validated, and none if the zone is
+	// insecure. A non-nil error means the lookup failed and the
+	// host can't be used.
+	LookupTLSA(ctx context.Context, name string) ([]TLSA, error)
+}
+
+// usableTLSA returns the records usable for SMTP.
+func usableTLSA(rrs []TLSA) []TLSA {
+	var usable []TLSA
+	for _, rr := range rrs {
+		if (rr.Usage == DANETA || rr.Usage == DANEEE) && rr.Selector <= SelectorSPKI && rr.MatchingType <= MatchSHA512 {
+			usable = append(usable, rr)
+		}
+	}
+	return usable
+}
+
+// matches reports whether rr's data matches cert.
+func (rr *TLSA) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if rr.Selector == SelectorSPKI {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch rr.MatchingType {
+	case MatchSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case MatchSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, rr.Data)
+}
+
+var errDANE = errors.New("relay: server certificate matches no TLSA record")
+
+// verifyDANE checks the certificates in cs against rrs, for the MX
+// host name host (RFC 7672 s3). DANE-EE records match the server's
+// own certificate, whatever its names and dates; DANE-TA records
+// match a certificate in its chain, which must then validate the
+// server's for host.
+func verifyDANE(cs tls.ConnectionState, rrs []TLSA, host string) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return errDANE
+	}
+	for _, rr := range rrs {
+		if rr.Usage == DANEEE && rr.matches(certs[0]) {
+			return nil
+		}
+	}
+	for _, rr := range rrs {
+		if rr.Usage != DANETA {
+			continue
+		}
+		for i, ta := range certs {
+			if !rr.matches(ta) {
+				continue
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(ta)
+			inter := x509.NewCertPool()
+			for _, c := range certs[1:i] {
+				inter.AddCert(c)
+			}
+			if i == 0 {
+				// The trust anchor is the server's
+				// certificate itself; only the name matters.
+				if certs[0].VerifyHostname(host) == nil {
+					return nil
+				}
+				continue
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       host,
+				Roots:         roots,
+				Intermediates: inter,
+			})
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return errDANE
+}
+
+// verifyPKIX checks the certificates in cs the way crypto/tls does
+// by default, for when verification is done by hand.
+func verifyPKIX(cs tls.ConnectionState, roots *x509.CertPool, host string) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("relay: server sent no certificate")
+	}
+	inter := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inter.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: inter,
+	})
+	return err
+}
@@ -0,0 +1,148 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+)
+
+// TLSResult is the outcome of applying a destination's TLS policy,
+// for TLS reporting (RFC 8460).
+type TLSResult struct {
+	Domain string // the recipient domain
+	MX     string // the host, or "" if fetching the policy failed
+	Policy string // "sts" or "dane"
+	Mode   string // the MTA-STS policy's mode
+	Err    error  // nil on success
+}
+
+// tlsPolicy is how TLS is required and verified for one host, and
+// the other settings for connecting to it.
+type tlsPolicy struct {
+	auth         smtp.Auth
+	config       *tls.Config // base configuration, or nil
+	needTLS      bool        // fail without STARTTLS
+	domain, host string
+	kind, mode   string // as in TLSResult; kind is "" for none
+	tlsa         []TLSA
+	verify       bool // verify the certificate, with DANE if tlsa is set
+	enforce      bool // fail on TLS or verification errors
+	requireTLS   bool // the message was sent with REQUIRETLS
+}
+
+// policy returns the TLS policy for sending mail for domain via
+// hostport, one of its MX hosts, or for the empty domain via a fixed
+// host. r is the domain's Route, and sts its MTA-STS policy, if any.
+// Relaxed messages, with "TLS-Required: No", are sent despite policy
+// failures.
+func (c *Client) policy(ctx context.Context, domain, hostport string, r *Route, sts *STSPolicy, requireTLS, relaxed bool) (*tlsPolicy, error) {
+	name, _, _ := net.SplitHostPort(hostport)
+	p := &tlsPolicy{
+		auth:       c.Auth,
+		config:     c.TLSConfig,
+		needTLS:    c.RequireTLS,
+		domain:     domain,
+		host:       name,
+		requireTLS: requireTLS,
+	}
+	if r != nil {
+		if r.Auth != nil {
+			p.auth = r.Auth
+		}
+		if r.TLSConfig != nil {
+			p.config = r.TLSConfig
+		}
+		p.needTLS = p.needTLS || r.RequireTLS
+	}
+	if domain == "" {
+		p.verify, p.enforce = requireTLS, requireTLS
+		return p, nil
+	}
+	if c.DANE != nil {
+		rrs, err := c.DANE.LookupTLSA(ctx, "_25._tcp."+name)
+		if err != nil {
+			return nil, &textproto.Error{Code: 451, Msg: fmt.Sprintf("4.7.5 TLSA lookup for %s failed: %v", name, err)}
+		}
+		if p.tlsa = usableTLSA(rrs); len(p.tlsa) > 0 {
+			p.kind, p.verify, p.enforce = "dane", true, true
+		}
+	}
+	if p.kind == "" && sts != nil {
+		p.kind, p.mode, p.verify = "sts", sts.Mode, true
+		p.enforce = sts.Mode == STSEnforce
+		if !sts.Match(name) {
+			err := fmt.Errorf("relay: MX %s not allowed by the MTA-STS policy of %s", name, domain)
+			c.report(p, err)
+			if requireTLS || (p.enforce && !relaxed) {
+				return nil, &textproto.Error{Code: 451, Msg: "4.7.5 " + strings.TrimPrefix(err.Error(), "relay: ")}
+			}
+		}
+	}
+	if requireTLS {
+		if p.kind == "" {
+			return nil, &textproto.Error{Code: 550, Msg: "5.7.30 REQUIRETLS: no MTA-STS or DANE policy for " + domain}
+		}
+		p.enforce = true
+	}
+	if relaxed {
+		p.enforce = false
+	}
+	return p, nil
+}
+
+// report passes the result of applying p to ReportTLS.
+func (c *Client) report(p *tlsPolicy, err error) {
+	if c.ReportTLS == nil || p.kind == "" {
+		return
+	}
+	c.ReportTLS(TLSResult{Domain: p.domain, MX: p.host, Policy: p.kind, Mode: p.mode, Err: err})
+}
+
+// tlsConfig returns the configuration for STARTTLS with host under
+// p. Verification errors are stored in *verr, whether or not they
+// fail the handshake.
+func (p *tlsPolicy) tlsConfig(host string, verr *error) *tls.Config {
+	if !p.verify {
+		if p.config != nil {
+			return p.config
+		}
+		return &tls.Config{ServerName: host}
+	}
+	cfg := &tls.Config{}
+	if p.config != nil {
+		cfg = p.config.Clone()
+	}
+	cfg.ServerName = host
+	roots := cfg.RootCAs
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(p.tlsa) > 0 {
+			*verr = verifyDANE(cs, p.tlsa, host)
+		} else {
+			*verr = verifyPKIX(cs, roots, host)
+		}
+		if p.enforce {
+			return *verr
+		}
+		return nil
+	}
+	return cfg
+}
+
+// tlsNotRequired reports whether the message has a "TLS-Required: No"
+// header (RFC 8689 s5), asking for TLS policies not to be enforced.
+func tlsNotRequired(msg []byte) bool {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg)))
+	h, _ := r.ReadMIMEHeader()
+	return strings.EqualFold(strings.TrimSpace(h.Get("TLS-Required")), "No")
+}
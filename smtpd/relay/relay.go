@@ -0,0 +1,412 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package relay implements an SMTP client that forwards messages to a
+// smarthost or directly to recipients' mail exchangers.
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+	"github.com/bradfitz/go-smtpd/smtpd/downgrade"
+	"github.com/bradfitz/go-smtpd/smtpd/verp"
+)
+
+// Client forwards messages over SMTP.
+type Client struct {
+	// Smarthost, if non-empty, is the host:port all mail is sent
+	// through. Otherwise mail goes to each recipient domain's MX
+	// hosts on port 25.
+	Smarthost string
+
+	// Auth, if non-nil, authenticates with the smarthost.
+	Auth smtp.Auth
+
+	// LocalName is the name sent with EHLO; "localhost" if empty.
+	LocalName string
+
+	// TLSConfig, if non-nil, is used to STARTTLS when the server
+	// offers it. If nil, a default configuration verifying the
+	// server's name is used. Set RequireTLS to refuse servers that
+	// don't offer STARTTLS.
+	TLSConfig  *tls.Config
+	RequireTLS bool
+
+	// Timeout bounds each connection's lifetime; 5 minutes if zero.
+	Timeout time.Duration
+
+	// Resolver, if non-nil, is used for MX lookups.
+	Resolver smtpd.Resolver
+
+	// SelectSource, if non-nil, chooses the local address to send
+	// a message from sender from to the recipient domain (empty
+	// when sending to Smarthost), such as to keep bulk and
+	// transactional mail on separate IPs.
+	SelectSource func(from, domain string) Source
+
+	// VERP sends each recipient its own copy of a message, from a
+	// sender encoding the recipient's address (see package verp),
+	// so bounces can be attributed. Null senders are left alone.
+	VERP bool
+
+	// STS, if non-nil, applies recipient domains' MTA-STS policies
+	// when delivering to MX hosts.
+	STS *STSCache
+
+	// DANE, if non-nil, looks up MX hosts' TLSA records, which
+	// take precedence over MTA-STS policies (RFC 7672). Resolver
+	// should then be a validating resolver too.
+	DANE TLSAResolver
+
+	// ReportTLS, if non-nil, is called with the result of each
+	// connection made under an MTA-STS or DANE policy, and for
+	// policies that couldn't be fetched.
+	ReportTLS func(TLSResult)
+
+	// Routes maps destination domains to how their mail is sent.
+	// A key such as "example.com" matches that domain,
+	// ".example.com" its subdomains, and "*" any other. A Route's
+	// limits are shared by the domains it matches, except for the
+	// "*" Route's, which apply to each domain separately.
+	Routes map[string]*Route
+
+	mu       sync.Mutex
+	limiters map[string]*limiter
+}
+
+// Source is a local address to send from.
+type Source struct {
+	IP net.IP // nil to let the system choose
+
+	// Name is the name sent with EHLO, which should match IP's
+	// reverse DNS. Client.LocalName is used if it's empty.
+	Name string
+}
+
+// source returns the Source for sending from from to domain.
+func (c *Client) source(from, domain string) Source {
+	var src Source
+	if c.SelectSource != nil {
+		src = c.SelectSource(from, domain)
+	}
+	if src.Name == "" {
+		src.Name = c.LocalName
+	}
+	if src.Name == "" {
+		src.Name = "localhost"
+	}
+	return src
+}
+
+// Send delivers the message read from r from from to rcpts. The
+// returned slice holds the result for each recipient. Errors holding
+// SMTP replies are *textproto.Error values; permanent failures have
+// 5xx codes (see IsPermanent).
+func (c *Client) Send(from string, rcpts []string, r io.Reader) (rcptErrs []error, err error) {
+	return c.send(from, rcpts, r, false)
+}
+
+// SendRequireTLS is like Send, for a message sent with the REQUIRETLS
+// extension (RFC 8689). It's only delivered over TLS to servers that
+// support REQUIRETLS and are authenticated by DANE, or by MTA-STS and
+// their certificate; the Smarthost needs only the certificate.
+func (c *Client) SendRequireTLS(from string, rcpts []string, r io.Reader) (rcptErrs []error, err error) {
+	return c.send(from, rcpts, r, true)
+}
+
+func (c *Client) send(from string, rcpts []string, r io.Reader, requireTLS bool) (rcptErrs []error, err error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rcptErrs = make([]error, len(rcpts))
+	if c.VERP && from != "" {
+		for domain, idx := range c.route(rcpts) {
+			for _, j := range idx {
+				errs := c.sendDomain(domain, verp.Encode(from, rcpts[j]), rcpts[j:j+1], body, requireTLS)
+				rcptErrs[j] = errs[0]
+			}
+		}
+		return rcptErrs, nil
+	}
+	for domain, idx := range c.route(rcpts) {
+		addrs := make([]string, len(idx))
+		for i, j := range idx {
+			addrs[i] = rcpts[j]
+		}
+		errs := c.sendDomain(domain, from, addrs, body, requireTLS)
+		for i, j := range idx {
+			rcptErrs[j] = errs[i]
+		}
+	}
+	return rcptErrs, nil
+}
+
+// route groups recipients by the domain they're delivered through,
+// returning their indexes. Mail for domains without a Route goes
+// through the Smarthost, if set, under the empty domain.
+func (c *Client) route(rcpts []string) map[string][]int {
+	m := make(map[string][]int)
+	for i, rcpt := range rcpts {
+		domain := ""
+		if at := strings.LastIndex(rcpt, "@"); at != -1 {
+			domain = strings.ToLower(rcpt[at+1:])
+		}
+		if c.Smarthost != "" {
+			if _, r := c.lookupRoute(domain); r == nil {
+				domain = ""
+			}
+		}
+		m[domain] = append(m[domain], i)
+	}
+	return m
+}
+
+// hosts returns the host:port addresses to try for domain's MX hosts,
+// in order.
+func (c *Client) hosts(ctx context.Context, domain string) ([]string, error) {
+	res := c.Resolver
+	if res == nil {
+		res = net.DefaultResolver
+	}
+	mxs, err := res.LookupMX(ctx, domain)
+	if err != nil {
+		var de *net.DNSError
+		if !errors.As(err, &de) || !de.IsNotFound {
+			return nil, err
+		}
+		mxs = nil
+	}
+	if len(mxs) == 0 {
+		// Implicit MX (RFC 5321 s5.1).
+		return []string{net.JoinHostPort(domain, "25")}, nil
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	var hosts []string
+	for _, mx := range mxs {
+		if mx.Host == "." {
+			return nil, &textproto.Error{Code: 556, Msg: "5.1.10 Recipient address has null MX"}
+		}
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), "25"))
+	}
+	return hosts, nil
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 5 * time.Minute
+	}
+	return c.Timeout
+}
+
+// sendDomain delivers to rcpts, trying each of domain's hosts until
+// one of them gives an answer other than a temporary failure for the
+// whole transaction.
+func (c *Client) sendDomain(domain, from string, rcpts []string, body []byte, requireTLS bool) []error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+	fill := func(err error) []error {
+		errs := make([]error, len(rcpts))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	key, r := c.lookupRoute(domain)
+	var hosts []string
+	var err error
+	mxDomain := ""
+	switch {
+	case r != nil && r.Host != "":
+		hosts = []string{r.Host}
+	case c.Smarthost != "":
+		hosts = []string{c.Smarthost}
+	default:
+		mxDomain = domain
+		hosts, err = c.hosts(ctx, domain)
+	}
+	if err != nil {
+		return fill(err)
+	}
+	lim := c.limiter(domain, key, r)
+	if lim != nil {
+		if err := lim.waitMessage(ctx, r); err != nil {
+			return fill(err)
+		}
+	}
+	var sts *STSPolicy
+	if c.STS != nil && mxDomain != "" {
+		var perr error
+		sts, perr = c.STS.Policy(ctx, domain)
+		if perr != nil {
+			c.report(&tlsPolicy{domain: domain, kind: "sts"}, perr)
+		}
+		if sts != nil && sts.Mode == STSNone {
+			sts = nil
+		}
+	}
+	relaxed := !requireTLS && tlsNotRequired(body)
+	src := c.source(from, domain)
+	for _, host := range hosts {
+		var p *tlsPolicy
+		p, err = c.policy(ctx, mxDomain, host, r, sts, requireTLS, relaxed)
+		if err != nil {
+			if IsPermanent(err) {
+				break
+			}
+			continue
+		}
+		if lim != nil {
+			if err = lim.acquireConn(ctx); err != nil {
+				break
+			}
+		}
+		var errs []error
+		errs, err = c.sendHost(ctx, src, host, p, from, rcpts, body)
+		if lim != nil {
+			lim.releaseConn()
+		}
+		if err == nil {
+			return errs
+		}
+		if IsPermanent(err) {
+			break
+		}
+	}
+	return fill(err)
+}
+
+// sendHost delivers to rcpts via host under the TLS policy p. A
+// non-nil error applies to all recipients.
+func (c *Client) sendHost(ctx context.Context, src Source, host string, p *tlsPolicy, from string, rcpts []string, body []byte) ([]error, error) {
+	var d net.Dialer
+	if src.IP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: src.IP}
+	}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	serverName, _, _ := net.SplitHostPort(host)
+	sc, err := smtp.NewClient(conn, serverName)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer sc.Close()
+	if err := sc.Hello(src.Name); err != nil {
+		return nil, err
+	}
+	if ok, _ := sc.Extension("STARTTLS"); ok {
+		var verr error
+		err := sc.StartTLS(p.tlsConfig(serverName, &verr))
+		if verr == nil {
+			verr = err
+		}
+		c.report(p, verr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := &textproto.Error{Code: 454, Msg: "4.7.10 TLS not available from " + serverName}
+		c.report(p, err)
+		if p.needTLS || p.enforce {
+			return nil, err
+		}
+	}
+	if p.requireTLS {
+		if ok, _ := sc.Extension("REQUIRETLS"); !ok {
+			return nil, &textproto.Error{Code: 550, Msg: "5.7.30 REQUIRETLS not supported by " + serverName}
+		}
+	}
+	if p.auth != nil {
+		if err := sc.Auth(p.auth); err != nil {
+			return nil, err
+		}
+	}
+	if ok, _ := sc.Extension("8BITMIME"); !ok {
+		body = downgrade.Message(body)
+	}
+	if err := mail(sc, from, p.requireTLS); err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(rcpts))
+	accepted := 0
+	for i, rcpt := range rcpts {
+		if errs[i] = sc.Rcpt(rcpt); errs[i] == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		sc.Quit()
+		return errs, nil
+	}
+	w, err := sc.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	sc.Quit()
+	return errs, nil
+}
+
+// mail sends the MAIL command, which net/smtp can't do with the
+// REQUIRETLS parameter.
+func mail(sc *smtp.Client, from string, requireTLS bool) error {
+	if !requireTLS {
+		return sc.Mail(from)
+	}
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("relay: sender contains CR or LF")
+	}
+	cmd := "MAIL FROM:<%s>"
+	if ok, _ := sc.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := sc.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	id, err := sc.Text.Cmd(cmd+" REQUIRETLS", from)
+	if err != nil {
+		return err
+	}
+	sc.Text.StartResponse(id)
+	defer sc.Text.EndResponse(id)
+	_, _, err = sc.Text.ReadResponse(250)
+	return err
+}
+
+// IsPermanent reports whether err is a permanent delivery failure: a
+// 5xx SMTP reply.
+func IsPermanent(err error) bool {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return te.Code >= 500
+	}
+	var se smtpd.SMTPError
+	if errors.As(err, &se) {
+		return strings.HasPrefix(string(se), "5")
+	}
+	return false
+}
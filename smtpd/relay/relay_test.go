@@ -0,0 +1,348 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// mx is an SMTP server for tests, keeping the messages it accepts.
+// Recipients in refuse are refused with their replies.
+type mx struct {
+	addr   string
+	refuse map[string]smtpd.SMTPError
+
+	mu   sync.Mutex
+	msgs []message
+}
+
+type message struct {
+	from  string
+	rcpts []string
+	body  string
+}
+
+type collector struct {
+	s   *mx
+	msg message
+}
+
+func (e *collector) AddRecipient(rcpt smtpd.MailAddress) error {
+	if err, ok := e.s.refuse[rcpt.Email()]; ok {
+		return err
+	}
+	e.msg.rcpts = append(e.msg.rcpts, rcpt.Email())
+	return nil
+}
+
+func (e *collector) BeginData() error        { return nil }
+func (e *collector) Write(line []byte) error { e.msg.body += string(line); return nil }
+
+func (e *collector) Close() error {
+	e.s.mu.Lock()
+	defer e.s.mu.Unlock()
+	e.s.msgs = append(e.s.msgs, e.msg)
+	return nil
+}
+
+func newMX(t *testing.T) *mx {
+	t.Helper()
+	s := &mx{refuse: map[string]smtpd.SMTPError{"nobody@example.com": "550 5.1.1 User unknown"}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &smtpd.Server{
+		Hostname: "mx.example.com",
+		Log:      func(string, ...interface{}) {}, // sessions may outlive the test
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			return &collector{s: s, msg: message{from: from.Email()}}, nil
+		},
+	}
+	go srv.Serve(ln)
+	s.addr = ln.Addr().String()
+	return s
+}
+
+func (s *mx) received() []message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := append([]message(nil), s.msgs...)
+	sort.Slice(msgs, func(i, j int) bool { return strings.Join(msgs[i].rcpts, ",") < strings.Join(msgs[j].rcpts, ",") })
+	return msgs
+}
+
+// codes returns the reply code of each of errs, 0 for nil.
+func codes(t *testing.T, errs []error) []int {
+	t.Helper()
+	c := make([]int, len(errs))
+	for i, err := range errs {
+		var te *textproto.Error
+		if errors.As(err, &te) {
+			c[i] = te.Code
+		} else if err != nil {
+			t.Errorf("recipient %d: %v", i, err)
+		}
+	}
+	return c
+}
+
+const testMessage = "Subject: hi\r\n\r\n.leading dot\r\nbody\r\n"
+
+func TestSmarthost(t *testing.T) {
+	s := newMX(t)
+	c := &Client{Smarthost: s.addr, Timeout: 5 * time.Second}
+	errs, err := c.Send("sender@example.org", []string{"jane@example.com", "nobody@example.com", "joe@example.net"}, strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := codes(t, errs); !reflect.DeepEqual(got, []int{0, 550, 0}) {
+		t.Errorf("reply codes %v", got)
+	}
+	if !IsPermanent(errs[1]) {
+		t.Errorf("IsPermanent(%v) = false", errs[1])
+	}
+	want := []message{{"sender@example.org", []string{"jane@example.com", "joe@example.net"}, testMessage}}
+	if got := s.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("received %+v; want %+v", got, want)
+	}
+}
+
+func TestVERP(t *testing.T) {
+	s := newMX(t)
+	c := &Client{Smarthost: s.addr, Timeout: 5 * time.Second, VERP: true}
+	if _, err := c.Send("bounces@lists.org", []string{"jane@example.com", "joe@example.net"}, strings.NewReader(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	// Bounces aren't VERP-encoded.
+	if _, err := c.Send("", []string{"jane@example.com", "joe@example.net"}, strings.NewReader(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range s.received() {
+		got = append(got, m.from+" -> "+strings.Join(m.rcpts, ","))
+	}
+	sort.Strings(got)
+	want := []string{
+		" -> jane@example.com,joe@example.net",
+		"bounces+jane=example.com@lists.org -> jane@example.com",
+		"bounces+joe=example.net@lists.org -> joe@example.net",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q; want %q", got, want)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	a, b, smart := newMX(t), newMX(t), newMX(t)
+	c := &Client{
+		Smarthost: smart.addr,
+		Timeout:   5 * time.Second,
+		Routes: map[string]*Route{
+			"example.com":  {Host: a.addr},
+			".example.net": {Host: b.addr},
+		},
+	}
+	rcpts := []string{"jane@example.com", "joe@sub.example.net", "jill@sub.example.net", "ann@example.org"}
+	errs, err := c.Send("sender@example.org", rcpts, strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes(t, errs)
+	for _, tt := range []struct {
+		s    *mx
+		want []string
+	}{
+		{a, []string{"jane@example.com"}},
+		{b, []string{"joe@sub.example.net", "jill@sub.example.net"}},
+		{smart, []string{"ann@example.org"}},
+	} {
+		if msgs := tt.s.received(); len(msgs) != 1 || !reflect.DeepEqual(msgs[0].rcpts, tt.want) {
+			t.Errorf("%s received %+v; want one message to %q", tt.s.addr, msgs, tt.want)
+		}
+	}
+
+	for domain, want := range map[string]string{
+		"example.com":     "example.com",
+		"sub.example.com": "",
+		"example.net":     "",
+		"a.example.net":   ".example.net",
+		"a.b.example.net": ".example.net",
+		"":                "",
+	} {
+		if key, _ := c.lookupRoute(domain); key != want {
+			t.Errorf("lookupRoute(%q) = %q; want %q", domain, key, want)
+		}
+	}
+	c.Routes["*"] = &Route{Host: a.addr}
+	if key, _ := c.lookupRoute("example.org"); key != "*" {
+		t.Errorf("lookupRoute with a default route = %q", key)
+	}
+}
+
+func TestDeliveryFailures(t *testing.T) {
+	s := newMX(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	// An unreachable host fails every recipient temporarily.
+	c := &Client{Smarthost: down, Timeout: 5 * time.Second}
+	errs, err := c.Send("sender@example.org", []string{"jane@example.com", "joe@example.com"}, strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range errs {
+		if err == nil || IsPermanent(err) {
+			t.Errorf("unreachable host: recipient %d: %v; want a temporary failure", i, err)
+		}
+	}
+
+	// As does a host without STARTTLS when a Route requires TLS.
+	c = &Client{Timeout: 5 * time.Second, Routes: map[string]*Route{"example.com": {Host: s.addr, RequireTLS: true}}}
+	errs, _ = c.Send("sender@example.org", []string{"jane@example.com"}, strings.NewReader(testMessage))
+	if got := codes(t, errs); got[0] != 454 {
+		t.Errorf("RequireTLS without STARTTLS: %v; want 454", errs[0])
+	}
+	if msgs := s.received(); len(msgs) != 0 {
+		t.Errorf("sent %+v in the clear", msgs)
+	}
+}
+
+// mxResolver is a Resolver answering MX lookups from a map. Names
+// mapped to nil fail temporarily, and others are not found.
+type mxResolver map[string][]*net.MX
+
+func (r mxResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) { return nil, nil }
+func (r mxResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, nil
+}
+func (r mxResolver) LookupTXT(ctx context.Context, name string) ([]string, error) { return nil, nil }
+
+func (r mxResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if mxs == nil {
+		return nil, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	return mxs, nil
+}
+
+func TestHosts(t *testing.T) {
+	c := &Client{Resolver: mxResolver{
+		"example.com":   {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}, {Host: "mx3.example.com.", Pref: 20}},
+		"null.example":  {{Host: ".", Pref: 0}},
+		"flaky.example": nil,
+	}}
+	tests := []struct {
+		domain string
+		want   []string
+		code   int // of the error, or -1 for a non-SMTP one
+	}{
+		{"example.com", []string{"mx1.example.com:25", "mx2.example.com:25", "mx3.example.com:25"}, 0},
+		{"nomx.example", []string{"nomx.example:25"}, 0},
+		{"null.example", nil, 556},
+		{"flaky.example", nil, -1},
+	}
+	for _, tt := range tests {
+		hosts, err := c.hosts(context.Background(), tt.domain)
+		code := 0
+		var te *textproto.Error
+		if errors.As(err, &te) {
+			code = te.Code
+		} else if err != nil {
+			code = -1
+		}
+		if !reflect.DeepEqual(hosts, tt.want) || code != tt.code {
+			t.Errorf("hosts(%q) = %q, %v; want %q, code %d", tt.domain, hosts, err, tt.want, tt.code)
+		}
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&textproto.Error{Code: 550, Msg: "5.1.1 no"}, true},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 later"}, false},
+		{smtpd.SMTPError("554 5.7.1 no"), true},
+		{smtpd.SMTPError("421 4.3.2 closing"), false},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsPermanent(tt.err); got != tt.want {
+			t.Errorf("IsPermanent(%v) = %v", tt.err, got)
+		}
+	}
+}
+
+func TestSTSPolicy(t *testing.T) {
+	p, err := parseSTSPolicy(strings.NewReader("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 604800\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != STSEnforce || p.MaxAge != 7*24*time.Hour || len(p.MX) != 2 {
+		t.Errorf("policy %+v", p)
+	}
+	for host, want := range map[string]bool{
+		"mail.example.com":  true,
+		"MAIL.example.com.": true,
+		"mx1.example.net":   true,
+		"a.b.example.net":   false,
+		"example.net":       false,
+		"mail2.example.com": false,
+	} {
+		if got := p.Match(host); got != want {
+			t.Errorf("Match(%q) = %v", host, got)
+		}
+	}
+
+	p, err = parseSTSPolicy(strings.NewReader("version: STSv1\nmode: none\nmax_age: 99999999999\n"))
+	if err != nil || p.MaxAge != maxSTSAge {
+		t.Errorf("capped max_age: %+v, %v", p, err)
+	}
+	for _, bad := range []string{
+		"mode: enforce\nmx: a.example\nmax_age: 1\n",
+		"version: STSv1\nmode: strict\nmx: a.example\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmax_age: 1\n",
+		"version: STSv1\nmode: testing\nmx: a.example\n",
+	} {
+		if _, err := parseSTSPolicy(strings.NewReader(bad)); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestTLSNotRequired(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"TLS-Required: No\r\nSubject: x\r\n\r\nbody\r\n": true,
+		"Subject: x\r\ntls-required:  no \r\n\r\n":       true,
+		"Subject: x\r\n\r\nTLS-Required: No\r\n":         false,
+		"TLS-Required: Yes\r\n\r\n":                      false,
+	} {
+		if got := tlsNotRequired([]byte(msg)); got != want {
+			t.Errorf("tlsNotRequired(%q) = %v", msg, got)
+		}
+	}
+}
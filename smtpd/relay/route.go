@@ -0,0 +1,154 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route is how mail for a destination domain is sent, overriding the
+// Client's settings, like an entry in Postfix's transport map.
+type Route struct {
+	// Host, if non-empty, is the host:port mail is sent to instead
+	// of the Smarthost or the domain's MX hosts. MTA-STS and DANE
+	// don't apply to it.
+	Host string
+
+	// Auth and TLSConfig, if non-nil, replace the Client's.
+	Auth      smtp.Auth
+	TLSConfig *tls.Config
+
+	// RequireTLS refuses servers that don't offer STARTTLS.
+	RequireTLS bool
+
+	// MaxConns, if non-zero, limits the concurrent connections
+	// to the destination.
+	MaxConns int
+
+	// MaxMessages, if non-zero, limits the messages sent to the
+	// destination to MaxMessages every Per (a minute if zero),
+	// evenly spaced. Messages wait for their turn, up to the
+	// Client's Timeout.
+	MaxMessages int
+	Per         time.Duration
+}
+
+// lookupRoute returns the route for domain and its key in c.Routes,
+// or nil if there's none.
+func (c *Client) lookupRoute(domain string) (key string, r *Route) {
+	if domain == "" || len(c.Routes) == 0 {
+		return "", nil
+	}
+	if r := c.Routes[domain]; r != nil {
+		return domain, r
+	}
+	for d := domain; ; {
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+		if r := c.Routes["."+d]; r != nil {
+			return "." + d, r
+		}
+	}
+	if r := c.Routes["*"]; r != nil {
+		return "*", r
+	}
+	return "", nil
+}
+
+// limiter enforces a Route's limits.
+type limiter struct {
+	conns chan struct{} // nil if unlimited
+
+	mu   sync.Mutex
+	next time.Time // when the next message may be sent
+}
+
+// limiter returns the limiter for mail to domain through the route r
+// found under key, or nil if it has no limits.
+func (c *Client) limiter(domain, key string, r *Route) *limiter {
+	if r == nil || (r.MaxConns == 0 && r.MaxMessages == 0) {
+		return nil
+	}
+	if key == "*" {
+		key = domain
+	} else {
+		key = "route " + key
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limiters == nil {
+		c.limiters = make(map[string]*limiter)
+	}
+	l := c.limiters[key]
+	if l == nil {
+		l = new(limiter)
+		if r.MaxConns > 0 {
+			l.conns = make(chan struct{}, r.MaxConns)
+		}
+		c.limiters[key] = l
+	}
+	return l
+}
+
+var errRateLimited = &textproto.Error{Code: 451, Msg: "4.4.5 Destination rate limit reached; try again later"}
+
+// waitMessage waits for the turn of a message under r's message rate.
+func (l *limiter) waitMessage(ctx context.Context, r *Route) error {
+	if r.MaxMessages == 0 {
+		return nil
+	}
+	per := r.Per
+	if per == 0 {
+		per = time.Minute
+	}
+	now := time.Now()
+	l.mu.Lock()
+	t := l.next
+	if t.Before(now) {
+		t = now
+	}
+	l.next = t.Add(per / time.Duration(r.MaxMessages))
+	l.mu.Unlock()
+	if t == now {
+		return nil
+	}
+	timer := time.NewTimer(t.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errRateLimited
+	}
+}
+
+// acquireConn waits for a free connection slot. The caller must call
+// releaseConn after.
+func (l *limiter) acquireConn(ctx context.Context) error {
+	if l.conns == nil {
+		return nil
+	}
+	select {
+	case l.conns <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errRateLimited
+	}
+}
+
+func (l *limiter) releaseConn() {
+	if l.conns != nil {
+		<-l.conns
+	}
+}
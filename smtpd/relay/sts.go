@@ -0,0 +1,219 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// STS modes.
+const (
+	STSEnforce = "enforce"
+	STSTesting = "testing"
+	STSNone    = "none"
+)
+
+// STSPolicy is a domain's MTA-STS policy (RFC 8461).
+type STSPolicy struct {
+	ID      string   // from the _mta-sts TXT record
+	Mode    string   // STSEnforce, STSTesting or STSNone
+	MX      []string // patterns such as "mx.example.com" or "*.example.com"
+	MaxAge  time.Duration
+	Expires time.Time
+}
+
+// Match reports whether the MX host name host is allowed by p.
+func (p *STSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pat := range p.MX {
+		pat = strings.ToLower(pat)
+		if rest, ok := strings.CutPrefix(pat, "*."); ok {
+			if i := strings.IndexByte(host, '.'); i > 0 && host[i+1:] == rest {
+				return true
+			}
+		} else if host == pat {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSTSAge is the longest a policy is cached.
+const maxSTSAge = 31557600 * time.Second
+
+// STSCache fetches domains' MTA-STS policies and caches them for
+// their max_age, as RFC 8461 requires. Its zero value is ready to use.
+type STSCache struct {
+	// Resolver, if non-nil, is used for the _mta-sts TXT lookups.
+	Resolver smtpd.Resolver
+
+	// HTTPClient, if non-nil, fetches the policies. Redirects are
+	// never followed.
+	HTTPClient *http.Client
+
+	// Clock, if non-nil, is used for policy expiry.
+	Clock smtpd.Clock
+
+	mu       sync.Mutex
+	policies map[string]*STSPolicy
+}
+
+func (c *STSCache) now() time.Time {
+	if c.Clock == nil {
+		return smtpd.SystemClock.Now()
+	}
+	return c.Clock.Now()
+}
+
+// Policy returns domain's policy, or nil if it has none. A policy
+// that can't be fetched is treated as absent, except that a
+// previously fetched one keeps being used until it expires; the
+// error is returned along with it.
+func (c *STSCache) Policy(ctx context.Context, domain string) (*STSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	c.mu.Lock()
+	cached := c.policies[domain]
+	c.mu.Unlock()
+	if cached != nil && !c.now().Before(cached.Expires) {
+		cached = nil
+	}
+
+	id, err := c.lookupID(ctx, domain)
+	if err != nil || id == "" || (cached != nil && cached.ID == id) {
+		return cached, err
+	}
+	p, err := c.fetch(ctx, domain)
+	if err != nil {
+		return cached, fmt.Errorf("relay: fetching MTA-STS policy for %s: %v", domain, err)
+	}
+	p.ID = id
+	p.Expires = c.now().Add(p.MaxAge)
+	c.mu.Lock()
+	if c.policies == nil {
+		c.policies = make(map[string]*STSPolicy)
+	}
+	c.policies[domain] = p
+	c.mu.Unlock()
+	return p, nil
+}
+
+// lookupID returns the id of domain's STS TXT record, or "" if it
+// has none.
+func (c *STSCache) lookupID(ctx context.Context, domain string) (string, error) {
+	res := c.Resolver
+	if res == nil {
+		res = net.DefaultResolver
+	}
+	txts, err := res.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		var de *net.DNSError
+		if errors.As(err, &de) && de.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	var id string
+	n := 0
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1;") && txt != "v=STSv1" {
+			continue
+		}
+		n++
+		for _, f := range strings.Split(txt, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(f), "id="); ok {
+				id = v
+			}
+		}
+	}
+	if n != 1 {
+		// None, or ambiguous (RFC 8461 s3.1).
+		return "", nil
+	}
+	return id, nil
+}
+
+// fetch retrieves and parses domain's policy file.
+func (c *STSCache) fetch(ctx context.Context, domain string) (*STSPolicy, error) {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = &http.Client{Timeout: time.Minute}
+	}
+	nc := *hc
+	nc.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := nc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", res.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mt != "text/plain" {
+		return nil, fmt.Errorf("content type %q is not text/plain", mt)
+	}
+	return parseSTSPolicy(io.LimitReader(res.Body, 64<<10))
+}
+
+// parseSTSPolicy parses a policy file (RFC 8461 s3.2).
+func parseSTSPolicy(r io.Reader) (*STSPolicy, error) {
+	p := new(STSPolicy)
+	var version string
+	age := int64(-1)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(k) {
+		case "version":
+			version = v
+		case "mode":
+			p.Mode = v
+		case "mx":
+			p.MX = append(p.MX, v)
+		case "max_age":
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				age = n
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case version != "STSv1":
+		return nil, errors.New("bad policy version")
+	case p.Mode != STSEnforce && p.Mode != STSTesting && p.Mode != STSNone:
+		return nil, fmt.Errorf("bad policy mode %q", p.Mode)
+	case age < 0:
+		return nil, errors.New("bad policy max_age")
+	case p.Mode != STSNone && len(p.MX) == 0:
+		return nil, errors.New("policy has no mx")
+	}
+	if age > int64(maxSTSAge/time.Second) {
+		age = int64(maxSTSAge / time.Second)
+	}
+	p.MaxAge = time.Duration(age) * time.Second
+	return p, nil
+}
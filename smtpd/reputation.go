@@ -0,0 +1,191 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reputation events recorded by the server. Hooks may record these
+// and others with Reputation.Record.
+const (
+	EventRejected         = "rejected"          // connection, sender or message rejected
+	EventInvalidRecipient = "invalid-recipient" // recipient rejected
+	EventAuthFailure      = "auth-failure"      // failed authentication
+	EventGreylistPassed   = "greylist-passed"   // retried after greylisting
+	EventAccepted         = "accepted"          // message accepted
+)
+
+// DefaultReputationWeights are the event weights used when
+// Reputation.Weights is nil. Positive weights count against a client.
+var DefaultReputationWeights = map[string]float64{
+	EventRejected:         1,
+	EventInvalidRecipient: 1,
+	EventAuthFailure:      2,
+	EventGreylistPassed:   -1,
+	EventAccepted:         -0.5,
+}
+
+// Reputation tracks the recent behavior of client IP addresses as a
+// score that decays over time. Higher scores are worse. A Server with
+// a Reputation records its own events and, if BlockScore is set,
+// turns away clients whose score reaches it.
+type Reputation struct {
+	// HalfLife is how long it takes an event's weight to halve.
+	// If zero, it's one hour.
+	HalfLife time.Duration
+
+	// Weights gives the weight of each event. If nil,
+	// DefaultReputationWeights is used.
+	Weights map[string]float64
+
+	// BlockScore, if positive, is the score at which an address is
+	// blocked for BlockDuration (one hour if zero).
+	BlockScore    float64
+	BlockDuration time.Duration
+
+	// Store holds the scores. If nil, they're kept in memory.
+	Store Store
+
+	// Clock, if non-nil, times decay and blocks.
+	Clock Clock
+
+	// mu serializes updates from this process. Updates from other
+	// processes sharing Store may race; the scores are heuristics.
+	mu      sync.Mutex
+	mem     MemoryStore
+	memOnce sync.Once
+}
+
+// ipRecord is a client's reputation, as stored in the Store.
+type ipRecord struct {
+	score        float64
+	updated      time.Time
+	blockedUntil time.Time
+}
+
+func (r *Reputation) store() Store {
+	if r.Store != nil {
+		return r.Store
+	}
+	r.memOnce.Do(func() { r.mem.Clock = r.Clock })
+	return &r.mem
+}
+
+func (r *Reputation) halfLife() time.Duration {
+	if r.HalfLife == 0 {
+		return time.Hour
+	}
+	return r.HalfLife
+}
+
+// decayed returns rec's score as of now.
+func (r *Reputation) decayed(rec ipRecord, now time.Time) float64 {
+	halves := float64(now.Sub(rec.updated)) / float64(r.halfLife())
+	return rec.score * math.Pow(0.5, halves)
+}
+
+// ipKey returns the Store key for the IP address of addr.
+func ipKey(addr net.Addr) string {
+	return "reputation:" + addrIP(addr)
+}
+
+// addrIP returns the IP address of addr as a string.
+func addrIP(addr net.Addr) string {
+	ip := addr.String()
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP.String()
+	default:
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	return ip
+}
+
+func (r *Reputation) load(key string) (ipRecord, error) {
+	var rec ipRecord
+	v, err := r.store().Get(key)
+	if err != nil || v == nil {
+		return rec, err
+	}
+	var updated, blocked int64
+	if _, err := fmt.Sscanf(string(v), "%g %d %d", &rec.score, &updated, &blocked); err != nil {
+		return ipRecord{}, err
+	}
+	rec.updated = time.Unix(0, updated)
+	rec.blockedUntil = time.Unix(0, blocked)
+	return rec, nil
+}
+
+// Record records an event for the client at addr.
+func (r *Reputation) Record(addr net.Addr, event string) {
+	weights := r.Weights
+	if weights == nil {
+		weights = DefaultReputationWeights
+	}
+	w, ok := weights[event]
+	if !ok {
+		return
+	}
+	key := ipKey(addr)
+	now := clockOrSystem(r.Clock).Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, err := r.load(key)
+	if err != nil {
+		log.Printf("smtpd: loading reputation of %v: %v", addr, err)
+	}
+	rec.score = r.decayed(rec, now) + w
+	rec.updated = now
+	if r.BlockScore > 0 && rec.score >= r.BlockScore {
+		d := r.BlockDuration
+		if d == 0 {
+			d = time.Hour
+		}
+		rec.blockedUntil = now.Add(d)
+	}
+	// Keep the record until its score has decayed to nothing.
+	ttl := 10 * r.halfLife()
+	if d := rec.blockedUntil.Sub(now); d > ttl {
+		ttl = d
+	}
+	v := fmt.Sprintf("%g %d %d", rec.score, rec.updated.UnixNano(), rec.blockedUntil.UnixNano())
+	if err := r.store().Set(key, []byte(v), ttl); err != nil {
+		log.Printf("smtpd: saving reputation of %v: %v", addr, err)
+	}
+}
+
+// Score returns the current score of the client at addr.
+func (r *Reputation) Score(addr net.Addr) float64 {
+	rec, err := r.load(ipKey(addr))
+	if err != nil {
+		log.Printf("smtpd: loading reputation of %v: %v", addr, err)
+	}
+	return r.decayed(rec, clockOrSystem(r.Clock).Now())
+}
+
+// Blocked reports whether the client at addr is temporarily blocked.
+func (r *Reputation) Blocked(addr net.Addr) bool {
+	rec, err := r.load(ipKey(addr))
+	if err != nil {
+		log.Printf("smtpd: loading reputation of %v: %v", addr, err)
+	}
+	return clockOrSystem(r.Clock).Now().Before(rec.blockedUntil)
+}
+
+// recordEvent records event for the session's client if the server
+// tracks reputation.
+func (s *session) recordEvent(event string) {
+	if r := s.srv.Reputation; r != nil {
+		r.Record(s.Addr(), event)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// SASLMechanism is the server side of a SASL mechanism (RFC 4422)
+// offered with AUTH, registered in Server.AuthMechanisms. It's shared
+// by all sessions; each exchange's state is in the SASLExchange from
+// Start.
+type SASLMechanism interface {
+	// Start begins an authentication exchange with c.
+	Start(c Connection) SASLExchange
+}
+
+// SASLExchange is the server's side of one authentication exchange.
+type SASLExchange interface {
+	// Next is called with the client's initial response, or nil if
+	// it sent none, and then with its response to each challenge.
+	// It returns the next challenge to send, or done and the
+	// identity the client authenticated as. An SMTPError is sent
+	// as the reply; other errors fail with 535.
+	Next(response []byte) (challenge []byte, done bool, identity string, err error)
+}
+
+// PlainMechanism returns the PLAIN mechanism (RFC 4616), which calls
+// verify with the identities and password the client sends. The
+// client authenticates as username. Clients asking to act as another
+// identity are refused; see Server.OnAuthorize.
+func PlainMechanism(verify func(c Connection, identity, username, password string) error) SASLMechanism {
+	return &plainMech{verify: verify}
+}
+
+type plainMech struct {
+	verify    func(c Connection, identity, username, password string) error
+	authorize func(c Connection, identity, username string) error // or nil
+}
+
+func (m *plainMech) Start(c Connection) SASLExchange {
+	return &plainExchange{m: m, c: c}
+}
+
+type plainExchange struct {
+	m *plainMech
+	c Connection
+}
+
+var errAuthzDenied = SMTPError("535 5.7.8 Error: not authorized to act as requested identity")
+
+func (e *plainExchange) Next(resp []byte) ([]byte, bool, string, error) {
+	if resp == nil {
+		return []byte{}, false, "", nil
+	}
+	parts := bytes.Split(resp, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, "", errAuthDecode
+	}
+	identity, username, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if err := e.m.verify(e.c, identity, username, password); err != nil {
+		return nil, false, "", err
+	}
+	if identity == "" || identity == username {
+		return nil, true, username, nil
+	}
+	if e.m.authorize == nil {
+		return nil, false, "", errAuthzDenied
+	}
+	if err := e.m.authorize(e.c, identity, username); err != nil {
+		return nil, false, "", err
+	}
+	return nil, true, identity, nil
+}
+
+// XOAUTH2Mechanism returns the XOAUTH2 mechanism used by Gmail and
+// Outlook clients to send OAuth 2.0 bearer tokens, which calls verify
+// with the user and token. Failures are reported to the client with
+// an error JSON challenge before the final reply, as it expects.
+func XOAUTH2Mechanism(verify func(c Connection, user, token string) error) SASLMechanism {
+	return xoauth2Mech(verify)
+}
+
+type xoauth2Mech func(c Connection, user, token string) error
+
+func (m xoauth2Mech) Start(c Connection) SASLExchange {
+	return &xoauth2Exchange{verify: m, c: c}
+}
+
+type xoauth2Exchange struct {
+	verify xoauth2Mech
+	c      Connection
+	err    error // failure to report after the error JSON
+}
+
+// xoauth2Error is the challenge reporting a failed XOAUTH2 attempt.
+var xoauth2Error = []byte(`{"status":"401","schemes":"bearer"}`)
+
+func (e *xoauth2Exchange) Next(resp []byte) ([]byte, bool, string, error) {
+	if e.err != nil {
+		// The client acknowledged the error JSON.
+		return nil, false, "", e.err
+	}
+	if resp == nil {
+		return []byte{}, false, "", nil
+	}
+	user, token, ok := parseXOAUTH2(resp)
+	if !ok {
+		return nil, false, "", errAuthDecode
+	}
+	if err := e.verify(e.c, user, token); err != nil {
+		e.err = err
+		return xoauth2Error, false, "", nil
+	}
+	return nil, true, user, nil
+}
+
+// parseXOAUTH2 parses an XOAUTH2 initial response, such as
+// "user=someone@example.com\x01auth=Bearer ya29...\x01\x01".
+func parseXOAUTH2(resp []byte) (user, token string, ok bool) {
+	for _, f := range strings.Split(string(resp), "\x01") {
+		if v, found := strings.CutPrefix(f, "user="); found {
+			user = v
+		} else if v, found := strings.CutPrefix(f, "auth="); found {
+			scheme, t, _ := strings.Cut(v, " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				token = t
+			}
+		}
+	}
+	return user, token, user != "" && token != ""
+}
+
+// externalMech is the EXTERNAL mechanism (RFC 4422 appendix A), for
+// clients authenticating as the identity Server.OnTLSClientCert gave
+// their TLS certificate, which it holds.
+type externalMech string
+
+func (m externalMech) Start(c Connection) SASLExchange { return m }
+
+func (m externalMech) Next(resp []byte) ([]byte, bool, string, error) {
+	if resp == nil {
+		return []byte{}, false, "", nil
+	}
+	// The client may name the identity it's authorizing as, which
+	// must be the certificate's.
+	if len(resp) > 0 && string(resp) != string(m) {
+		return nil, false, "", errAuthFailed
+	}
+	return nil, true, string(m), nil
+}
+
+// authMechanism returns the mechanism registered as name, or nil.
+func (s *session) authMechanism(name string) SASLMechanism {
+	srv := s.srv
+	if m := srv.AuthMechanisms[name]; m != nil {
+		return m
+	}
+	if name == "EXTERNAL" && s.certUser != "" {
+		return externalMech(s.certUser)
+	}
+	if name == "PLAIN" && srv.PlainAuth && srv.OnAuth != nil {
+		return &plainMech{
+			verify: func(c Connection, identity, username, password string) error {
+				return srv.OnAuth(c, "PLAIN", identity, username, password)
+			},
+			authorize: srv.OnAuthorize,
+		}
+	}
+	return nil
+}
+
+// authMechanismNames returns the names of the mechanisms offered, for
+// the EHLO reply.
+func (s *session) authMechanismNames() []string {
+	srv := s.srv
+	var names []string
+	for name := range srv.AuthMechanisms {
+		names = append(names, name)
+	}
+	if srv.AuthMechanisms["PLAIN"] == nil && srv.PlainAuth && srv.OnAuth != nil {
+		names = append(names, "PLAIN")
+	}
+	if srv.AuthMechanisms["EXTERNAL"] == nil && s.certUser != "" {
+		names = append(names, "EXTERNAL")
+	}
+	sort.Strings(names)
+	return names
+}
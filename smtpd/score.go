@@ -0,0 +1,106 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"net"
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd/parse"
+)
+
+// Signals recorded by the server for Scoring. Hooks may record
+// their own with Connection.AddSignal.
+const (
+	SignalHELOBareIP     = "helo.bare-ip"     // HELO/EHLO with an IP not in brackets
+	SignalHELONotFQDN    = "helo.not-fqdn"    // HELO/EHLO name without a dot
+	SignalHELOOurName    = "helo.our-name"    // HELO/EHLO with the server's own name
+	SignalHELOBadLiteral = "helo.bad-literal" // HELO/EHLO with a malformed address literal
+	SignalEarlyTalker    = "early-talker"     // sent data before the greeting; see Server.GreetDelay
+	SignalDNSBL          = "dnsbl:"           // prefix of signals for listings, followed by the zone; see Server.DNSBLs
+)
+
+// ScoreAction is the disposition Scoring assigns to a message.
+type ScoreAction int
+
+const (
+	ScoreAccept ScoreAction = iota
+	ScoreTag                // accept with an X-Spam-Flag header
+	ScoreDefer              // temporarily reject
+	ScoreReject             // permanently reject
+)
+
+// Scoring combines the signals recorded for a session into a single
+// score when the client sends DATA, and maps it to an action.
+type Scoring struct {
+	// Weights gives the score contributed by each occurrence of a
+	// signal. Signals not listed count for nothing.
+	Weights map[string]float64
+
+	// TagScore, DeferScore and RejectScore are the scores at or
+	// above which messages are tagged, deferred and rejected. Zero
+	// disables an action.
+	TagScore    float64
+	DeferScore  float64
+	RejectScore float64
+}
+
+// Score returns the total weight of signals, which maps signal names
+// to their number of occurrences.
+func (sc *Scoring) Score(signals map[string]int) float64 {
+	var total float64
+	for name, n := range signals {
+		total += sc.Weights[name] * float64(n)
+	}
+	return total
+}
+
+// Action returns the action for a score.
+func (sc *Scoring) Action(score float64) ScoreAction {
+	switch {
+	case sc.RejectScore != 0 && score >= sc.RejectScore:
+		return ScoreReject
+	case sc.DeferScore != 0 && score >= sc.DeferScore:
+		return ScoreDefer
+	case sc.TagScore != 0 && score >= sc.TagScore:
+		return ScoreTag
+	}
+	return ScoreAccept
+}
+
+func (s *session) AddSignal(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signals == nil {
+		s.signals = make(map[string]int)
+	}
+	s.signals[name]++
+}
+
+func (s *session) Signals() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]int, len(s.signals))
+	for name, n := range s.signals {
+		m[name] = n
+	}
+	return m
+}
+
+// helloSignals records signals for a dubious HELO/EHLO name.
+func (s *session) helloSignals(host string) {
+	switch {
+	case net.ParseIP(host) != nil:
+		s.AddSignal(SignalHELOBareIP)
+	case strings.HasPrefix(host, "["):
+		if _, ok := parse.AddressLiteral(host); !ok {
+			s.AddSignal(SignalHELOBadLiteral)
+		}
+	case strings.EqualFold(host, s.srv.hostname()):
+		s.AddSignal(SignalHELOOurName)
+	case !strings.Contains(host, "."):
+		s.AddSignal(SignalHELONotFQDN)
+	}
+}
@@ -6,28 +6,31 @@
 // its behavior.
 package smtpd
 
-// TODO:
-//  -- send 421 to connected clients on graceful server shutdown (s3.8)
-//
-
 import (
 	"bufio"
 	"bytes"
-	"errors"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/mail"
+	"net/textproto"
 	"os/exec"
-	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unicode"
-)
 
-var (
-	rcptToRE = regexp.MustCompile(`[Tt][Oo]:<(.+)>`)
-	//mailFromRE = regexp.MustCompile(`(?i)^from:\s*<(.*?)>`)
-	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<(.*)>`)
+	"github.com/bradfitz/go-smtpd/smtpd/dnsbl"
+	"github.com/bradfitz/go-smtpd/smtpd/parse"
 )
 
 // Server is an SMTP server.
@@ -37,37 +40,635 @@ type Server struct {
 	ReadTimeout  time.Duration // optional read timeout
 	WriteTimeout time.Duration // optional write timeout
 
-	PlainAuth bool // advertise plain auth (assumes you're on SSL)
+	// ReadBufferSize and WriteBufferSize optionally set the size of
+	// each connection's read and write buffers; bufio's default if
+	// zero. DataReadBufferSize, if larger than the read buffer, is
+	// the read buffer size used while receiving a message.
+	ReadBufferSize     int
+	WriteBufferSize    int
+	DataReadBufferSize int
+
+	// MaxErrors, if non-zero, is how many consecutive commands a
+	// client may send that are refused as malformed, unrecognized or
+	// out of sequence (500 to 504 replies) before the connection is
+	// closed, to shed broken clients and probes.
+	MaxErrors int
+
+	// Tarpit, if non-nil, is called before the server sends the
+	// banner and each 4xx or 5xx reply, with the reply and how many
+	// of those the client has been sent already, and returns how long
+	// to wait first, so that spammers and dictionary attacks waste
+	// their time. ErrorDelay makes a simple policy; others might
+	// delay the banner for clients with a poor Reputation. The wait
+	// ends early if the client disconnects or Shutdown gives up.
+	Tarpit func(c Connection, reply string, errors int) time.Duration
+
+	// CommandRate, if positive, limits each session to that many
+	// commands per second on average, in bursts of up to CommandBurst,
+	// or CommandRate if that's zero. Faster commands are delayed, and
+	// clients kept waiting for more than 10 seconds in a row are
+	// disconnected with 421.
+	// NewCommandLimiter, if non-nil, returns each session's limiter
+	// instead, such as for tests.
+	CommandRate       float64
+	CommandBurst      int
+	NewCommandLimiter func(c Connection) RateLimiter
+
+	// MaxRecipients optionally limits the recipients of a message.
+	// Further RCPT commands are refused with 452 (RFC 5321 s4.5.3.1.10)
+	// without calling the hooks, and the client may send the rest of
+	// the message to them later.
+	MaxRecipients int
+
+	// MaxRecipientsOvershoot, if non-zero, is how many recipients
+	// beyond MaxRecipients a client may try in a session before the
+	// connection is closed.
+	MaxRecipientsOvershoot int
+
+	// MaxSize optionally limits the size of messages, in bytes, as
+	// advertised with the SIZE extension (RFC 1870). Larger messages
+	// are refused with 552, after reading and discarding the rest.
+	MaxSize int64
+
+	// DataTimeout optionally limits how long the server waits for
+	// each read of a message after DATA or BDAT, in place of
+	// ReadTimeout, which applies to commands. RFC 5321 (s4.5.3.2)
+	// suggests 3 minutes, where commands get 5.
+	DataTimeout time.Duration
+
+	// SessionTimeout optionally limits the length of a session.
+	// Clients still connected after it are disconnected with a 421
+	// reply at their next command, or during their message.
+	SessionTimeout time.Duration
+
+	// MaxCommandLine and MaxDataLine optionally set the longest
+	// command and message lines accepted, in bytes including CRLF,
+	// in place of the 512 and 1000 of RFC 5321 (s4.5.3.1). MAIL and
+	// RCPT commands may be 1024 bytes longer, for their parameters,
+	// and AUTH ones up to 12288 bytes (RFC 4954). Longer commands are
+	// refused with 500; messages with longer lines are read to their
+	// end and then refused.
+	MaxCommandLine int
+	MaxDataLine    int
+
+	// MaxDataDuration optionally limits the total time a client may
+	// spend sending a single message after DATA.
+	MaxDataDuration time.Duration
+
+	// MinDataRate optionally sets the slowest average rate, in bytes
+	// per second, at which a client may send a message after DATA.
+	// Slower clients are disconnected with a 421 reply.
+	MinDataRate int
+
+	// LMTP makes the server speak LMTP (RFC 2033) instead of SMTP,
+	// for final delivery behind an MTA: clients greet it with LHLO,
+	// and get a reply for each recipient at the end of a message.
+	// ListenAndServe then listens on ":24" by default, or on a Unix
+	// socket if Addr is a path.
+	LMTP bool
+
+	// PlainAuth enables the AUTH PLAIN mechanism (RFC 4954),
+	// verified by OnAuth. The password is sent in the clear.
+	PlainAuth bool
+
+	// AllowInsecureAuth lets clients authenticate without TLS.
+	// Otherwise AUTH is only offered once the connection is
+	// encrypted, so that credentials aren't sent in the clear.
+	AllowInsecureAuth bool
+
+	// RequireTLS refuses mail from clients that haven't started
+	// TLS, with a 530 reply to MAIL, as on a submission port.
+	RequireTLS bool
+
+	// OnAuth is called to verify the credentials sent with AUTH
+	// PLAIN. identity is the authorization identity, usually
+	// empty, and username the authentication identity. If it
+	// returns nil, the session is authenticated as username; see
+	// Connection.User. An SMTPError is sent as the reply.
+	OnAuth func(c Connection, mechanism string, identity, username, password string) error
+
+	// OnAuthorize, if non-nil, is called after OnAuth accepts
+	// credentials whose authorization identity differs from
+	// username, to permit username to act as identity, such as an
+	// administrator sending for a user (RFC 4616 s2). If it returns
+	// nil, the session is authenticated as identity. If it's nil,
+	// such attempts are refused with a 535 reply.
+	OnAuthorize func(c Connection, identity, username string) error
+
+	// AuthMechanisms are the SASL mechanisms offered with AUTH,
+	// keyed by their upper-case names, in addition to PLAIN if
+	// PlainAuth is set and EXTERNAL with OnTLSClientCert.
+	AuthMechanisms map[string]SASLMechanism
+
+	// OnTLSClientCert, if non-nil, is called when a client's TLS
+	// certificate verifies, with its chain, leaf first; for that,
+	// TLSConfig.ClientAuth must ask for certificates. The identity
+	// returned may then authenticate with AUTH EXTERNAL, as relays
+	// do instead of using passwords; if it's empty, EXTERNAL isn't
+	// offered. If it returns an error, the connection is closed and
+	// an SMTPError is sent as the reply.
+	OnTLSClientCert func(c Connection, chain []*x509.Certificate) (identity string, err error)
 
 	// OnNewConnection, if non-nil, is called on new connections.
 	// If it returns non-nil, the connection is closed.
 	OnNewConnection func(c Connection) error
 
+	// Tracer, if non-nil, traces sessions and their mail
+	// transactions.
+	Tracer Tracer
+
+	// Metrics, if non-nil, is told of the server's activity, such
+	// as connections, messages and commands; see CounterMetrics.
+	Metrics Metrics
+
+	// OnPanic, if non-nil, is called when a session panics, such
+	// as in a hook, with the value recovered and the goroutine's
+	// stack trace. The client is sent a 421 reply and the session
+	// ends; other sessions carry on. If nil, the panic is logged.
+	OnPanic func(c Connection, recovered interface{}, stack []byte)
+
+	// OnSessionEnd, if non-nil, is called when a session ends,
+	// with its statistics, such as for accounting.
+	OnSessionEnd func(c Connection, stats SessionStats)
+
+	// OnHello, if non-nil, is called with the verb, HELO or EHLO,
+	// and the host a client greets the server with. If it returns
+	// non-nil, the greeting is refused, with the error as the reply
+	// if it's an SMTPError, and the client may try again.
+	OnHello func(c Connection, verb, host string) error
+
+	// OnClientID, if non-nil, enables the CLIENTID extension and is
+	// called when a client identifies itself with a CLIENTID command.
+	// If it returns non-nil, the identity is rejected.
+	OnClientID func(c Connection, idType, id string) error
+
 	// OnNewMail must be defined and is called when a new message beings.
-	// (when a MAIL FROM line arrives)
+	// (when a MAIL FROM line arrives) If it returns an SMTPError, that
+	// is sent as the reply; other errors close the connection. It
+	// may also return a Verdict such as Discard. c.Features reports
+	// the MAIL parameters, such as whether the message needs
+	// SMTPUTF8 handling.
 	OnNewMail func(c Connection, from MailAddress) (Envelope, error)
+
+	// OnRcpt, if non-nil, is called for each RCPT TO before the
+	// Envelope's AddRecipient, with the command's ESMTP parameters
+	// keyed by upper-case keyword. Its errors reject the recipient
+	// as AddRecipient's do, and AddRecipient isn't called.
+	OnRcpt func(c Connection, env Envelope, rcpt MailAddress, params map[string]string) error
+
+	// OnParams, if non-nil, is called with the ESMTP parameters of
+	// each MAIL or RCPT command, keyed by upper-case keyword, before
+	// the command's other hooks. It returns the keywords it doesn't
+	// support, if any, and the command is refused with 555 (RFC 5321
+	// s4.1.1.11).
+	OnParams func(c Connection, verb string, params map[string]string) (unsupported []string)
+
+	// OnATRN, if non-nil, enables the ATRN command (RFC 2645) and
+	// is called with the domains the client asked to dequeue, or nil
+	// for all of its domains. It returns the spooled messages to
+	// deliver once the connection is reversed. OnATRN must refuse
+	// clients that aren't authorized for the domains.
+	OnATRN func(c Connection, domains []string) ([]SpooledMessage, error)
+
+	// OnHeaders, if non-nil, is called during DATA once the message
+	// header has been received, before the body. If it returns
+	// non-nil, the message is rejected without reading the body: the
+	// error is sent as the reply and the connection is closed. A
+	// Verdict such as Discard or Quarantine accepts the message.
+	OnHeaders func(c Connection, env Envelope, h mail.Header) error
+
+	// AddReceivedHeader prepends a Received trace header, as made by
+	// ReceivedLine, to each message passed to the Envelope.
+	AddReceivedHeader bool
+
+	// GreetDelay, if non-zero, is how long the server waits before
+	// sending the banner. Clients that send anything in that time,
+	// as many spam bots do, get SignalEarlyTalker, and are refused if
+	// RejectEarlyTalkers is set.
+	GreetDelay         time.Duration
+	RejectEarlyTalkers bool
+
+	// Scoring, if non-nil, weighs the signals recorded for a session
+	// when the client sends DATA, and tags, defers or rejects the
+	// message accordingly.
+	Scoring *Scoring
+
+	// EndOfDataTimeout optionally limits how long the server waits
+	// for Envelope.Close at the end of a message. When it expires,
+	// the client is sent a 451 reply and, if the Envelope is a
+	// ContextCloser, its context is canceled.
+	EndOfDataTimeout time.Duration
+
+	// RejectBareDotLines rejects messages containing a dot line
+	// delimited by a bare CR or LF, such as <LF>.<LF>, which other
+	// MTAs may take as the end of the message (SMTP smuggling). The
+	// message only ever ends at <CRLF>.<CRLF> either way.
+	RejectBareDotLines bool
+
+	// StrictCRLF rejects commands, and messages sent with DATA,
+	// containing any bare CR or LF, not just around dot lines, so
+	// that nothing relayed can be read differently downstream.
+	StrictCRLF bool
+
+	// RejectUndeclared8Bit rejects messages containing 8-bit data
+	// from clients that didn't declare BODY=8BITMIME. Otherwise
+	// they're accepted, and the Envelope is told if it's an
+	// Undeclared8BitEnvelope.
+	RejectUndeclared8Bit bool
+
+	// TLSConfig, if non-nil, enables the STARTTLS extension
+	// (RFC 3207) using this configuration. It's also used by
+	// ServeTLS.
+	TLSConfig *tls.Config
+
+	// GetTLSConfig, if non-nil, returns the configuration for a
+	// client's TLS handshake, when it sends STARTTLS or connects to
+	// ServeTLS, so certificates can be chosen per client or rotated
+	// without a restart. It also enables STARTTLS. If it returns a
+	// nil configuration, TLSConfig is used; if that's nil too, or
+	// GetTLSConfig returns an error, STARTTLS is refused with a 454
+	// reply, and an implicit TLS connection is closed.
+	GetTLSConfig func(c Connection) (*tls.Config, error)
+
+	// ProxyProtocol makes the server expect each connection to begin
+	// with a PROXY protocol header, version 1 or 2, as sent by
+	// HAProxy and load balancers, and take the client's address from
+	// it for Connection.Addr, hooks and logging. Connections without
+	// one are closed, so every client must come through the proxy.
+	ProxyProtocol bool
+
+	// XClientAllowed, if non-nil, enables Postfix's XCLIENT command
+	// for clients at the addresses it returns true for, such as a
+	// trusted frontend proxy, to pass on the original client's
+	// address, name, greeting and login.
+	XClientAllowed func(addr net.Addr) bool
+
+	// TLSHandshakeTimeout optionally limits how long a TLS
+	// handshake may take. If zero, ReadTimeout is used, or 30
+	// seconds if that's zero too.
+	TLSHandshakeTimeout time.Duration
+
+	// OfferREQUIRETLS advertises the REQUIRETLS extension (RFC
+	// 8689) to clients that started TLS. Set it only if the
+	// Envelopes honor Features().RequireTLS when relaying, as the
+	// queue package's do.
+	OfferREQUIRETLS bool
+
+	// TLSResumption controls TLS session resumption, which saves
+	// clients that reconnect often a full handshake.
+	TLSResumption TLSResumption
+
+	// Reputation, if non-nil, tracks the behavior of client
+	// addresses, and may block clients that misbehave.
+	Reputation *Reputation
+
+	// Resolver, if non-nil, is used for all DNS lookups instead of
+	// net.DefaultResolver. See CachingResolver.
+	Resolver Resolver
+
+	// ReverseDNS makes the server look up each client's address in
+	// DNS as it connects, in the background, for
+	// Connection.ReverseDNS and the Received header. The lookup
+	// gives up after ReverseDNSTimeout, or 5 seconds if that's
+	// zero.
+	ReverseDNS        bool
+	ReverseDNSTimeout time.Duration
+
+	// DNSBLs are DNS blocklists, such as "zen.spamhaus.org", to
+	// look up each client's address in as it connects, in the
+	// background, for Connection.DNSBL and Scoring: each listing
+	// adds a signal named SignalDNSBL followed by the zone. The
+	// lookups give up after DNSBLTimeout, or 5 seconds if that's
+	// zero.
+	DNSBLs       []string
+	DNSBLTimeout time.Duration
+
+	// RejectDNSBL makes the server refuse MAIL from listed clients
+	// with DNSBLReply, in which ${ip}, ${zone} and ${reason} are
+	// replaced by the client's address and the first listing's
+	// zone and TXT record, the latter stripped of control characters
+	// and cut to 200 bytes. If DNSBLReply is empty, the reply is
+	// "554 5.7.1 Service unavailable; client host [${ip}] blocked
+	// using ${zone}".
+	RejectDNSBL bool
+	DNSBLReply  string
+
+	// MaxConcurrentData, if positive, limits how many sessions may
+	// be receiving a message body at once. Clients sending DATA
+	// beyond the limit get a 451 reply.
+	MaxConcurrentData int
+
+	inData atomic.Int32 // sessions in DATA
+
+	// MaxConnections, if positive, limits how many connections the
+	// server handles at once, and MaxConnectionsPerIP how many it
+	// handles from each client IP address, as counted by ConnLimiter,
+	// or in memory if that's nil. Further connections are sent a 421
+	// reply and closed.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	ConnLimiter         ConnLimiter
+	conns               MemoryConnLimiter
+
+	// MaxSessionsPerUser, if positive, limits how many sessions may
+	// be authenticated as the same user at once. Authenticating
+	// beyond the limit gets a 421 reply and the connection is
+	// closed. MaxMessagesPerUser, if positive, likewise limits how
+	// many of a user's messages may be in DATA at once; clients
+	// beyond it get a 451 reply.
+	MaxSessionsPerUser int
+	MaxMessagesPerUser int
+
+	userMu sync.Mutex
+	users  map[string]*userCount
+
+	// SubaddressDelimiters holds the characters that may separate
+	// a mailbox from a sub-address tag in the local part of an
+	// address, as in "user+tag@example.com"; "+" if empty. The
+	// first delimiter in the local part ends the mailbox.
+	SubaddressDelimiters string
+
+	// HealthChecks, if non-nil, are run by Health to check the
+	// state of the server's backends, such as a delivery queue or
+	// a policy service. Each returns nil if healthy.
+	HealthChecks map[string]func() error
+
+	// Clock, if non-nil, is used for timing and scheduling, such as
+	// phase timing, EndOfDataTimeout and TLS ticket key rotation.
+	Clock Clock
+
+	listeners atomic.Int32 // in Serve
+	sessions  atomic.Int32 // open sessions
+
+	lnMu         sync.Mutex
+	lns          map[net.Listener]bool
+	shuttingDown atomic.Bool
+
+	ctxOnce   sync.Once
+	ctx       context.Context // parent of sessions' contexts
+	cancelCtx context.CancelFunc
+
+	// Log, if non-nil, receives the server's log messages instead
+	// of the standard logger. See also SetLogLevel.
+	Log func(format string, args ...interface{})
+
+	// LogEntry, if non-nil, receives the server's log messages
+	// with their category and level, for structured logging. It
+	// takes precedence over Log. See package syslog for adapters.
+	LogEntry func(c LogCategory, l LogLevel, msg string)
+
+	// Logger, if non-nil, receives the server's log messages as
+	// structured records, taking precedence over LogEntry and Log.
+	// Messages about a session have its ID and the client's
+	// address as attributes, and protocol traces the command verb
+	// or reply code.
+	Logger *slog.Logger
+
+	// Transcript, if non-nil, is called as each session starts. If
+	// it returns a writer, every line read from and written to the
+	// client is copied to it with a timestamp and a "C:" or "S:"
+	// prefix, for debugging, and it's closed when the session ends.
+	Transcript func(c Connection) io.WriteCloser
+
+	// DebugSession, if non-nil, is called as each session starts.
+	// If it returns true, the session logs at LogDebug in every
+	// category, such as to trace one client's protocol exchange.
+	DebugSession func(c Connection) bool
+
+	logLevels [numLogCategories]atomic.Int32
+
+	certConfig    *tls.Config // from ListenAndServeTLS, in place of TLSConfig
+	tlsMu         sync.Mutex
+	ticketKeys    [][32]byte // newest first
+	ticketRotated time.Time
+	tlsHandshakes atomic.Int64
+	tlsResumed    atomic.Int64
 }
 
 // MailAddress is defined by
 type MailAddress interface {
-	Email() string    // email address, as provided
-	Hostname() string // canonical hostname, lowercase
+	// Email returns the address as provided, less any source route
+	// (RFC 5321 s4.1.2), such as the "@relay.example:" prefix of
+	// "@relay.example:user@example.com".
+	Email() string
+
+	// Raw returns exactly what the client sent between the angle
+	// brackets, in its original case.
+	Raw() string
+
+	// Hostname returns the domain part of the address in lower case,
+	// or, for an address literal, the literal in canonical form, such
+	// as "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+	Hostname() string
+
+	// Tag returns the sub-address of the local part: "tag" in
+	// "user+tag@example.com", or "" if there's none. See
+	// Server.SubaddressDelimiters.
+	Tag() string
+
+	// BaseAddress returns Email without the sub-address, such as
+	// "user@example.com" for "user+tag@example.com".
+	BaseAddress() string
 }
 
 // Connection is implemented by the SMTP library and provided to callers
 // customizing their own Servers.
 type Connection interface {
+	// ID returns a random identifier for the session, unique
+	// across servers and restarts, for logging and tracing.
+	ID() string
+
 	Addr() net.Addr
-	Close() error // to force-close a connection
+	LocalAddr() net.Addr // the server's address
+	Close() error        // to force-close a connection
+
+	// HeloName returns the host the client greeted the server with,
+	// and HeloType the command it used, "HELO", "EHLO" or "LHLO". Both are
+	// empty before the greeting and again after STARTTLS.
+	HeloName() string
+	HeloType() string
+
+	// ClientName returns the client's verified host name, as passed
+	// on by a proxy with XCLIENT, or "" if unknown.
+	ClientName() string
+
+	// ReverseDNS returns the result of looking up the client's
+	// address in DNS, if Server.ReverseDNS is set, waiting for the
+	// lookup begun when it connected to finish.
+	ReverseDNS() RDNS
+
+	// DNSBL returns the client's listings in Server.DNSBLs,
+	// waiting for the lookups begun when it connected to finish.
+	DNSBL() []dnsbl.Listing
+
+	// TLS returns the state of the connection's TLS session, or nil
+	// if the client hasn't used STARTTLS.
+	TLS() *tls.ConnectionState
+
+	// PeerCertificates returns the client's verified TLS
+	// certificate chain, leaf first, or nil if it sent none.
+	PeerCertificates() []*x509.Certificate
+
+	// RawConn returns the connection to the client, for setting
+	// socket options and the like. After STARTTLS it's the
+	// *tls.Conn wrapping the original connection. Reading from or
+	// writing to it interferes with the session.
+	RawConn() net.Conn
+
+	// ClientID returns the identity the client declared with the
+	// CLIENTID command, or empty strings if none.
+	ClientID() (idType, id string)
+
+	// AddSignal records an observation about the client, such as a
+	// DNSBL listing, for Server.Scoring to weigh. Signals last for
+	// the rest of the session.
+	AddSignal(name string)
+
+	// Signals returns how many times each signal has been recorded
+	// for the session so far.
+	Signals() map[string]int
+
+	// MessageCounts returns how many messages the client has sent
+	// in this session, and how many of those were rejected.
+	MessageCounts() (sent, rejected int)
+
+	// Logf logs a message about the session through the Server's
+	// logging hooks, if category c is enabled at level l, so that
+	// Envelopes and hooks log as the server does.
+	Logf(c LogCategory, l LogLevel, format string, args ...interface{})
+
+	// Timing returns when the session reached each phase of its
+	// current or most recent mail transaction.
+	Timing() Timing
+
+	// Features returns the service extensions the client has used.
+	Features() Features
+
+	// MailParams returns the ESMTP parameters of the current or most
+	// recent MAIL command, keyed by upper-case keyword.
+	MailParams() map[string]string
+
+	// User returns the identity the client authenticated as with
+	// AUTH, or "" if it hasn't.
+	User() string
+
+	// Context returns the session's context, which is canceled when
+	// the session ends, when the client disconnects while a hook
+	// or Envelope method runs, or when Shutdown gives up waiting.
+	// Envelopes can keep it from OnNewMail.
+	Context() context.Context
+
+	// SetValue stores a value for the rest of the session under
+	// key, which should be a comparable type defined by the caller,
+	// as with context keys, so that hooks can pass on what they
+	// learn about the client. Value returns it, or nil. Both are
+	// safe for concurrent use.
+	SetValue(key, value interface{})
+	Value(key interface{}) interface{}
 }
 
 type Envelope interface {
 	AddRecipient(rcpt MailAddress) error
 	BeginData() error
+	// Write is passed the message a line at a time, whether it was
+	// sent with DATA or BDAT. Each line ends in a line break, except
+	// perhaps the last, and mustn't be kept after Write returns.
 	Write(line []byte) error
 	Close() error
 }
 
+// ContextCloser is implemented by Envelopes whose end-of-data
+// processing can be abandoned. If an Envelope implements it,
+// CloseContext is called in place of Close, and ctx is canceled when
+// the server gives up waiting (see Server.EndOfDataTimeout).
+type ContextCloser interface {
+	CloseContext(ctx context.Context) error
+}
+
+// PRDREnvelope is an Envelope that can accept or reject a message
+// separately for each recipient. If the client negotiates the PRDR
+// extension on MAIL FROM, RecipientVerdict is called after a
+// successful Close for each recipient accepted by AddRecipient, in
+// order, and its result is sent as that recipient's reply.
+type PRDREnvelope interface {
+	Envelope
+	RecipientVerdict(rcpt MailAddress) error
+}
+
+// RecipientErrors is an error an Envelope's Close can return to
+// accept the message for some recipients and refuse it for others:
+// the result for each recipient accepted by AddRecipient, in order,
+// with nil or a Verdict accepting it. Clients using the PRDR extension
+// get a reply for each recipient, as in LMTP mode. Other clients are
+// refused with the first error if every recipient was refused, or with
+// the first temporary (4xx) SMTPError if there is one, so that they
+// retry the message for every recipient. Otherwise they're told the
+// message was accepted, and the Envelope must bounce it to the
+// recipients that refused it.
+type RecipientErrors []error
+
+func (e RecipientErrors) Error() string {
+	for _, err := range e {
+		if err != nil && verdict(err) == nil {
+			return "refused for some recipients: " + err.Error()
+		}
+	}
+	return "accepted for all recipients"
+}
+
+// all returns the error to refuse the whole message with if it was
+// refused for every one of n recipients, or nil.
+func (e RecipientErrors) all(n int) error {
+	if n == 0 || len(e) < n {
+		return nil
+	}
+	for _, err := range e[:n] {
+		if err == nil || verdict(err) != nil {
+			return nil
+		}
+	}
+	return e[0]
+}
+
+// temporary returns the first temporary failure for the n
+// recipients, or nil.
+func (e RecipientErrors) temporary(n int) error {
+	if len(e) < n {
+		n = len(e)
+	}
+	for _, err := range e[:n] {
+		if se, ok := err.(SMTPError); ok && strings.HasPrefix(string(se), "4") {
+			return se
+		}
+	}
+	return nil
+}
+
+// recipientResult returns the result of the current message for the
+// i'th of its recipients, rcpt, from rerrs or pe, either of which may
+// be nil.
+func recipientResult(i int, rcpt MailAddress, pe PRDREnvelope, rerrs RecipientErrors) error {
+	var err error
+	if i < len(rerrs) {
+		err = rerrs[i]
+	}
+	if err == nil && pe != nil {
+		err = pe.RecipientVerdict(rcpt)
+	}
+	if verdict(err) != nil {
+		return nil
+	}
+	return err
+}
+
+// Undeclared8BitEnvelope is an Envelope that wants to know about
+// messages containing 8-bit data that the client didn't declare with
+// BODY=8BITMIME. Undeclared8Bit is called before Close.
+type Undeclared8BitEnvelope interface {
+	Envelope
+	Undeclared8Bit()
+}
+
 type BasicEnvelope struct {
 	rcpts []MailAddress
 }
@@ -93,6 +694,8 @@ func (e *BasicEnvelope) Close() error {
 	return nil
 }
 
+func (srv *Server) now() time.Time { return clockOrSystem(srv.Clock).Now() }
+
 func (srv *Server) hostname() string {
 	if srv.Hostname != "" {
 		return srv.Hostname
@@ -111,21 +714,50 @@ func (srv *Server) ListenAndServe() error {
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":25"
+		if srv.LMTP {
+			addr = ":24"
+		}
 	}
-	ln, e := net.Listen("tcp", addr)
+	ln, e := listen(addr)
 	if e != nil {
 		return e
 	}
 	return srv.Serve(ln)
 }
 
+// listen listens on addr: a Unix socket if it's a path, or else a TCP
+// address, using a listener inherited from Upgrade if there is one.
+func listen(addr string) (net.Listener, error) {
+	if strings.Contains(addr, "/") {
+		return net.Listen("unix", addr)
+	}
+	ln, err := inheritedListener(addr)
+	if ln == nil && err == nil {
+		ln, err = net.Listen("tcp", addr)
+	}
+	return ln, err
+}
+
 func (srv *Server) Serve(ln net.Listener) error {
+	return srv.serve(ln, false)
+}
+
+// serve accepts connections on ln, starting TLS on each at once if
+// implicitTLS is set.
+func (srv *Server) serve(ln net.Listener, implicitTLS bool) error {
 	defer ln.Close()
+	if !srv.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
 	for {
 		rw, e := ln.Accept()
 		if e != nil {
+			if srv.shuttingDown.Load() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
-				log.Printf("smtpd: Accept error: %v", e)
+				srv.logf(LogConn, LogError, "Accept error: %v", e)
 				continue
 			}
 			return e
@@ -134,47 +766,196 @@ func (srv *Server) Serve(ln net.Listener) error {
 		if err != nil {
 			continue
 		}
+		sess.implicitTLS = implicitTLS
+		srv.sessions.Add(1)
 		go sess.serve()
 	}
-	panic("not reached")
 }
 
 type session struct {
-	srv *Server
-	rwc net.Conn
-	br  *bufio.Reader
-	bw  *bufio.Writer
+	id     string
+	srv    *Server
+	rwc    net.Conn
+	remote net.Addr    // client's address from a PROXY header, or nil
+	cr     *connReader // under br
+	br     *bufio.Reader
+	bw     *bufio.Writer
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	env       Envelope      // current envelope, or nil
+	rcpts     []MailAddress // accepted recipients of env
+	envClosed bool          // env's Close was called
+	prdr      bool          // client requested PRDR for env
+	bdat      *bdatState    // message of env being sent with BDAT, or nil
 
-	env Envelope // current envelope, or nil
+	stream *dataStream // message of env being passed to Data, or nil
+
+	body8bit bool // client declared BODY=8BITMIME for env
+
+	mailParams map[string]string // of the latest MAIL command
+	pipelined  bool              // client has pipelined commands
+
+	discarded int // recipients of env dropped by a Discard verdict
+	overshoot int // recipients refused in this session for MaxRecipients
+
+	syntaxErrors int           // consecutive commands refused as malformed
+	limiter      RateLimiter   // for Server.CommandRate, or nil
+	throttled    time.Duration // delay of consecutive commands by limiter
+	errorReplies int           // 4xx and 5xx replies sent, for Server.Tarpit
+
+	rcptKept []bool // for each recipient given a 250, whether it's in rcpts, in LMTP mode
 
 	helloType string
 	helloHost string
+
+	xclientOK   bool   // client may use XCLIENT
+	xclientHelo string // greeting passed with XCLIENT, or empty
+	clientName  string // client's host name passed with XCLIENT, or empty
+
+	rdns  *rdnsLookup  // for Server.ReverseDNS, or nil
+	dnsbl *dnsblLookup // for Server.DNSBLs, or nil
+
+	clientIDType string
+	clientID     string
+
+	signals map[string]int // for Server.Scoring; guarded by mu
+
+	tlsState    *tls.ConnectionState // nil until STARTTLS
+	implicitTLS bool                 // TLS starts with the connection
+	certUser    string               // identity for AUTH EXTERNAL, from OnTLSClientCert
+
+	messages int // messages sent in this session
+	rejected int // of messages, how many were refused
+
+	// For SessionStats:
+	bytesIn   int64
+	bytesOut  int64
+	commands  int
+	quit      bool   // client sent QUIT
+	connErr   error  // first error from the connection
+	lastReply string // last line sent
+
+	// For Server.Tracer:
+	span      Span            // the session's, or nil
+	txSpan    Span            // the current transaction's, or nil
+	sessCtx   context.Context // ctx outside the transaction's span
+	msgBytes  int64           // written to the Envelope
+	txCounted bool            // the transaction's message was counted
+
+	timing  Timing
+	expires time.Time // end of Server.SessionTimeout, or zero
+
+	user string // authenticated user, or empty
+
+	debug      bool        // log at LogDebug, for Server.DebugSession
+	transcript *transcript // for Server.Transcript, or nil
+
+	connAddr net.Addr // counted by the ConnLimiter, or nil
+
+	mu     sync.Mutex
+	values map[interface{}]interface{} // guarded by mu
 }
 
 func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
 	s = &session{
+		id:  newSessionID(),
 		srv: srv,
 		rwc: rwc,
-		br:  bufio.NewReader(rwc),
-		bw:  bufio.NewWriter(rwc),
 	}
+	s.cr = &connReader{conn: rwc, s: s}
+	s.br = srv.newReader(s.cr)
+	s.bw = srv.newWriter(statsWriter{rwc, s})
+	s.ctx, s.cancel = context.WithCancelCause(srv.baseContext())
+	s.timing.Connect = srv.now()
 	return
 }
 
+func (srv *Server) newReader(r io.Reader) *bufio.Reader {
+	if srv.ReadBufferSize > 0 {
+		return bufio.NewReaderSize(r, srv.ReadBufferSize)
+	}
+	return bufio.NewReader(r)
+}
+
+func (srv *Server) newWriter(w io.Writer) *bufio.Writer {
+	if srv.WriteBufferSize > 0 {
+		return bufio.NewWriterSize(w, srv.WriteBufferSize)
+	}
+	return bufio.NewWriter(w)
+}
+
+// useDataReader switches to a read buffer of Server.DataReadBufferSize
+// for receiving a message, if that's larger. The returned func
+// switches back, unless the larger buffer holds data read ahead.
+func (s *session) useDataReader() (restore func()) {
+	base, n := s.br, s.srv.DataReadBufferSize
+	if n <= base.Size() {
+		return func() {}
+	}
+	s.br = bufio.NewReaderSize(base, n)
+	return func() {
+		if s.br.Buffered() == 0 {
+			s.br = base
+		}
+	}
+}
+
 func (s *session) errorf(format string, args ...interface{}) {
-	log.Printf("Client error: "+format, args...)
+	s.logf(LogConn, LogInfo, format, args...)
 }
 
 func (s *session) sendf(format string, args ...interface{}) {
 	if s.srv.WriteTimeout != 0 {
 		s.rwc.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
 	}
+	if s.logEnabled(LogProto, LogDebug) {
+		reply := fmt.Sprintf(format, args...)
+		var attrs []slog.Attr
+		if len(reply) >= 3 {
+			if code, err := strconv.Atoi(reply[:3]); err == nil {
+				attrs = append(attrs, slog.Int("code", code))
+			}
+		}
+		s.logAttrs(LogProto, LogDebug, fmt.Sprintf("S: %q", reply), attrs...)
+	}
 	fmt.Fprintf(s.bw, format, args...)
 	s.bw.Flush()
 }
 
 func (s *session) sendlinef(format string, args ...interface{}) {
-	s.sendf(format+"\r\n", args...)
+	line := fmt.Sprintf(format, args...)
+	// Count replies refusing malformed or unrecognized commands
+	// (500 to 504) for Server.MaxErrors.
+	if len(line) >= 3 && line[0] == '5' && line[1] == '0' && line[2] <= '4' {
+		s.syntaxErrors++
+	} else {
+		s.syntaxErrors = 0
+	}
+	if line != "" && (line[0] == '4' || line[0] == '5') {
+		s.tarpit(line)
+		s.errorReplies++
+	}
+	s.lastReply = line
+	s.sendf("%s\r\n", line)
+}
+
+// finalWriteTimeout bounds the write of a last reply to a client that
+// is being disconnected, which may not be reading.
+const finalWriteTimeout = 2 * time.Second
+
+// sendFinalLinef sends a last line before the connection is closed.
+func (s *session) sendFinalLinef(format string, args ...interface{}) {
+	s.lastReply = fmt.Sprintf(format, args...)
+	s.rwc.SetWriteDeadline(time.Now().Add(finalWriteTimeout))
+	fmt.Fprintf(s.bw, "%s\r\n", s.lastReply)
+	s.bw.Flush()
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
 }
 
 func (s *session) sendSMTPErrorOrLinef(err error, format string, args ...interface{}) {
@@ -186,78 +967,344 @@ func (s *session) sendSMTPErrorOrLinef(err error, format string, args ...interfa
 }
 
 func (s *session) Addr() net.Addr {
+	if s.remote != nil {
+		return s.remote
+	}
 	return s.rwc.RemoteAddr()
 }
 
 func (s *session) Close() error { return s.rwc.Close() }
 
-func (s *session) serve() {
-	defer s.rwc.Close()
+func (s *session) RawConn() net.Conn { return s.rwc }
+
+func (s *session) LocalAddr() net.Addr { return s.rwc.LocalAddr() }
+
+func (s *session) HeloName() string { return s.helloHost }
+
+func (s *session) HeloType() string { return s.helloType }
+
+func (s *session) ClientName() string { return s.clientName }
+
+func (s *session) TLS() *tls.ConnectionState { return s.tlsState }
+
+func (s *session) PeerCertificates() []*x509.Certificate {
+	if s.tlsState == nil || len(s.tlsState.VerifiedChains) == 0 {
+		return nil
+	}
+	return s.tlsState.VerifiedChains[0]
+}
+
+func (s *session) MessageCounts() (sent, rejected int) { return s.messages, s.rejected }
+
+func (s *session) ClientID() (idType, id string) { return s.clientIDType, s.clientID }
+
+func (s *session) ID() string { return s.id }
+
+func (s *session) SetValue(key, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[interface{}]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *session) Value(key interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// greet checks whether to accept the client and sends the greeting,
+// reporting whether the session can continue.
+func (s *session) greet() bool {
+	if r := s.srv.Reputation; r != nil && r.Blocked(s.Addr()) {
+		s.sendlinef("421 4.7.0 %s Error: too many errors from your address, try again later", s.srv.hostname())
+		return false
+	}
 	if onc := s.srv.OnNewConnection; onc != nil {
-		if err := onc(s); err != nil {
+		stop := s.watchClient()
+		err := onc(s)
+		stop()
+		if err != nil {
+			s.recordEvent(EventRejected)
 			s.sendSMTPErrorOrLinef(err, "554 connection rejected")
+			return false
+		}
+	}
+	proto := "ESMTP"
+	if s.srv.LMTP {
+		proto = "LMTP"
+	}
+	banner := fmt.Sprintf("220 %s %s gosmtpd", s.srv.hostname(), proto)
+	s.tarpit(banner)
+	s.sendlinef("%s", banner)
+	return true
+}
+
+// recoverPanic, deferred by serve, ends a session that panicked with
+// a 421 reply, so one bad hook call doesn't take the server down.
+func (s *session) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	if s.srv.OnPanic != nil {
+		s.srv.OnPanic(s, r, stack)
+	} else {
+		s.logf(LogConn, LogError, "panic serving session: %v\n%s", r, stack)
+	}
+	s.sendFinalLinef("421 4.3.0 %s Internal server error", s.srv.hostname())
+}
+
+// serve runs the session. The caller must have counted it in
+// srv.sessions.
+func (s *session) serve() {
+	defer s.srv.sessions.Add(-1)
+	s.srv.metrics().ConnOpened()
+	defer s.endSession()
+	defer s.rwc.Close()
+	defer s.cancel(nil)
+	defer s.releaseUser()
+	defer s.resetTx()
+	defer s.recoverPanic()
+	if d := s.srv.SessionTimeout; d > 0 {
+		s.expires = s.srv.now().Add(d)
+	}
+	if s.srv.ProxyProtocol {
+		if err := s.readProxyHeader(); err != nil {
+			s.errorf("reading PROXY header: %v", err)
+			s.setConnErr(err)
+			return
+		}
+	}
+	s.startSessionSpan()
+	s.startReverseDNS()
+	s.startDNSBL()
+	s.debug = s.srv.DebugSession != nil && s.srv.DebugSession(s)
+	s.startTranscript()
+	s.xclientOK = s.srv.XClientAllowed != nil && s.srv.XClientAllowed(s.Addr())
+	if s.implicitTLS && !s.startImplicitTLS() {
+		return
+	}
+	defer s.releaseConn()
+	if err := s.acquireConn(); err != nil {
+		s.sendFinalLinef("%s", err)
+		return
+	}
+	if s.pregreet() {
+		s.AddSignal(SignalEarlyTalker)
+		if s.srv.RejectEarlyTalkers {
+			s.recordEvent(EventRejected)
+			s.sendlinef("554 5.5.0 %s Error: talked before the greeting", s.srv.hostname())
 			return
 		}
 	}
-	s.sendf("220 %s ESMTP gosmtpd\r\n", s.srv.hostname())
+	if !s.greet() {
+		return
+	}
+	s.limiter = s.newCommandLimiter()
 	for {
-		if s.srv.ReadTimeout != 0 {
-			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+		if s.txOver() {
+			s.endTxSpan()
 		}
-		sl, err := s.br.ReadSlice('\n')
+		if max := s.srv.MaxErrors; max > 0 && s.syntaxErrors >= max {
+			s.logf(LogProto, LogInfo, "too many errors")
+			s.recordEvent(EventRejected)
+			s.sendFinalLinef("421 4.7.0 %s Error: too many errors, closing connection", s.srv.hostname())
+			return
+		}
+		s.rwc.SetReadDeadline(s.readDeadline(s.srv.ReadTimeout))
+		sl, tooLong, err := s.readLine(s.commandLimit("AUTH") + s.commandLimit("MAIL"))
 		if err != nil {
+			switch {
+			case isTimeout(err) && s.expired():
+				s.sendFinalLinef("421 4.4.2 %s Error: session time limit exceeded, closing connection", s.srv.hostname())
+			case isTimeout(err):
+				s.sendFinalLinef("421 4.4.2 %s Error: idle timeout, closing connection", s.srv.hostname())
+			}
 			s.errorf("read error: %v", err)
 			return
 		}
-		line := cmdLine(string(sl))
-		if err := line.checkValid(); err != nil {
+		line := parse.Line(sl)
+		s.commands++
+		if verb := line.Verb(); commandVerbs[verb] {
+			s.srv.metrics().Command(verb)
+		} else {
+			s.srv.metrics().Command("UNKNOWN")
+		}
+		if s.logEnabled(LogProto, LogDebug) {
+			s.logAttrs(LogProto, LogDebug, fmt.Sprintf("C: %q", line), slog.String("verb", line.Verb()))
+		}
+		if !s.throttle() {
+			return
+		}
+		if s.br.Buffered() > 0 {
+			s.pipelined = true
+		}
+		if tooLong || len(line) > s.commandLimit(line.Verb()) {
+			s.sendlinef("%s", errLineTooLong)
+			continue
+		}
+		if s.srv.StrictCRLF && hasBareCRLF(sl) {
+			s.sendlinef("500 5.5.2 Error: bare <CR> or <LF> not allowed")
+			continue
+		}
+		if s.env == nil && s.srv.shuttingDown.Load() {
+			s.sendFinalLinef("421 4.3.2 %s Error: shutting down, try again later", s.srv.hostname())
+			return
+		}
+		if err := line.CheckValid(); err != nil {
 			s.sendlinef("500 %v", err)
 			continue
 		}
 
 		switch line.Verb() {
 		case "HELO", "EHLO":
+			if s.srv.LMTP {
+				s.sendlinef("500 5.5.1 Error: LMTP requires LHLO")
+				continue
+			}
+			s.handleHello(line.Verb(), line.Arg())
+		case "LHLO":
+			if !s.srv.LMTP {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
 			s.handleHello(line.Verb(), line.Arg())
 		case "QUIT":
+			s.quit = true
 			s.sendlinef("221 2.0.0 Bye")
 			return
 		case "RSET":
-			s.env = nil
+			s.resetTx()
 			s.sendlinef("250 2.0.0 OK")
 		case "NOOP":
 			s.sendlinef("250 2.0.0 OK")
 		case "MAIL":
 			arg := line.Arg() // "From:<foo@bar.com>"
-			m := mailFromRE.FindStringSubmatch(arg)
-			if m == nil {
-				log.Printf("invalid MAIL arg: %q", arg)
+			path, params, err := parse.ReversePath(arg)
+			if err != nil {
+				s.logf(LogProto, LogInfo, "invalid MAIL arg: %q", arg)
 				s.sendlinef("501 5.1.7 Bad sender address syntax")
 				continue
 			}
-			s.handleMailFrom(m[1])
+			s.handleMailFrom(path, params)
 		case "RCPT":
-			s.handleRcpt(line)
+			if !s.handleRcpt(line) {
+				return
+			}
 		case "DATA":
 			s.handleData()
+		case "BDAT":
+			if !s.handleBDAT(line.Arg()) {
+				return
+			}
+		case "ATRN":
+			if s.srv.OnATRN == nil {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
+			if s.handleATRN(line.Arg()) {
+				return
+			}
+		case "STARTTLS":
+			if !s.srv.tlsEnabled() {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
+			if !s.handleStartTLS() {
+				return
+			}
+		case "AUTH":
+			if len(s.authMechanismNames()) == 0 {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
+			if !s.handleAuth(line.Arg()) {
+				return
+			}
+		case "CLIENTID":
+			if s.srv.OnClientID == nil {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
+			s.handleClientID(line.Arg())
+		case "XCLIENT":
+			if s.srv.XClientAllowed == nil {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
+			if !s.handleXClient(line.Arg()) {
+				return
+			}
 		default:
-			log.Printf("Client: %q, verhb: %q", line, line.Verb())
+			s.logf(LogProto, LogInfo, "unrecognized command %q", line)
 			s.sendlinef("502 5.5.2 Error: command not recognized")
 		}
 	}
 }
 
 func (s *session) handleHello(greeting, host string) {
+	if s.xclientHelo != "" {
+		// A proxy greets the server for the client it named.
+		host = s.xclientHelo
+	}
+	if h := s.srv.OnHello; h != nil {
+		stop := s.watchClient()
+		err := h(s, greeting, host)
+		stop()
+		if err != nil {
+			s.logf(LogProto, LogInfo, "rejecting %s %q: %v", greeting, host, err)
+			s.recordEvent(EventRejected)
+			s.sendSMTPErrorOrLinef(err, "550 5.7.1 Error: %s rejected", greeting)
+			return
+		}
+	}
 	s.helloType = greeting
 	s.helloHost = host
+	s.timing.Hello = s.srv.now()
+	s.helloSignals(host)
 	fmt.Fprintf(s.bw, "250-%s\r\n", s.srv.hostname())
 	extensions := []string{}
-	if s.srv.PlainAuth {
-		extensions = append(extensions, "250-AUTH PLAIN")
+	if names := s.authMechanismNames(); len(names) > 0 && s.authAllowed() {
+		extensions = append(extensions, "250-AUTH "+strings.Join(names, " "))
+	}
+	if s.srv.OnClientID != nil {
+		extensions = append(extensions, "250-CLIENTID")
+	}
+	if s.srv.OnATRN != nil {
+		extensions = append(extensions, "250-ATRN")
+	}
+	if s.xclientOK {
+		extensions = append(extensions, "250-XCLIENT "+strings.Join(xclientAttrs, " "))
+	}
+	if s.srv.tlsEnabled() && s.tlsState == nil {
+		extensions = append(extensions, "250-STARTTLS")
+	}
+	if s.srv.OfferREQUIRETLS && s.tlsState != nil {
+		extensions = append(extensions, "250-REQUIRETLS")
+	}
+	if s.srv.MaxSize > 0 {
+		extensions = append(extensions, fmt.Sprintf("250-SIZE %d", s.srv.MaxSize))
+	} else {
+		extensions = append(extensions, "250-SIZE")
+	}
+	if !s.srv.LMTP {
+		extensions = append(extensions, "250-PRDR")
 	}
 	extensions = append(extensions, "250-PIPELINING",
-		"250-SIZE 10240000",
 		"250-ENHANCEDSTATUSCODES",
 		"250-8BITMIME",
+		"250-CHUNKING",
+		"250-SMTPUTF8",
 		"250 DSN")
 	for _, ext := range extensions {
 		fmt.Fprintf(s.bw, "%s\r\n", ext)
@@ -265,26 +1312,117 @@ func (s *session) handleHello(greeting, host string) {
 	s.bw.Flush()
 }
 
-func (s *session) handleMailFrom(email string) {
-	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
-	// cannot implement one or more of the parameters associated
-	// qwith a particular MAIL FROM or RCPT TO command, it will return
-	// code 555.
+func (s *session) handleClientID(arg string) {
+	f := strings.Fields(arg)
+	switch {
+	case !s.extended():
+		s.sendlinef("503 5.5.1 Error: send EHLO first")
+		return
+	case s.clientID != "":
+		s.sendlinef("503 5.5.1 Error: CLIENTID already given")
+		return
+	case s.env != nil:
+		s.sendlinef("503 5.5.1 Error: CLIENTID not permitted during mail transaction")
+		return
+	case len(f) != 2:
+		s.sendlinef("501 5.5.4 Syntax: CLIENTID <type> <token>")
+		return
+	}
+	idType, id := strings.ToUpper(f[0]), f[1]
+	if err := s.srv.OnClientID(s, idType, id); err != nil {
+		s.sendSMTPErrorOrLinef(err, "550 5.7.1 CLIENTID rejected")
+		return
+	}
+	s.clientIDType, s.clientID = idType, id
+	s.sendlinef("250 2.0.0 OK")
+}
+
+// resetSession discards what the session has learned from the client
+// other than its address, and any transaction in progress, so that it
+// must start over with EHLO, as after STARTTLS or XCLIENT.
+func (s *session) resetSession() {
+	s.resetTx()
+	s.releaseUser()
+	s.helloType, s.helloHost = "", ""
+	s.clientIDType, s.clientID = "", ""
+	s.mailParams = nil
+	s.pipelined = false
+}
 
+// resetTx abandons the current mail transaction, if any.
+func (s *session) resetTx() {
+	s.endBDAT()
+	s.abortStream()
+	s.abortEnvelope()
+	s.env = nil
+	s.envClosed = false
+	s.rcpts = nil
+	s.prdr = false
+	s.body8bit = false
+	s.discarded = 0
+	s.rcptKept = nil
+}
+
+func (s *session) handleMailFrom(email, params string) {
 	if s.env != nil {
 		s.sendlinef("503 5.5.1 Error: nested MAIL command")
 		return
 	}
+	if s.srv.RequireTLS && s.tlsState == nil {
+		s.sendlinef("530 5.7.0 Must issue a STARTTLS command first")
+		return
+	}
+	s.startTiming()
+	s.startTxSpan(email)
+	var err error
+	s.mailParams, err = parse.Params(params)
+	if err != nil {
+		s.sendlinef("501 5.5.4 Error: %v", err)
+		return
+	}
+	if is8bit([]byte(email)) && !s.smtpUTF8() {
+		s.sendlinef("553 5.6.7 Error: UTF-8 address requires SMTPUTF8")
+		return
+	}
+	if err := checkMailDSN(s.mailParams); err != nil {
+		s.sendlinef("%s", err.Error())
+		return
+	}
+	if !s.checkParams("MAIL", s.mailParams) {
+		return
+	}
+	if max := s.srv.MaxSize; max > 0 && s.Features().Size > max {
+		s.sendlinef("%s", errTooBig.Error())
+		return
+	}
+	if !s.checkDNSBL() {
+		return
+	}
 	cb := s.srv.OnNewMail
 	if cb == nil {
-		log.Printf("smtp: Server.OnNewMail is nil; rejecting MAIL FROM")
+		s.logf(LogDelivery, LogError, "Server.OnNewMail is nil; rejecting MAIL FROM")
 		s.sendf("451 Server.OnNewMail not configured\r\n")
 		return
 	}
 	s.env = nil
-	env, err := cb(s, addrString(email))
+	stop := s.watchClient()
+	env, err := cb(s, s.mailAddress(email))
+	stop()
+	if v := verdict(err); v != nil {
+		s.env = env
+		if err = s.applyVerdict(v); err != nil {
+			s.env = nil
+		}
+		env = s.env
+	}
 	if err != nil {
-		log.Printf("rejecting MAIL FROM %q: %v", email, err)
+		s.logf(LogDelivery, LogInfo, "rejecting MAIL FROM %q: %v", email, err)
+		s.recordEvent(EventRejected)
+		if se, ok := err.(SMTPError); ok {
+			// The hook chose the reply; the session goes on.
+			s.sendlinef("%s", se.Error())
+			return
+		}
 		s.sendf("451 denied\r\n")
 
 		s.bw.Flush()
@@ -293,32 +1431,90 @@ func (s *session) handleMailFrom(email string) {
 		return
 	}
 	s.env = env
+	s.prdr = parse.HasParam(params, "PRDR")
+	s.body8bit = strings.EqualFold(s.mailParams["BODY"], "8BITMIME") || s.smtpUTF8()
 	s.sendlinef("250 2.1.0 Ok")
 }
 
-func (s *session) handleRcpt(line cmdLine) {
-	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
-	// cannot implement one or more of the parameters associated
-	// qwith a particular MAIL FROM or RCPT TO command, it will return
-	// code 555.
-
+// handleRcpt handles a RCPT command and reports whether the session
+// can continue.
+func (s *session) handleRcpt(line parse.Line) bool {
 	if s.env == nil {
 		s.sendlinef("503 5.5.1 Error: need MAIL command")
-		return
+		return true
 	}
 	arg := line.Arg() // "To:<foo@bar.com>"
-	m := rcptToRE.FindStringSubmatch(arg)
-	if m == nil {
-		log.Printf("bad RCPT address: %q", arg)
-		s.sendlinef("501 5.1.7 Bad sender address syntax")
-		return
+	received := s.srv.now()
+	path, rawParams, err := parse.ForwardPath(arg)
+	if err != nil {
+		s.logf(LogProto, LogInfo, "bad RCPT address: %q", arg)
+		s.sendlinef("501 5.1.3 Bad recipient address syntax")
+		return true
+	}
+	if is8bit([]byte(path)) && !s.smtpUTF8() {
+		s.sendlinef("553 5.6.7 Error: UTF-8 address requires SMTPUTF8")
+		return true
 	}
-	err := s.env.AddRecipient(addrString(m[1]))
+	params, err := parse.Params(rawParams)
 	if err != nil {
+		s.sendlinef("501 5.5.4 Error: %v", err)
+		return true
+	}
+	opts, err := parseRcptOptions(params)
+	if err != nil {
+		s.sendlinef("%s", err.Error())
+		return true
+	}
+	if !s.checkParams("RCPT", params) {
+		return true
+	}
+	if max := s.srv.MaxRecipients; max > 0 && len(s.rcpts)+s.discarded >= max {
+		s.logf(LogProto, LogInfo, "too many recipients")
+		s.overshoot++
+		if limit := s.srv.MaxRecipientsOvershoot; limit > 0 && s.overshoot > limit {
+			s.sendFinalLinef("421 4.5.3 %s Error: too many recipients, closing connection", s.srv.hostname())
+			return false
+		}
+		s.sendlinef("452 4.5.3 Error: too many recipients")
+		return true
+	}
+	rcpt := s.mailAddress(path)
+	stop := s.watchClient()
+	if h := s.srv.OnRcpt; h != nil {
+		err = h(s, s.env, rcpt, params)
+	}
+	if err == nil {
+		if oe, ok := s.env.(RcptOptionsEnvelope); ok {
+			err = oe.AddRecipientWithOptions(rcpt, opts)
+		} else {
+			err = s.env.AddRecipient(rcpt)
+		}
+	}
+	stop()
+	if v := verdict(err); v != nil {
+		if v.Action == VerdictDiscard {
+			s.logf(LogDelivery, LogInfo, "discarding recipient %q", path)
+			s.discarded++
+			if s.srv.LMTP {
+				s.rcptKept = append(s.rcptKept, false)
+			}
+			s.sendlinef("250 2.1.0 Ok")
+			return true
+		}
+		err = nil
+	}
+	if err != nil {
+		s.recordEvent(EventInvalidRecipient)
 		s.sendSMTPErrorOrLinef(err, "550 bad recipient")
-		return
+		return true
+	}
+	s.rcpts = append(s.rcpts, rcpt)
+	if s.srv.LMTP {
+		s.rcptKept = append(s.rcptKept, true)
 	}
+	s.timing.Rcpts = append(s.timing.Rcpts, received)
 	s.sendlinef("250 2.1.0 Ok")
+	return true
 }
 
 func (s *session) handleData() {
@@ -326,95 +1522,566 @@ func (s *session) handleData() {
 		s.sendlinef("503 5.5.1 Error: need RCPT command")
 		return
 	}
-	if err := s.env.BeginData(); err != nil {
-		s.handleError(err)
+	if s.bdat != nil {
+		s.sendlinef("503 5.5.1 Error: DATA not permitted during BDAT transfer")
+		return
+	}
+	end, ok := s.beginData()
+	if !ok {
 		return
 	}
+	defer end()
 	s.sendlinef("354 Go ahead")
+	defer s.useDataReader()()
+	start := s.srv.now()
+	var n int64 // bytes read since start
+	inHeader := s.srv.OnHeaders != nil
+	var hdr []byte
+	prevCRLF := true // previous line ended in CRLF
+	bareDot := false // saw a dot line delimited by a bare CR or LF
+	has8bit := false
+	tooBig := false  // over MaxSize; the rest is discarded
+	tooLong := false // has a line over MaxDataLine; likewise
+	bareEOL := false // has a bare CR or LF anywhere; with StrictCRLF, likewise
+	var werr error   // from the Envelope; likewise
+	raw := s.transparency() == Raw
 	for {
-		sl, err := s.br.ReadSlice('\n')
+		if d := s.dataDeadline(start, n); !d.IsZero() {
+			s.rwc.SetReadDeadline(d)
+		}
+		sl, long, err := s.readLine(s.dataLineLimit())
 		if err != nil {
-			s.errorf("read error: %v", err)
+			if isTimeout(err) {
+				s.sendFinalLinef("421 4.4.2 %s Error: timeout exceeded", s.srv.hostname())
+				s.rwc.Close()
+			}
+			s.errorf("read error after %v and %d bytes of DATA: %v", s.srv.now().Sub(start), n, err)
 			return
 		}
-		if bytes.Equal(sl, []byte(".\r\n")) {
+		n += int64(len(sl))
+		if prevCRLF && bytes.Equal(sl, []byte(".\r\n")) {
+			s.timing.DataEnd = s.srv.now()
 			break
 		}
-		if sl[0] == '.' {
+		if !bareDot && isBareDotLine(sl, prevCRLF) {
+			bareDot = true
+			s.logf(LogProto, LogInfo, "sent a dot line with bare CR or LF")
+		}
+		if !bareEOL && !long && hasBareCRLF(sl) {
+			bareEOL = true
+			s.logf(LogProto, LogDebug, "sent a bare CR or LF")
+		}
+		lineStart := prevCRLF // sl begins a line, rather than following a bare LF
+		prevCRLF = long || bytes.HasSuffix(sl, []byte("\r\n"))
+		if long && !tooLong {
+			tooLong = true
+			s.logf(LogProto, LogInfo, "sent a message line over %d bytes", s.dataLineLimit())
+		}
+		if tooBig = tooBig || s.srv.MaxSize > 0 && n > s.srv.MaxSize; tooBig || tooLong || bareEOL && s.srv.StrictCRLF || werr != nil {
+			continue
+		}
+		if !has8bit && !s.body8bit {
+			has8bit = is8bit(sl)
+		}
+		wire := sl
+		if lineStart && sl[0] == '.' {
 			sl = sl[1:]
 		}
-		err = s.env.Write(sl)
-		if err != nil {
-			s.sendSMTPErrorOrLinef(err, "550 ??? failed")
-			return
+		if inHeader {
+			if string(sl) == "\r\n" || len(hdr)+len(sl) > maxHeaderBytes {
+				inHeader = false
+				if !s.checkHeader(hdr) {
+					return
+				}
+			} else {
+				hdr = append(hdr, sl...)
+			}
+		}
+		if raw {
+			err = s.write(wire)
+		} else {
+			err = s.write(sl)
 		}
+		if err != nil && !s.envVerdict(err) {
+			werr = err
+		}
+	}
+	if werr != nil {
+		s.logf(LogDelivery, LogError, "writing message: %v", werr)
+		s.recordEvent(EventRejected)
+		s.sendSMTPErrorOrLinef(werr, "451 4.3.0 Error: writing message failed")
+		s.countMessage(true)
+		s.resetTx()
+		return
+	}
+	if tooBig {
+		s.rejectTooBig()
+		return
 	}
-	if err := s.env.Close(); err != nil {
+	if tooLong {
+		s.recordEvent(EventRejected)
+		s.sendlinef("%s", errLineTooLong)
+		s.countMessage(true)
+		s.resetTx()
+		return
+	}
+	if bareEOL && s.srv.StrictCRLF {
+		s.sendlinef("550 5.5.2 Error: bare <CR> or <LF> not allowed")
+		s.countMessage(true)
+		s.resetTx()
+		return
+	}
+	if inHeader && !s.checkHeader(hdr) {
+		return
+	}
+	s.finishData(has8bit, bareDot)
+}
+
+// beginData starts receiving the current transaction's message, with
+// DATA or the first BDAT. If it fails, it replies and reports false;
+// otherwise end must be called once the message is done.
+func (s *session) beginData() (end func(), ok bool) {
+	s.timing.DataStart = s.srv.now()
+	var score float64
+	var action ScoreAction
+	if sc := s.srv.Scoring; sc != nil {
+		score = sc.Score(s.Signals())
+		action = sc.Action(score)
+		switch action {
+		case ScoreReject:
+			s.recordEvent(EventRejected)
+			s.sendlinef("550 5.7.1 Error: message rejected as spam (score %.1f)", score)
+			s.countMessage(true)
+			s.resetTx()
+			return nil, false
+		case ScoreDefer:
+			s.sendlinef("451 4.7.1 Error: message deferred (score %.1f), try again later", score)
+			s.countMessage(true)
+			s.resetTx()
+			return nil, false
+		}
+	}
+	endData := func() {}
+	if max := s.srv.MaxConcurrentData; max > 0 {
+		if int(s.srv.inData.Add(1)) > max {
+			s.srv.inData.Add(-1)
+			s.sendlinef("451 4.3.2 Error: too many concurrent deliveries, try again later")
+			return nil, false
+		}
+		endData = func() { s.srv.inData.Add(-1) }
+	}
+	if !s.acquireUserMessage() {
+		endData()
+		s.sendlinef("451 4.7.0 Error: too many messages in progress for %s, try again later", s.user)
+		return nil, false
+	}
+	end = func() {
+		s.releaseUserMessage()
+		endData()
+	}
+	if len(s.rcpts) == 0 && s.discarded > 0 {
+		s.abortEnvelope()
+		s.env = discardEnvelope{}
+	}
+	stop := s.watchClient()
+	err := s.env.BeginData()
+	stop()
+	if err != nil && !s.envVerdict(err) {
+		end()
+		s.countMessage(true)
 		s.handleError(err)
+		return nil, false
+	}
+	s.startStream()
+	if s.srv.AddReceivedHeader {
+		s.writeReceived()
+	}
+	if s.srv.Scoring != nil {
+		if action == ScoreTag {
+			s.write([]byte("X-Spam-Flag: YES\r\n"))
+		}
+		s.write([]byte(fmt.Sprintf("X-Spam-Score: %.1f\r\n", score)))
+	}
+	return end, true
+}
+
+var errTooBig = SMTPError("552 5.3.4 Error: message size exceeds fixed maximum message size")
+
+// rejectTooBig refuses the current message for exceeding MaxSize.
+func (s *session) rejectTooBig() {
+	s.logf(LogDelivery, LogInfo, "message larger than %d bytes", s.srv.MaxSize)
+	s.recordEvent(EventRejected)
+	s.sendlinef("%s", errTooBig.Error())
+	s.countMessage(true)
+	s.resetTx()
+}
+
+// finishData ends the current transaction once its message has been
+// received and its header checked, and sends the final reply.
+func (s *session) finishData(has8bit, bareDot bool) {
+	if has8bit && !s.checkUndeclared8Bit() {
+		return
+	}
+	if bareDot && s.srv.RejectBareDotLines {
+		s.sendlinef("550 5.5.2 Error: bare <CR> or <LF> around dot line not allowed")
+		s.countMessage(true)
+		s.resetTx()
+		return
+	}
+	err := s.endStream()
+	if err == nil || s.envVerdict(err) {
+		if err = s.closeEnvelope(); err != nil && s.envVerdict(err) {
+			err = nil
+		}
+	}
+	rerrs, isRcptErrs := err.(RecipientErrors)
+	if isRcptErrs {
+		err = nil
+	}
+	if s.srv.LMTP {
+		s.finishLMTP(err, rerrs)
 		return
 	}
+	if isRcptErrs && !s.prdr {
+		if err = rerrs.all(len(s.rcpts)); err == nil {
+			err = rerrs.temporary(len(s.rcpts))
+		}
+	}
+	if err != nil {
+		s.recordEvent(EventRejected)
+		s.countMessage(true)
+		s.handleError(err)
+		return
+	}
+	accepted := true
+	if pe, ok := s.env.(PRDREnvelope); s.prdr && (ok || isRcptErrs) {
+		accepted = s.sendPRDRVerdicts(pe, rerrs)
+	} else {
+		s.sendlinef("250 2.0.0 Ok: queued")
+	}
+	if accepted {
+		s.recordEvent(EventAccepted)
+	} else {
+		s.recordEvent(EventRejected)
+	}
+	s.countMessage(!accepted)
+	s.resetTx()
+}
+
+// checkParams refuses a command with parameters Server.OnParams
+// doesn't support, and reports whether the command goes on.
+func (s *session) checkParams(verb string, params map[string]string) bool {
+	h := s.srv.OnParams
+	if h == nil || len(params) == 0 {
+		return true
+	}
+	if bad := h(s, verb, params); len(bad) > 0 {
+		s.sendlinef("555 5.5.4 Error: unsupported parameter %s", strings.Join(bad, " "))
+		return false
+	}
+	return true
+}
+
+func (s *session) MailParams() map[string]string { return s.mailParams }
+
+// smtpUTF8 reports whether the current or latest MAIL command asked
+// for SMTPUTF8 (RFC 6531), allowing UTF-8 in addresses and headers.
+func (s *session) smtpUTF8() bool {
+	_, ok := s.mailParams["SMTPUTF8"]
+	return ok
+}
+
+// is8bit reports whether line has bytes with the high bit set.
+func is8bit(line []byte) bool {
+	for _, b := range line {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUndeclared8Bit handles a message containing 8-bit data the
+// client didn't declare, and reports whether it goes on.
+func (s *session) checkUndeclared8Bit() bool {
+	s.logf(LogProto, LogInfo, "sent 8-bit data without BODY=8BITMIME")
+	if s.srv.RejectUndeclared8Bit {
+		s.sendlinef("554 5.6.1 Error: 8-bit data requires BODY=8BITMIME")
+		s.countMessage(true)
+		s.resetTx()
+		return false
+	}
+	if ue, ok := s.env.(Undeclared8BitEnvelope); ok {
+		ue.Undeclared8Bit()
+	}
+	return true
+}
+
+// countMessage counts a message the client finished sending.
+func (s *session) countMessage(rejected bool) {
+	s.endTiming()
+	s.messages++
+	if rejected {
+		s.rejected++
+	}
+	s.srv.metrics().Message(!rejected)
+	s.traceMessage()
+}
+
+var errEndOfDataTimeout = SMTPError("451 4.3.0 Error: timeout processing message, try again later")
+
+// closeEnvelope ends the current message, waiting at most
+// Server.EndOfDataTimeout for the Envelope to finish.
+func (s *session) closeEnvelope() error {
+	defer s.watchClient()()
+	env := s.env
+	s.envClosed = true
+	d := s.srv.EndOfDataTimeout
+	if d == 0 {
+		if cc, ok := env.(ContextCloser); ok {
+			return cc.CloseContext(s.ctx)
+		}
+		return env.Close()
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	timer := clockOrSystem(s.srv.Clock).NewTimer(d)
+	defer timer.Stop()
+	errc := make(chan error, 1)
+	go func() {
+		if cc, ok := env.(ContextCloser); ok {
+			errc <- cc.CloseContext(ctx)
+			return
+		}
+		errc <- env.Close()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-timer.C():
+		cancel()
+		s.logf(LogDelivery, LogError, "Envelope.Close took longer than %v", d)
+		return errEndOfDataTimeout
+	}
+}
+
+// sendPRDRVerdicts sends the per-recipient replies and the final
+// reply for a message accepted under the PRDR extension, from pe or
+// rerrs, either of which may be nil. It reports whether any recipient
+// accepted the message.
+func (s *session) sendPRDRVerdicts(pe PRDREnvelope, rerrs RecipientErrors) bool {
+	s.sendlinef("353 PRDR content analysis beginning")
+	accepted := 0
+	for i, rcpt := range s.rcpts {
+		if err := recipientResult(i, rcpt, pe, rerrs); err != nil {
+			s.sendSMTPErrorOrLinef(err, "550 5.7.1 <%s> message rejected", rcpt.Email())
+			continue
+		}
+		accepted++
+		s.sendlinef("250 2.1.5 <%s> Ok", rcpt.Email())
+	}
+	if accepted == 0 {
+		s.sendlinef("550 5.7.1 Message rejected for all recipients")
+		return false
+	}
 	s.sendlinef("250 2.0.0 Ok: queued")
-	s.env = nil
+	return true
 }
 
+// hasBareCRLF reports whether line contains a CR or LF other than a
+// final CRLF.
+func hasBareCRLF(line []byte) bool {
+	body := bytes.TrimSuffix(line, []byte("\r\n"))
+	return bytes.IndexByte(body, '\r') >= 0 || bytes.IndexByte(body, '\n') >= 0
+}
+
+// isBareDotLine reports whether line, which follows a line ending in
+// CRLF if prevCRLF is set, contains a line consisting of a single dot
+// where a bare CR or LF, rather than CRLF, delimits it on either side.
+// Some MTAs treat bare CRs within a line as line breaks too.
+func isBareDotLine(line []byte, prevCRLF bool) bool {
+	for i, c := range line {
+		if c != '.' {
+			continue
+		}
+		var startBare bool
+		switch {
+		case i == 0:
+			startBare = !prevCRLF
+		case line[i-1] == '\r':
+			startBare = true
+		default:
+			continue
+		}
+		after := line[i+1:]
+		var endBare bool
+		switch {
+		case bytes.Equal(after, []byte("\r\n")):
+		case bytes.HasPrefix(after, []byte("\n")):
+			endBare = true
+		case bytes.HasPrefix(after, []byte("\r")) && !bytes.HasPrefix(after, []byte("\r\n")):
+			endBare = true
+		default:
+			continue
+		}
+		if startBare || endBare {
+			return true
+		}
+	}
+	return false
+}
+
+// maxHeaderBytes is the most header data passed to
+// Server.OnHeaders; a longer header is cut off at this size.
+const maxHeaderBytes = 256 << 10
+
+// checkHeader parses the raw message header hdr and passes it to
+// the OnHeaders hook. If the hook rejects the message, checkHeader
+// replies, closes the connection and returns false.
+func (s *session) checkHeader(hdr []byte) bool {
+	// A malformed header is passed along as far as it parsed.
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(hdr))).ReadMIMEHeader()
+	err := s.srv.OnHeaders(s, s.env, mail.Header(h))
+	if v := verdict(err); v != nil {
+		err = s.applyVerdict(v)
+	}
+	if err == nil {
+		return true
+	}
+	s.recordEvent(EventRejected)
+	s.countMessage(true)
+	s.sendSMTPErrorOrLinef(err, "554 5.7.1 Error: message header rejected")
+	s.rwc.Close()
+	s.resetTx()
+	return false
+}
+
+// maxDataLine is the longest text line, including CRLF, that
+// RFC 5321 (s4.5.3.1.6) requires servers to accept.
+const maxDataLine = 1000
+
+// readDeadline returns the deadline for a read that may take up to
+// timeout, or the zero time if there is none, but no later than the
+// end of the session's SessionTimeout.
+func (s *session) readDeadline(timeout time.Duration) time.Time {
+	var d time.Time
+	if timeout != 0 {
+		d = s.srv.now().Add(timeout)
+	}
+	if !s.expires.IsZero() && (d.IsZero() || s.expires.Before(d)) {
+		d = s.expires
+	}
+	return d
+}
+
+// expired reports whether the session has run out of SessionTimeout.
+func (s *session) expired() bool {
+	return !s.expires.IsZero() && !s.srv.now().Before(s.expires)
+}
+
+// dataDeadline returns the read deadline for the next line of a
+// message whose DATA phase began at start and has read n bytes so
+// far, or the zero time if there is none.
+func (s *session) dataDeadline(start time.Time, n int64) time.Time {
+	timeout := s.srv.DataTimeout
+	if timeout == 0 {
+		timeout = s.srv.ReadTimeout
+	}
+	d := s.readDeadline(timeout)
+	earliest := func(t time.Time) {
+		if d.IsZero() || t.Before(d) {
+			d = t
+		}
+	}
+	if s.srv.MaxDataDuration != 0 {
+		earliest(start.Add(s.srv.MaxDataDuration))
+	}
+	if r := s.srv.MinDataRate; r > 0 {
+		// Allow enough time for one more full line at the minimum rate.
+		earliest(start.Add(time.Duration(n+maxDataLine) * time.Second / time.Duration(r)))
+	}
+	return d
+}
+
+// handleError replies to a message the Envelope failed, with err if
+// it's an SMTPError, and ends the transaction.
 func (s *session) handleError(err error) {
 	if se, ok := err.(SMTPError); ok {
 		s.sendlinef("%s", se)
-		return
+	} else {
+		s.logf(LogDelivery, LogError, "%v", err)
+		s.sendlinef("451 4.3.0 Error: processing message failed, try again later")
 	}
-	log.Printf("Error: %s", err)
-	s.env = nil
+	s.resetTx()
 }
 
-type addrString string
-
-func (a addrString) Email() string {
-	return string(a)
+// addrString is a MailAddress as sent by the client.
+type addrString struct {
+	addr   string
+	delims string // sub-address delimiters
 }
 
-func (a addrString) Hostname() string {
-	e := string(a)
-	if idx := strings.Index(e, "@"); idx != -1 {
-		return strings.ToLower(e[idx+1:])
+func (s *session) mailAddress(addr string) addrString {
+	delims := s.srv.SubaddressDelimiters
+	if delims == "" {
+		delims = "+"
 	}
-	return ""
+	return addrString{addr, delims}
 }
 
-type cmdLine string
+func (a addrString) String() string { return a.addr }
 
-func (cl cmdLine) checkValid() error {
-	if !strings.HasSuffix(string(cl), "\r\n") {
-		return errors.New(`line doesn't end in \r\n`)
-	}
-	// Check for verbs defined not to have an argument
-	// (RFC 5321 s4.1.1)
-	switch cl.Verb() {
-	case "RSET", "DATA", "QUIT":
-		if cl.Arg() != "" {
-			return errors.New("unexpected argument")
+func (a addrString) Email() string {
+	e := a.addr
+	if strings.HasPrefix(e, "@") {
+		if idx := strings.Index(e, ":"); idx != -1 {
+			return e[idx+1:]
 		}
 	}
-	return nil
+	return e
+}
+
+func (a addrString) Raw() string {
+	return a.addr
 }
 
-func (cl cmdLine) Verb() string {
-	s := string(cl)
-	if idx := strings.Index(s, " "); idx != -1 {
-		return strings.ToUpper(s[:idx])
+func (a addrString) Hostname() string {
+	e := a.Email()
+	// The local part may be quoted and contain '@'; the domain can't.
+	idx := strings.LastIndex(e, "@")
+	if idx == -1 {
+		return ""
+	}
+	host := e[idx+1:]
+	if ip, ok := parse.AddressLiteral(host); ok {
+		return parse.FormatAddressLiteral(ip)
 	}
-	return strings.ToUpper(s[:len(s)-2])
+	return strings.ToLower(host)
 }
 
-func (cl cmdLine) Arg() string {
-	s := string(cl)
-	if idx := strings.Index(s, " "); idx != -1 {
-		return strings.TrimRightFunc(s[idx+1:len(s)-2], unicode.IsSpace)
+// splitTag splits Email into the mailbox, sub-address tag and domain
+// (including its '@'). Quoted local parts have no tag.
+func (a addrString) splitTag() (box, tag, domain string) {
+	e := a.Email()
+	local := e
+	if at := strings.LastIndex(e, "@"); at != -1 {
+		local, domain = e[:at], e[at:]
 	}
-	return ""
+	i := strings.IndexAny(local, a.delims)
+	if i <= 0 || strings.HasPrefix(local, `"`) {
+		return local, "", domain
+	}
+	return local[:i], local[i+1:], domain
+}
+
+func (a addrString) Tag() string {
+	_, tag, _ := a.splitTag()
+	return tag
 }
 
-func (cl cmdLine) String() string {
-	return string(cl)
+func (a addrString) BaseAddress() string {
+	box, _, domain := a.splitTag()
+	return box + domain
 }
 
 type SMTPError string
@@ -0,0 +1,510 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEnvelope records a message and returns beginErr, writeErr and
+// closeErr from BeginData, Write and Close.
+type testEnvelope struct {
+	rcpts    []MailAddress
+	beginErr error
+	writeErr error
+	closeErr error
+
+	mu    sync.Mutex
+	data  strings.Builder
+	lines []string // as passed to Write
+}
+
+func (e *testEnvelope) AddRecipient(rcpt MailAddress) error {
+	e.rcpts = append(e.rcpts, rcpt)
+	return nil
+}
+
+func (e *testEnvelope) BeginData() error { return e.beginErr }
+
+func (e *testEnvelope) Write(line []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.writeErr != nil {
+		return e.writeErr
+	}
+	e.data.Write(line)
+	e.lines = append(e.lines, string(line))
+	return nil
+}
+
+// Data returns the message as written to the Envelope.
+func (e *testEnvelope) Data() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.data.String()
+}
+
+// Lines returns the message as passed to each call of Write.
+func (e *testEnvelope) Lines() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.lines...)
+}
+
+func (e *testEnvelope) Close() error { return e.closeErr }
+
+// testServer starts srv on a loopback listener and returns a client
+// connected to it, past the greeting and EHLO.
+func testServer(t *testing.T, srv *Server) *textproto.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Hostname == "" {
+		srv.Hostname = "mx.example.com"
+	}
+	if srv.Log == nil {
+		srv.Log = t.Logf
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(nc)
+	t.Cleanup(func() { c.Close() })
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	cmd(t, c, 250, "EHLO client.example.com")
+	return c
+}
+
+// cmd sends a command and checks its reply's code.
+func cmd(t *testing.T, c *textproto.Conn, code int, format string, args ...interface{}) string {
+	t.Helper()
+	if err := c.PrintfLine(format, args...); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Fields(format)[0], err)
+	}
+	return msg
+}
+
+// sendData sends a message's contents, raw, and returns the reply.
+func sendData(t *testing.T, c *textproto.Conn, data string) (int, string) {
+	t.Helper()
+	cmd(t, c, 354, "DATA")
+	if _, err := c.W.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	code, msg, err := c.ReadResponse(0)
+	if _, ok := err.(*textproto.Error); err != nil && !ok {
+		t.Fatal(err)
+	}
+	return code, msg
+}
+
+func TestCloseErrorWithoutPRDR(t *testing.T) {
+	tests := []struct {
+		name     string
+		closeErr error
+		code     int
+	}{
+		{"accepted", nil, 250},
+		{"rejected", SMTPError("554 5.7.1 rejected by content filter"), 554},
+		{"deferred", SMTPError("451 4.3.0 try again later"), 451},
+		{"all recipients refused", RecipientErrors{
+			SMTPError("550 5.1.1 no such user"),
+			SMTPError("552 5.2.2 mailbox full"),
+		}, 550},
+		{"one recipient refused", RecipientErrors{
+			nil,
+			SMTPError("550 5.1.1 no such user"),
+		}, 250},
+		{"one recipient deferred", RecipientErrors{
+			nil,
+			SMTPError("452 4.2.2 mailbox full"),
+		}, 452},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &testEnvelope{closeErr: tt.closeErr}
+			c := testServer(t, &Server{
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					return env, nil
+				},
+			})
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+			cmd(t, c, 250, "RCPT TO:<a@example.com>")
+			cmd(t, c, 250, "RCPT TO:<b@example.com>")
+			code, msg := sendData(t, c, "Subject: test\r\n\r\nbody\r\n.\r\n")
+			if code != tt.code {
+				t.Errorf("reply = %d %s; want %d", code, msg, tt.code)
+			}
+		})
+	}
+}
+
+func TestFanoutPartialFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		errB error
+		code int
+	}{
+		{"delivered", nil, 250},
+		{"deferred", SMTPError("452 4.2.2 mailbox full"), 452},
+		{"I/O error", errors.New("disk on fire"), 451},
+		{"refused", SMTPError("550 5.1.1 no such user"), 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			envs := map[string]*testEnvelope{}
+			c := testServer(t, &Server{
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					return &FanoutEnvelope{New: func(rcpt MailAddress) (Envelope, error) {
+						env := &testEnvelope{}
+						if rcpt.Email() == "b@example.com" {
+							env.closeErr = tt.errB
+						}
+						mu.Lock()
+						envs[rcpt.Email()] = env
+						mu.Unlock()
+						return env, nil
+					}}, nil
+				},
+			})
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+			cmd(t, c, 250, "RCPT TO:<a@example.com>")
+			cmd(t, c, 250, "RCPT TO:<b@example.com>")
+			code, msg := sendData(t, c, "Subject: test\r\n\r\nbody\r\n.\r\n")
+			if code != tt.code {
+				t.Errorf("reply = %d %s; want %d", code, msg, tt.code)
+			}
+			mu.Lock()
+			env := envs["a@example.com"]
+			mu.Unlock()
+			if got := env.Data(); got != "Subject: test\r\n\r\nbody\r\n" {
+				t.Errorf("copy for a@example.com = %q", got)
+			}
+		})
+	}
+}
+
+func TestAuthPlainAuthorizationIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		resp      string // identity\x00username\x00password
+		authorize func(c Connection, identity, username string) error
+		code      int
+		user      string
+	}{
+		{"no identity", "\x00alice\x00secret", nil, 235, "alice"},
+		{"same identity", "alice\x00alice\x00secret", nil, 235, "alice"},
+		{"other identity", "bob\x00alice\x00secret", nil, 535, ""},
+		{"permitted", "bob\x00alice\x00secret",
+			func(c Connection, identity, username string) error { return nil }, 235, "bob"},
+		{"not permitted", "bob\x00alice\x00secret",
+			func(c Connection, identity, username string) error { return errAuthFailed }, 535, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := make(chan string, 1)
+			c := testServer(t, &Server{
+				PlainAuth:         true,
+				AllowInsecureAuth: true,
+				OnAuth: func(c Connection, mechanism, identity, username, password string) error {
+					if username != "alice" || password != "secret" {
+						return errAuthFailed
+					}
+					return nil
+				},
+				OnAuthorize: tt.authorize,
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					users <- c.User()
+					return &testEnvelope{}, nil
+				},
+			})
+			resp := base64.StdEncoding.EncodeToString([]byte(tt.resp))
+			cmd(t, c, tt.code, "AUTH PLAIN %s", resp)
+			if tt.code != 235 {
+				return
+			}
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+			if got := <-users; got != tt.user {
+				t.Errorf("User() = %q; want %q", got, tt.user)
+			}
+		})
+	}
+}
+
+// smuggled is a second transaction hidden in a message, which a server
+// ending DATA at the separator before it would take as commands.
+const smuggled = "MAIL FROM:<admin@example.com>\r\nRCPT TO:<victim@example.com>\r\nDATA\r\nSubject: smuggled\r\n\r\nforged\r\n"
+
+func TestSMTPSmuggling(t *testing.T) {
+	tests := []struct {
+		name string
+		sep  string // between the message and smuggled
+	}{
+		{"bare LF", "\n.\n"},
+		{"bare LF before", "\n.\r\n"},
+		{"bare LF after", "\r\n.\n"},
+		{"bare CR", "\r.\r"},
+		{"bare CR before", "\r.\r\n"},
+		{"bare CR after", "\r\n.\r"},
+		{"bare CR then LF", "\r.\n"},
+	}
+	for _, tt := range tests {
+		for _, reject := range []bool{false, true} {
+			name := tt.name
+			if reject {
+				name += " rejected"
+			}
+			t.Run(name, func(t *testing.T) {
+				var mu sync.Mutex
+				var envs []*testEnvelope
+				c := testServer(t, &Server{
+					RejectBareDotLines: reject,
+					OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+						env := &testEnvelope{}
+						mu.Lock()
+						envs = append(envs, env)
+						mu.Unlock()
+						return env, nil
+					},
+				})
+				cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+				cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+				code, msg := sendData(t, c, "Subject: test\r\n\r\nbody"+tt.sep+smuggled+".\r\n")
+				want := 250
+				if reject {
+					want = 550
+				}
+				if code != want {
+					t.Errorf("reply = %d %s; want %d", code, msg, want)
+				}
+				// The session must be ready for a new command, not
+				// left in the smuggled transaction.
+				cmd(t, c, 250, "NOOP")
+				mu.Lock()
+				defer mu.Unlock()
+				if len(envs) != 1 {
+					t.Fatalf("%d transactions; want 1", len(envs))
+				}
+				if got := envs[0].Data(); !reject && !strings.Contains(got, "MAIL FROM:<admin@example.com>") {
+					t.Errorf("message = %q; want the smuggled commands in it", got)
+				}
+			})
+		}
+	}
+}
+
+func TestStrictCRLF(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"CRLF", "Subject: test\r\n\r\nbody\r\n"},
+		{"bare LF", "Subject: test\n\nbody\r\n"},
+		{"bare CR", "Subject: test\r\n\r\nbo\rdy\r\n"},
+	}
+	for _, tt := range tests {
+		for _, strict := range []bool{false, true} {
+			name := tt.name
+			if strict {
+				name += " strict"
+			}
+			t.Run(name, func(t *testing.T) {
+				env := &testEnvelope{}
+				c := testServer(t, &Server{
+					StrictCRLF: strict,
+					OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+						return env, nil
+					},
+				})
+				cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+				cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+				code, msg := sendData(t, c, tt.body+".\r\n")
+				want := 250
+				if strict && tt.name != "CRLF" {
+					want = 550
+				}
+				if code != want {
+					t.Errorf("reply = %d %s; want %d", code, msg, want)
+				}
+				cmd(t, c, 250, "NOOP")
+			})
+		}
+	}
+}
+
+func TestStrictCRLFCommands(t *testing.T) {
+	for _, line := range []string{"NOOP\n", "NOOP\rx\r\n"} {
+		c := testServer(t, &Server{StrictCRLF: true})
+		if _, err := c.W.WriteString(line); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.W.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := c.ReadResponse(500); err != nil {
+			t.Errorf("%q: %v %s", line, err, msg)
+		}
+		// The session carries on after the rejected command.
+		cmd(t, c, 250, "NOOP")
+	}
+}
+
+func TestWriteErrorDiscardsMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		writeErr error
+		code     int
+	}{
+		{"I/O error", errors.New("disk on fire"), 451},
+		{"refused", SMTPError("554 5.6.0 Error: message content rejected"), 554},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var froms []string
+			c := testServer(t, &Server{
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					mu.Lock()
+					froms = append(froms, from.Email())
+					mu.Unlock()
+					return &testEnvelope{writeErr: tt.writeErr}, nil
+				},
+			})
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+			cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+			// Were the rest of the message read as commands, NOOP's
+			// 250 would come before the reply to the message.
+			code, msg := sendData(t, c, "Subject: test\r\n\r\nNOOP\r\n"+smuggled+"RSET\r\n.\r\n")
+			if code != tt.code {
+				t.Errorf("reply = %d %s; want %d", code, msg, tt.code)
+			}
+			cmd(t, c, 250, "NOOP")
+			// The failed transaction is over, so a new one can start.
+			cmd(t, c, 250, "MAIL FROM:<again@example.org>")
+			mu.Lock()
+			defer mu.Unlock()
+			if want := []string{"sender@example.org", "again@example.org"}; strings.Join(froms, " ") != strings.Join(want, " ") {
+				t.Errorf("transactions from %q; want %q", froms, want)
+			}
+		})
+	}
+}
+
+func TestEnvelopeErrorEndsTransaction(t *testing.T) {
+	tests := []struct {
+		name string
+		env  *testEnvelope
+		code int
+	}{
+		{"BeginData refused", &testEnvelope{beginErr: SMTPError("554 5.7.1 Error: not accepting mail")}, 554},
+		{"BeginData failed", &testEnvelope{beginErr: errors.New("disk on fire")}, 451},
+		{"Close refused", &testEnvelope{closeErr: SMTPError("554 5.7.1 Error: message looks like spam")}, 554},
+		{"Close failed", &testEnvelope{closeErr: errors.New("disk on fire")}, 451},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			second := &testEnvelope{}
+			envs := make(chan *testEnvelope, 2)
+			envs <- tt.env
+			envs <- second
+			c := testServer(t, &Server{
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					return <-envs, nil
+				},
+			})
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+			cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+			if err := c.PrintfLine("DATA"); err != nil {
+				t.Fatal(err)
+			}
+			code, msg, _ := c.ReadResponse(0)
+			if code == 354 {
+				if _, err := c.W.WriteString("Subject: first\r\n\r\nbody\r\n.\r\n"); err != nil {
+					t.Fatal(err)
+				}
+				c.W.Flush()
+				code, msg, _ = c.ReadResponse(0)
+			}
+			if code != tt.code {
+				t.Fatalf("reply = %d %s; want %d", code, msg, tt.code)
+			}
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+			cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+			if code, msg := sendData(t, c, "Subject: second\r\n\r\nbody\r\n.\r\n"); code != 250 {
+				t.Fatalf("second message: %d %s", code, msg)
+			}
+			if got, want := second.Data(), "Subject: second\r\n\r\nbody\r\n"; got != want {
+				t.Errorf("second message = %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPRDRRejectedCounts(t *testing.T) {
+	tests := []struct {
+		name               string
+		rerrs              RecipientErrors
+		replies            []int // after 353
+		accepted, rejected int
+	}{
+		{"one refused", RecipientErrors{nil, SMTPError("550 5.7.1 spam")}, []int{250, 550, 250}, 1, 0},
+		{"all refused", RecipientErrors{SMTPError("550 5.7.1 spam"), SMTPError("550 5.7.1 spam")}, []int{550, 550, 550}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := make(chan SessionStats, 1)
+			c := testServer(t, &Server{
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					return &testEnvelope{closeErr: tt.rerrs}, nil
+				},
+				OnSessionEnd: func(c Connection, st SessionStats) { stats <- st },
+			})
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org> PRDR")
+			cmd(t, c, 250, "RCPT TO:<a@example.com>")
+			cmd(t, c, 250, "RCPT TO:<b@example.com>")
+			if code, msg := sendData(t, c, "Subject: test\r\n\r\nbody\r\n.\r\n"); code != 353 {
+				t.Fatalf("reply = %d %s; want 353", code, msg)
+			}
+			for i, want := range tt.replies {
+				if _, msg, err := c.ReadResponse(want); err != nil {
+					t.Fatalf("reply %d: %v %s", i, err, msg)
+				}
+			}
+			cmd(t, c, 221, "QUIT")
+			st := <-stats
+			if st.Accepted != tt.accepted || st.Rejected != tt.rejected {
+				t.Errorf("Accepted, Rejected = %d, %d; want %d, %d", st.Accepted, st.Rejected, tt.accepted, tt.rejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package smtptest records SMTP session transcripts and replays them
+// against a Server, so tests can check that a server's replies don't
+// change.
+//
+// A transcript has one line per protocol line: "C: " and the line for
+// what the client sent, "S: " and the line for the server's replies.
+// Lines that don't end in CRLF or hold control characters are written
+// as "C| " or "S| " and a Go-quoted string of the whole line. Lines
+// beginning with "#" are comments.
+package smtptest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// Record returns a net.Conn that passes through to c, the server's
+// side of a connection, writing a transcript of the session to w.
+// TLS sessions are only recorded up to STARTTLS.
+func Record(c net.Conn, w io.Writer) net.Conn {
+	return &recordConn{Conn: c, w: w}
+}
+
+type recordConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	w        io.Writer
+	in, out  []byte // partial lines
+	startTLS bool   // client sent STARTTLS
+	stopped  bool   // TLS started
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.record('C', &c.in, p[:n])
+	return n, err
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.record('S', &c.out, p[:n])
+	return n, err
+}
+
+func (c *recordConn) Close() error {
+	c.mu.Lock()
+	if !c.stopped {
+		for _, pending := range []struct {
+			who byte
+			buf []byte
+		}{{'C', c.in}, {'S', c.out}} {
+			if len(pending.buf) > 0 {
+				writeLine(c.w, pending.who, pending.buf)
+			}
+		}
+		c.in, c.out = nil, nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// record adds p, sent by who, to the transcript.
+func (c *recordConn) record(who byte, partial *[]byte, p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	*partial = append(*partial, p...)
+	for {
+		i := bytes.IndexByte(*partial, '\n')
+		if i == -1 {
+			return
+		}
+		line := (*partial)[:i+1]
+		writeLine(c.w, who, line)
+		*partial = (*partial)[i+1:]
+		switch {
+		case who == 'C':
+			c.startTLS = strings.EqualFold(strings.TrimSpace(string(line)), "STARTTLS")
+		case c.startTLS && bytes.HasPrefix(line, []byte("220 ")):
+			fmt.Fprintf(c.w, "# TLS started; not recorded further\n")
+			c.stopped = true
+			return
+		}
+	}
+}
+
+func writeLine(w io.Writer, who byte, line []byte) {
+	text, ok := bytes.CutSuffix(line, []byte("\r\n"))
+	if ok && printable(text) {
+		fmt.Fprintf(w, "%c: %s\n", who, text)
+		return
+	}
+	fmt.Fprintf(w, "%c| %s\n", who, strconv.Quote(string(line)))
+}
+
+func printable(b []byte) bool {
+	for _, r := range string(b) {
+		if r < ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordListener wraps ln so the transcript of each connection it
+// accepts is written to a new file in dir.
+func RecordListener(ln net.Listener, dir string) net.Listener {
+	return &recordListener{Listener: ln, dir: dir}
+}
+
+type recordListener struct {
+	net.Listener
+	dir string
+	n   atomic.Int64
+}
+
+func (l *recordListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%d.txt", time.Now().Format("20060102-150405"), l.n.Add(1))
+	f, err := os.Create(filepath.Join(l.dir, name))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &fileRecordConn{Conn: Record(c, f), f: f}, nil
+}
+
+type fileRecordConn struct {
+	net.Conn
+	f    *os.File
+	once sync.Once
+}
+
+func (c *fileRecordConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.f.Close() })
+	return err
+}
+
+// timestampRE matches the timestamps masked when comparing replies:
+// RFC 5322 dates and RFC 3339 times.
+var timestampRE = regexp.MustCompile(`(?:[A-Z][a-z]{2}, )?\d{1,2} [A-Z][a-z]{2} \d{4} \d{2}:\d{2}:\d{2}(?: [+-]\d{4})?|\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2})`)
+
+// Replay plays the client side of transcript to srv over a loopback
+// connection and checks that srv's replies match the transcript's,
+// apart from timestamps. It returns an error describing the first
+// difference. Transcripts of TLS sessions can't be replayed.
+func Replay(srv *smtpd.Server, transcript io.Reader) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	go srv.Serve(ln)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	br := bufio.NewReader(c)
+	sc := bufio.NewScanner(transcript)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		tl := sc.Text()
+		if tl == "" || strings.HasPrefix(tl, "#") {
+			continue
+		}
+		if len(tl) < 3 || tl[0] != 'C' && tl[0] != 'S' || tl[1] != ':' && tl[1] != '|' || tl[2] != ' ' {
+			return fmt.Errorf("transcript line %d: malformed: %q", lineNum, tl)
+		}
+		want := tl[3:] + "\r\n"
+		if tl[1] == '|' {
+			if want, err = strconv.Unquote(tl[3:]); err != nil {
+				return fmt.Errorf("transcript line %d: %v", lineNum, err)
+			}
+		}
+		if tl[0] == 'C' {
+			if _, err := io.WriteString(c, want); err != nil {
+				return fmt.Errorf("transcript line %d: writing: %v", lineNum, err)
+			}
+			continue
+		}
+		got, err := br.ReadString('\n')
+		if err != nil && (err != io.EOF || got == "") {
+			return fmt.Errorf("transcript line %d: reading reply: %v", lineNum, err)
+		}
+		if timestampRE.ReplaceAllString(got, "TIME") != timestampRE.ReplaceAllString(want, "TIME") {
+			return fmt.Errorf("transcript line %d: server sent %q, want %q", lineNum, got, want)
+		}
+	}
+	return sc.Err()
+}
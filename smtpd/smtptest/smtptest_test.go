@@ -0,0 +1,181 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtptest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// fakeConn is a net.Conn reading from r and writing to w.
+type fakeConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *fakeConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *fakeConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *fakeConn) Close() error                { return nil }
+
+func TestRecord(t *testing.T) {
+	var transcript bytes.Buffer
+	fc := &fakeConn{}
+	c := Record(fc, &transcript)
+	read := func(client string) {
+		fc.r = strings.NewReader(client)
+		buf := make([]byte, 7)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				return
+			}
+		}
+	}
+	// Replies are recorded as whole lines, however they're written.
+	c.Write([]byte("220 mx"))
+	c.Write([]byte(".example.com ESMTP\r"))
+	c.Write([]byte("\n"))
+	read("EHLO client\r\nbare LF\n")
+	c.Write([]byte("250 ok\r\n502 no\r\n"))
+	read("STARTTLS\r\n")
+	c.Write([]byte("220 Ready to start TLS\r\n"))
+	read("secret\r\n")
+	c.Write([]byte("after TLS\r\n"))
+	c.Close()
+	const want = "S: 220 mx.example.com ESMTP\n" +
+		"C: EHLO client\n" +
+		"C| \"bare LF\\n\"\n" +
+		"S: 250 ok\n" +
+		"S: 502 no\n" +
+		"C: STARTTLS\n" +
+		"S: 220 Ready to start TLS\n" +
+		"# TLS started; not recorded further\n"
+	if got := transcript.String(); got != want {
+		t.Errorf("transcript:\n%s\nwant:\n%s", got, want)
+	}
+	if fc.w.String() != "220 mx.example.com ESMTP\r\n250 ok\r\n502 no\r\n220 Ready to start TLS\r\nafter TLS\r\n" {
+		t.Errorf("passed through %q", fc.w.String())
+	}
+
+	// A partial line is recorded when the connection closes.
+	transcript.Reset()
+	fc = &fakeConn{r: strings.NewReader("QUIT")}
+	c = Record(fc, &transcript)
+	c.Read(make([]byte, 10))
+	c.Close()
+	if got := transcript.String(); got != "C| \"QUIT\"\n" {
+		t.Errorf("partial line recorded as %q", got)
+	}
+}
+
+// discard is an Envelope accepting messages without keeping them.
+type discard struct{}
+
+func (discard) AddRecipient(rcpt smtpd.MailAddress) error { return nil }
+func (discard) BeginData() error                          { return nil }
+func (discard) Write(line []byte) error                   { return nil }
+func (discard) Close() error                              { return nil }
+
+// newServer returns a Server accepting mail for example.com.
+func newServer() *smtpd.Server {
+	return &smtpd.Server{
+		Hostname:          "mx.example.com",
+		AddReceivedHeader: true,
+		Log:               func(string, ...interface{}) {},
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			return discard{}, nil
+		},
+		OnRcpt: func(c smtpd.Connection, env smtpd.Envelope, rcpt smtpd.MailAddress, params map[string]string) error {
+			if rcpt.Hostname() != "example.com" {
+				return smtpd.SMTPError("550 5.7.1 Error: relaying denied")
+			}
+			return nil
+		},
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := RecordListener(ln, dir)
+	defer rl.Close()
+	go newServer().Serve(rl)
+
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Hello("client.example.org")
+	c.Mail("sender@example.org")
+	if err := c.Rcpt("relay@example.net"); err == nil {
+		t.Error("relaying allowed")
+	}
+	c.Rcpt("jane@example.com")
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "Subject: hi\r\n\r\n.dot\r\n")
+	w.Close()
+	c.Quit()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if len(files) != 1 {
+		t.Fatalf("recorded %d transcripts", len(files))
+	}
+	// The transcript is complete once the server closes the
+	// connection, which it does after QUIT.
+	var transcript []byte
+	for i := 0; i < 100; i++ {
+		if transcript, _ = os.ReadFile(files[0]); bytes.Contains(transcript, []byte("\nS: 221 ")) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, want := range []string{"C: RCPT TO:<relay@example.net>\nS: 550 5.7.1 Error: relaying denied\n", "C: ..dot\n"} {
+		if !bytes.Contains(transcript, []byte(want)) {
+			t.Errorf("transcript lacks %q:\n%s", want, transcript)
+		}
+	}
+
+	if err := Replay(newServer(), bytes.NewReader(transcript)); err != nil {
+		t.Errorf("replaying the transcript: %v", err)
+	}
+
+	// A server that replies differently fails the replay.
+	changed := newServer()
+	changed.OnRcpt = nil
+	err = Replay(changed, bytes.NewReader(transcript))
+	if err == nil || !strings.Contains(err.Error(), "relaying denied") {
+		t.Errorf("replay against a changed server: %v", err)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	for _, tt := range []struct {
+		transcript, want string
+	}{
+		{"# comment\n\nX: junk\n", "transcript line 3: malformed"},
+		{"C| not quoted\n", "transcript line 1"},
+		{"S: 554 not this\n", `transcript line 1: server sent "220 `},
+	} {
+		err := Replay(newServer(), strings.NewReader(tt.transcript))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Replay(%q) = %v; want %q", tt.transcript, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// defaultTimeout bounds the checks made by OnNewMail if
+// Checker.Timeout isn't set (RFC 7208 s4.6.4).
+const defaultTimeout = 20 * time.Second
+
+type verdictKey struct{}
+
+// OnNewMail returns an smtpd.Server.OnNewMail hook that checks the
+// sender of each message before calling next. next and the Envelope
+// it returns can get the Verdict with VerdictFor, such as to add its
+// Header to the message. If reject is set, messages that Fail are
+// refused with a 550 reply instead.
+func (c *Checker) OnNewMail(reject bool, next func(smtpd.Connection, smtpd.MailAddress) (smtpd.Envelope, error)) func(smtpd.Connection, smtpd.MailAddress) (smtpd.Envelope, error) {
+	return func(conn smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+		conn.SetValue(verdictKey{}, nil)
+		addr, ok := conn.Addr().(*net.TCPAddr)
+		if !ok {
+			return next(conn, from)
+		}
+		d := c.Timeout
+		if d == 0 {
+			d = defaultTimeout
+		}
+		ctx, cancel := context.WithTimeout(conn.Context(), d)
+		v := c.Check(ctx, addr.IP, conn.HeloName(), from.Email())
+		cancel()
+		conn.SetValue(verdictKey{}, v)
+		if reject && v.Result == Fail {
+			reply := "550 5.7.23 Error: SPF validation failed"
+			if exp := commentText(v.Explanation); strings.TrimSpace(exp) != "" {
+				reply += ": " + exp
+			}
+			return nil, smtpd.SMTPError(reply)
+		}
+		return next(conn, from)
+	}
+}
+
+// VerdictFor returns the Verdict for the current message from conn,
+// as checked by Checker.OnNewMail, or nil.
+func VerdictFor(conn smtpd.Connection) *Verdict {
+	v, _ := conn.Value(verdictKey{}).(*Verdict)
+	return v
+}
@@ -0,0 +1,178 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spf
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// expand expands the macros in s, a domain-spec or, if exp is set,
+// an explanation string (RFC 7208 s7). Expanded domain-specs longer
+// than a domain name lose labels from the left.
+func (e *eval) expand(s, domain string, exp bool) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("spf: bad macro in %q", s)
+		}
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("spf: unterminated macro in %q", s)
+			}
+			v, err := e.macro(s[i+1:i+end], domain, exp)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i += end
+		default:
+			return "", fmt.Errorf("spf: bad macro in %q", s)
+		}
+	}
+	out := b.String()
+	if !exp {
+		for len(out) > 253 {
+			_, rest, ok := strings.Cut(out, ".")
+			if !ok {
+				break
+			}
+			out = rest
+		}
+	}
+	return out, nil
+}
+
+// macro expands one macro, the part of "%{...}" within the braces.
+func (e *eval) macro(m, domain string, exp bool) (string, error) {
+	bad := fmt.Errorf("spf: bad macro %%{%s}", m)
+	if m == "" {
+		return "", bad
+	}
+	letter := m[0]
+	var v string
+	switch letter | 0x20 {
+	case 's':
+		v = e.sender
+	case 'l':
+		v = e.sender
+		if i := strings.LastIndex(e.sender, "@"); i >= 0 {
+			v = e.sender[:i]
+		}
+		if v == "" {
+			v = "postmaster"
+		}
+	case 'o':
+		v = e.sender[strings.LastIndex(e.sender, "@")+1:]
+	case 'd':
+		v = domain
+	case 'i':
+		v = dottedIP(e)
+	case 'p':
+		v, _ = e.validatedName(domain)
+		if v == "" {
+			v = "unknown"
+		}
+	case 'v':
+		v = "in-addr"
+		if e.ip.To4() == nil {
+			v = "ip6"
+		}
+	case 'h':
+		v = e.helo
+	case 'c', 'r', 't':
+		if !exp {
+			return "", bad
+		}
+		switch letter | 0x20 {
+		case 'c':
+			v = e.ip.String()
+		case 'r':
+			v = e.c.Hostname
+			if v == "" {
+				v = "unknown"
+			}
+		case 't':
+			v = strconv.FormatInt(now().Unix(), 10)
+		}
+	default:
+		return "", bad
+	}
+
+	// Transformers: a number of parts to keep and "r" to reverse
+	// them, then delimiters to split on.
+	rest := m[1:]
+	n := 0
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		n = n*10 + int(rest[0]-'0')
+		rest = rest[1:]
+		if n == 0 {
+			return "", bad
+		}
+	}
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", bad
+		}
+		delims = rest
+	}
+	if n > 0 || reverse || delims != "." {
+		parts := strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(delims, r) })
+		if reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if n > 0 && n < len(parts) {
+			parts = parts[len(parts)-n:]
+		}
+		v = strings.Join(parts, ".")
+	}
+	if letter >= 'A' && letter <= 'Z' {
+		v = url.PathEscape(v)
+	}
+	return v, nil
+}
+
+// dottedIP returns the client's address for the %{i} macro: dotted
+// decimal for IPv4, and dot-separated nibbles for IPv6.
+func dottedIP(e *eval) string {
+	if ip4 := e.ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	var b strings.Builder
+	for i, c := range e.ip.To16() {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		fmt.Fprintf(&b, "%x.%x", c>>4, c&0xf)
+	}
+	return b.String()
+}
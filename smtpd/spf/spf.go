@@ -0,0 +1,657 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package spf checks whether a host may send mail for a domain, with
+// the Sender Policy Framework (RFC 7208).
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result is the outcome of an SPF check (RFC 7208 s2.6).
+type Result string
+
+const (
+	None      Result = "none"      // no policy, or the domain isn't valid
+	Neutral   Result = "neutral"   // the policy makes no assertion
+	Pass      Result = "pass"      // the host may send for the domain
+	Fail      Result = "fail"      // the host may not send for the domain
+	SoftFail  Result = "softfail"  // the host probably may not send
+	TempError Result = "temperror" // a transient DNS failure
+	PermError Result = "permerror" // the policy is broken
+)
+
+// Resolver performs the DNS lookups for a check. *net.Resolver and
+// smtpd.Resolver implement it.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) (names []string, err error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Limits on the DNS lookups a check may make (RFC 7208 s4.6.4).
+const (
+	maxLookups     = 10 // by terms: include, a, mx, ptr, exists, redirect
+	maxVoidLookups = 2  // answering "not found" or nothing
+	maxMXNames     = 10 // looked up for each mx
+	maxPTRNames    = 10 // checked for each ptr or %{p}
+)
+
+// Checker checks SPF policies. The zero value is ready to use.
+type Checker struct {
+	// Resolver does the DNS lookups; net.DefaultResolver if nil.
+	Resolver Resolver
+
+	// Hostname is the receiving host, for the %{r} macro in
+	// explanations; "unknown" if empty.
+	Hostname string
+
+	// Timeout bounds each check made by OnNewMail; 20 seconds if
+	// zero.
+	Timeout time.Duration
+}
+
+func (c *Checker) resolver() Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Verdict is the outcome of checking a message's sender.
+type Verdict struct {
+	Result Result
+
+	// Identity is the identity checked: "mailfrom", or "helo" for
+	// messages with a null sender.
+	Identity string
+
+	IP     net.IP
+	HELO   string
+	Sender string // the MAIL FROM address, or postmaster@ the HELO name
+	Domain string // the domain whose policy was checked
+
+	// Mechanism is the term that matched, such as "ip4:192.0.2.0/24",
+	// or "default" if none did.
+	Mechanism string
+
+	// Explanation is the domain's explanation for a Fail, from its
+	// exp= modifier, if any.
+	Explanation string
+
+	// Err is the problem behind a TempError or PermError.
+	Err error
+}
+
+// Check checks whether ip may send mail from the MAIL FROM address
+// mailFrom, or if it's empty, from the client's HELO name (RFC 7208
+// s2.4).
+func (c *Checker) Check(ctx context.Context, ip net.IP, helo, mailFrom string) *Verdict {
+	v := &Verdict{IP: ip, HELO: helo, Sender: mailFrom, Identity: "mailfrom"}
+	if mailFrom == "" {
+		v.Identity = "helo"
+		v.Sender = "postmaster@" + helo
+	}
+	v.Domain = v.Sender[strings.LastIndex(v.Sender, "@")+1:]
+	e := &eval{c: c, ctx: ctx, ip: ip, helo: helo, sender: v.Sender}
+	v.Result, v.Mechanism, v.Err = e.checkHost(v.Domain)
+	v.Explanation = e.exp
+	return v
+}
+
+// CheckHost is the check_host() function of RFC 7208 s4: it checks
+// whether ip may send mail for domain, for a message from sender
+// whose client greeted the server with helo. It returns the result,
+// and for a TempError or PermError the problem.
+func (c *Checker) CheckHost(ctx context.Context, ip net.IP, domain, sender, helo string) (Result, error) {
+	e := &eval{c: c, ctx: ctx, ip: ip, helo: helo, sender: sender}
+	res, _, err := e.checkHost(domain)
+	return res, err
+}
+
+// eval is the state of one check.
+type eval struct {
+	c      *Checker
+	ctx    context.Context
+	ip     net.IP
+	helo   string
+	sender string
+
+	lookups int    // of maxLookups
+	voids   int    // of maxVoidLookups
+	exp     string // explanation of a Fail
+}
+
+var (
+	errTooManyLookups = errors.New("spf: too many DNS lookups")
+	errTooManyVoids   = errors.New("spf: too many void DNS lookups")
+	errMultiple       = errors.New("spf: multiple SPF records")
+)
+
+// checkHost evaluates the policy of domain, returning the result and
+// the term that decided it.
+func (e *eval) checkHost(domain string) (Result, string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if !validDomain(domain) {
+		return None, "", nil
+	}
+	rec, err := e.record(domain)
+	if rec == "" || err != nil {
+		if err == nil {
+			return None, "", nil
+		}
+		if err == errMultiple {
+			return PermError, "", err
+		}
+		return TempError, "", err
+	}
+	terms, redirect, exp, err := parseRecord(rec)
+	if err != nil {
+		return PermError, "", err
+	}
+	for _, t := range terms {
+		match, err := e.match(t, domain)
+		if err != nil {
+			if res, ok := err.(resultError); ok {
+				return res.res, t.String(), res.err
+			}
+			return PermError, t.String(), err
+		}
+		if match {
+			if t.qual == Fail && exp != "" {
+				e.explain(exp, domain)
+			}
+			return t.qual, t.String(), nil
+		}
+	}
+	if redirect != "" {
+		if err := e.count(); err != nil {
+			return PermError, "redirect=" + redirect, err
+		}
+		target, err := e.expand(redirect, domain, false)
+		if err != nil {
+			return PermError, "redirect=" + redirect, err
+		}
+		res, mech, err := e.checkHost(target)
+		if res == None {
+			return PermError, "redirect=" + redirect, fmt.Errorf("spf: redirect to %s without a policy", target)
+		}
+		return res, mech, err
+	}
+	return Neutral, "default", nil
+}
+
+// resultError is an error that ends a check with a given result.
+type resultError struct {
+	res Result
+	err error
+}
+
+func (re resultError) Error() string { return re.err.Error() }
+
+func tempError(err error) error { return resultError{TempError, err} }
+
+// record returns domain's SPF record, or "" if it has none.
+func (e *eval) record(domain string) (string, error) {
+	txts, err := e.c.resolver().LookupTXT(e.ctx, domain)
+	if err != nil {
+		if notFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	var rec string
+	for _, t := range txts {
+		lt := strings.ToLower(t)
+		if lt == "v=spf1" || strings.HasPrefix(lt, "v=spf1 ") {
+			if rec != "" {
+				return "", errMultiple
+			}
+			rec = t
+		}
+	}
+	return rec, nil
+}
+
+// count counts a term that makes DNS lookups against maxLookups.
+func (e *eval) count() error {
+	e.lookups++
+	if e.lookups > maxLookups {
+		return errTooManyLookups
+	}
+	return nil
+}
+
+// lookupErr handles a lookup error from a term: "not found" counts as
+// a void lookup, and others are TempErrors.
+func (e *eval) lookupErr(err error) error {
+	if notFound(err) {
+		return e.void()
+	}
+	return tempError(err)
+}
+
+// void counts a lookup that found nothing against maxVoidLookups.
+func (e *eval) void() error {
+	e.voids++
+	if e.voids > maxVoidLookups {
+		return errTooManyVoids
+	}
+	return nil
+}
+
+func notFound(err error) bool {
+	de, ok := err.(*net.DNSError)
+	return ok && de.IsNotFound
+}
+
+// term is a mechanism in an SPF record.
+type term struct {
+	qual   Result
+	name   string // lower case
+	arg    string // domain-spec or address, if any
+	cidr4  int    // prefix length, or -1
+	cidr6  int
+	source string // as written
+}
+
+func (t term) String() string { return t.source }
+
+var qualifiers = map[byte]Result{'+': Pass, '-': Fail, '~': SoftFail, '?': Neutral}
+
+// parseRecord parses an SPF record into its mechanisms and its
+// redirect and exp modifiers.
+func parseRecord(rec string) (terms []term, redirect, exp string, err error) {
+	fields := strings.Fields(rec)[1:]
+	seen := map[string]bool{}
+	for _, f := range fields {
+		if name, val, ok := modifier(f); ok {
+			switch name {
+			case "redirect", "exp":
+				if seen[name] {
+					return nil, "", "", fmt.Errorf("spf: repeated %s modifier", name)
+				}
+				seen[name] = true
+				if name == "redirect" {
+					redirect = val
+				} else {
+					exp = val
+				}
+			}
+			// Unknown modifiers are ignored (RFC 7208 s6).
+			continue
+		}
+		t, err := parseTerm(f)
+		if err != nil {
+			return nil, "", "", err
+		}
+		terms = append(terms, t)
+	}
+	// With an "all" mechanism, redirect is ignored (RFC 7208 s6.1).
+	for _, t := range terms {
+		if t.name == "all" {
+			redirect = ""
+		}
+	}
+	return terms, redirect, exp, nil
+}
+
+// modifier parses f as a modifier, name=value.
+func modifier(f string) (name, val string, ok bool) {
+	name, val, ok = strings.Cut(f, "=")
+	if !ok || name == "" || !isAlpha(name[0]) {
+		return "", "", false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !isAlpha(c) && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return "", "", false
+		}
+	}
+	return strings.ToLower(name), val, true
+}
+
+func isAlpha(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+func parseTerm(f string) (term, error) {
+	t := term{qual: Pass, cidr4: -1, cidr6: -1, source: f}
+	if q, ok := qualifiers[f[0]]; ok {
+		t.qual = q
+		f = f[1:]
+	}
+	i := strings.IndexAny(f, ":/")
+	if i < 0 {
+		i = len(f)
+	}
+	t.name, f = strings.ToLower(f[:i]), f[i:]
+	bad := fmt.Errorf("spf: bad mechanism %q", t.source)
+	switch t.name {
+	case "all":
+		if f != "" {
+			return t, bad
+		}
+	case "include", "exists":
+		if !strings.HasPrefix(f, ":") || len(f) == 1 {
+			return t, bad
+		}
+		t.arg = f[1:]
+	case "a", "mx", "ptr":
+		if strings.HasPrefix(f, ":") {
+			end := strings.Index(f, "/")
+			if end < 0 {
+				end = len(f)
+			}
+			t.arg, f = f[1:end], f[end:]
+			if t.arg == "" {
+				return t, bad
+			}
+		}
+		if t.name == "ptr" {
+			if f != "" {
+				return t, bad
+			}
+			break
+		}
+		var err error
+		if t.cidr4, t.cidr6, err = parseDualCIDR(f); err != nil {
+			return t, bad
+		}
+	case "ip4", "ip6":
+		if !strings.HasPrefix(f, ":") {
+			return t, bad
+		}
+		t.arg = f[1:]
+		addr, bits, ok := strings.Cut(t.arg, "/")
+		ip := net.ParseIP(addr)
+		if ip == nil || (t.name == "ip4") != (ip.To4() != nil && !strings.Contains(addr, ":")) {
+			return t, bad
+		}
+		max := 32
+		if t.name == "ip6" {
+			max = 128
+		}
+		n := max
+		if ok {
+			var err error
+			if n, err = parseCIDRBits(bits, max); err != nil {
+				return t, bad
+			}
+		}
+		t.cidr4, t.cidr6 = n, n
+		t.arg = addr
+	default:
+		return t, fmt.Errorf("spf: unknown mechanism %q", t.source)
+	}
+	return t, nil
+}
+
+// parseDualCIDR parses the optional "/n" and "//n" prefix lengths of
+// an a or mx mechanism.
+func parseDualCIDR(s string) (cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	if s == "" {
+		return
+	}
+	if !strings.HasPrefix(s, "//") {
+		rest := s[1:]
+		v4, v6, has6 := strings.Cut(rest, "//")
+		if cidr4, err = parseCIDRBits(v4, 32); err != nil {
+			return
+		}
+		if !has6 {
+			return
+		}
+		s = "//" + v6
+	}
+	cidr6, err = parseCIDRBits(s[2:], 128)
+	return
+}
+
+func parseCIDRBits(s string, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max || s != strconv.Itoa(n) {
+		return 0, fmt.Errorf("spf: bad prefix length %q", s)
+	}
+	return n, nil
+}
+
+// match reports whether mechanism t matches the client.
+func (e *eval) match(t term, domain string) (bool, error) {
+	switch t.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return inNet(e.ip, net.ParseIP(t.arg), t.cidr4, t.cidr6), nil
+	}
+
+	if err := e.count(); err != nil {
+		return false, err
+	}
+	target := domain
+	if t.arg != "" {
+		var err error
+		if target, err = e.expand(t.arg, domain, false); err != nil {
+			return false, err
+		}
+	}
+	switch t.name {
+	case "include":
+		res, _, err := e.checkHost(target)
+		switch res {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, tempError(err)
+		case None:
+			return false, fmt.Errorf("spf: include of %s without a policy", target)
+		}
+		return false, err
+	case "a":
+		return e.matchHost(target, t)
+	case "mx":
+		mxs, err := e.c.resolver().LookupMX(e.ctx, target)
+		if err != nil {
+			return false, e.lookupErr(err)
+		}
+		if len(mxs) > maxMXNames {
+			return false, fmt.Errorf("spf: %s has more than %d MX records", target, maxMXNames)
+		}
+		if len(mxs) == 0 {
+			return false, e.void()
+		}
+		for _, mx := range mxs {
+			if ok, err := e.matchHost(mx.Host, t); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		name, err := e.validatedName(target)
+		return name != "", err
+	case "exists":
+		addrs, err := e.c.resolver().LookupIPAddr(e.ctx, target)
+		if err != nil {
+			return false, e.lookupErr(err)
+		}
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, e.void()
+	}
+	return false, fmt.Errorf("spf: unknown mechanism %q", t.source)
+}
+
+// matchHost reports whether one of host's addresses, within t's
+// prefix lengths, is the client's.
+func (e *eval) matchHost(host string, t term) (bool, error) {
+	addrs, err := e.c.resolver().LookupIPAddr(e.ctx, strings.TrimSuffix(host, "."))
+	if err != nil {
+		return false, e.lookupErr(err)
+	}
+	if len(addrs) == 0 {
+		return false, e.void()
+	}
+	for _, a := range addrs {
+		if inNet(e.ip, a.IP, t.cidr4, t.cidr6) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// inNet reports whether ip is in the network of addr with the prefix
+// length for its family. Addresses of different families don't match.
+func inNet(ip, addr net.IP, cidr4, cidr6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		a4 := addr.To4()
+		return a4 != nil && ip4.Mask(net.CIDRMask(cidr4, 32)).Equal(a4.Mask(net.CIDRMask(cidr4, 32)))
+	}
+	if addr.To4() != nil {
+		return false
+	}
+	return ip.Mask(net.CIDRMask(cidr6, 128)).Equal(addr.Mask(net.CIDRMask(cidr6, 128)))
+}
+
+// validatedName returns the first of the client's names, in target
+// or a subdomain of it, that resolves back to its address, or "" if
+// none do (RFC 7208 s5.5).
+func (e *eval) validatedName(target string) (string, error) {
+	// Lookup failures just mean no match (RFC 7208 s5.5).
+	names, err := e.c.resolver().LookupAddr(e.ctx, e.ip.String())
+	if err != nil {
+		return "", nil
+	}
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	for i, name := range names {
+		if i == maxPTRNames {
+			break
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if target != "" && name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		addrs, err := e.c.resolver().LookupIPAddr(e.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(e.ip) {
+				return name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// explain sets the explanation for a Fail from the exp= modifier's
+// domain-spec, ignoring any errors (RFC 7208 s6.2).
+func (e *eval) explain(spec, domain string) {
+	target, err := e.expand(spec, domain, false)
+	if err != nil {
+		return
+	}
+	txts, err := e.c.resolver().LookupTXT(e.ctx, target)
+	if err != nil || len(txts) != 1 {
+		return
+	}
+	if exp, err := e.expand(txts[0], domain, true); err == nil {
+		e.exp = exp
+	}
+}
+
+// validDomain reports whether domain can be checked: a name of at
+// least two labels, none of them empty or too long (RFC 7208 s4.3).
+func validDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// now is the time for the %{t} macro.
+var now = time.Now
+
+// Header returns a Received-SPF header field recording v (RFC 7208
+// s9.1), ending in CRLF, for the receiving host receiver.
+func (v *Verdict) Header(receiver string) string {
+	var comment string
+	switch v.Result {
+	case Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", v.Sender, v.IP)
+	case Fail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", v.Sender, v.IP)
+	case SoftFail:
+		comment = fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", v.Sender, v.IP)
+	case Neutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", v.IP, v.Sender)
+	case None:
+		comment = fmt.Sprintf("domain of %s does not designate permitted sender hosts", v.Sender)
+	default:
+		comment = fmt.Sprintf("error in processing SPF policy of %s", v.Domain)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received-SPF: %s (%s: %s)\r\n\t", v.Result, commentText(receiver), commentText(comment))
+	fmt.Fprintf(&b, "client-ip=%s; envelope-from=%s; helo=%s;", v.IP, quote(v.Sender), quote(v.HELO))
+	if v.Err != nil {
+		fmt.Fprintf(&b, " problem=%s;", quote(v.Err.Error()))
+	}
+	if v.Mechanism != "" {
+		fmt.Fprintf(&b, " mechanism=%s;", quote(v.Mechanism))
+	}
+	fmt.Fprintf(&b, " identity=%s; receiver=%s;\r\n", v.Identity, quote(receiver))
+	return b.String()
+}
+
+// commentText returns s without the characters that can't appear in
+// a header comment.
+func commentText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || r == '(' || r == ')' || r == '\\' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// quote returns s as a quoted string, unless it's a dot-atom.
+func quote(s string) string {
+	atom := s != ""
+	for i := 0; i < len(s) && atom; i++ {
+		c := s[i]
+		atom = isAlpha(c) || c >= '0' && c <= '9' || c >= 0x80 || strings.IndexByte("!#$%&'*+-/=?^_`{|}~.", c) >= 0
+	}
+	if atom && s[0] != '.' && s[len(s)-1] != '.' && !strings.Contains(s, "..") {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= ' ' && r != 0x7f:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
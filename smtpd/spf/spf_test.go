@@ -0,0 +1,261 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDNS is a Resolver answering from maps. Names in fail get a
+// temporary error; other names missing from the maps aren't found.
+type fakeDNS struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func (d *fakeDNS) err(name string) error {
+	if d.fail[name] {
+		return &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (d *fakeDNS) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := d.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, d.err(addr)
+}
+
+func (d *fakeDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := d.ip[host]
+	if !ok {
+		return nil, d.err(host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (d *fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := d.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, d.err(name)
+}
+
+func (d *fakeDNS) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := d.mx[name]
+	if !ok {
+		return nil, d.err(name)
+	}
+	var mxs []*net.MX
+	for i, h := range hosts {
+		mxs = append(mxs, &net.MX{Host: h, Pref: uint16(10 * i)})
+	}
+	return mxs, nil
+}
+
+// The examples of RFC 7208 s7.4.
+func TestMacroExpansion(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return time.Unix(1320148800, 0) }
+	e := &eval{
+		c:      &Checker{Hostname: "mx.example.net"},
+		ctx:    context.Background(),
+		ip:     net.ParseIP("192.0.2.3"),
+		helo:   "mail.example.com",
+		sender: "strong-bad@email.example.com",
+	}
+	tests := []struct {
+		in, want string
+		exp      bool
+	}{
+		{"%{s}", "strong-bad@email.example.com", false},
+		{"%{o}", "email.example.com", false},
+		{"%{d}", "email.example.com", false},
+		{"%{d4}", "email.example.com", false},
+		{"%{d3}", "email.example.com", false},
+		{"%{d2}", "example.com", false},
+		{"%{d1}", "com", false},
+		{"%{dr}", "com.example.email", false},
+		{"%{d2r}", "example.email", false},
+		{"%{l}", "strong-bad", false},
+		{"%{l-}", "strong.bad", false},
+		{"%{lr}", "strong-bad", false},
+		{"%{lr-}", "bad.strong", false},
+		{"%{l1r-}", "strong", false},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com", false},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com", false},
+		{"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com", false},
+		{"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com", false},
+		{"%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net", false},
+		{"%{h}%%%_%-", "mail.example.com% %20", false},
+		{"%{c} via %{r} at %{t}", "192.0.2.3 via mx.example.net at 1320148800", true},
+		{"%{L} is %{S}", "strong-bad is strong-bad@email.example.com", false},
+	}
+	for _, tt := range tests {
+		got, err := e.expand(tt.in, "email.example.com", tt.exp)
+		if err != nil || got != tt.want {
+			t.Errorf("expand(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	const want6 = "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got, err := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com", false); err != nil || got != want6 {
+		t.Errorf("IPv6: got %q, %v; want %q", got, err, want6)
+	}
+
+	for _, bad := range []string{"%", "%x", "%{", "%{d0}", "%{q}", "%{d2!}", "%{c}", "%{r}", "%{t}"} {
+		if got, err := e.expand(bad, "email.example.com", false); err == nil {
+			t.Errorf("expand(%q) = %q; want an error", bad, got)
+		}
+	}
+
+	// Long expansions lose labels from the left.
+	e.sender = strings.Repeat("a", 60) + "@example.com"
+	long := strings.Repeat("%{l}.", 5) + "example.com"
+	got, err := e.expand(long, "example.com", false)
+	if err != nil || len(got) > 253 || !strings.HasSuffix(got, ".example.com") {
+		t.Errorf("long expansion = %q (%d bytes), %v", got, len(got), err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dns := &fakeDNS{
+		txt: map[string][]string{
+			"example.com":           {"v=spf1 ip4:192.0.2.0/24 a:mail.example.com/32 mx include:partner.example -all"},
+			"partner.example":       {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"redirected.example":    {"some other record", "v=spf1 redirect=example.com"},
+			"neutral.example":       {"v=spf1 ?all"},
+			"default.example":       {"v=spf1 ip4:198.51.100.1"},
+			"two.example":           {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example":        {"v=spf1 ip4:192.0.2.300 -all"},
+			"explained.example":     {"v=spf1 -all exp=why.%{d}"},
+			"why.explained.example": {"%{i} may not send for %{d}"},
+			"nopolicy.example":      {"v=spf1 include:nothing.example -all"},
+			"flaky.example":         {"v=spf1 a:down.example -all"},
+			"ptr.example":           {"v=spf1 ptr -all"},
+		},
+		ip: map[string][]string{
+			"mail.example.com":   {"203.0.113.5", "203.0.113.6"},
+			"mx1.example.com":    {"198.51.100.25"},
+			"host.ptr.example":   {"203.0.113.99"},
+			"forged.ptr.example": {"203.0.113.1"},
+		},
+		mx:   map[string][]string{"example.com": {"mx1.example.com."}},
+		ptr:  map[string][]string{"203.0.113.99": {"forged.ptr.example.", "host.ptr.example."}},
+		fail: map[string]bool{"down.example": true, "timeout.example": true},
+	}
+	c := &Checker{Resolver: dns}
+	tests := []struct {
+		ip, domain string
+		want       Result
+		mech       string
+	}{
+		{"192.0.2.77", "example.com", Pass, "ip4:192.0.2.0/24"},
+		{"203.0.113.5", "example.com", Pass, "a:mail.example.com/32"},
+		{"198.51.100.25", "example.com", Pass, "mx"},
+		{"2001:db8::1", "example.com", Pass, "include:partner.example"},
+		{"203.0.113.7", "example.com", Fail, "-all"},
+		{"2001:db9::1", "partner.example", SoftFail, "~all"},
+		{"192.0.2.1", "redirected.example", Pass, "ip4:192.0.2.0/24"},
+		{"203.0.113.7", "redirected.example", Fail, "-all"},
+		{"192.0.2.1", "neutral.example", Neutral, "?all"},
+		{"192.0.2.1", "default.example", Neutral, "default"},
+		{"192.0.2.1", "none.example", None, ""},
+		{"192.0.2.1", "localhost", None, ""},
+		{"192.0.2.1", "two.example", PermError, ""},
+		{"192.0.2.1", "broken.example", PermError, ""},
+		{"192.0.2.1", "nopolicy.example", PermError, "include:nothing.example"},
+		{"192.0.2.1", "flaky.example", TempError, "a:down.example"},
+		{"192.0.2.1", "timeout.example", TempError, ""},
+		{"203.0.113.99", "ptr.example", Pass, "ptr"},
+		{"203.0.113.1", "ptr.example", Fail, "-all"},
+	}
+	for _, tt := range tests {
+		v := c.Check(context.Background(), net.ParseIP(tt.ip), "helo.example", "user@"+tt.domain)
+		if v.Result != tt.want || v.Mechanism != tt.mech {
+			t.Errorf("%s from %s: %s by %q (%v); want %s by %q", tt.domain, tt.ip, v.Result, v.Mechanism, v.Err, tt.want, tt.mech)
+		}
+		if (v.Result == TempError || v.Result == PermError) != (v.Err != nil) {
+			t.Errorf("%s from %s: %s with Err %v", tt.domain, tt.ip, v.Result, v.Err)
+		}
+	}
+
+	v := c.Check(context.Background(), net.ParseIP("192.0.2.9"), "helo.example", "user@explained.example")
+	if v.Result != Fail || v.Explanation != "192.0.2.9 may not send for explained.example" {
+		t.Errorf("explained: %s %q", v.Result, v.Explanation)
+	}
+
+	// A null sender is checked as postmaster at the HELO name.
+	v = c.Check(context.Background(), net.ParseIP("192.0.2.9"), "example.com", "")
+	if v.Identity != "helo" || v.Sender != "postmaster@example.com" || v.Result != Pass {
+		t.Errorf("null sender: %+v", v)
+	}
+}
+
+func TestLookupLimit(t *testing.T) {
+	// chainN's policy includes chainN+1's, through chain<last>,
+	// whose policy passes everyone.
+	chain := func(last int) *fakeDNS {
+		dns := &fakeDNS{txt: map[string][]string{}}
+		for i := 0; i < last; i++ {
+			dns.txt[fmt.Sprintf("chain%d.example", i)] = []string{fmt.Sprintf("v=spf1 include:chain%d.example -all", i+1)}
+		}
+		dns.txt[fmt.Sprintf("chain%d.example", last)] = []string{"v=spf1 +all"}
+		return dns
+	}
+	ip := net.ParseIP("192.0.2.1")
+	res, err := (&Checker{Resolver: chain(maxLookups)}).CheckHost(context.Background(), ip, "chain0.example", "user@chain0.example", "helo.example")
+	if res != Pass || err != nil {
+		t.Errorf("%d lookups: %s, %v; want pass", maxLookups, res, err)
+	}
+	res, err = (&Checker{Resolver: chain(maxLookups + 1)}).CheckHost(context.Background(), ip, "chain0.example", "user@chain0.example", "helo.example")
+	if res != PermError || err != errTooManyLookups {
+		t.Errorf("%d lookups: %s, %v; want permerror, %v", maxLookups+1, res, err, errTooManyLookups)
+	}
+
+	// Void lookups have a lower limit.
+	dns := &fakeDNS{txt: map[string][]string{
+		"void2.example": {"v=spf1 a:gone1.example a:gone2.example +all"},
+		"void3.example": {"v=spf1 a:gone1.example a:gone2.example mx:gone3.example +all"},
+	}}
+	c := &Checker{Resolver: dns}
+	if res, err := c.CheckHost(context.Background(), ip, "void2.example", "", "helo.example"); res != Pass {
+		t.Errorf("2 void lookups: %s, %v; want pass", res, err)
+	}
+	if res, err := c.CheckHost(context.Background(), ip, "void3.example", "", "helo.example"); res != PermError || err != errTooManyVoids {
+		t.Errorf("3 void lookups: %s, %v; want permerror, %v", res, err, errTooManyVoids)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	v := &Verdict{
+		Result:    Fail,
+		Identity:  "mailfrom",
+		IP:        net.ParseIP("192.0.2.1"),
+		HELO:      "helo.example",
+		Sender:    "odd user@example.com",
+		Domain:    "example.com",
+		Mechanism: "-all",
+	}
+	const want = "Received-SPF: fail (mx.example.net: domain of odd user@example.com does not designate 192.0.2.1 as permitted sender)\r\n" +
+		"\tclient-ip=192.0.2.1; envelope-from=\"odd user@example.com\"; helo=helo.example; mechanism=-all; identity=mailfrom; receiver=mx.example.net;\r\n"
+	if got := v.Header("mx.example.net"); got != want {
+		t.Errorf("Header =\n%q\nwant\n%q", got, want)
+	}
+}
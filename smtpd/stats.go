@@ -0,0 +1,81 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// SessionStats summarizes a finished session, for
+// Server.OnSessionEnd.
+type SessionStats struct {
+	Duration time.Duration
+	BytesIn  int64 // read from the client, after any TLS decryption
+	BytesOut int64 // written to the client, before any TLS encryption
+	Commands int   // command lines read
+	Accepted int   // messages accepted
+	Rejected int   // messages refused
+
+	// Err is why the session ended: nil if the client sent QUIT,
+	// the error from the connection if it failed or the client
+	// disconnected, or an SMTPError holding the reply the server
+	// closed the connection with.
+	Err error
+}
+
+// endSession reports the end of the session to Server.Metrics, its
+// Tracer and OnSessionEnd, and ends its transcript.
+func (s *session) endSession() {
+	m := s.srv.metrics()
+	m.Bytes(s.bytesIn, s.bytesOut)
+	m.ConnClosed()
+	st := SessionStats{
+		Duration: s.srv.now().Sub(s.timing.Connect),
+		BytesIn:  s.bytesIn,
+		BytesOut: s.bytesOut,
+		Commands: s.commands,
+		Accepted: s.messages - s.rejected,
+		Rejected: s.rejected,
+	}
+	switch {
+	case s.quit:
+	case s.connErr != nil:
+		st.Err = s.connErr
+	case strings.HasPrefix(s.lastReply, "4") || strings.HasPrefix(s.lastReply, "5"):
+		st.Err = SMTPError(s.lastReply)
+	}
+	s.endSessionSpan(st.Err)
+	if s.srv.OnSessionEnd != nil {
+		s.srv.OnSessionEnd(s, st)
+	}
+	s.endTranscript()
+}
+
+// setConnErr records err as the connection's failure, if it's the
+// first.
+func (s *session) setConnErr(err error) {
+	if s.connErr == nil {
+		s.connErr = err
+	}
+}
+
+// statsWriter counts the bytes the session writes to w, and records
+// write errors.
+type statsWriter struct {
+	w io.Writer
+	s *session
+}
+
+func (sw statsWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.s.bytesOut += int64(n)
+	sw.s.record(fromServer, p[:n])
+	if err != nil {
+		sw.s.setConnErr(err)
+	}
+	return n, err
+}
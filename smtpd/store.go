@@ -0,0 +1,104 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store is a key-value store with expiring entries, holding the state
+// of policy features such as reputation tracking. Servers in a
+// cluster can share a Store to apply policy consistently.
+type Store interface {
+	// Get returns the value for key, or nil if it's absent or
+	// expired.
+	Get(key string) ([]byte, error)
+
+	// Set sets the value for key, expiring after ttl.
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Incr atomically increments the integer value for key,
+	// creating it with expiry ttl if absent, and returns the new
+	// value.
+	Incr(key string, ttl time.Duration) (int64, error)
+
+	// Delete removes key.
+	Delete(key string) error
+}
+
+// MemoryStore is a Store in process memory. The zero value is ready
+// to use.
+type MemoryStore struct {
+	// Clock, if non-nil, times entries' expiry.
+	Clock Clock
+
+	mu   sync.Mutex
+	m    map[string]memEntry
+	sets int // since last prune
+}
+
+type memEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func (s *MemoryStore) now() time.Time { return clockOrSystem(s.Clock).Now() }
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok || s.now().After(e.expires) {
+		return nil, nil
+	}
+	return e.value, nil
+}
+
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, append([]byte(nil), value...), s.now().Add(ttl))
+	return nil
+}
+
+// set stores an entry. s.mu must be held.
+func (s *MemoryStore) set(key string, value []byte, expires time.Time) {
+	if s.m == nil {
+		s.m = make(map[string]memEntry)
+	}
+	s.m[key] = memEntry{value, expires}
+	if s.sets++; s.sets >= 1024 {
+		s.sets = 0
+		now := s.now()
+		for k, e := range s.m {
+			if now.After(e.expires) {
+				delete(s.m, k)
+			}
+		}
+	}
+}
+
+func (s *MemoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	e, ok := s.m[key]
+	if !ok || now.After(e.expires) {
+		e = memEntry{expires: now.Add(ttl)}
+	}
+	n, _ := strconv.ParseInt(string(e.value), 10, 64)
+	n++
+	s.set(key, []byte(strconv.FormatInt(n, 10)), e.expires)
+	return n, nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+	return nil
+}
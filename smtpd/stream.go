@@ -0,0 +1,86 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"errors"
+	"io"
+)
+
+// DataEnvelope is an Envelope that reads its message as a stream
+// rather than a line at a time, such as to pass it to a MIME parser
+// or copy it to disk. If an Envelope implements it, Data is called in
+// place of Write, in its own goroutine, once the message begins.
+//
+// r returns the message, with any headers the server adds and
+// dot-unstuffed unless the Envelope asks otherwise (see Transparency),
+// then io.EOF. If the message is abandoned, such as for
+// exceeding Server.MaxSize, r returns ErrMessageAbandoned instead.
+// Data's error is handled as Close's would be; Close is only called
+// if it returns nil or a Verdict.
+type DataEnvelope interface {
+	Envelope
+	Data(r io.Reader) error
+}
+
+// ErrMessageAbandoned is returned by the reader passed to
+// DataEnvelope.Data if the message is abandoned before its end.
+var ErrMessageAbandoned = errors.New("smtpd: message abandoned")
+
+// dataStream is a message being passed to DataEnvelope.Data.
+type dataStream struct {
+	pw   *io.PipeWriter
+	done chan error // Data's result
+}
+
+// startStream calls the current Envelope's Data method, if it has
+// one, for the message beginning.
+func (s *session) startStream() {
+	s.abortStream()
+	de, ok := s.env.(DataEnvelope)
+	if !ok {
+		return
+	}
+	pr, pw := io.Pipe()
+	ds := &dataStream{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := de.Data(pr)
+		// Writes go on succeeding if Data returns early.
+		io.Copy(io.Discard, pr)
+		ds.done <- err
+	}()
+	s.stream = ds
+}
+
+// endStream ends the message being streamed, if any, and returns
+// Data's result.
+func (s *session) endStream() error {
+	ds := s.stream
+	if ds == nil {
+		return nil
+	}
+	s.stream = nil
+	ds.pw.Close()
+	return <-ds.done
+}
+
+// abortStream abandons the message being streamed, if any.
+func (s *session) abortStream() {
+	if ds := s.stream; ds != nil {
+		s.stream = nil
+		ds.pw.CloseWithError(ErrMessageAbandoned)
+		<-ds.done
+	}
+}
+
+// write passes part of the current message to the Envelope.
+func (s *session) write(p []byte) error {
+	s.msgBytes += int64(len(p))
+	if s.stream != nil {
+		_, err := s.stream.pw.Write(p)
+		return err
+	}
+	return s.env.Write(p)
+}
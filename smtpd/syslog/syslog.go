@@ -0,0 +1,192 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package syslog sends an smtpd.Server's log messages to syslog or to
+// the systemd journal. Use a Syslog or Journal's Log method as the
+// Server's LogEntry:
+//
+//	j, err := syslog.NewJournal("smtpd")
+//	...
+//	srv.LogEntry = j.Log
+package syslog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// facilityMail is the syslog facility for the mail system.
+const facilityMail = 2
+
+// severity returns the syslog severity for a log level.
+func severity(l smtpd.LogLevel) int {
+	switch {
+	case l <= smtpd.LogError:
+		return 3 // err
+	case l == smtpd.LogInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// Syslog writes log messages to a syslog server in the RFC 5424
+// format, with facility mail. The message ID is the log category.
+type Syslog struct {
+	tag      string
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+	net  string
+	addr string
+}
+
+// NewSyslog connects to the syslog server at raddr on network ("udp",
+// "tcp" or "unixgram"), or to the local syslog daemon if both are
+// empty. Messages are tagged with tag, the application name.
+func NewSyslog(network, raddr, tag string) (*Syslog, error) {
+	hostname, _ := os.Hostname()
+	s := &Syslog{tag: tag, hostname: hostname, net: network, addr: raddr}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect (re)connects to the syslog server. s.mu must be held or s
+// not yet shared.
+func (s *Syslog) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.net != "" || s.addr != "" {
+		c, err := net.Dial(s.net, s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = c
+		return nil
+	}
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		for _, network := range []string{"unixgram", "unix"} {
+			if c, err := net.Dial(network, path); err == nil {
+				s.conn = c
+				return nil
+			}
+		}
+	}
+	return errors.New("syslog: no local syslog daemon found")
+}
+
+// Log writes a log message. Its signature matches
+// smtpd.Server.LogEntry.
+func (s *Syslog) Log(c smtpd.LogCategory, l smtpd.LogLevel, msg string) {
+	pri := facilityMail*8 + severity(l)
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", pri,
+		time.Now().Format(time.RFC3339Nano), nilValue(s.hostname),
+		nilValue(s.tag), os.Getpid(), c, msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil && s.connect() != nil {
+		return
+	}
+	if s.net == "tcp" {
+		// Octet counting framing (RFC 6587 s3.4.1).
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		// The daemon may have restarted; try once more.
+		if s.connect() == nil {
+			s.conn.Write([]byte(line))
+		}
+	}
+}
+
+// nilValue returns v, or "-", syslog's NILVALUE, if it's empty.
+func nilValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(v, " ", "_")
+}
+
+// Close closes the connection to the syslog server.
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// journalSocket is where journald receives native protocol messages.
+const journalSocket = "/run/systemd/journal/socket"
+
+// Journal writes log messages to the systemd journal, with the fields
+// MESSAGE, PRIORITY, SYSLOG_FACILITY, SYSLOG_IDENTIFIER and
+// SMTPD_CATEGORY.
+type Journal struct {
+	tag  string
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+// NewJournal returns a Journal whose messages carry the syslog
+// identifier tag. It fails if journald isn't running.
+func NewJournal(tag string) (*Journal, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UnixAddr{Name: journalSocket, Net: "unixgram"}
+	if _, err := os.Stat(journalSocket); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("syslog: journald not available: %v", err)
+	}
+	return &Journal{tag: tag, conn: conn, addr: addr}, nil
+}
+
+// Log writes a log message. Its signature matches
+// smtpd.Server.LogEntry.
+func (j *Journal) Log(c smtpd.LogCategory, l smtpd.LogLevel, msg string) {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", msg)
+	journalField(&b, "PRIORITY", fmt.Sprint(severity(l)))
+	journalField(&b, "SYSLOG_FACILITY", fmt.Sprint(facilityMail))
+	journalField(&b, "SYSLOG_IDENTIFIER", j.tag)
+	journalField(&b, "SMTPD_CATEGORY", c.String())
+	j.conn.WriteToUnix(b.Bytes(), j.addr)
+}
+
+// journalField appends a field in journald's native protocol. Values
+// with newlines are length-prefixed.
+func journalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// Close releases the Journal's socket.
+func (j *Journal) Close() error {
+	return j.conn.Close()
+}
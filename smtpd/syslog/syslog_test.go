@@ -0,0 +1,155 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, err := NewSyslog("udp", pc.LocalAddr().String(), "my smtpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.hostname = "mx.example.com"
+
+	tests := []struct {
+		c    smtpd.LogCategory
+		l    smtpd.LogLevel
+		msg  string
+		want string
+	}{
+		{smtpd.LogDelivery, smtpd.LogError, "delivery failed", `<19>1 \S+ mx.example.com my_smtpd \d+ delivery - delivery failed`},
+		{smtpd.LogConn, smtpd.LogInfo, "connection from 192.0.2.1", `<22>1 \S+ mx.example.com my_smtpd \d+ conn - connection from 192.0.2.1`},
+		{smtpd.LogProto, smtpd.LogDebug, "C: NOOP", `<23>1 \S+ mx.example.com my_smtpd \d+ proto - C: NOOP`},
+	}
+	buf := make([]byte, 1024)
+	for _, tt := range tests {
+		s.Log(tt.c, tt.l, tt.msg)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile("^" + tt.want + "$").Match(buf[:n]) {
+			t.Errorf("sent %q; want match for %q", buf[:n], tt.want)
+		}
+	}
+
+	// The timestamp is RFC 3339.
+	s.Log(smtpd.LogConn, smtpd.LogInfo, "x")
+	n, _, _ := pc.ReadFrom(buf)
+	fields := strings.Fields(string(buf[:n]))
+	if _, err := time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+		t.Errorf("timestamp %q: %v", fields[1], err)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s, err := NewSyslog("tcp", ln.Addr().String(), "smtpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s.Log(smtpd.LogAuth, smtpd.LogInfo, "one")
+	s.Log(smtpd.LogAuth, smtpd.LogInfo, "message two")
+	s.Close()
+
+	// Messages are framed by octet counting.
+	br := bufio.NewReader(c)
+	for _, want := range []string{" auth - one", " auth - message two"} {
+		var n int
+		if _, err := fmt.Fscanf(br, "%d ", &n); err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(msg), "<22>1 ") || !strings.HasSuffix(string(msg), want) {
+			t.Errorf("message %q; want one ending %q", msg, want)
+		}
+	}
+}
+
+func TestNilValue(t *testing.T) {
+	for in, want := range map[string]string{"": "-", "smtpd": "smtpd", "my smtpd": "my_smtpd"} {
+		if got := nilValue(in); got != want {
+			t.Errorf("nilValue(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	srv, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer srv.Close()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &Journal{tag: "smtpd", conn: conn, addr: &net.UnixAddr{Name: path, Net: "unixgram"}}
+	defer j.Close()
+
+	j.Log(smtpd.LogTLS, smtpd.LogError, "handshake failed:\nbad certificate")
+	buf := make([]byte, 1024)
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := srv.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "handshake failed:\nbad certificate"
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(msg)))
+	want := "MESSAGE\n" + string(size[:]) + msg + "\n" +
+		"PRIORITY=3\n" +
+		"SYSLOG_FACILITY=2\n" +
+		"SYSLOG_IDENTIFIER=smtpd\n" +
+		"SMTPD_CATEGORY=tls\n"
+	if got := buf[:n]; !bytes.Equal(got, []byte(want)) {
+		t.Errorf("sent %q; want %q", got, want)
+	}
+}
+
+func TestNewJournal(t *testing.T) {
+	if _, err := os.Stat(journalSocket); err == nil {
+		t.Skip("journald is running")
+	}
+	if j, err := NewJournal("smtpd"); err == nil {
+		j.Close()
+		t.Error("NewJournal succeeded without journald")
+	}
+}
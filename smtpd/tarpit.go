@@ -0,0 +1,50 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import "time"
+
+// ErrorDelay returns a Server.Tarpit policy that delays each error
+// reply by step for every error the client was sent before it, up to
+// max, and doesn't delay the banner.
+func ErrorDelay(step, max time.Duration) func(c Connection, reply string, errors int) time.Duration {
+	return func(c Connection, reply string, errors int) time.Duration {
+		if reply[0] != '4' && reply[0] != '5' {
+			return 0
+		}
+		d := step * time.Duration(errors)
+		if d > max || d < 0 {
+			d = max
+		}
+		return d
+	}
+}
+
+// tarpit waits before the server sends reply, as Server.Tarpit
+// decides. The wait ends early if the client disconnects or the
+// session's context is canceled, such as when Shutdown gives up.
+func (s *session) tarpit(reply string) {
+	if s.srv.Tarpit == nil || s.ctx.Err() != nil {
+		return
+	}
+	d := s.srv.Tarpit(s, reply, s.errorReplies)
+	if d <= 0 {
+		return
+	}
+	s.logf(LogProto, LogDebug, "delaying reply by %v", d)
+	s.sleep(d)
+}
+
+// sleep waits for d, or until the client disconnects or the session's
+// context is canceled.
+func (s *session) sleep(d time.Duration) {
+	defer s.watchClient()()
+	t := clockOrSystem(s.srv.Clock).NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+	case <-s.ctx.Done():
+	}
+}
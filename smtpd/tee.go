@@ -0,0 +1,114 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import "log"
+
+// TeeEnvelope is an Envelope that passes the message to its embedded
+// primary Envelope and also copies it to Archive, such as a journal
+// directory or an archiving service.
+//
+// Only recipients accepted by the primary Envelope are given to
+// Archive. Unless ArchiveRequired is set, the first error from
+// Archive is logged and the archive copy is abandoned, without
+// affecting the primary delivery.
+type TeeEnvelope struct {
+	Envelope
+	Archive Envelope
+
+	// ArchiveRequired makes archiving failures fail the message.
+	// Archive is then closed before the primary Envelope, so a
+	// message may be archived even if the primary rejects it.
+	ArchiveRequired bool
+
+	archiveErr error
+}
+
+var errArchive = SMTPError("451 4.3.0 Error: message could not be archived")
+
+// archive calls fn on the archive unless it has already failed, and
+// reports whether the message can go on.
+func (e *TeeEnvelope) archive(fn func() error) bool {
+	if e.archiveErr != nil {
+		return !e.ArchiveRequired
+	}
+	if e.archiveErr = fn(); e.archiveErr != nil {
+		log.Printf("smtpd: archive envelope: %v", e.archiveErr)
+		return !e.ArchiveRequired
+	}
+	return true
+}
+
+func (e *TeeEnvelope) AddRecipient(rcpt MailAddress) error {
+	if err := e.Envelope.AddRecipient(rcpt); err != nil {
+		return err
+	}
+	if !e.archive(func() error { return e.Archive.AddRecipient(rcpt) }) {
+		return errArchive
+	}
+	return nil
+}
+
+func (e *TeeEnvelope) BeginData() error {
+	if err := e.Envelope.BeginData(); err != nil {
+		return err
+	}
+	if !e.archive(e.Archive.BeginData) {
+		return errArchive
+	}
+	return nil
+}
+
+func (e *TeeEnvelope) Write(line []byte) error {
+	if err := e.Envelope.Write(line); err != nil {
+		return err
+	}
+	if !e.archive(func() error { return e.Archive.Write(line) }) {
+		return errArchive
+	}
+	return nil
+}
+
+func (e *TeeEnvelope) Close() error {
+	if e.ArchiveRequired {
+		if !e.archive(e.Archive.Close) {
+			abort(e.Envelope)
+			return errArchive
+		}
+		return e.Envelope.Close()
+	}
+	if err := e.Envelope.Close(); err != nil {
+		return err
+	}
+	if e.archiveErr != nil {
+		abort(e.Archive)
+		return nil
+	}
+	e.archive(e.Archive.Close)
+	return nil
+}
+
+// Abort passes the end of the transaction on to both Envelopes that
+// are AbortEnvelopes.
+func (e *TeeEnvelope) Abort() {
+	abort(e.Envelope)
+	abort(e.Archive)
+}
+
+// abort calls env's Abort if it's an AbortEnvelope.
+func abort(env Envelope) {
+	if ae, ok := env.(AbortEnvelope); ok {
+		ae.Abort()
+	}
+}
+
+// RecipientVerdict passes through the primary Envelope's verdict if
+// it's a PRDREnvelope.
+func (e *TeeEnvelope) RecipientVerdict(rcpt MailAddress) error {
+	if pe, ok := e.Envelope.(PRDREnvelope); ok {
+		return pe.RecipientVerdict(rcpt)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Timing records when a session reached each phase of its current or
+// most recent mail transaction. Phases not reached are zero.
+//
+// The gaps between phases show where time goes: between Mail and
+// DataStart it's mostly the client and network, plus the OnNewMail
+// and AddRecipient hooks; between DataEnd and Done it's all
+// Envelope.Close.
+type Timing struct {
+	Connect   time.Time   // connection accepted
+	Hello     time.Time   // HELO or EHLO received
+	Mail      time.Time   // MAIL received
+	Rcpts     []time.Time // each accepted RCPT received
+	DataStart time.Time   // DATA received
+	DataEnd   time.Time   // end of message data received
+	Done      time.Time   // reply to the message sent
+}
+
+// String returns the time of each phase reached, relative to Connect.
+func (t Timing) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "connect=%s", t.Connect.Format(time.RFC3339Nano))
+	add := func(name string, at time.Time) {
+		if !at.IsZero() {
+			fmt.Fprintf(&b, " %s=+%v", name, at.Sub(t.Connect))
+		}
+	}
+	add("hello", t.Hello)
+	add("mail", t.Mail)
+	for _, r := range t.Rcpts {
+		add("rcpt", r)
+	}
+	add("data", t.DataStart)
+	add("dataend", t.DataEnd)
+	add("done", t.Done)
+	return b.String()
+}
+
+func (s *session) Timing() Timing {
+	t := s.timing
+	t.Rcpts = append([]time.Time(nil), t.Rcpts...)
+	return t
+}
+
+// startTiming begins timing a new transaction.
+func (s *session) startTiming() {
+	s.timing = Timing{Connect: s.timing.Connect, Hello: s.timing.Hello, Mail: s.srv.now()}
+}
+
+// endTiming records the end of a message transaction.
+func (s *session) endTiming() {
+	s.timing.Done = s.srv.now()
+	s.logf(LogDelivery, LogDebug, "timing: %v", s.timing)
+}
@@ -0,0 +1,372 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// handleStartTLS upgrades the session to TLS (RFC 3207) and reports
+// whether the session can continue.
+func (s *session) handleStartTLS() bool {
+	if s.tlsState != nil {
+		s.sendlinef("503 5.5.1 Error: TLS already active")
+		return true
+	}
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: STARTTLS not permitted during mail transaction")
+		return true
+	}
+	cfg, err := s.tlsConfig()
+	if err != nil {
+		s.logf(LogTLS, LogError, "TLS configuration: %v", err)
+		s.sendlinef("454 4.7.0 TLS not available due to temporary reason")
+		return true
+	}
+	s.sendlinef("220 2.0.0 Ready to start TLS")
+
+	// Anything the client pipelined after STARTTLS was sent in the
+	// clear, and mustn't be taken as sent over TLS (RFC 3207 s6).
+	if n := s.br.Buffered() + len(s.cr.pending); n > 0 {
+		s.logf(LogTLS, LogInfo, "discarding %d bytes sent after STARTTLS", n)
+		s.br.Discard(s.br.Buffered())
+		s.cr.pending = nil
+	}
+	if !s.startTLS(cfg) {
+		return false
+	}
+
+	// The client must start over with EHLO (RFC 3207 s4.2).
+	s.resetSession()
+	return true
+}
+
+// defaultTLSHandshakeTimeout is the TLS handshake timeout if neither
+// TLSHandshakeTimeout nor ReadTimeout is set.
+const defaultTLSHandshakeTimeout = 30 * time.Second
+
+// startImplicitTLS begins the connection with a TLS handshake, for
+// ServeTLS, and reports whether it succeeded.
+func (s *session) startImplicitTLS() bool {
+	cfg, err := s.tlsConfig()
+	if err != nil {
+		s.logf(LogTLS, LogError, "TLS configuration: %v", err)
+		s.setConnErr(err)
+		return false
+	}
+	return s.startTLS(cfg)
+}
+
+// startTLS performs a TLS handshake with the client using cfg, and
+// reports whether it succeeded.
+func (s *session) startTLS(cfg *tls.Config) bool {
+	tc := tls.Server(s.rwc, cfg)
+	d := s.srv.TLSHandshakeTimeout
+	if d == 0 {
+		d = s.srv.ReadTimeout
+	}
+	if d == 0 {
+		d = defaultTLSHandshakeTimeout
+	}
+	tc.SetDeadline(time.Now().Add(d))
+	if err := tc.Handshake(); err != nil {
+		s.logf(LogTLS, LogInfo, "TLS handshake: %v", err)
+		s.setConnErr(err)
+		return false
+	}
+	tc.SetDeadline(time.Time{})
+	state := tc.ConnectionState()
+	s.logf(LogTLS, LogDebug, "TLS version %x, cipher %s, resumed %v",
+		state.Version, tls.CipherSuiteName(state.CipherSuite), state.DidResume)
+	s.srv.tlsHandshakes.Add(1)
+	if state.DidResume {
+		s.srv.tlsResumed.Add(1)
+	}
+	s.srv.metrics().TLSHandshake(state.DidResume)
+	s.traceTLS(&state)
+	s.tlsState = &state
+	s.rwc = tc
+	s.cr = &connReader{conn: tc, s: s}
+	s.br = s.srv.newReader(s.cr)
+	s.bw = s.srv.newWriter(statsWriter{tc, s})
+	return s.checkClientCert()
+}
+
+// checkClientCert passes the client's verified certificate, if any,
+// to Server.OnTLSClientCert, and reports whether the session can
+// continue.
+func (s *session) checkClientCert() bool {
+	chain := s.PeerCertificates()
+	if chain == nil || s.srv.OnTLSClientCert == nil {
+		return true
+	}
+	identity, err := s.srv.OnTLSClientCert(s, chain)
+	if err != nil {
+		s.logf(LogTLS, LogInfo, "client certificate %q refused: %v", chain[0].Subject, err)
+		if se, ok := err.(SMTPError); ok {
+			s.sendFinalLinef("%s", se.Error())
+		} else {
+			s.sendFinalLinef("421 4.7.0 %s Error: client certificate not accepted", s.srv.hostname())
+		}
+		return false
+	}
+	s.logf(LogTLS, LogDebug, "client certificate %q for %q", chain[0].Subject, identity)
+	s.certUser = identity
+	return true
+}
+
+// ServeTLS is like Serve, but for implicit TLS (RFC 8314), as on the
+// submissions port 465: a TLS handshake using TLSConfig, or the
+// configuration from GetTLSConfig, begins each connection, and
+// STARTTLS isn't offered.
+func (srv *Server) ServeTLS(ln net.Listener) error {
+	if !srv.tlsEnabled() {
+		return errors.New("smtpd: ServeTLS needs a TLSConfig or GetTLSConfig")
+	}
+	return srv.serve(ln, true)
+}
+
+// ListenAndServeTLS listens on Addr, or ":465" if it's empty, and
+// calls ServeTLS. If certFile and keyFile are given, the certificate
+// they hold is added to a copy of TLSConfig, or to a new configuration
+// if it's nil, which the Server uses in its place; TLSConfig itself is
+// left unchanged. Call it before serving other listeners, which will
+// also use the certificate for STARTTLS.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		cfg := &tls.Config{}
+		if srv.TLSConfig != nil {
+			cfg = srv.TLSConfig.Clone()
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+		srv.certConfig = cfg
+	}
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":465"
+	}
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeTLS(ln)
+}
+
+// TLSResumption configures TLS session resumption for a Server.
+type TLSResumption struct {
+	// Disabled turns off session resumption.
+	Disabled bool
+
+	// KeyRotation, if non-zero, makes the Server generate its own
+	// session ticket keys, replacing the encryption key at this
+	// interval, and install them with the TLS configuration's
+	// SetSessionTicketKeys. Otherwise crypto/tls manages the keys.
+	KeyRotation time.Duration
+
+	// KeyLifetime is how long a rotated-out key still decrypts
+	// tickets, bounding how long a session can be resumed. If zero,
+	// keys are kept for two rotations.
+	KeyLifetime time.Duration
+}
+
+// TLSStats reports TLS handshake counts for a Server.
+type TLSStats struct {
+	Handshakes int64 // completed handshakes
+	Resumed    int64 // of those, resumed sessions
+}
+
+// TLSStats returns the Server's TLS handshake counts.
+func (srv *Server) TLSStats() TLSStats {
+	return TLSStats{
+		Handshakes: srv.tlsHandshakes.Load(),
+		Resumed:    srv.tlsResumed.Load(),
+	}
+}
+
+// tlsEnabled reports whether the server can do TLS.
+func (srv *Server) tlsEnabled() bool {
+	return srv.TLSConfig != nil || srv.certConfig != nil || srv.GetTLSConfig != nil
+}
+
+var errNoTLSConfig = errors.New("smtpd: no TLS configuration")
+
+// tlsConfig returns the configuration for a new TLS handshake with
+// the session's client.
+func (s *session) tlsConfig() (*tls.Config, error) {
+	srv := s.srv
+	cfg := srv.TLSConfig
+	if srv.certConfig != nil {
+		cfg = srv.certConfig
+	}
+	if srv.GetTLSConfig != nil {
+		c, err := srv.GetTLSConfig(s)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			cfg = c
+		}
+	}
+	if cfg == nil {
+		return nil, errNoTLSConfig
+	}
+	r := srv.TLSResumption
+	if r.Disabled {
+		if !cfg.SessionTicketsDisabled {
+			cfg = cfg.Clone()
+			cfg.SessionTicketsDisabled = true
+		}
+		return cfg, nil
+	}
+	if r.KeyRotation > 0 {
+		srv.rotateTicketKeys(cfg)
+	}
+	return cfg, nil
+}
+
+// rotateTicketKeys installs the server's session ticket keys in cfg,
+// first adding a new one if the current one is due for rotation. Each
+// configuration is given the keys, including those from GetTLSConfig,
+// so tickets work across them.
+func (srv *Server) rotateTicketKeys(cfg *tls.Config) {
+	srv.tlsMu.Lock()
+	defer srv.tlsMu.Unlock()
+	r := srv.TLSResumption
+	now := srv.now()
+	if len(srv.ticketKeys) > 0 && now.Sub(srv.ticketRotated) < r.KeyRotation {
+		cfg.SetSessionTicketKeys(srv.ticketKeys)
+		return
+	}
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		srv.logf(LogTLS, LogError, "generating session ticket key: %v", err)
+		return
+	}
+	lifetime := r.KeyLifetime
+	if lifetime == 0 {
+		lifetime = 2 * r.KeyRotation
+	}
+	keep := 1 + int((lifetime+r.KeyRotation-1)/r.KeyRotation)
+	srv.ticketKeys = append([][32]byte{key}, srv.ticketKeys...)
+	if len(srv.ticketKeys) > keep {
+		srv.ticketKeys = srv.ticketKeys[:keep]
+	}
+	cfg.SetSessionTicketKeys(srv.ticketKeys)
+	srv.ticketRotated = now
+}
+
+// CertReloader serves a TLS certificate loaded from PEM files,
+// reloading it when the files change, so certificates can be renewed
+// underneath a running server. Use its GetCertificate method in the
+// tls.Config given to the Server.
+type CertReloader struct {
+	certFile, keyFile string
+
+	// CheckInterval is how often the files are checked for changes,
+	// at most once per handshake. If zero, they're checked every
+	// minute.
+	CheckInterval time.Duration
+
+	// Clock, if non-nil, is the time source, as for tests.
+	Clock Clock
+
+	// Log, if non-nil, receives failures to reload the certificate
+	// instead of the standard logger, such as a Server's Log.
+	Log func(format string, args ...interface{})
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certStamp fileStamp
+	keyStamp  fileStamp
+	checked   time.Time
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func statStamp(name string) (fileStamp, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}, nil
+}
+
+// NewCertReloader returns a CertReloader for the named certificate and
+// key files, which must be loadable now.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load (re)reads the certificate. r.mu must be held, or r unshared.
+func (r *CertReloader) load() error {
+	cs, err := statStamp(r.certFile)
+	if err != nil {
+		return err
+	}
+	ks, err := statStamp(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && cs == r.certStamp && ks == r.keyStamp {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.certStamp, r.keyStamp = &cert, cs, ks
+	return nil
+}
+
+// GetCertificate returns the current certificate, first reloading it
+// if the files have changed. If reloading fails, as it may while the
+// files are being replaced, the previous certificate is served.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	interval := r.CheckInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	now := clockOrSystem(r.Clock).Now()
+	if r.checked.IsZero() {
+		// The files were loaded by NewCertReloader.
+		r.checked = now
+	}
+	if now.Sub(r.checked) >= interval {
+		r.checked = now
+		if err := r.load(); err != nil {
+			r.logf("smtpd: reloading TLS certificate %s: %v", r.certFile, err)
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *CertReloader) logf(format string, args ...interface{}) {
+	if r.Log != nil {
+		r.Log(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
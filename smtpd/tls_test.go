@@ -0,0 +1,122 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for name, and its key,
+// to certFile and keyFile.
+func writeCert(t *testing.T, name, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certName(t *testing.T, r *CertReloader) string {
+	t.Helper()
+	c, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, "old.example", certFile, keyFile)
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Now())
+	var logged []string
+	r.Clock = clock
+	r.Log = func(format string, args ...interface{}) { logged = append(logged, fmt.Sprintf(format, args...)) }
+	r.CheckInterval = time.Minute
+
+	if got := certName(t, r); got != "old.example" {
+		t.Fatalf("serving %q", got)
+	}
+	writeCert(t, "new.example", certFile, keyFile)
+	// Make sure the files look changed even on coarse clocks.
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	if got := certName(t, r); got != "old.example" {
+		t.Errorf("reloaded before CheckInterval: serving %q", got)
+	}
+	clock.Advance(time.Minute)
+	if got := certName(t, r); got != "new.example" {
+		t.Errorf("after CheckInterval, serving %q; want new.example", got)
+	}
+
+	// A broken replacement leaves the last certificate in use.
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	clock.Advance(time.Minute)
+	if got := certName(t, r); got != "new.example" {
+		t.Errorf("after a failed reload, serving %q; want new.example", got)
+	}
+	if len(logged) != 1 {
+		t.Errorf("logged %q; want the failed reload", logged)
+	}
+}
+
+func TestListenAndServeTLSKeepsConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, "mx.example.com", certFile, keyFile)
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	srv := &Server{Addr: "256.0.0.1:0", TLSConfig: cfg}
+	if err := srv.ListenAndServeTLS(certFile, keyFile); err == nil {
+		t.Fatal("listening on a bad address succeeded")
+	}
+	if srv.TLSConfig != cfg || len(cfg.Certificates) != 0 {
+		t.Errorf("TLSConfig changed")
+	}
+	if srv.certConfig == nil || len(srv.certConfig.Certificates) != 1 || srv.certConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("certificate not added to a copy of TLSConfig")
+	}
+}
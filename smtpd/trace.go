@@ -0,0 +1,124 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+)
+
+// Tracer starts spans tracing sessions and their mail transactions,
+// for a tracing system such as OpenTelemetry. An adapter implements
+// it with the system's own tracer, so the server doesn't depend on
+// one. The spans are in the contexts hooks get from
+// Connection.Context.
+type Tracer interface {
+	// StartSession starts a span for a new session, as a child of
+	// any span in ctx, and returns ctx holding it.
+	StartSession(ctx context.Context, c Connection) (context.Context, Span)
+
+	// StartTransaction starts a span for a mail transaction, from
+	// MAIL to the reply to its message, as a child of the session's
+	// span in ctx, and returns ctx holding it.
+	StartTransaction(ctx context.Context, c Connection) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute annotates the span. The value is a string,
+	// int64 or bool.
+	SetAttribute(key string, value interface{})
+
+	// End ends the span. err is nil if it succeeded, or else what
+	// ended it, such as an SMTPError holding the last reply or a
+	// connection error.
+	End(err error)
+}
+
+// startSessionSpan starts the session's span, if there's a Tracer.
+func (s *session) startSessionSpan() {
+	if s.srv.Tracer == nil {
+		return
+	}
+	s.ctx, s.span = s.srv.Tracer.StartSession(s.ctx, s)
+	if addr, ok := s.Addr().(*net.TCPAddr); ok {
+		s.span.SetAttribute("client.address", addr.IP.String())
+		s.span.SetAttribute("client.port", int64(addr.Port))
+	}
+}
+
+// traceTLS annotates the session's span once TLS starts.
+func (s *session) traceTLS(state *tls.ConnectionState) {
+	if s.span == nil {
+		return
+	}
+	s.span.SetAttribute("tls.protocol.version", tls.VersionName(state.Version))
+	s.span.SetAttribute("tls.cipher", tls.CipherSuiteName(state.CipherSuite))
+	s.span.SetAttribute("tls.resumed", state.DidResume)
+}
+
+// endSessionSpan ends the session's span, with the error that ended
+// the session.
+func (s *session) endSessionSpan(err error) {
+	if s.span == nil {
+		return
+	}
+	s.endTxSpan()
+	s.span.SetAttribute("smtp.helo", s.helloHost)
+	s.span.SetAttribute("smtp.commands", int64(s.commands))
+	s.span.SetAttribute("smtp.messages", int64(s.messages))
+	s.span.End(err)
+}
+
+// startTxSpan starts a span for the mail transaction begun by MAIL
+// from the address from.
+func (s *session) startTxSpan(from string) {
+	if s.span == nil {
+		return
+	}
+	s.endTxSpan()
+	s.sessCtx = s.ctx
+	s.ctx, s.txSpan = s.srv.Tracer.StartTransaction(s.ctx, s)
+	s.txSpan.SetAttribute("smtp.mail_from", from)
+	s.msgBytes = 0
+	s.txCounted = false
+}
+
+// traceMessage annotates the transaction's span with its message.
+func (s *session) traceMessage() {
+	if s.txSpan == nil {
+		return
+	}
+	s.txCounted = true
+	s.txSpan.SetAttribute("smtp.rcpt_count", int64(len(s.rcpts)))
+	s.txSpan.SetAttribute("smtp.message.size", int64(s.msgBytes))
+}
+
+// txOver reports whether the traced transaction is over: it was
+// refused or abandoned, or its message got its reply.
+func (s *session) txOver() bool {
+	return s.txSpan != nil && (s.env == nil || s.txCounted)
+}
+
+// endTxSpan ends the transaction's span, if any, with its last reply.
+func (s *session) endTxSpan() {
+	if s.txSpan == nil {
+		return
+	}
+	var err error
+	if len(s.lastReply) >= 3 {
+		if code, cerr := strconv.Atoi(s.lastReply[:3]); cerr == nil {
+			s.txSpan.SetAttribute("smtp.response.code", int64(code))
+			if code >= 400 {
+				err = SMTPError(s.lastReply)
+			}
+		}
+	}
+	s.txSpan.End(err)
+	s.txSpan = nil
+	s.ctx = s.sessCtx
+}
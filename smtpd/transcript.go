@@ -0,0 +1,94 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// transcript copies a session's traffic to a writer from
+// Server.Transcript, a line at a time, such as:
+//
+//	2011-10-16T00:53:41.886Z C: "EHLO example.com\r\n"
+//
+// Lines are quoted so that stray control characters show. What the
+// client sends after STARTTLS is recorded decrypted.
+type transcript struct {
+	w       io.WriteCloser
+	partial [2][]byte // incomplete lines, by direction
+}
+
+const (
+	fromClient = iota
+	fromServer
+)
+
+var transcriptPrefixes = [2]string{"C", "S"}
+
+// startTranscript starts recording the session, if Server.Transcript
+// wants it to be.
+func (s *session) startTranscript() {
+	if s.srv.Transcript == nil {
+		return
+	}
+	if w := s.srv.Transcript(s); w != nil {
+		s.transcript = &transcript{w: w}
+	}
+}
+
+// record adds p, which the client sent or the server wrote as dir
+// says, to the transcript.
+func (s *session) record(dir int, p []byte) {
+	t := s.transcript
+	if t == nil || len(p) == 0 {
+		return
+	}
+	buf := append(t.partial[dir], p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		if !s.writeTranscript(dir, buf[:i+1]) {
+			return
+		}
+		buf = buf[i+1:]
+	}
+	t.partial[dir] = append(t.partial[dir][:0], buf...)
+}
+
+// writeTranscript writes a line to the transcript, and reports
+// whether it's still being recorded.
+func (s *session) writeTranscript(dir int, line []byte) bool {
+	_, err := fmt.Fprintf(s.transcript.w, "%s %s: %q\n",
+		s.srv.now().UTC().Format(time.RFC3339Nano), transcriptPrefixes[dir], line)
+	if err != nil {
+		s.logf(LogConn, LogError, "writing transcript: %v", err)
+		s.transcript.w.Close()
+		s.transcript = nil
+		return false
+	}
+	return true
+}
+
+// endTranscript writes any incomplete lines and closes the transcript.
+func (s *session) endTranscript() {
+	t := s.transcript
+	if t == nil {
+		return
+	}
+	for dir, line := range t.partial {
+		if len(line) > 0 && !s.writeTranscript(dir, line) {
+			return
+		}
+	}
+	if err := t.w.Close(); err != nil {
+		s.logf(LogConn, LogError, "closing transcript: %v", err)
+	}
+	s.transcript = nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+// Transparency is how a message sent with DATA is passed to its
+// Envelope, which the client dot-stuffs (RFC 5321 s4.5.2): it doubles
+// the dot at the start of any line that begins with one, so that the
+// message can't end early.
+type Transparency int
+
+const (
+	// Unstuffed passes the message with the extra dots removed, as
+	// it was before the client sent it. It's the default.
+	Unstuffed Transparency = iota
+
+	// Raw passes the message's lines exactly as the client sent
+	// them, still dot-stuffed, without the final ".\r\n", such as
+	// for archives that must keep byte-exact copies. Messages sent
+	// with BDAT aren't dot-stuffed, so are passed as sent either way.
+	Raw
+)
+
+// TransparencyEnvelope is an Envelope that chooses its Transparency.
+type TransparencyEnvelope interface {
+	Envelope
+	Transparency() Transparency
+}
+
+// transparency returns the current Envelope's Transparency.
+func (s *session) transparency() Transparency {
+	if te, ok := s.env.(TransparencyEnvelope); ok {
+		return te.Transparency()
+	}
+	return Unstuffed
+}
@@ -0,0 +1,74 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"fmt"
+	"testing"
+)
+
+// transparencyEnvelope is a testEnvelope with a chosen Transparency.
+type transparencyEnvelope struct {
+	testEnvelope
+	t Transparency
+}
+
+func (e *transparencyEnvelope) Transparency() Transparency { return e.t }
+
+func TestTransparency(t *testing.T) {
+	const sent = "Subject: dots\r\n\r\n..leading\r\n...two\r\nmid.dle\r\nbare\n..after LF\r\n"
+	tests := []struct {
+		name string
+		env  Envelope
+		want string
+	}{
+		{"default", &testEnvelope{}, "Subject: dots\r\n\r\n.leading\r\n..two\r\nmid.dle\r\nbare\n..after LF\r\n"},
+		{"Unstuffed", &transparencyEnvelope{t: Unstuffed}, "Subject: dots\r\n\r\n.leading\r\n..two\r\nmid.dle\r\nbare\n..after LF\r\n"},
+		{"Raw", &transparencyEnvelope{t: Raw}, sent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testServer(t, &Server{
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					return tt.env, nil
+				},
+			})
+			cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+			cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+			if code, msg := sendData(t, c, sent+".\r\n"); code != 250 {
+				t.Fatalf("reply = %d %s", code, msg)
+			}
+			if got := tt.env.(interface{ Data() string }).Data(); got != tt.want {
+				t.Errorf("message = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransparencyBDAT(t *testing.T) {
+	const sent = "Subject: dots\r\n\r\n..leading\r\n.\r\n"
+	for _, tr := range []Transparency{Unstuffed, Raw} {
+		env := &transparencyEnvelope{t: tr}
+		c := testServer(t, &Server{
+			OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+				return env, nil
+			},
+		})
+		cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+		cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+		if _, err := fmt.Fprintf(c.W, "BDAT %d LAST\r\n%s", len(sent), sent); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.W.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("BDAT: %v %s", err, msg)
+		}
+		if got := env.Data(); got != sent {
+			t.Errorf("Transparency %d: message = %q; want %q", tr, got, sent)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve, ServeTLS and their
+// ListenAndServe variants after Shutdown.
+var ErrServerClosed = errors.New("smtpd: Server closed")
+
+// listenFDsEnv names the environment variable telling a process
+// started by Upgrade how many listening sockets it inherited, as file
+// descriptors from 3 on.
+const listenFDsEnv = "SMTPD_LISTEN_FDS"
+
+// trackListener adds or removes ln from the server's listeners. Adding
+// fails once the server is shutting down.
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.lnMu.Lock()
+	defer srv.lnMu.Unlock()
+	if add {
+		if srv.shuttingDown.Load() {
+			return false
+		}
+		if srv.lns == nil {
+			srv.lns = make(map[net.Listener]bool)
+		}
+		srv.lns[ln] = true
+		srv.listeners.Add(1)
+		return true
+	}
+	delete(srv.lns, ln)
+	srv.listeners.Add(-1)
+	return true
+}
+
+// Shutdown stops the server accepting connections and waits for its
+// sessions to end. Sessions finish any mail transaction in progress
+// and are then sent a 421 reply at their next command; idle sessions
+// end when they next send a command or time out. If ctx ends first,
+// Shutdown cancels the remaining sessions' contexts, leaving them
+// running, and returns ctx's error.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.lnMu.Lock()
+	srv.shuttingDown.Store(true)
+	var err error
+	for ln := range srv.lns {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	srv.lnMu.Unlock()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for srv.sessions.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			srv.baseContext()
+			srv.cancelCtx()
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return err
+}
+
+// Upgrade starts a new copy of the running program, with the same
+// arguments, which inherits the server's listening sockets; its
+// ListenAndServe uses them rather than listening anew, so no
+// connections are refused during the handover. The caller should
+// then Shutdown the server to drain its sessions and exit, leaving the
+// new process serving.
+func (srv *Server) Upgrade() (*os.Process, error) {
+	srv.lnMu.Lock()
+	var files []*os.File
+	for ln := range srv.lns {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			srv.lnMu.Unlock()
+			return nil, fmt.Errorf("smtpd: can't pass %T to a new process", ln)
+		}
+		f, err := fl.File()
+		if err != nil {
+			srv.lnMu.Unlock()
+			return nil, err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	srv.lnMu.Unlock()
+	if len(files) == 0 {
+		return nil, errors.New("smtpd: no listeners to pass on")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), listenFDsEnv+"="+strconv.Itoa(len(files)))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	inherited   []net.Listener
+	inheritErr  error
+)
+
+// inheritedListener returns the listener for addr passed on by a
+// parent process's Upgrade, or nil if there's none.
+func inheritedListener(addr string) (net.Listener, error) {
+	inheritOnce.Do(func() {
+		n, _ := strconv.Atoi(os.Getenv(listenFDsEnv))
+		os.Unsetenv(listenFDsEnv)
+		for i := 0; i < n; i++ {
+			f := os.NewFile(uintptr(3+i), "listener")
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				inheritErr = fmt.Errorf("smtpd: inherited listener %d: %v", i, err)
+				return
+			}
+			inherited = append(inherited, ln)
+		}
+	})
+	if inheritErr != nil {
+		return nil, inheritErr
+	}
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	for i, ln := range inherited {
+		got, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || got.Port != want.Port {
+			continue
+		}
+		if want.IP == nil && got.IP.IsUnspecified() || want.IP.Equal(got.IP) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			return ln, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+// userCount is what an authenticated user has in progress.
+type userCount struct {
+	sessions int
+	messages int // in DATA
+}
+
+var errTooManyUserSessions = SMTPError("421 4.7.0 Error: too many sessions for this user, closing connection")
+
+// setUser records that the session authenticated as user. It fails if
+// that would exceed Server.MaxSessionsPerUser; the caller should then
+// send the error and close the connection.
+func (s *session) setUser(user string) error {
+	srv := s.srv
+	srv.userMu.Lock()
+	defer srv.userMu.Unlock()
+	if srv.users == nil {
+		srv.users = make(map[string]*userCount)
+	}
+	uc := srv.users[user]
+	if uc == nil {
+		uc = new(userCount)
+		srv.users[user] = uc
+	}
+	if max := srv.MaxSessionsPerUser; max > 0 && uc.sessions >= max {
+		s.logf(LogAuth, LogInfo, "user %q has %d sessions, rejecting", user, uc.sessions)
+		return errTooManyUserSessions
+	}
+	uc.sessions++
+	s.user = user
+	return nil
+}
+
+// releaseUser ends the session's count against its user.
+func (s *session) releaseUser() {
+	if s.user == "" {
+		return
+	}
+	srv := s.srv
+	srv.userMu.Lock()
+	defer srv.userMu.Unlock()
+	uc := srv.users[s.user]
+	if uc.sessions--; uc.sessions == 0 {
+		delete(srv.users, s.user)
+	}
+	s.user = ""
+}
+
+// acquireUserMessage counts a message the session's user has begun
+// sending, reporting false if that would exceed
+// Server.MaxMessagesPerUser. Unauthenticated sessions aren't limited.
+func (s *session) acquireUserMessage() bool {
+	if s.user == "" {
+		return true
+	}
+	srv := s.srv
+	srv.userMu.Lock()
+	defer srv.userMu.Unlock()
+	uc := srv.users[s.user]
+	if max := srv.MaxMessagesPerUser; max > 0 && uc.messages >= max {
+		return false
+	}
+	uc.messages++
+	return true
+}
+
+func (s *session) releaseUserMessage() {
+	if s.user == "" {
+		return
+	}
+	srv := s.srv
+	srv.userMu.Lock()
+	defer srv.userMu.Unlock()
+	srv.users[s.user].messages--
+}
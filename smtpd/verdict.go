@@ -0,0 +1,156 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import "fmt"
+
+// Hooks and Envelope methods accept a recipient or message by
+// returning nil, and refuse it by returning an SMTPError, as built by
+// Reject and TempFail. They may also return Discard or a Quarantine
+// verdict.
+
+// Reject returns an error refusing with the permanent reply code
+// (5xx; 550 if code isn't one) and message msg, which may begin with
+// an enhanced status code.
+func Reject(code int, msg string) error {
+	if code/100 != 5 {
+		code = 550
+	}
+	return SMTPError(fmt.Sprintf("%d %s", code, msg))
+}
+
+// TempFail returns an error refusing with the temporary reply code
+// (4xx; 451 if code isn't one) and message msg, asking the client
+// to try again later.
+func TempFail(code int, msg string) error {
+	if code/100 != 4 {
+		code = 451
+	}
+	return SMTPError(fmt.Sprintf("%d %s", code, msg))
+}
+
+// A Verdict is an error that tells the server to accept a message
+// but dispose of it other than by normal delivery.
+type Verdict struct {
+	Action VerdictAction
+	Reason string
+}
+
+// VerdictAction is a disposition chosen by a Verdict.
+type VerdictAction int
+
+const (
+	// VerdictDiscard accepts and silently drops the message, or,
+	// from AddRecipient, the recipient.
+	VerdictDiscard VerdictAction = iota + 1
+
+	// VerdictQuarantine accepts the message for quarantine.
+	// Returned by an Envelope method, it means the Envelope has
+	// quarantined it itself. Returned by OnNewMail (along with an
+	// Envelope) or OnHeaders, the Envelope must be a
+	// QuarantineEnvelope; otherwise the message is deferred.
+	VerdictQuarantine
+)
+
+func (v *Verdict) Error() string {
+	switch v.Action {
+	case VerdictDiscard:
+		return "discard"
+	case VerdictQuarantine:
+		return "quarantine: " + v.Reason
+	}
+	return "verdict " + v.Reason
+}
+
+// Discard is a Verdict that accepts and drops a message or recipient.
+var Discard error = &Verdict{Action: VerdictDiscard}
+
+// Quarantine returns a Verdict quarantining the message for reason.
+func Quarantine(reason string) error {
+	return &Verdict{Action: VerdictQuarantine, Reason: reason}
+}
+
+// QuarantineEnvelope is an Envelope that can hold messages aside,
+// such as for review by an administrator. Quarantine is called when
+// OnNewMail or OnHeaders returns a Quarantine verdict, and the message
+// is then written to the Envelope as usual.
+type QuarantineEnvelope interface {
+	Envelope
+	Quarantine(reason string)
+}
+
+// AbortEnvelope is an Envelope that holds resources, such as a
+// temporary file, to release if its transaction ends without Close
+// being called, such as after RSET, at the end of the session, or
+// when the message is refused or discarded, including after an error
+// from BeginData or Write. Abort is then called once.
+type AbortEnvelope interface {
+	Envelope
+	Abort()
+}
+
+// abortEnvelope calls the current Envelope's Abort if it has one and
+// hasn't been closed.
+func (s *session) abortEnvelope() {
+	if ae, ok := s.env.(AbortEnvelope); ok && !s.envClosed {
+		s.envClosed = true
+		ae.Abort()
+	}
+}
+
+// verdict returns err as a Verdict, or nil if it isn't one.
+func verdict(err error) *Verdict {
+	v, _ := err.(*Verdict)
+	return v
+}
+
+// discardEnvelope is an Envelope that drops everything.
+type discardEnvelope struct{}
+
+func (discardEnvelope) AddRecipient(rcpt MailAddress) error { return nil }
+func (discardEnvelope) BeginData() error                    { return nil }
+func (discardEnvelope) Write(line []byte) error             { return nil }
+func (discardEnvelope) Close() error                        { return nil }
+
+var errNoQuarantine = SMTPError("451 4.3.0 Error: message could not be quarantined")
+
+// applyVerdict carries out v, a verdict returned by a hook other than
+// an Envelope method, for the current transaction. It returns an
+// error to reply with if v can't be carried out.
+func (s *session) applyVerdict(v *Verdict) error {
+	switch v.Action {
+	case VerdictDiscard:
+		s.logf(LogDelivery, LogInfo, "discarding message")
+		s.abortEnvelope()
+		s.env = discardEnvelope{}
+		return nil
+	case VerdictQuarantine:
+		qe, ok := s.env.(QuarantineEnvelope)
+		if !ok {
+			s.logf(LogDelivery, LogError, "can't quarantine message (%s): Envelope isn't a QuarantineEnvelope", v.Reason)
+			return errNoQuarantine
+		}
+		s.logf(LogDelivery, LogInfo, "quarantining message: %s", v.Reason)
+		qe.Quarantine(v.Reason)
+		return nil
+	}
+	return fmt.Errorf("unknown verdict action %d", v.Action)
+}
+
+// envVerdict reports whether err, returned by the current Envelope
+// while it has the message, is a Verdict accepting it. After a
+// Discard, the rest of the message is dropped.
+func (s *session) envVerdict(err error) bool {
+	v := verdict(err)
+	if v == nil {
+		return false
+	}
+	if v.Action == VerdictDiscard {
+		s.logf(LogDelivery, LogInfo, "discarding message")
+		s.abortEnvelope()
+		s.env = discardEnvelope{}
+	}
+	return true
+}
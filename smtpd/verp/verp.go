@@ -0,0 +1,46 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package verp encodes and decodes variable envelope return paths
+// (VERP): envelope senders that carry the recipient's address, so a
+// bounce identifies which recipient failed even when it doesn't say.
+//
+// The recipient rcpt@example.com of mail from list-bounces@lists.org
+// is sent from list-bounces+rcpt=example.com@lists.org.
+package verp
+
+import "strings"
+
+// Encode returns the VERP sender for mail from sender to rcpt. If
+// either address has no domain, sender is returned unchanged.
+func Encode(sender, rcpt string) string {
+	sat := strings.LastIndex(sender, "@")
+	rat := strings.LastIndex(rcpt, "@")
+	if sat == -1 || rat == -1 {
+		return sender
+	}
+	return sender[:sat] + "+" + rcpt[:rat] + "=" + rcpt[rat+1:] + sender[sat:]
+}
+
+// Decode returns the recipient encoded in addr, a VERP sender built
+// from sender, such as the recipient of a bounce. It reports false if
+// addr isn't one.
+func Decode(sender, addr string) (rcpt string, ok bool) {
+	sat := strings.LastIndex(sender, "@")
+	aat := strings.LastIndex(addr, "@")
+	if sat == -1 || aat == -1 || !strings.EqualFold(sender[sat:], addr[aat:]) {
+		return "", false
+	}
+	prefix := sender[:sat] + "+"
+	local := addr[:aat]
+	if len(local) <= len(prefix) || !strings.EqualFold(local[:len(prefix)], prefix) {
+		return "", false
+	}
+	local = local[len(prefix):]
+	eq := strings.LastIndex(local, "=")
+	if eq <= 0 || eq == len(local)-1 {
+		return "", false
+	}
+	return local[:eq] + "@" + local[eq+1:], true
+}
@@ -0,0 +1,59 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verp
+
+import "testing"
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		sender, rcpt, want string
+	}{
+		{"list-bounces@lists.org", "rcpt@example.com", "list-bounces+rcpt=example.com@lists.org"},
+		{"bounces@lists.org", "first.last+tag@mail.example.com", "bounces+first.last+tag=mail.example.com@lists.org"},
+		{"bounces", "rcpt@example.com", "bounces"},
+		{"bounces@lists.org", "postmaster", "bounces@lists.org"},
+		{"", "rcpt@example.com", ""},
+	}
+	for _, tt := range tests {
+		if got := Encode(tt.sender, tt.rcpt); got != tt.want {
+			t.Errorf("Encode(%q, %q) = %q; want %q", tt.sender, tt.rcpt, got, tt.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	const sender = "list-bounces@lists.org"
+	tests := []struct {
+		addr string
+		want string // "" if addr isn't a VERP address
+	}{
+		{"list-bounces+rcpt=example.com@lists.org", "rcpt@example.com"},
+		{"LIST-BOUNCES+rcpt=example.com@LISTS.ORG", "rcpt@example.com"},
+		{"list-bounces+a=b=example.com@lists.org", "a=b@example.com"},
+		{"list-bounces@lists.org", ""},
+		{"list-bounces+@lists.org", ""},
+		{"list-bounces+rcpt@lists.org", ""},
+		{"list-bounces+=example.com@lists.org", ""},
+		{"list-bounces+rcpt=@lists.org", ""},
+		{"list-bounces+rcpt=example.com@other.org", ""},
+		{"other+rcpt=example.com@lists.org", ""},
+		{"no-at-sign", ""},
+	}
+	for _, tt := range tests {
+		got, ok := Decode(sender, tt.addr)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("Decode(%q) = %q, %v; want %q", tt.addr, got, ok, tt.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, rcpt := range []string{"rcpt@example.com", "a.b+c@sub.example.co.uk", "odd=local@example.net"} {
+		addr := Encode("bounces@lists.org", rcpt)
+		if got, ok := Decode("bounces@lists.org", addr); !ok || got != rcpt {
+			t.Errorf("Decode(Encode(%q)) = %q, %v", rcpt, got, ok)
+		}
+	}
+}
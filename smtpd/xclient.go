@@ -0,0 +1,125 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/go-smtpd/smtpd/parse"
+)
+
+// xclientAttrs are the XCLIENT attributes supported, as advertised.
+var xclientAttrs = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN"}
+
+// handleXClient handles Postfix's XCLIENT command, with which a
+// trusted proxy passes on what it knows of the client it's relaying
+// for. The session then starts over as if the client had connected,
+// and handleXClient reports whether it can continue.
+func (s *session) handleXClient(arg string) bool {
+	if !s.xclientOK {
+		s.logf(LogProto, LogInfo, "XCLIENT not permitted")
+		s.sendlinef("550 5.7.0 Error: insufficient authorization")
+		return true
+	}
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: MAIL transaction in progress")
+		return true
+	}
+	f := strings.Fields(arg)
+	if len(f) == 0 {
+		s.sendlinef("501 5.5.4 Syntax: XCLIENT attribute=value...")
+		return true
+	}
+	attrs := make(map[string]string)
+	for _, kv := range f {
+		k, v, ok := strings.Cut(kv, "=")
+		k = strings.ToUpper(k)
+		if !ok || !xclientAttr(k) {
+			s.sendlinef("501 5.5.4 Bad XCLIENT attribute name: %s", k)
+			return true
+		}
+		v, err := parse.XText(v)
+		if err != nil {
+			s.sendlinef("501 5.5.4 Bad XCLIENT %s syntax: %v", k, err)
+			return true
+		}
+		if v == "[UNAVAILABLE]" || v == "[TEMPUNAVAIL]" {
+			v = ""
+		}
+		attrs[k] = v
+	}
+
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok {
+		addr = new(net.TCPAddr)
+	}
+	addr = &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+	if v, ok := attrs["ADDR"]; ok {
+		addr.IP = nil
+		if v != "" {
+			addr.IP = net.ParseIP(strings.TrimPrefix(strings.ToUpper(v), "IPV6:"))
+			if addr.IP == nil {
+				s.sendlinef("501 5.5.4 Bad XCLIENT ADDR syntax: %s", v)
+				return true
+			}
+		}
+		addr.Port = 0
+	}
+	if v, ok := attrs["PORT"]; ok {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if v != "" && err != nil {
+			s.sendlinef("501 5.5.4 Bad XCLIENT PORT syntax: %s", v)
+			return true
+		}
+		addr.Port = int(port)
+	}
+	helloType := ""
+	switch v := strings.ToUpper(attrs["PROTO"]); v {
+	case "":
+	case "SMTP":
+		helloType = "HELO"
+	case "ESMTP":
+		helloType = "EHLO"
+	default:
+		s.sendlinef("501 5.5.4 Bad XCLIENT PROTO syntax: %s", v)
+		return true
+	}
+	s.logf(LogConn, LogInfo, "XCLIENT %s", arg)
+
+	// Start over as Postfix does, for the new client.
+	s.resetSession()
+	s.helloType, s.helloHost = helloType, attrs["HELO"]
+	s.xclientHelo = s.helloHost
+	s.mu.Lock()
+	s.signals = nil
+	s.mu.Unlock()
+	s.remote = addr
+	if _, ok := attrs["ADDR"]; ok {
+		s.rdns, s.dnsbl = nil, nil
+		s.startReverseDNS()
+		s.startDNSBL()
+	}
+	if v, ok := attrs["NAME"]; ok {
+		s.clientName = v
+	}
+	if user := attrs["LOGIN"]; user != "" {
+		if err := s.setUser(user); err != nil {
+			s.sendSMTPErrorOrLinef(err, "421 4.7.0 Error: closing connection")
+			return false
+		}
+	}
+	return s.greet()
+}
+
+func xclientAttr(k string) bool {
+	for _, a := range xclientAttrs {
+		if k == a {
+			return true
+		}
+	}
+	return false
+}